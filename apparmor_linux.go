@@ -1,51 +1,312 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template"
 
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
 	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+	tbsupervise "i2pgit.org/idk/i2p.plugins.tor-manager/supervise"
 )
 
-// Generates files corresponding to:
-// https://github.com/micahflee/torbrowser-launcher/blob/develop/apparmor/tunables/torbrowser
-func generateTunables() (string, error) {
-	var returnable string
-	userHome, err := os.UserHomeDir()
+// The profiles are based on:
+// https://github.com/micahflee/torbrowser-launcher/tree/develop/apparmor
+
+// apparmorMarker is the first line of every file tor-manager generates, files
+// without it are never overwritten or removed.
+const apparmorMarker = "# Generated by tor-manager, changes are overwritten by -apparmor-install"
+
+// apparmorTree is an installed browser tree and the profile directories the
+// browsers run from it write to.
+type apparmorTree struct {
+	// Name is used in the tree's profile and variable names.
+	Name string
+	// Dir is the install directory, with the home directory as @{HOME}.
+	Dir string
+	// Browser is the browser's executable in the install's Browser directory,
+	// and Launcher the script which starts it, if there is one.
+	Browser  string
+	Launcher string
+	// Tor is true if the install has its own Tor.
+	Tor bool
+	// Profiles are the profile directories outside the install.
+	Profiles []string
+}
+
+// apparmorData is what the AppArmor templates are executed with.
+type apparmorData struct {
+	Marker     string
+	Executable string
+	WorkingDir string
+	Store      string
+	Ephemeral  []string
+	// I2PConfig are the directories an I2P router's configuration may be in,
+	// and I2PWritable the router's directories tor-manager writes to: the
+	// i2psnark directory and the eepsite's document root.
+	I2PConfig   []string
+	I2PWritable []string
+	Trees       []*apparmorTree
+}
+
+var apparmorName = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// apparmorPath returns path as it is written in an AppArmor profile: the home
+// directory becomes @{HOME}, and paths with spaces are quoted.
+func apparmorPath(path string) string {
+	if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(path, home+string(filepath.Separator)) {
+		path = "@{HOME}" + strings.TrimPrefix(path, home)
+	}
+	if strings.ContainsAny(path, " \t") {
+		return fmt.Sprintf("%q", path)
+	}
+	return path
+}
+
+// apparmorTrees returns every installed browser tree, with the profile
+// directories of the modes run from it. Trees which are links to another tree
+// are the same tree to AppArmor, so they are merged.
+func apparmorTrees() []*apparmorTree {
+	var trees []*apparmorTree
+	byDir := make(map[string]*apparmorTree)
+	tree := func(install string) *apparmorTree {
+		if !tbget.FileExists(install) {
+			return nil
+		}
+		dir, err := filepath.EvalSymlinks(install)
+		if err != nil {
+			return nil
+		}
+		if dir, err = filepath.Abs(dir); err != nil {
+			return nil
+		}
+		if t, ok := byDir[dir]; ok {
+			return t
+		}
+		name := strings.Trim(apparmorName.ReplaceAllString(filepath.Base(dir), "_"), "_")
+		for _, t := range trees {
+			if t.Name == name {
+				name = fmt.Sprintf("%s_%d", name, len(trees))
+			}
+		}
+		browser := filepath.Base(client.TBS.SpecificFirefoxPath(dir))
+		t := &apparmorTree{
+			Name:     name,
+			Dir:      apparmorPath(dir),
+			Browser:  browser,
+			Launcher: strings.TrimSuffix(browser, ".real"),
+			Tor:      tbget.FileExists(filepath.Join(dir, "Browser", "TorBrowser", "Tor", "tor")),
+		}
+		byDir[dir] = t
+		trees = append(trees, t)
+		return t
+	}
+	for _, install := range client.TBD.InstallTrees() {
+		tree(install)
+	}
+	profiles, err := client.TBS.Profiles()
 	if err != nil {
-		return "", err
+		log.Println("apparmorTrees:", err)
 	}
-	if *verbose {
-		log.Println("Generating tunables for apparmor")
+	for _, p := range profiles {
+		dir := client.TBS.ProfileDir(p)
+		if dir == "" {
+			// Tor Browser's own profile is inside the install.
+			continue
+		}
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		for _, install := range client.TBS.ModeInstalls(p.Mode) {
+			if t := tree(install); t != nil {
+				t.Profiles = append(t.Profiles, apparmorPath(dir))
+			}
+		}
+	}
+	for _, t := range trees {
+		sort.Strings(t.Profiles)
+	}
+	return trees
+}
+
+// apparmorI2P returns the directories an I2P router's configuration may be in,
+// and the directories of the router tor-manager writes to.
+func apparmorI2P() ([]string, []string) {
+	var config, writable []string
+	for _, dir := range tbdiscover.ConfigDirs() {
+		if abs, err := filepath.Abs(dir); err == nil {
+			config = append(config, apparmorPath(abs))
+		}
+	}
+	router := tbdiscover.Default()
+	for _, dir := range []string{router.SnarkDir, router.EepsiteDocroot} {
+		if dir == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(dir); err == nil {
+			writable = append(writable, apparmorPath(abs))
+		}
 	}
-	installDir := strings.Replace(client.TBD.BrowserDir(), userHome, "@{HOME}", 1)
-	returnable += "@{torbrowser_installation_dir} = " + installDir + "\n"
-	returnable += "@{torbrowser_home_dir} = " + installDir + "/Browser\n"
-	return returnable, nil
+	return config, writable
 }
 
-func generateTorProfile() (string, error) {
-	var returnable string
-	userHome, err := os.UserHomeDir()
+// apparmorEphemeral returns the patterns ephemeral profiles are created at.
+func apparmorEphemeral() []string {
+	var dirs []string
+	for _, root := range tbsupervise.EphemeralRoots() {
+		if abs, err := filepath.Abs(root); err == nil {
+			dirs = append(dirs, apparmorPath(filepath.Join(abs, "tor-manager-ephemeral-*")))
+		}
+	}
+	return dirs
+}
+
+func apparmorDataForInstall() (*apparmorData, error) {
+	exe, err := os.Executable()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if *verbose {
-		log.Println("Generating Tor profile for apparmor")
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return nil, err
 	}
+	workdir, err := filepath.Abs(tbget.WORKING_DIR)
+	if err != nil {
+		return nil, err
+	}
+	store, err := filepath.Abs(client.TBS.ExtensionStore())
+	if err != nil {
+		return nil, err
+	}
+	config, writable := apparmorI2P()
+	return &apparmorData{
+		Marker:      apparmorMarker,
+		Executable:  apparmorPath(exe),
+		WorkingDir:  apparmorPath(workdir),
+		Store:       apparmorPath(store),
+		Ephemeral:   apparmorEphemeral(),
+		I2PConfig:   config,
+		I2PWritable: writable,
+		Trees:       apparmorTrees(),
+	}, nil
+}
 
-	torBrowserExecutable := strings.Replace(filepath.Join(client.TBD.BrowserDir(), "Browser", "TorBrowser", "Tor", "tor"), userHome, "@{HOME}", 1)
+var apparmorTemplates = template.Must(template.New("apparmor").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(`{{define "tunables"}}{{.Marker}}
+@{tormanager_executable} = {{.Executable}}
+@{tormanager_dir} = {{.WorkingDir}}
+@{tormanager_extension_store} = {{.Store}}
+@{tormanager_ephemeral_dirs} = {{join .Ephemeral " "}}
+@{tormanager_i2p_config_dirs} = {{join .I2PConfig " "}}
+{{range .Trees}}
+@{tormanager_{{.Name}}_installation_dir} = {{.Dir}}
+@{tormanager_{{.Name}}_home_dir} = {{.Dir}}/Browser
+{{- if .Profiles}}
+@{tormanager_{{.Name}}_profile_dirs} = {{join .Profiles " "}}
+{{- end}}
+{{end}}{{end}}
 
-	returnable += `#include <tunables/global>
-#include <tunables/torbrowser>
+{{define "tor-manager"}}{{.Marker}}
+#include <tunables/global>
+#include <tunables/tor-manager>
 
-@{torbrowser_tor_executable} = ` + torBrowserExecutable + `
+# tor-manager downloads, verifies and serves the browsers, so it may use the
+# network and write to its working directory. The browsers and Tor it runs are
+# confined by their own profiles.
+profile tor-manager @{tormanager_executable} flags=(attach_disconnected) {
+	#include <abstractions/base>
+	#include <abstractions/nameservice>
+	#include <abstractions/ssl_certs>
+	#include <abstractions/gnome>
+
+	network,
+	dbus,
+
+	@{tormanager_executable} mrix,
+	owner @{tormanager_dir}/ rw,
+	owner @{tormanager_dir}/** rwkl,
+	owner @{HOME}/ r,
+	@{tormanager_i2p_config_dirs}/** r,
+{{- range .I2PWritable}}
+	{{.}}/** rw,
+{{- end}}
+
+	# The offline proxy's sockets and the sandbox's root
+	owner /tmp/tor-manager-*/ rw,
+	owner /tmp/tor-manager-*/** rwl,
+	owner @{tormanager_ephemeral_dirs}/ rw,
+	owner @{tormanager_ephemeral_dirs}/** rw,
+
+	# Creating the namespaces of the sandbox and the offline browser's
+	# network, which are set up by the helper
+	@{PROC}/sys/kernel/unprivileged_userns_clone r,
+	@{PROC}/sys/user/max_user_namespaces r,
+	owner @{PROC}/@{pids}/{uid_map,gid_map,setgroups} rw,
+	owner @{PROC}/@{pid}/attr/{,apparmor/}current r,
+	owner @{PROC}/@{pid}/task/[0-9]*/attr/{,apparmor/}exec w,
+	change_profile -> tor-manager//helper,
+
+	# Browsers, Tor, and the I2P router
+{{- range .Trees}}
+	@{tormanager_{{.Name}}_installation_dir}/** Pixmr,
+{{- end}}
+	/{usr/,}{s,}bin/* Pix,
+	/usr/lib/jvm/**/bin/* Pix,
+	/usr/lib{,32,64}/** mr,
+	/usr/share/** r,
+
+	# tor-manager runs as the helper in this profile, with --sandbox-helper or
+	# --netns-helper, to build the sandbox and bring up the namespace's
+	# loopback before it runs the browser.
+	profile helper flags=(attach_disconnected) {
+		#include <abstractions/base>
+
+		capability sys_admin,
+		capability net_admin,
+		network inet dgram,
+		network inet stream,
+		network unix stream,
+
+		# The sandbox is built in its root, and every other mount stays
+		# where it is.
+		mount options=(rw,rprivate) -> /,
+		mount fstype=tmpfs -> /tmp/tor-manager-sandbox*/{,**/},
+		mount options=(rw,rbind) -> /tmp/tor-manager-sandbox*/**,
+		mount options in (ro,remount,bind,nosuid,nodev,noexec,noatime,nodiratime,relatime) -> /tmp/tor-manager-sandbox*/**,
+		pivot_root oldroot=/tmp/tor-manager-sandbox*/.oldroot/ /tmp/tor-manager-sandbox*/,
+		umount /.oldroot/,
 
-profile torbrowser_tor @{torbrowser_tor_executable} {
+		@{tormanager_executable} mr,
+		owner /tmp/tor-manager-*/ rw,
+		owner /tmp/tor-manager-*/** rwl,
+		/.oldroot/ w,
+		@{PROC}/@{pid}/attr/{,apparmor/}current r,
+
+		# The browsers it runs
+{{- range .Trees}}
+		@{tormanager_{{.Name}}_installation_dir}/** Pixmr,
+{{- end}}
+		/{usr/,}{s,}bin/* Pix,
+		/usr/lib{,32,64}/** mr,
+	}
+
+	#include if exists <local/tor-manager>
+}
+{{end}}
+
+{{define "tor"}}{{.Marker}}
+#include <tunables/global>
+#include <tunables/tor-manager>
+
+profile tor-manager.{{.Name}}.tor @{tormanager_{{.Name}}_home_dir}/TorBrowser/Tor/tor {
 	#include <abstractions/base>
 
 	network netlink raw,
@@ -56,24 +317,24 @@ profile torbrowser_tor @{torbrowser_tor_executable} {
 	/etc/nsswitch.conf r,
 	/etc/passwd r,
 	/etc/resolv.conf r,
-	owner @{torbrowser_home_dir}/TorBrowser/Tor/tor mr,
-	owner @{torbrowser_home_dir}/TorBrowser/Data/Tor/ rw,
-	owner @{torbrowser_home_dir}/TorBrowser/Data/Tor/** rw,
-	owner @{torbrowser_home_dir}/TorBrowser/Data/Tor/lock rwk,
-	owner @{torbrowser_home_dir}/TorBrowser/Tor/*.so mr,
-	owner @{torbrowser_home_dir}/TorBrowser/Tor/*.so.* mr,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Tor/tor mr,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Data/Tor/ rw,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Data/Tor/** rw,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Data/Tor/lock rwk,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Tor/*.so mr,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Tor/*.so.* mr,
 
 	# Support some of the included pluggable transports
-	owner @{torbrowser_home_dir}/TorBrowser/Tor/PluggableTransports/** rix,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Tor/PluggableTransports/** rix,
 	@{PROC}/sys/net/core/somaxconn r,
 	#include <abstractions/ssl_certs>
 
 	# Silence file_inherit logs
-	deny @{torbrowser_home_dir}/{browser/,}omni.ja r,
-	deny @{torbrowser_home_dir}/{browser/,}features/*.xpi r,
-	deny @{torbrowser_home_dir}/TorBrowser/Data/Browser/profile.default/.parentlock rw,
-	deny @{torbrowser_home_dir}/TorBrowser/Data/Browser/profile.default/extensions/*.xpi r,
-	deny @{torbrowser_home_dir}/TorBrowser/Data/Browser/profile.default/startupCache/* r,
+	deny @{tormanager_{{.Name}}_home_dir}/{browser/,}omni.ja r,
+	deny @{tormanager_{{.Name}}_home_dir}/{browser/,}features/*.xpi r,
+	deny @{tormanager_{{.Name}}_home_dir}/TorBrowser/Data/Browser/profile.default/.parentlock rw,
+	deny @{tormanager_{{.Name}}_home_dir}/TorBrowser/Data/Browser/profile.default/extensions/*.xpi r,
+	deny @{tormanager_{{.Name}}_home_dir}/TorBrowser/Data/Browser/profile.default/startupCache/* r,
 	# Silence logs from included pluggable transports
 	deny /etc/hosts r,
 	deny /etc/services r,
@@ -84,30 +345,15 @@ profile torbrowser_tor @{torbrowser_tor_executable} {
 	# OnionShare compatibility
 	/tmp/onionshare/** rw,
 
-	#include <local/torbrowser.Tor.tor>
-}`
-	return returnable, nil
+	#include if exists <local/tor-manager.{{.Name}}.tor>
 }
+{{end}}
 
-func generateFirefoxProfile() (string, error) {
-	var returnable string
-	userHome, err := os.UserHomeDir()
-	if err != nil {
-		return "", err
-	}
-	if *verbose {
-		log.Println("Generating Firefox profile for apparmor")
-	}
+{{define "firefox"}}{{.Marker}}
+#include <tunables/global>
+#include <tunables/tor-manager>
 
-	firefoxBrowserExecutable := strings.Replace(filepath.Join(client.TBD.BrowserDir(), "Browser", "firefox.real"), userHome, "@{HOME}", 1)
-
-	returnable += `#include <tunables/global>
-#include <tunables/torbrowser>
-
-@{i2pbrowser_home_dir} = ` + strings.Replace(filepath.Join(tbget.UNPACK_PATH(), "i2p.firefox"), userHome, "@{HOME}", 1) + `
-@{torbrowser_firefox_executable} = ` + firefoxBrowserExecutable + `
-
-profile torbrowser_firefox @{torbrowser_firefox_executable} {
+profile tor-manager.{{.Name}}.firefox @{tormanager_{{.Name}}_home_dir}/{{.Browser}} {
 	#include <abstractions/audio>
 	#include <abstractions/dri-enumerate>
 	#include <abstractions/gnome>
@@ -115,22 +361,24 @@ profile torbrowser_firefox @{torbrowser_firefox_executable} {
 	#include <abstractions/mesa>
 	#include <abstractions/opencl>
 	#include if exists <abstractions/vulkan>
-  
-	# Uncomment the following lines if you want to give the Tor Browser read-write
+
+	# Uncomment the following lines if you want to give the browser read-write
 	# access to most of your personal files.
 	# #include <abstractions/user-download>
 	# @{HOME}/ r,
-  
+
 	# Audio support
 	/{,usr/}bin/pulseaudio Pixr,
-  
+
 	#dbus,
 	network netlink raw,
 	network tcp,
-  
+	# The offline proxy's address inside an offline browser's network namespace
+	network unix,
+
 	ptrace (trace) peer=@{profile_name},
 	signal (receive, send) set=("term") peer=@{profile_name},
-  
+
 	deny /etc/host.conf r,
 	deny /etc/hosts r,
 	deny /etc/nsswitch.conf r,
@@ -139,13 +387,13 @@ profile torbrowser_firefox @{torbrowser_firefox_executable} {
 	deny /etc/passwd r,
 	deny /etc/group r,
 	deny /etc/mailcap r,
-  
-	/etc/osxhine-id r,
-	/var/lib/dbus/osxhine-id r,
-  
+
+	/etc/machine-id r,
+	/var/lib/dbus/machine-id r,
+
 	/dev/ r,
 	/dev/shm/ r,
-  
+
 	owner @{PROC}/@{pid}/cgroup r,
 	owner @{PROC}/@{pid}/environ r,
 	owner @{PROC}/@{pid}/fd/ r,
@@ -154,46 +402,61 @@ profile torbrowser_firefox @{torbrowser_firefox_executable} {
 	owner @{PROC}/@{pid}/status r,
 	owner @{PROC}/@{pid}/task/*/stat r,
 	@{PROC}/sys/kernel/random/uuid r,
-  
-	owner @{torbrowser_installation_dir}/ r,
-	owner @{torbrowser_installation_dir}/* r,
-	owner @{torbrowser_installation_dir}/.** rwk,
-	owner @{torbrowser_installation_dir}/update.test/ rwk,
-	owner @{torbrowser_home_dir}/.** rwk,
-	owner @{torbrowser_home_dir}/ rw,
-	owner @{torbrowser_home_dir}/** rwk,
-	owner @{torbrowser_home_dir}.bak/ rwk,
-	owner @{torbrowser_home_dir}.bak/** rwk,
-	owner @{torbrowser_home_dir}/*.so mr,
-	owner @{torbrowser_home_dir}/.cache/fontconfig/ rwk,
-	owner @{torbrowser_home_dir}/.cache/fontconfig/** rwkl,
-	owner @{torbrowser_home_dir}/browser/** r,
-	owner @{torbrowser_home_dir}/{,browser/}components/*.so mr,
-	owner @{torbrowser_home_dir}/Downloads/ rwk,
-	owner @{torbrowser_home_dir}/Downloads/** rwk,
-	owner @{torbrowser_home_dir}/firefox rix,
-	owner @{torbrowser_home_dir}/{,TorBrowser/UpdateInfo/}updates/[0-9]*/* rw,
-	owner @{torbrowser_home_dir}/{,TorBrowser/UpdateInfo/}updates/[0-9]*/{,MozUpdater/bgupdate/}updater ix,
-	owner @{torbrowser_home_dir}/updater ix,
-	owner @{torbrowser_home_dir}/TorBrowser/Data/Browser/.parentwritetest rw,
-	owner @{torbrowser_home_dir}/TorBrowser/Data/Browser/profiles.ini r,
-	owner @{torbrowser_home_dir}/TorBrowser/Data/Browser/profile.default/{,**} rwk,
-	owner @{torbrowser_home_dir}/TorBrowser/Data/fontconfig/fonts.conf r,
-	owner @{torbrowser_home_dir}/fonts/* l,
-	owner @{torbrowser_home_dir}/TorBrowser/Tor/tor px,
-	owner @{torbrowser_home_dir}/TorBrowser/Tor/ r,
-	owner @{torbrowser_home_dir}/TorBrowser/Tor/*.so mr,
-	owner @{torbrowser_home_dir}/TorBrowser/Tor/*.so.* mr,
-	owner @{torbrowser_home_dir}/TorBrowser/Tor/libstdc++/*.so mr,
-	owner @{torbrowser_home_dir}/TorBrowser/Tor/libstdc++/*.so.* mr,
-	owner @{i2pbrowser_home_dir}/i2p.firefox/{,**} rwk,
-  
+
+	owner @{tormanager_{{.Name}}_installation_dir}/ r,
+	owner @{tormanager_{{.Name}}_installation_dir}/* r,
+	owner @{tormanager_{{.Name}}_installation_dir}/.** rwk,
+	owner @{tormanager_{{.Name}}_installation_dir}/update.test/ rwk,
+	owner @{tormanager_{{.Name}}_home_dir}/.** rwk,
+	owner @{tormanager_{{.Name}}_home_dir}/ rw,
+	owner @{tormanager_{{.Name}}_home_dir}/** rwk,
+	owner @{tormanager_{{.Name}}_home_dir}.bak/ rwk,
+	owner @{tormanager_{{.Name}}_home_dir}.bak/** rwk,
+	owner @{tormanager_{{.Name}}_home_dir}/*.so mr,
+	owner @{tormanager_{{.Name}}_home_dir}/.cache/fontconfig/ rwk,
+	owner @{tormanager_{{.Name}}_home_dir}/.cache/fontconfig/** rwkl,
+	owner @{tormanager_{{.Name}}_home_dir}/browser/** r,
+	owner @{tormanager_{{.Name}}_home_dir}/{,browser/}components/*.so mr,
+	owner @{tormanager_{{.Name}}_home_dir}/Downloads/ rwk,
+	owner @{tormanager_{{.Name}}_home_dir}/Downloads/** rwk,
+{{- if ne .Launcher .Browser}}
+	owner @{tormanager_{{.Name}}_home_dir}/{{.Launcher}} rix,
+{{- end}}
+	owner @{tormanager_{{.Name}}_home_dir}/{,TorBrowser/UpdateInfo/}updates/[0-9]*/* rw,
+	owner @{tormanager_{{.Name}}_home_dir}/{,TorBrowser/UpdateInfo/}updates/[0-9]*/{,MozUpdater/bgupdate/}updater ix,
+	owner @{tormanager_{{.Name}}_home_dir}/updater ix,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Data/Browser/.parentwritetest rw,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Data/Browser/profiles.ini r,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Data/Browser/profile.default/{,**} rwk,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Data/fontconfig/fonts.conf r,
+	owner @{tormanager_{{.Name}}_home_dir}/fonts/* l,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Tor/tor px,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Tor/ r,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Tor/*.so mr,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Tor/*.so.* mr,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Tor/libstdc++/*.so mr,
+	owner @{tormanager_{{.Name}}_home_dir}/TorBrowser/Tor/libstdc++/*.so.* mr,
+{{- if .Profiles}}
+
+	# The profiles tor-manager runs from this install
+	owner @{tormanager_{{.Name}}_profile_dirs}/ rwk,
+	owner @{tormanager_{{.Name}}_profile_dirs}/** rwk,
+{{- end}}
+
+	# Ephemeral profiles
+	owner @{tormanager_ephemeral_dirs}/ rwk,
+	owner @{tormanager_ephemeral_dirs}/** rwk,
+
+	# Extensions are installed from tor-manager's extension store
+	owner @{tormanager_extension_store}/ r,
+	owner @{tormanager_extension_store}/*.xpi r,
+
 	# parent Firefox process when restarting after upgrade, Web Content processes
-	owner @{torbrowser_firefox_executable} pxmr -> torbrowser_firefox,
-  
+	owner @{tormanager_{{.Name}}_home_dir}/{{.Browser}} pxmr -> tor-manager.{{.Name}}.firefox,
+
 	/etc/mailcap r,
 	/etc/mime.types r,
-  
+
 	/usr/share/ r,
 	/usr/share/glib-2.0/schemas/gschemas.compiled r,
 	/usr/share/mime/ r,
@@ -202,11 +465,11 @@ profile torbrowser_firefox @{torbrowser_firefox_executable} {
 	/usr/share/gnome/applications/ r,
 	/usr/share/gnome/applications/kde4/ r,
 	/usr/share/poppler/cMap/ r,
-  
+
 	# Distribution homepage
 	/usr/share/homepage/ r,
 	/usr/share/homepage/** r,
-  
+
 	/sys/bus/pci/devices/ r,
 	@{sys}/devices/pci[0-9]*/**/irq r,
 	/sys/devices/system/cpu/ r,
@@ -215,20 +478,20 @@ profile torbrowser_firefox @{torbrowser_firefox_executable} {
 	/sys/devices/system/node/node[0-9]*/meminfo r,
 	/sys/fs/cgroup/cpu,cpuacct/{,user.slice/}cpu.cfs_quota_us r,
 	deny /sys/devices/virtual/block/*/uevent r,
-  
+
 	# Should use abstractions/gstreamer instead once merged upstream
 	/etc/udev/udev.conf r,
 	/run/udev/data/+pci:* r,
 	/sys/devices/pci[0-9]*/**/uevent r,
 	owner /{dev,run}/shm/shmfd-* rw,
-  
+
 	# Required for multiprocess Firefox (aka Electrolysis, i.e. e10s)
 	owner /{dev,run}/shm/org.chromium.* rw,
 	owner /dev/shm/org.mozilla.ipc.[0-9]*.[0-9]* rw, # for Chromium IPC
-  
+
 	# Required for Wayland display protocol support
 	owner /dev/shm/wayland.mozilla.ipc.[0-9]* rw,
-  
+
 	# Silence denial logs about permissions we don't need
 	deny @{HOME}/.cache/fontconfig/ rw,
 	deny @{HOME}/.cache/fontconfig/** rw,
@@ -239,18 +502,18 @@ profile torbrowser_firefox @{torbrowser_firefox_executable} {
 	deny /sys/devices/system/cpu/*/cache/index[0-9]*/size r,
 	deny /run/user/[0-9]*/dconf/user rw,
 	deny /usr/bin/lsb_release x,
-  
+
 	# Silence denial logs about PulseAudio
 	deny /etc/pulse/client.conf r,
 	deny /usr/bin/pulseaudio x,
-  
+
 	# KDE 4
 	owner @{HOME}/.kde/share/config/* r,
-  
+
 	# Xfce4
 	/etc/xfce4/defaults.list r,
 	/usr/share/xfce4/applications/ r,
-  
+
 	# u2f (tested with Yubikey 4)
 	/sys/class/ r,
 	/sys/bus/ r,
@@ -259,67 +522,249 @@ profile torbrowser_firefox @{torbrowser_firefox_executable} {
 	/dev/hidraw* rw,
 	# Yubikey NEO also needs this:
 	/sys/devices/**/hidraw/hidraw*/uevent r,
-  
+
 	# Needed for Firefox sandboxing via unprivileged user namespaces
 	capability sys_admin,
 	capability sys_chroot,
 	owner @{PROC}/@{pid}/{gid,uid}_map w,
 	owner @{PROC}/@{pid}/setgroups w,
-  
+
 	# Remove these rules once we can assume abstractions/vulkan is recent enough
 	# to include them
 	/etc/glvnd/egl_vendor.d/{*,.json} r,
 	/usr/share/glvnd/egl_vendor.d/{,*.json} r,
-  
-	#include <local/torbrowser.Browser.firefox>
-  }
-  
- `
-	return returnable, nil
+
+	#include if exists <local/tor-manager.{{.Name}}.firefox>
 }
+{{end}}`))
 
-func GenerateAppArmor() error {
-	if tunables, err := generateTunables(); err == nil {
-		path := filepath.Join(tbget.UNPACK_PATH(), "tunables.torbrowser.apparmor")
-		if *verbose {
-			fmt.Printf("Writing %s\n", path)
-		}
-		if err := ioutil.WriteFile(path, []byte(tunables), 0644); err != nil {
+// generateAppArmor returns the contents of the AppArmor files for the current
+// installs, by path relative to the AppArmor root.
+func generateAppArmor() (map[string]string, error) {
+	data, err := apparmorDataForInstall()
+	if err != nil {
+		return nil, err
+	}
+	if *verbose {
+		log.Println("Generating AppArmor profiles for", len(data.Trees), "installs")
+	}
+	files := make(map[string]string)
+	execute := func(path, name string, value interface{}) error {
+		var buf bytes.Buffer
+		if err := apparmorTemplates.ExecuteTemplate(&buf, name, value); err != nil {
 			return err
 		}
-		if *verbose {
-			fmt.Printf("%s", tunables)
+		files[path] = buf.String()
+		return nil
+	}
+	if err := execute(filepath.Join("tunables", "tor-manager"), "tunables", data); err != nil {
+		return nil, err
+	}
+	if err := execute("tor-manager", "tor-manager", data); err != nil {
+		return nil, err
+	}
+	for _, t := range data.Trees {
+		tree := struct {
+			*apparmorTree
+			Marker string
+		}{t, apparmorMarker}
+		if t.Tor {
+			if err := execute("tor-manager."+t.Name+".tor", "tor", tree); err != nil {
+				return nil, err
+			}
+		}
+		if err := execute("tor-manager."+t.Name+".firefox", "firefox", tree); err != nil {
+			return nil, err
 		}
-	} else {
-		return err
 	}
-	if torProfile, err := generateTorProfile(); err == nil {
-		path := filepath.Join(tbget.UNPACK_PATH(), "torbrowser.Tor.tor.apparmor")
-		if *verbose {
-			fmt.Printf("Writing %s\n", path)
+	return files, nil
+}
+
+// apparmorParser returns the path of apparmor_parser, which is usually in
+// sbin and so not on an ordinary user's PATH.
+func apparmorParser() (string, error) {
+	if path, err := exec.LookPath("apparmor_parser"); err == nil {
+		return path, nil
+	}
+	for _, path := range []string{"/sbin/apparmor_parser", "/usr/sbin/apparmor_parser"} {
+		if tbget.FileExists(path) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("apparmor_parser is not installed")
+}
+
+// ValidateAppArmor checks the generated files with apparmor_parser without
+// loading them. It is skipped when apparmor_parser isn't installed.
+func ValidateAppArmor(files map[string]string) error {
+	parser, err := apparmorParser()
+	if err != nil {
+		log.Println("ValidateAppArmor: skipping validation,", err)
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "tor-manager-apparmor")
+	if err != nil {
+		return fmt.Errorf("ValidateAppArmor: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := writeAppArmorFiles(dir, files); err != nil {
+		return fmt.Errorf("ValidateAppArmor: %s", err)
+	}
+	for _, path := range apparmorProfiles(files) {
+		out, err := exec.Command(parser, "-Q", "-K", "-I", dir, filepath.Join(dir, path)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ValidateAppArmor: %s: %s: %s", path, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// apparmorProfiles returns the paths of the profiles among files, leaving out
+// the tunables.
+func apparmorProfiles(files map[string]string) []string {
+	var paths []string
+	for path := range files {
+		if filepath.Dir(path) == "." {
+			paths = append(paths, path)
 		}
-		if err := ioutil.WriteFile(path, []byte(torProfile), 0644); err != nil {
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func writeAppArmorFiles(root string, files map[string]string) error {
+	for path, content := range files {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 			return err
 		}
-		if *verbose {
-			fmt.Printf("%s", torProfile)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generatedAppArmor returns the files under root which tor-manager generated,
+// by path relative to root.
+func generatedAppArmor(root string) []string {
+	var paths []string
+	for _, pattern := range []string{"tor-manager*", filepath.Join("tunables", "tor-manager")} {
+		matches, _ := filepath.Glob(filepath.Join(root, pattern))
+		for _, match := range matches {
+			content, err := ioutil.ReadFile(match)
+			if err != nil || !strings.HasPrefix(string(content), apparmorMarker) {
+				continue
+			}
+			rel, _ := filepath.Rel(root, match)
+			paths = append(paths, rel)
 		}
-	} else {
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// apparmorLoads returns true if the files under root are loaded into the
+// kernel when they change: the root is the system's, and we can load them.
+func apparmorLoads(root string) bool {
+	if _, err := apparmorParser(); err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(root)
+	return err == nil && abs == "/etc/apparmor.d" && os.Geteuid() == 0
+}
+
+// InstallAppArmor generates, validates and writes the AppArmor profiles to the
+// AppArmor root. Files which haven't changed are left alone, and profiles for
+// installs which are gone are removed. If root is the system's, changed
+// profiles are loaded as well.
+func InstallAppArmor(root string) error {
+	files, err := generateAppArmor()
+	if err != nil {
+		return fmt.Errorf("InstallAppArmor: %s", err)
+	}
+	if err := ValidateAppArmor(files); err != nil {
 		return err
 	}
-	if firefoxProfile, err := generateFirefoxProfile(); err == nil {
-		path := filepath.Join(tbget.UNPACK_PATH(), "torbrowser.Browser.firefox.apparmor")
-		if *verbose {
-			fmt.Printf("Writing %s\n", path)
+	loads := apparmorLoads(root)
+	parser, _ := apparmorParser()
+	for _, path := range generatedAppArmor(root) {
+		if _, ok := files[path]; ok {
+			continue
 		}
-		if err := ioutil.WriteFile(path, []byte(firefoxProfile), 0644); err != nil {
-			return err
+		log.Println("InstallAppArmor: removing", filepath.Join(root, path))
+		if loads && filepath.Dir(path) == "." {
+			exec.Command(parser, "-R", filepath.Join(root, path)).Run()
+		}
+		os.Remove(filepath.Join(root, path))
+	}
+	changed := make(map[string]bool)
+	for path, content := range files {
+		target := filepath.Join(root, path)
+		existing, err := ioutil.ReadFile(target)
+		if err == nil && string(existing) == content {
+			continue
+		}
+		if err == nil && !strings.HasPrefix(string(existing), apparmorMarker) {
+			return fmt.Errorf("InstallAppArmor: %s was not written by tor-manager, not overwriting it", target)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("InstallAppArmor: %s", err)
+		}
+		if err := ioutil.WriteFile(target+".tmp", []byte(content), 0644); err != nil {
+			return fmt.Errorf("InstallAppArmor: %s", err)
+		}
+		if err := os.Rename(target+".tmp", target); err != nil {
+			return fmt.Errorf("InstallAppArmor: %s", err)
 		}
 		if *verbose {
-			fmt.Printf("%s", firefoxProfile)
+			fmt.Printf("Writing %s\n%s", target, content)
+		}
+		changed[path] = true
+	}
+	if len(changed) == 0 {
+		log.Println("InstallAppArmor: the profiles in", root, "are up to date")
+		return nil
+	}
+	if !loads {
+		return nil
+	}
+	// Every profile includes the tunables, so they all reload when it changes.
+	tunables := changed[filepath.Join("tunables", "tor-manager")]
+	for _, path := range apparmorProfiles(files) {
+		if !changed[path] && !tunables {
+			continue
+		}
+		if out, err := exec.Command(parser, "-r", filepath.Join(root, path)).CombinedOutput(); err != nil {
+			return fmt.Errorf("InstallAppArmor: loading %s: %s: %s", path, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// UninstallAppArmor unloads and removes the AppArmor files tor-manager wrote
+// to the AppArmor root.
+func UninstallAppArmor(root string) error {
+	loads := apparmorLoads(root)
+	parser, _ := apparmorParser()
+	for _, path := range generatedAppArmor(root) {
+		target := filepath.Join(root, path)
+		if loads && filepath.Dir(path) == "." {
+			if out, err := exec.Command(parser, "-R", target).CombinedOutput(); err != nil {
+				log.Println("UninstallAppArmor: unloading", target, err, strings.TrimSpace(string(out)))
+			}
+		}
+		log.Println("UninstallAppArmor: removing", target)
+		if err := os.Remove(target); err != nil {
+			return fmt.Errorf("UninstallAppArmor: %s", err)
 		}
-	} else {
-		return err
 	}
 	return nil
 }
+
+// GenerateAppArmor writes the AppArmor profiles to the apparmor directory of
+// the working directory, laid out like /etc/apparmor.d, and returns it.
+func GenerateAppArmor() (string, error) {
+	dir := filepath.Join(tbget.UNPACK_PATH(), "apparmor")
+	return dir, InstallAppArmor(dir)
+}
@@ -0,0 +1,381 @@
+// Package tbcontrol is a client for the i2pcontrol JSON-RPC API of an I2P
+// router, which tor-manager uses to show the router's status and to restart or
+// shut it down.
+package tbcontrol
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Settings are the i2pcontrol endpoint and password.
+type Settings struct {
+	URL      string `json:"url,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Error is an error the i2pcontrol API answered with.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("i2pcontrol error %d: %s", e.Code, e.Message)
+}
+
+// tokenError returns true if the error means the client has to authenticate
+// again: the token is missing, unknown or expired.
+func tokenError(err error) bool {
+	e, ok := err.(*Error)
+	return ok && (e.Code == -32002 || e.Code == -32003 || e.Code == -32004)
+}
+
+// Client talks to the i2pcontrol API of a router. It authenticates when it
+// first needs to and again whenever its token expires.
+type Client struct {
+	// HTTPClient makes the requests. By default it doesn't check certificates,
+	// as the I2PControl plugin's is self-signed.
+	HTTPClient *http.Client
+	path       string
+	mutex      sync.Mutex
+	settings   Settings
+	token      string
+	id         int
+}
+
+// NewClient returns a Client for the i2pcontrol API at the URL.
+func NewClient(url, password string) *Client {
+	return &Client{
+		HTTPClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		},
+		settings: Settings{URL: url, Password: password},
+	}
+}
+
+// Open returns a Client with the settings saved at path. Settings which weren't
+// saved are taken from defaults, and those set in overrides take precedence
+// over both without being saved. Configure saves the settings to path.
+func Open(path string, defaults, overrides Settings) (*Client, error) {
+	c := NewClient(defaults.URL, defaults.Password)
+	c.path = path
+	saved, err := loadSettings(path)
+	if err != nil {
+		return nil, fmt.Errorf("Open: %s", err)
+	}
+	c.settings = merge(merge(c.settings, saved), overrides)
+	return c, nil
+}
+
+// merge returns base with the settings set in over replacing its own.
+func merge(base, over Settings) Settings {
+	if over.URL != "" {
+		base.URL = over.URL
+	}
+	if over.Password != "" {
+		base.Password = over.Password
+	}
+	return base
+}
+
+func loadSettings(path string) (Settings, error) {
+	var s Settings
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+// saveSettings writes the settings so only the user can read them, replacing
+// the file in one step so a password is never left half-written.
+func saveSettings(path string, s Settings) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".i2pcontrol-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// URL returns the URL of the i2pcontrol API.
+func (c *Client) URL() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.settings.URL
+}
+
+// Configure changes the URL and password, leaving either unchanged if it is
+// empty, and saves them if the Client was opened from a settings file. The
+// password is only ever sent to the URL it was given for, so changing the URL
+// needs the password again.
+func (c *Client) Configure(url, password string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if url != "" && url != c.settings.URL && password == "" {
+		return fmt.Errorf("Configure: enter the password again to change the URL to %s", url)
+	}
+	c.settings = merge(c.settings, Settings{URL: url, Password: password})
+	c.token = ""
+	if c.path == "" {
+		return nil
+	}
+	saved, err := loadSettings(c.path)
+	if err != nil {
+		return fmt.Errorf("Configure: %s", err)
+	}
+	if err := saveSettings(c.path, merge(saved, Settings{URL: url, Password: password})); err != nil {
+		return fmt.Errorf("Configure: %s", err)
+	}
+	return nil
+}
+
+// rpc sends a JSON-RPC request and decodes the result into result.
+func (c *Client) rpc(ctx context.Context, url, method string, params map[string]interface{}, result interface{}) error {
+	c.mutex.Lock()
+	c.id++
+	id := c.id
+	c.mutex.Unlock()
+	body, err := json.Marshal(map[string]interface{}{
+		"id":      id,
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&reply); err != nil {
+		return fmt.Errorf("%s didn't answer with JSON-RPC (%s): %s", url, resp.Status, err)
+	}
+	if reply.Error != nil {
+		return reply.Error
+	}
+	if result == nil || len(reply.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(reply.Result, result)
+}
+
+// authenticate returns the token of the Client, authenticating if it has none.
+func (c *Client) authenticate(ctx context.Context) (string, string, error) {
+	c.mutex.Lock()
+	settings, token := c.settings, c.token
+	c.mutex.Unlock()
+	if token != "" {
+		return settings.URL, token, nil
+	}
+	var result struct {
+		Token string `json:"Token"`
+	}
+	params := map[string]interface{}{"API": 1, "Password": settings.Password}
+	if err := c.rpc(ctx, settings.URL, "Authenticate", params, &result); err != nil {
+		return "", "", err
+	}
+	c.mutex.Lock()
+	if c.settings == settings {
+		c.token = result.Token
+	}
+	c.mutex.Unlock()
+	return settings.URL, result.Token, nil
+}
+
+// call sends an authenticated request, authenticating again once if the token
+// has expired.
+func (c *Client) call(ctx context.Context, method string, params map[string]interface{}, result interface{}) error {
+	for attempt := 0; ; attempt++ {
+		url, token, err := c.authenticate(ctx)
+		if err != nil {
+			return err
+		}
+		params["Token"] = token
+		err = c.rpc(ctx, url, method, params, result)
+		if attempt == 0 && tokenError(err) {
+			c.mutex.Lock()
+			if c.token == token {
+				c.token = ""
+			}
+			c.mutex.Unlock()
+			continue
+		}
+		return err
+	}
+}
+
+// Status is what the router reports about itself.
+type Status struct {
+	Version string `json:"version"`
+	// Status is the router's own summary of its state.
+	Status        string `json:"status"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+	// BandwidthIn and BandwidthOut are in bytes per second, averaged over a
+	// second.
+	BandwidthIn          float64 `json:"bandwidth_in"`
+	BandwidthOut         float64 `json:"bandwidth_out"`
+	KnownPeers           int     `json:"known_peers"`
+	ActivePeers          int     `json:"active_peers"`
+	ParticipatingTunnels int     `json:"participating_tunnels"`
+	NetStatus            int     `json:"net_status"`
+	NetStatusName        string  `json:"net_status_name"`
+}
+
+// Uptime returns how long the router has been running.
+func (s *Status) Uptime() time.Duration {
+	return time.Duration(s.UptimeSeconds) * time.Second
+}
+
+// netStatusNames are the names of the network status codes of i2pcontrol.
+var netStatusNames = []string{
+	"OK",
+	"Testing",
+	"Firewalled",
+	"Hidden",
+	"Firewalled and fast",
+	"Firewalled and floodfill",
+	"Firewalled with inbound TCP",
+	"Firewalled with UDP disabled",
+	"I2CP error",
+	"Clock skew",
+	"Private TCP address",
+	"Symmetric NAT",
+	"UDP port in use",
+	"No active peers, check the connection and firewall",
+	"UDP disabled and TCP unset",
+}
+
+// NetStatusName returns the name of an i2pcontrol network status code.
+func NetStatusName(code int) string {
+	if code < 0 || code >= len(netStatusNames) {
+		return fmt.Sprintf("Unknown (%d)", code)
+	}
+	return netStatusNames[code]
+}
+
+// Status asks the router for its status.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	params := map[string]interface{}{
+		"i2p.router.status":                    nil,
+		"i2p.router.version":                   nil,
+		"i2p.router.uptime":                    nil,
+		"i2p.router.net.bw.inbound.1s":         nil,
+		"i2p.router.net.bw.outbound.1s":        nil,
+		"i2p.router.net.status":                nil,
+		"i2p.router.net.tunnels.participating": nil,
+		"i2p.router.netdb.knownpeers":          nil,
+		"i2p.router.netdb.activepeers":         nil,
+	}
+	var result map[string]interface{}
+	if err := c.call(ctx, "RouterInfo", params, &result); err != nil {
+		return nil, fmt.Errorf("Status: %s", err)
+	}
+	s := &Status{
+		Version:              stringValue(result["i2p.router.version"]),
+		Status:               stringValue(result["i2p.router.status"]),
+		UptimeSeconds:        int64(numberValue(result["i2p.router.uptime"]) / 1000),
+		BandwidthIn:          numberValue(result["i2p.router.net.bw.inbound.1s"]),
+		BandwidthOut:         numberValue(result["i2p.router.net.bw.outbound.1s"]),
+		KnownPeers:           int(numberValue(result["i2p.router.netdb.knownpeers"])),
+		ActivePeers:          int(numberValue(result["i2p.router.netdb.activepeers"])),
+		ParticipatingTunnels: int(numberValue(result["i2p.router.net.tunnels.participating"])),
+		NetStatus:            int(numberValue(result["i2p.router.net.status"])),
+	}
+	s.NetStatusName = NetStatusName(s.NetStatus)
+	return s, nil
+}
+
+// numberValue returns a number from a RouterInfo result, which some routers
+// send as strings.
+func numberValue(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case string:
+		var f float64
+		fmt.Sscan(n, &f)
+		return f
+	}
+	return 0
+}
+
+func stringValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// manage sends a RouterManager request for the action.
+func (c *Client) manage(ctx context.Context, action string) error {
+	return c.call(ctx, "RouterManager", map[string]interface{}{action: nil}, nil)
+}
+
+// Restart restarts the router once its participating tunnels have expired.
+func (c *Client) Restart(ctx context.Context) error {
+	if err := c.manage(ctx, "RestartGraceful"); err != nil {
+		return fmt.Errorf("Restart: %s", err)
+	}
+	return nil
+}
+
+// ShutdownGraceful shuts the router down once its participating tunnels have
+// expired.
+func (c *Client) ShutdownGraceful(ctx context.Context) error {
+	if err := c.manage(ctx, "ShutdownGraceful"); err != nil {
+		return fmt.Errorf("ShutdownGraceful: %s", err)
+	}
+	return nil
+}
+
+// CancelShutdown cancels a graceful shutdown or restart. Routers which can't
+// cancel over i2pcontrol answer with an error, which is returned.
+func (c *Client) CancelShutdown(ctx context.Context) error {
+	if err := c.manage(ctx, "CancelShutdown"); err != nil {
+		return fmt.Errorf("CancelShutdown: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package tbcontrol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubRouter is an i2pcontrol API which answers like a router does.
+type stubRouter struct {
+	password string
+	// info is the result of RouterInfo.
+	info map[string]interface{}
+	// refuse are RouterManager actions answered with an error.
+	refuse map[string]bool
+
+	mutex   sync.Mutex
+	tokens  map[string]bool
+	auths   int
+	managed []string
+}
+
+func newStubRouter(password string) *stubRouter {
+	return &stubRouter{password: password, tokens: make(map[string]bool), refuse: make(map[string]bool)}
+}
+
+// expire forgets every token, as a router does when they time out.
+func (r *stubRouter) expire() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.tokens = make(map[string]bool)
+}
+
+func (r *stubRouter) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	var req struct {
+		ID      int                    `json:"id"`
+		JSONRPC string                 `json:"jsonrpc"`
+		Method  string                 `json:"method"`
+		Params  map[string]interface{} `json:"params"`
+	}
+	if err := json.NewDecoder(rq.Body).Decode(&req); err != nil || req.JSONRPC != "2.0" {
+		http.Error(rw, "bad request", http.StatusBadRequest)
+		return
+	}
+	result, rpcErr := r.answer(req.Method, req.Params)
+	reply := map[string]interface{}{"id": req.ID, "jsonrpc": "2.0"}
+	if rpcErr != nil {
+		reply["error"] = rpcErr
+	} else {
+		reply["result"] = result
+	}
+	json.NewEncoder(rw).Encode(reply)
+}
+
+func (r *stubRouter) answer(method string, params map[string]interface{}) (interface{}, *Error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if method == "Authenticate" {
+		if params["Password"] != r.password {
+			return nil, &Error{Code: -32001, Message: "Invalid password provided."}
+		}
+		r.auths++
+		token := fmt.Sprintf("token-%d", r.auths)
+		r.tokens[token] = true
+		return map[string]interface{}{"API": 1, "Token": token}, nil
+	}
+	token, ok := params["Token"].(string)
+	if !ok {
+		return nil, &Error{Code: -32002, Message: "No authentication token presented."}
+	}
+	if !r.tokens[token] {
+		return nil, &Error{Code: -32004, Message: "Provided authentication token was expired and will be removed."}
+	}
+	switch method {
+	case "RouterInfo":
+		result := make(map[string]interface{})
+		for key := range params {
+			if value, ok := r.info[key]; ok {
+				result[key] = value
+			}
+		}
+		return result, nil
+	case "RouterManager":
+		for action := range params {
+			if action == "Token" {
+				continue
+			}
+			if r.refuse[action] {
+				return nil, &Error{Code: -32602, Message: "Invalid parameters provided."}
+			}
+			r.managed = append(r.managed, action)
+		}
+		return map[string]interface{}{}, nil
+	}
+	return nil, &Error{Code: -32601, Message: "Method not found."}
+}
+
+func TestAuthenticate(t *testing.T) {
+	router := newStubRouter("itoopie")
+	server := httptest.NewTLSServer(router)
+	defer server.Close()
+
+	if err := NewClient(server.URL, "wrong").Restart(context.Background()); err == nil || !strings.Contains(err.Error(), "-32001") {
+		t.Fatalf("wrong password: got %v, want error -32001", err)
+	}
+	c := NewClient(server.URL, "itoopie")
+	for i := 0; i < 3; i++ {
+		if err := c.Restart(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if router.auths != 1 {
+		t.Errorf("authenticated %d times, want once", router.auths)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	router := newStubRouter("itoopie")
+	server := httptest.NewTLSServer(router)
+	defer server.Close()
+
+	c := NewClient(server.URL, "itoopie")
+	if err := c.Restart(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	router.expire()
+	if err := c.Restart(context.Background()); err != nil {
+		t.Fatalf("after expiry: %s", err)
+	}
+	if router.auths != 2 {
+		t.Errorf("authenticated %d times, want twice", router.auths)
+	}
+	if c.token != "token-2" {
+		t.Errorf("client kept token %q, want token-2", c.token)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	router := newStubRouter("itoopie")
+	router.info = map[string]interface{}{
+		"i2p.router.status":                    "Running",
+		"i2p.router.version":                   "2.3.0",
+		"i2p.router.uptime":                    3723000,
+		"i2p.router.net.bw.inbound.1s":         2048.5,
+		"i2p.router.net.bw.outbound.1s":        "1024",
+		"i2p.router.net.status":                2,
+		"i2p.router.net.tunnels.participating": "17",
+		"i2p.router.netdb.knownpeers":          3000,
+		"i2p.router.netdb.activepeers":         "250",
+	}
+	server := httptest.NewTLSServer(router)
+	defer server.Close()
+
+	status, err := NewClient(server.URL, "itoopie").Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Status{
+		Version:              "2.3.0",
+		Status:               "Running",
+		UptimeSeconds:        3723,
+		BandwidthIn:          2048.5,
+		BandwidthOut:         1024,
+		KnownPeers:           3000,
+		ActivePeers:          250,
+		ParticipatingTunnels: 17,
+		NetStatus:            2,
+		NetStatusName:        "Firewalled",
+	}
+	if *status != want {
+		t.Errorf("got %+v, want %+v", *status, want)
+	}
+	if status.Uptime().String() != "1h2m3s" {
+		t.Errorf("uptime %s, want 1h2m3s", status.Uptime())
+	}
+	if name := NetStatusName(99); name != "Unknown (99)" {
+		t.Errorf("NetStatusName(99) = %q", name)
+	}
+}
+
+func TestManage(t *testing.T) {
+	router := newStubRouter("itoopie")
+	router.refuse["CancelShutdown"] = true
+	server := httptest.NewTLSServer(router)
+	defer server.Close()
+
+	c := NewClient(server.URL, "itoopie")
+	ctx := context.Background()
+	if err := c.Restart(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ShutdownGraceful(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CancelShutdown(ctx); err == nil || !strings.HasPrefix(err.Error(), "CancelShutdown: ") {
+		t.Errorf("CancelShutdown on a router which can't cancel: got %v, want an error", err)
+	}
+	want := []string{"RestartGraceful", "ShutdownGraceful"}
+	if strings.Join(router.managed, ",") != strings.Join(want, ",") {
+		t.Errorf("router was sent %q, want %q", router.managed, want)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "i2pcontrol.json")
+	c, err := Open(path, Settings{URL: "https://127.0.0.1:7650/jsonrpc", Password: "itoopie"}, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Configure("https://evil.example:7650/jsonrpc", ""); err == nil {
+		t.Fatal("changed the URL without the password")
+	}
+	if c.URL() != "https://127.0.0.1:7650/jsonrpc" {
+		t.Errorf("URL changed to %s by a refused Configure", c.URL())
+	}
+	if err := c.Configure("", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Configure("https://127.0.0.1:7651/jsonrpc", "other"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("settings file mode %s, want 0600", info.Mode().Perm())
+	}
+	reopened, err := Open(path, Settings{}, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Settings{URL: "https://127.0.0.1:7651/jsonrpc", Password: "other"}
+	if reopened.settings != want {
+		t.Errorf("saved %+v, want %+v", reopened.settings, want)
+	}
+}
@@ -0,0 +1,106 @@
+package tbdiscover
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ReadConfig reads an I2P configuration file: key=value lines, with lines
+// starting with # or ; ignored.
+func ReadConfig(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadConfig: %s", err)
+	}
+	defer file.Close()
+	config := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		config[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ReadConfig: %s", err)
+	}
+	return config, nil
+}
+
+// configFiles returns the configuration file name in dir, followed by the
+// files in its split name.d directory, which newer routers use instead.
+func configFiles(dir, name string) []string {
+	var files []string
+	if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+		files = append(files, filepath.Join(dir, name))
+	}
+	split, _ := filepath.Glob(filepath.Join(dir, name+".d", "*.config"))
+	sort.Strings(split)
+	return append(files, split...)
+}
+
+// indexedSections reads the files and groups their prefix.N.key entries by
+// file and N, so the entries of each client or tunnel are together.
+func indexedSections(files []string, prefix string) []map[string]string {
+	pattern := regexp.MustCompile(`^` + regexp.QuoteMeta(prefix) + `\.(\d+)\.(.+)$`)
+	var sections []map[string]string
+	for _, file := range files {
+		config, err := ReadConfig(file)
+		if err != nil {
+			continue
+		}
+		byIndex := make(map[string]map[string]string)
+		var indices []string
+		for key, value := range config {
+			m := pattern.FindStringSubmatch(key)
+			if m == nil {
+				continue
+			}
+			if byIndex[m[1]] == nil {
+				byIndex[m[1]] = make(map[string]string)
+				indices = append(indices, m[1])
+			}
+			byIndex[m[1]][m[2]] = value
+		}
+		sort.Slice(indices, func(i, j int) bool {
+			if len(indices[i]) != len(indices[j]) {
+				return len(indices[i]) < len(indices[j])
+			}
+			return indices[i] < indices[j]
+		})
+		for _, index := range indices {
+			sections = append(sections, byIndex[index])
+		}
+	}
+	return sections
+}
+
+// ClientApps returns the client applications configured in clients.config and
+// clients.config.d in the configuration directory. Each has the main, args,
+// name and startOnLoad keys of its clientApp.N entries.
+func ClientApps(dir string) []map[string]string {
+	return indexedSections(configFiles(dir, "clients.config"), "clientApp")
+}
+
+// Tunnels returns the tunnels configured in i2ptunnel.config and
+// i2ptunnel.config.d in the configuration directory. Each has the keys of its
+// tunnel.N entries, like name, type, interface and listenPort.
+func Tunnels(dir string) []map[string]string {
+	return indexedSections(configFiles(dir, "i2ptunnel.config"), "tunnel")
+}
+
+// startOnLoad returns false if the section is configured not to start with
+// the router.
+func startOnLoad(section map[string]string) bool {
+	return section["startOnLoad"] != "false"
+}
@@ -0,0 +1,390 @@
+// Package tbdiscover finds the I2P router installed on this system and reads
+// its configuration, so that tor-manager uses the console, SAM, HTTP proxy and
+// i2pcontrol endpoints the router actually serves instead of I2P's defaults.
+package tbdiscover
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Endpoint is a service of the router.
+type Endpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Path is where an HTTP service is on the host, starting and ending with /.
+	Path string `json:"path,omitempty"`
+	// TLS is set if the service uses HTTPS.
+	TLS bool `json:"tls,omitempty"`
+	// Enabled is false if the router is configured not to start the service.
+	Enabled bool `json:"enabled"`
+}
+
+// Addr returns the host:port of the endpoint.
+func (e Endpoint) Addr() string {
+	return net.JoinHostPort(e.Host, e.PortString())
+}
+
+// PortString returns the port of the endpoint as a string.
+func (e Endpoint) PortString() string {
+	return strconv.Itoa(e.Port)
+}
+
+// URL returns the URL of an HTTP service.
+func (e Endpoint) URL() string {
+	scheme := "http"
+	if e.TLS {
+		scheme = "https"
+	}
+	path := e.Path
+	if path == "" {
+		path = "/"
+	}
+	return scheme + "://" + e.Addr() + path
+}
+
+// Router is an I2P router found on this system, with the endpoints and
+// directories it is configured to use. Anything which isn't configured has
+// I2P's default.
+type Router struct {
+	// ConfigDir is the router's configuration directory. It is empty if no
+	// router was found.
+	ConfigDir string `json:"config_dir"`
+	// Console is the router console.
+	Console Endpoint `json:"console"`
+	// SAM is the SAM bridge.
+	SAM Endpoint `json:"sam"`
+	// HTTPProxy is the I2P HTTP proxy tunnel.
+	HTTPProxy Endpoint `json:"http_proxy"`
+	// I2PControl is the i2pcontrol JSON-RPC API, from the console's jsonrpc
+	// webapp or the I2PControl plugin.
+	I2PControl Endpoint `json:"i2pcontrol"`
+	// I2PControlPassword is the password of the i2pcontrol API.
+	I2PControlPassword string `json:"-"`
+	// SnarkDir is the directory i2psnark keeps its torrents in.
+	SnarkDir string `json:"snark_dir"`
+	// EepsiteDocroot is the document root of the router's web server.
+	EepsiteDocroot string `json:"eepsite_docroot"`
+}
+
+// Defaults returns a Router with I2P's default endpoints and no directories.
+func Defaults() *Router {
+	return &Router{
+		Console:            Endpoint{Host: "127.0.0.1", Port: 7657, Path: "/", Enabled: true},
+		SAM:                Endpoint{Host: "127.0.0.1", Port: 7656, Enabled: true},
+		HTTPProxy:          Endpoint{Host: "127.0.0.1", Port: 4444, Enabled: true},
+		I2PControl:         Endpoint{Host: "127.0.0.1", Port: 7657, Path: "/jsonrpc/"},
+		I2PControlPassword: "itoopie",
+	}
+}
+
+// ConfigDirs returns the directories an I2P router's configuration may be in,
+// in the order they are searched: $I2P_CONFIG, the per-user and service
+// directories of the platform, then $I2P, which portable installs use.
+func ConfigDirs() []string {
+	var dirs []string
+	if dir := os.Getenv("I2P_CONFIG"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	home, _ := os.UserHomeDir()
+	switch runtime.GOOS {
+	case "windows":
+		if local := os.Getenv("LOCALAPPDATA"); local != "" {
+			dirs = append(dirs, filepath.Join(local, "I2P"))
+		}
+		if roaming := os.Getenv("APPDATA"); roaming != "" {
+			dirs = append(dirs, filepath.Join(roaming, "I2P"))
+		}
+		if home != "" {
+			dirs = append(dirs, filepath.Join(home, "AppData", "Local", "I2P"), filepath.Join(home, "AppData", "Roaming", "I2P"), filepath.Join(home, "i2p"))
+		}
+	case "darwin":
+		if home != "" {
+			dirs = append(dirs, filepath.Join(home, "Library", "Application Support", "i2p"))
+		}
+	default:
+		if home != "" {
+			dirs = append(dirs, filepath.Join(home, ".i2p"))
+		}
+		dirs = append(dirs, "/var/lib/i2p/i2p-config")
+	}
+	if dir := os.Getenv("I2P"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// FindConfigDir returns the first of ConfigDirs which holds a router's
+// configuration.
+func FindConfigDir() (string, error) {
+	for _, dir := range ConfigDirs() {
+		for _, name := range []string{"router.config", "clients.config", "clients.config.d"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return dir, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("FindConfigDir: no I2P router configuration in %s", strings.Join(ConfigDirs(), ", "))
+}
+
+// Discover finds the router and reads its configuration. If no router is
+// found, the defaults are returned with the error.
+func Discover() (*Router, error) {
+	dir, err := FindConfigDir()
+	if err != nil {
+		r := Defaults()
+		r.findDirs()
+		return r, err
+	}
+	return Read(dir), nil
+}
+
+// Read reads the configuration of the router in dir. Anything it doesn't
+// configure has I2P's default.
+func Read(dir string) *Router {
+	r := Defaults()
+	r.ConfigDir = dir
+	r.readClients()
+	r.readTunnels()
+	r.readI2PControl()
+	r.findDirs()
+	return r
+}
+
+var discovered struct {
+	sync.Mutex
+	router *Router
+	dir    string
+}
+
+// Default returns the router found by Discover the first time it is called,
+// or after Refresh. Its result must not be modified.
+func Default() *Router {
+	discovered.Lock()
+	defer discovered.Unlock()
+	if discovered.router == nil && discovered.dir != "" {
+		discovered.router = Read(discovered.dir)
+	}
+	if discovered.router == nil {
+		discovered.router, _ = Discover()
+	}
+	return discovered.router
+}
+
+// UseConfigDir makes Default return the router configured in dir, like the
+// embedded router, instead of searching ConfigDirs. An empty dir goes back to
+// searching.
+func UseConfigDir(dir string) {
+	discovered.Lock()
+	discovered.dir = dir
+	discovered.router = nil
+	discovered.Unlock()
+}
+
+// Refresh forgets the router found by Default, so the configuration is read
+// again the next time it is called.
+func Refresh() {
+	discovered.Lock()
+	discovered.router = nil
+	discovered.Unlock()
+}
+
+// readClients sets the console and SAM endpoints from the client
+// applications which serve them.
+func (r *Router) readClients() {
+	for _, app := range ClientApps(r.ConfigDir) {
+		args := strings.Fields(app["args"])
+		switch app["main"] {
+		case "net.i2p.router.web.RouterConsoleRunner":
+			r.Console = consoleEndpoint(args, r.Console)
+			r.Console.Enabled = startOnLoad(app)
+		case "net.i2p.sam.SAMBridge":
+			r.SAM = samEndpoint(args, r.SAM)
+			r.SAM.Enabled = startOnLoad(app)
+		}
+	}
+}
+
+// consoleEndpoint parses the arguments of the RouterConsoleRunner, which are
+// [-s sslport [hosts]] [port [hosts [webapps]]]. The plain HTTP port is
+// preferred if there is one.
+func consoleEndpoint(args []string, e Endpoint) Endpoint {
+	if len(args) > 1 && args[0] == "-s" {
+		if port, err := strconv.Atoi(args[1]); err == nil {
+			e.Port, e.TLS = port, true
+			if len(args) > 2 {
+				e.Host = pickHost(args[2])
+			}
+		}
+		if len(args) > 3 {
+			args = args[3:]
+		} else {
+			args = nil
+		}
+	}
+	if len(args) > 0 {
+		if port, err := strconv.Atoi(args[0]); err == nil {
+			e.Port, e.TLS = port, false
+			if len(args) > 1 {
+				e.Host = pickHost(args[1])
+			}
+		}
+	}
+	return e
+}
+
+// samEndpoint parses the arguments of the SAMBridge, which are
+// [keyfile [host] port] followed by name=value options.
+func samEndpoint(args []string, e Endpoint) Endpoint {
+	var positional []string
+	for _, arg := range args {
+		if !strings.Contains(arg, "=") && !strings.HasPrefix(arg, "-") {
+			positional = append(positional, arg)
+		}
+	}
+	for i, arg := range positional {
+		port, err := strconv.Atoi(arg)
+		if err != nil {
+			continue
+		}
+		e.Port = port
+		if i >= 2 || (i == 1 && !strings.HasSuffix(positional[0], ".keys")) {
+			e.Host = pickHost(positional[i-1])
+		}
+		break
+	}
+	return e
+}
+
+// pickHost returns the host to reach a service listening on the
+// comma-separated hosts on, preferring the IPv4 loopback.
+func pickHost(hosts string) string {
+	list := strings.Split(hosts, ",")
+	for _, host := range list {
+		if host == "127.0.0.1" || host == "localhost" {
+			return "127.0.0.1"
+		}
+	}
+	switch list[0] {
+	case "", "0.0.0.0", "::", "0:0:0:0:0:0:0:0":
+		return "127.0.0.1"
+	}
+	return list[0]
+}
+
+// readTunnels sets the HTTP proxy endpoint from the I2P HTTP Proxy tunnel, or
+// from the first HTTP client tunnel if it has been renamed.
+func (r *Router) readTunnels() {
+	var proxy map[string]string
+	for _, tunnel := range Tunnels(r.ConfigDir) {
+		if tunnel["type"] != "httpclient" {
+			continue
+		}
+		if tunnel["name"] == "I2P HTTP Proxy" {
+			proxy = tunnel
+			break
+		}
+		if proxy == nil {
+			proxy = tunnel
+		}
+	}
+	if proxy == nil {
+		return
+	}
+	if port, err := strconv.Atoi(proxy["listenPort"]); err == nil {
+		r.HTTPProxy.Port = port
+	}
+	if proxy["interface"] != "" {
+		r.HTTPProxy.Host = pickHost(proxy["interface"])
+	}
+	r.HTTPProxy.Enabled = startOnLoad(proxy)
+}
+
+// readI2PControl sets the i2pcontrol endpoint from the I2PControl plugin if it
+// is installed, otherwise from the console's jsonrpc webapp.
+func (r *Router) readI2PControl() {
+	plugin := filepath.Join(r.ConfigDir, "plugins", "I2PControl")
+	if _, err := os.Stat(plugin); err == nil {
+		r.I2PControl = Endpoint{Host: "127.0.0.1", Port: 7650, Path: "/", TLS: true, Enabled: true}
+		if plugins, err := ReadConfig(filepath.Join(r.ConfigDir, "plugins.config")); err == nil {
+			r.I2PControl.Enabled = plugins["plugin.I2PControl.startOnLoad"] != "false"
+		}
+		if config, err := ReadConfig(filepath.Join(plugin, "I2PControl.conf")); err == nil {
+			if host := config["i2pcontrol.listen.address"]; host != "" {
+				r.I2PControl.Host = pickHost(host)
+			}
+			if port, err := strconv.Atoi(config["i2pcontrol.listen.port"]); err == nil {
+				r.I2PControl.Port = port
+			}
+			if password := config["i2pcontrol.password"]; password != "" {
+				r.I2PControlPassword = password
+			}
+		}
+		return
+	}
+	r.I2PControl = r.Console
+	r.I2PControl.Path = "/jsonrpc/"
+	r.I2PControl.Enabled = false
+	if webapps, err := ReadConfig(filepath.Join(r.ConfigDir, "webapps.config")); err == nil {
+		r.I2PControl.Enabled = r.Console.Enabled && webapps["webapps.jsonrpc.startOnLoad"] == "true"
+	}
+	if router, err := ReadConfig(filepath.Join(r.ConfigDir, "router.config")); err == nil {
+		if password := router["i2pcontrol.password"]; password != "" {
+			r.I2PControlPassword = password
+		}
+	}
+}
+
+// findDirs finds the i2psnark and eepsite directories. $SNARK_CONFIG overrides
+// the i2psnark directory, and i2psnark.config can move it out of the
+// configuration directory.
+func (r *Router) findDirs() {
+	var roots []string
+	if r.ConfigDir != "" {
+		roots = append(roots, r.ConfigDir)
+	}
+	if dir := os.Getenv("I2P"); dir != "" && dir != r.ConfigDir {
+		roots = append(roots, dir)
+	}
+	if dir := os.Getenv("SNARK_CONFIG"); dir != "" && exists(dir) {
+		r.SnarkDir = dir
+	}
+	for _, root := range roots {
+		if r.SnarkDir == "" {
+			r.SnarkDir = snarkDir(root)
+		}
+		if docroot := filepath.Join(root, "eepsite", "docroot"); r.EepsiteDocroot == "" && exists(docroot) {
+			r.EepsiteDocroot = docroot
+		}
+	}
+}
+
+// snarkDir returns the i2psnark directory of the configuration directory, or
+// an empty string if it doesn't exist.
+func snarkDir(root string) string {
+	dir := "i2psnark"
+	for _, file := range []string{filepath.Join(root, "i2psnark.config.d", "i2psnark.config"), filepath.Join(root, "i2psnark.config")} {
+		if config, err := ReadConfig(file); err == nil && config["i2psnark.dir"] != "" {
+			dir = config["i2psnark.dir"]
+			break
+		}
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	if !exists(dir) {
+		return ""
+	}
+	return dir
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
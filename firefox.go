@@ -6,40 +6,66 @@ import (
 	"strings"
 
 	flag "github.com/spf13/pflag"
+	tbsupervise "i2pgit.org/idk/i2p.plugins.tor-manager/supervise"
 )
 
+// CleanupArgs separates tor-manager's own arguments from the ones passed
+// through to the browser. Everything after -- is passed through. Before it,
+// tor-manager's flags and their values are kept, and anything else is passed
+// through too with a warning, as older versions guessed which arguments were
+// meant for the browser. Single-dash long flags are given a second dash.
 func CleanupArgs() (args []string, trailers []string) {
-	// get a list of all possible flags from the flag package
 	args = []string{os.Args[0]}
-	for i, arg := range os.Args[1:] {
-		log.Printf("arg %d: %s", i, arg)
-		trailer := true
-		trimmed := strings.Split(strings.TrimLeft(arg, "-"), "=")[0]
-		flag.VisitAll(func(f *flag.Flag) {
-			//log.Printf("testing f.Name: %s against %s", f.Name, trimmed)
-			if f.Name == trimmed {
-				log.Printf("found known flag: %s", f.Name)
-				// if the next arg is not a flag(does not start with '-'), add it to the end of arg before
-				// appending arg to args
-				if i+1 < len(os.Args) && os.Args[i+1][0] != '-' {
-					args = append(args, arg+"="+os.Args[i+1])
-					i++
-					trailer = false
-				} else {
-					args = append(args, arg)
-					trailer = false
-				}
-				return
-			}
-		})
-		if trailer {
-			if arg != "--profile" && arg != "-P" && arg != "-profile" {
-				log.Printf("found possible firefox flag: %s", trimmed)
-				trailers = append(trailers, arg)
-			} else {
-				i++
-			}
+	rest := os.Args[1:]
+	for i := 0; i < len(rest); i++ {
+		arg := rest[i]
+		if arg == "--" {
+			trailers = append(trailers, rest[i+1:]...)
+			break
+		}
+		f, long := managerFlag(arg)
+		if f == nil {
+			log.Printf("passing %s through to the browser, put browser arguments after -- to be explicit", arg)
+			trailers = append(trailers, arg)
+			continue
+		}
+		if long && !strings.HasPrefix(arg, "--") {
+			arg = "-" + arg
+		}
+		args = append(args, arg)
+		if !strings.Contains(arg, "=") && f.NoOptDefVal == "" && i+1 < len(rest) {
+			i++
+			args = append(args, rest[i])
 		}
 	}
 	return
 }
+
+// managerFlag returns the tor-manager flag arg sets, and whether it is set by
+// its long name, or nil if arg isn't a tor-manager flag.
+func managerFlag(arg string) (*flag.Flag, bool) {
+	if !strings.HasPrefix(arg, "-") {
+		return nil, false
+	}
+	name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+	if f := flag.Lookup(name); f != nil {
+		return f, true
+	}
+	if len(name) == 1 && !strings.HasPrefix(arg, "--") {
+		return flag.CommandLine.ShorthandLookup(name), false
+	}
+	return nil, false
+}
+
+// validTrailers returns an error if the arguments passed through to the
+// browser aren't allowed in any mode. Whether they are allowed in the mode of
+// a browser is checked when it is launched.
+func validTrailers(trailers []string) error {
+	var err error
+	for _, mode := range tbsupervise.Modes {
+		if err = tbsupervise.ValidateBrowserArgs(mode, trailers); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package tbget
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CHANNEL is the release channel used by new TBDownloaders and by the functions
+// which aren't attached to a TBDownloader. It can be set with TOR_MANAGER_CHANNEL.
+var CHANNEL = DefaultChannel()
+
+// Channels is the list of release channels which can be selected.
+var Channels = []string{"release", "alpha", "nightly"}
+
+// DefaultChannel returns the channel configured in the environment, or "release".
+func DefaultChannel() string {
+	if channel, err := NormalizeChannel(os.Getenv("TOR_MANAGER_CHANNEL")); err == nil {
+		return channel
+	}
+	return "release"
+}
+
+// NormalizeChannel turns a user-supplied channel name into the name the update
+// feeds use. "stable" and an empty string mean "release".
+func NormalizeChannel(channel string) (string, error) {
+	switch strings.ToLower(channel) {
+	case "", "stable", "release":
+		return "release", nil
+	case "alpha":
+		return "alpha", nil
+	case "nightly":
+		return "nightly", nil
+	}
+	return "", fmt.Errorf("NormalizeChannel: unknown channel %s, choose one of %s", channel, strings.Join(Channels, ", "))
+}
+
+// ChannelPath returns path unchanged for the release channel and with the
+// channel name appended for every other channel, so that alpha and nightly
+// installs don't clobber the stable one.
+func ChannelPath(path, channel string) string {
+	if channel == "" || channel == "release" {
+		return path
+	}
+	return path + "-" + channel
+}
+
+// ChannelPrefix returns the path prefix mirrors index files of the channel under.
+func ChannelPrefix(channel string) string {
+	if channel == "" || channel == "release" {
+		return ""
+	}
+	return channel + "/"
+}
+
+// ChannelURL returns the update feed URL for the given channel.
+func ChannelURL(feed, channel string) string {
+	if channel == "" || channel == "release" {
+		return feed
+	}
+	return strings.Replace(feed, "/release/", "/"+channel+"/", 1)
+}
+
+// GetChannel returns the release channel of the TBDownloader.
+func (t *TBDownloader) GetChannel() string {
+	if t.Channel == "" {
+		return "release"
+	}
+	return t.Channel
+}
+
+// UpdatesURL returns the update feed URL for the TBDownloader's product and channel.
+func (t *TBDownloader) UpdatesURL() string {
+	return ChannelURL(t.GetProduct().UpdatesURL, t.GetChannel())
+}
+
+// FeedFile returns the name the update feed is cached under for the TBDownloader's product and channel.
+func (t *TBDownloader) FeedFile() string {
+	if t.GetChannel() == "release" {
+		return t.GetProduct().FeedFile
+	}
+	return strings.Replace(t.GetProduct().FeedFile, ".json", "-"+t.GetChannel()+".json", 1)
+}
+
+// SetChannel switches the TBDownloader to another release channel, moving its
+// download and unpack directories to the ones used by that channel.
+func (t *TBDownloader) SetChannel(channel string) error {
+	channel, err := NormalizeChannel(channel)
+	if err != nil {
+		return err
+	}
+	t.Channel = channel
+	t.DownloadPath = ChannelPath(DOWNLOAD_PATH(), channel)
+	t.UnpackPath = ChannelPath(UNPACK_PATH(), channel)
+	return nil
+}
@@ -0,0 +1,370 @@
+package tbget
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/connectproxy"
+	"golang.org/x/net/proxy"
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
+)
+
+// ConsensusMirror is a mirror which is asked to confirm a download, and the
+// route it is reached over: "clearnet", "tor" or "i2p".
+type ConsensusMirror struct {
+	URL   string `json:"url"`
+	Route string `json:"route"`
+}
+
+// CONSENSUS is the number of other mirrors which must agree with a download
+// before it is unpacked. Zero disables the check. It can be set with
+// TOR_MANAGER_CONSENSUS.
+var CONSENSUS = DefaultConsensus()
+
+// CONSENSUS_MIRRORS are the mirrors asked to confirm a download. They can be set
+// with TOR_MANAGER_CONSENSUS_MIRRORS as a comma-separated list of route=url pairs.
+var CONSENSUS_MIRRORS = DefaultConsensusMirrors()
+
+// CONSENSUS_MANIFEST is the name of the checksum manifest published next to
+// each release.
+const CONSENSUS_MANIFEST = "sha256sums-signed-build.txt"
+
+// DefaultConsensus returns the number of agreeing mirrors configured in the environment, or zero.
+func DefaultConsensus() int {
+	n, err := strconv.Atoi(os.Getenv("TOR_MANAGER_CONSENSUS"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// CheckConsensusSetting checks that consensus mirrors can agree over as many
+// different routes as the mirrors use. Each route counts once, so a larger
+// consensus could never be reached and every download would be refused.
+func CheckConsensusSetting(consensus int, mirrors []ConsensusMirror) error {
+	routes := make(map[string]bool)
+	for _, mirror := range mirrors {
+		routes[mirror.Route] = true
+	}
+	if consensus > len(routes) {
+		return fmt.Errorf("CheckConsensusSetting: a consensus of %d can't be reached, the consensus mirrors only use %d routes", consensus, len(routes))
+	}
+	return nil
+}
+
+// DefaultConsensusMirrors returns the mirrors configured in the environment,
+// or the Tor Project's distribution site and its mirrors.
+func DefaultConsensusMirrors() []ConsensusMirror {
+	if env := os.Getenv("TOR_MANAGER_CONSENSUS_MIRRORS"); env != "" {
+		mirrors, err := ParseConsensusMirrors(env)
+		if err == nil {
+			return mirrors
+		}
+		log.Println("DefaultConsensusMirrors:", err)
+	}
+	return []ConsensusMirror{
+		{URL: "https://dist.torproject.org/torbrowser/", Route: "clearnet"},
+		{URL: "https://tor.calyxinstitute.org/dist/torbrowser/", Route: "clearnet"},
+		{URL: "https://tor.eff.org/dist/torbrowser/", Route: "tor"},
+		{URL: "http://dist.torproject.i2p/torbrowser/", Route: "i2p"},
+	}
+}
+
+// ParseConsensusMirrors parses a comma-separated list of route=url pairs. A URL
+// without a route is reached over I2P if it is an I2P site and the clearnet otherwise.
+func ParseConsensusMirrors(list string) ([]ConsensusMirror, error) {
+	var mirrors []ConsensusMirror
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		mirror := ConsensusMirror{URL: entry, Route: "clearnet"}
+		if spl := strings.SplitN(entry, "=", 2); len(spl) == 2 {
+			mirror.Route, mirror.URL = spl[0], spl[1]
+		} else if MirrorIsI2P(entry) {
+			mirror.Route = "i2p"
+		}
+		switch mirror.Route {
+		case "clearnet", "tor", "i2p":
+		default:
+			return nil, fmt.Errorf("ParseConsensusMirrors: unknown route %s, choose one of clearnet, tor, i2p", mirror.Route)
+		}
+		if !strings.HasSuffix(mirror.URL, "/") {
+			mirror.URL += "/"
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	return mirrors, nil
+}
+
+// RouteClient returns an HTTP client which reaches the network over the given
+// route. The Tor route requires a Tor SOCKS proxy on 127.0.0.1:9050 and the I2P
+// route requires the I2P router's HTTP proxy.
+func RouteClient(route string) (*http.Client, error) {
+	switch route {
+	case "i2p":
+		proxyURL, err := url.Parse(tbdiscover.Default().HTTPProxy.URL())
+		if err != nil {
+			return nil, err
+		}
+		d, err := connectproxy.New(proxyURL, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Client{Transport: &http.Transport{Dial: d.Dial}, Timeout: 5 * time.Minute}, nil
+	case "tor":
+		d, err := proxy.SOCKS5("tcp", "127.0.0.1:9050", nil, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Client{Transport: &http.Transport{Dial: d.Dial}, Timeout: 5 * time.Minute}, nil
+	case "clearnet":
+		return &http.Client{Transport: &http.Transport{}, Timeout: 5 * time.Minute}, nil
+	}
+	return nil, fmt.Errorf("RouteClient: unknown route %s", route)
+}
+
+// MirrorVote is the answer a single mirror gave when asked to confirm a download.
+type MirrorVote struct {
+	ConsensusMirror
+	// Result is "agree", "disagree" or "unreachable".
+	Result string `json:"result"`
+	// Detail explains the result.
+	Detail string `json:"detail,omitempty"`
+}
+
+// ConsensusRecord is the outcome of a consensus check. It is stored next to the
+// install, see ConsensusFile.
+type ConsensusRecord struct {
+	File     string       `json:"file"`
+	Version  string       `json:"version"`
+	SHA256   string       `json:"sha256"`
+	Required int          `json:"required"`
+	Agreed   int          `json:"agreed"`
+	Passed   bool         `json:"passed"`
+	Checked  time.Time    `json:"checked"`
+	Votes    []MirrorVote `json:"votes"`
+}
+
+// ConsensusFile returns the path of the file which records the outcome of the
+// last consensus check of the install.
+func (t *TBDownloader) ConsensusFile() string {
+	return t.BrowserDir() + ".consensus.json"
+}
+
+// GetConsensusRecord returns the outcome of the last consensus check of the install.
+func (t *TBDownloader) GetConsensusRecord() (*ConsensusRecord, error) {
+	bytes, err := ioutil.ReadFile(t.ConsensusFile())
+	if err != nil {
+		return nil, err
+	}
+	var record ConsensusRecord
+	if err := json.Unmarshal(bytes, &record); err != nil {
+		return nil, fmt.Errorf("GetConsensusRecord: %s", err)
+	}
+	return &record, nil
+}
+
+// consensusMirrors orders the mirrors so that routes other than the one the
+// file was downloaded over come first. Mirrors on the host the file came from
+// can't confirm it, so they are dropped, and so are further mirrors on a host
+// which is already listed.
+func (t *TBDownloader) consensusMirrors() []ConsensusMirror {
+	primary := "clearnet"
+	if MirrorIsI2P(t.Mirror) {
+		primary = "i2p"
+	}
+	seen := map[string]bool{t.originHost(): true}
+	var others, same []ConsensusMirror
+	for _, mirror := range t.ConsensusMirrors {
+		host := mirrorHost(mirror.URL)
+		if host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		if mirror.Route == primary {
+			same = append(same, mirror)
+		} else {
+			others = append(others, mirror)
+		}
+	}
+	return append(others, same...)
+}
+
+// originHost returns the host the TBDownloader downloads releases from.
+func (t *TBDownloader) originHost() string {
+	if t.Mirror == "" || strings.Contains(t.Mirror, "i2psnark") {
+		return mirrorHost("https://dist.torproject.org/torbrowser/")
+	}
+	return mirrorHost(t.Mirror)
+}
+
+// mirrorHost returns the lower-cased host name of a mirror URL, or an empty
+// string if it can't be parsed.
+func mirrorHost(mirror string) string {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// CheckConsensus asks the TBDownloader's consensus mirrors to confirm the
+// downloaded file at binpath. Each mirror's detached signature must verify the
+// file, and its checksum manifest must list the file's hash if it publishes one.
+// At least Consensus mirrors must agree, each of them reached over a different
+// route, and none may disagree. The outcome is recorded in ConsensusFile whether
+// or not the check passes.
+func (t *TBDownloader) CheckConsensus(binpath string) error {
+	if t.Consensus <= 0 {
+		return nil
+	}
+	if t.GetProduct().UpdatesURL != TOR_UPDATES_URL {
+		return fmt.Errorf("CheckConsensus: no consensus mirrors carry %s", t.GetProduct().Title)
+	}
+	sum, err := fileSHA256(binpath)
+	if err != nil {
+		return fmt.Errorf("CheckConsensus: %s", err)
+	}
+	record := &ConsensusRecord{
+		File:     filepath.Base(binpath),
+		Version:  t.VersionFromName(binpath),
+		SHA256:   sum,
+		Required: t.Consensus,
+		Checked:  time.Now(),
+	}
+	disagreed := 0
+	agreed := make(map[string]bool)
+	for _, mirror := range t.consensusMirrors() {
+		if record.Agreed >= t.Consensus {
+			break
+		}
+		// A route which already confirmed the file can't confirm it again, as
+		// whoever controls it could answer for every mirror on it.
+		if agreed[mirror.Route] {
+			continue
+		}
+		vote := t.mirrorVote(mirror, binpath, record.Version, sum)
+		log.Printf("CheckConsensus: %s over %s: %s %s", mirror.URL, mirror.Route, vote.Result, vote.Detail)
+		switch vote.Result {
+		case "agree":
+			agreed[mirror.Route] = true
+			record.Agreed++
+		case "disagree":
+			disagreed++
+		}
+		record.Votes = append(record.Votes, vote)
+	}
+	record.Passed = disagreed == 0 && record.Agreed >= t.Consensus
+	if bytes, err := json.MarshalIndent(record, "", "  "); err == nil {
+		if err := ioutil.WriteFile(t.ConsensusFile(), bytes, 0644); err != nil {
+			log.Println("CheckConsensus:", err)
+		}
+	}
+	if disagreed > 0 {
+		return fmt.Errorf("CheckConsensus: %d mirrors disagree about %s, it may have been tampered with", disagreed, record.File)
+	}
+	if record.Agreed < t.Consensus {
+		return fmt.Errorf("CheckConsensus: only %d of the %d required mirrors on different routes could confirm %s", record.Agreed, t.Consensus, record.File)
+	}
+	return nil
+}
+
+// mirrorVote fetches the detached signature and checksum manifest of a release
+// from a mirror and compares them with the downloaded file.
+func (t *TBDownloader) mirrorVote(mirror ConsensusMirror, binpath, version, sum string) MirrorVote {
+	vote := MirrorVote{ConsensusMirror: mirror, Result: "unreachable"}
+	client, err := RouteClient(mirror.Route)
+	if err != nil {
+		vote.Detail = err.Error()
+		return vote
+	}
+	base := mirror.URL + version + "/"
+	asc, err := routeFetch(client, base+filepath.Base(binpath)+".asc")
+	if err != nil {
+		vote.Detail = err.Error()
+		return vote
+	}
+	sigpath := filepath.Join(t.DownloadPath, ".consensus-"+strconv.FormatInt(time.Now().UnixNano(), 36)+".asc")
+	if err := ioutil.WriteFile(sigpath, asc, 0644); err != nil {
+		vote.Detail = err.Error()
+		return vote
+	}
+	defer os.Remove(sigpath)
+	if err := Verify(filepath.Join(t.DownloadPath, t.SigningKey()), sigpath, binpath); err != nil {
+		vote.Result = "disagree"
+		vote.Detail = "signature does not match the downloaded file"
+		return vote
+	}
+	manifest, err := routeFetch(client, base+CONSENSUS_MANIFEST)
+	if err != nil {
+		vote.Result = "agree"
+		vote.Detail = "signature matches, no manifest"
+		return vote
+	}
+	listed, found := manifestSum(manifest, filepath.Base(binpath))
+	switch {
+	case !found:
+		vote.Result = "agree"
+		vote.Detail = "signature matches, file not in manifest"
+	case listed != sum:
+		vote.Result = "disagree"
+		vote.Detail = "manifest lists " + listed
+	default:
+		vote.Result = "agree"
+		vote.Detail = "signature and manifest match"
+	}
+	return vote
+}
+
+func routeFetch(client *http.Client, dl string) ([]byte, error) {
+	resp, err := client.Get(dl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", dl, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// manifestSum returns the hash a sha256sums manifest lists for the named file.
+func manifestSum(manifest []byte, name string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), true
+		}
+	}
+	return "", false
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
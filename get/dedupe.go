@@ -0,0 +1,161 @@
+package tbget
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// LinkTree creates the installed tree dest from the installed tree src, sharing
+// the immutable files between them. Regular files are hardlinked, falling back
+// to a copy if the filesystem can't link them. The parts of the tree the browser
+// writes to, like TorBrowser/Data, are always copied so each tree keeps its own.
+func LinkTree(src, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir():
+			// The source may be read-only, like a mounted disk image, but
+			// the new tree must be writable to be filled.
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !info.Mode().IsRegular():
+			return nil
+		case manifestSkipped(filepath.ToSlash(rel)):
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		if err := os.Link(path, target); err != nil {
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dest string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// linkI2PTree creates the I2P Browser tree from the Tor Browser tree. On macOS
+// the Tor Browser tree is a read-only disk image mount, which can't be
+// hardlinked to, so LinkTree copies its files instead.
+func (t *TBDownloader) linkI2PTree() error {
+	if err := LinkTree(t.BrowserDir(), t.I2PBrowserDir()); err != nil {
+		os.RemoveAll(t.I2PBrowserDir())
+		return err
+	}
+	return nil
+}
+
+// unlinkI2PTree removes an I2P Browser tree which older versions created on
+// macOS as a symlink to the Tor Browser tree, which made the two modes share
+// their data, so it is created again by linkI2PTree.
+func (t *TBDownloader) unlinkI2PTree() {
+	info, err := os.Lstat(t.I2PBrowserDir())
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return
+	}
+	log.Println("unlinkI2PTree: replacing the link", t.I2PBrowserDir(), "with a tree of its own")
+	if err := os.Remove(t.I2PBrowserDir()); err != nil {
+		log.Println("unlinkI2PTree:", err)
+	}
+}
+
+// DedupeI2PTree replaces the files of an I2P Browser tree which was copied
+// from the Tor Browser tree by an older version with hardlinks to the Tor
+// Browser tree's files, when they are identical. It returns the number of
+// bytes freed. It does nothing if the trees already share their files.
+func (t *TBDownloader) DedupeI2PTree() (int64, error) {
+	src, dest := t.BrowserDir(), t.I2PBrowserDir()
+	if !t.GetProduct().I2P || !FileExists(src) || !FileExists(dest) {
+		return 0, nil
+	}
+	binary := filepath.Join("Browser", t.GetProduct().BrowserBinary(t.OS))
+	a, aerr := os.Stat(filepath.Join(src, binary))
+	b, berr := os.Stat(filepath.Join(dest, binary))
+	if aerr != nil || berr != nil || os.SameFile(a, b) {
+		return 0, nil
+	}
+	manifest, _ := ReadManifest(dest)
+	trusted := t.ManifestTrusted(dest)
+	if manifest != nil {
+		if report, err := VerifyManifest(dest, false); err != nil || !report.OK() {
+			return 0, fmt.Errorf("DedupeI2PTree: %s does not match its manifest, not deduplicating it", dest)
+		}
+	}
+	var saved int64
+	err := walkTree(dest, func(rel, path string, info os.FileInfo) error {
+		// The tree's own policies.json is left alone while it is kept aside.
+		if path != filepath.Join(dest, filepath.FromSlash(rel)) {
+			return nil
+		}
+		source := filepath.Join(src, filepath.FromSlash(rel))
+		sinfo, err := os.Stat(source)
+		if err != nil || !sinfo.Mode().IsRegular() || sinfo.Size() != info.Size() || os.SameFile(sinfo, info) {
+			return nil
+		}
+		ssum, err := fileSHA256(source)
+		if err != nil {
+			return nil
+		}
+		dsum, err := fileSHA256(path)
+		if err != nil || ssum != dsum {
+			return nil
+		}
+		tmp := path + ".link-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		if err := os.Link(source, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		saved += info.Size()
+		return nil
+	})
+	if err != nil {
+		return saved, fmt.Errorf("DedupeI2PTree: %s", err)
+	}
+	if manifest != nil {
+		if err := WriteManifest(dest, manifest.Archive); err != nil {
+			return saved, fmt.Errorf("DedupeI2PTree: %s", err)
+		}
+		// The files keep their contents, so the new manifest is as
+		// trustworthy as the one it replaces.
+		if trusted {
+			if err := t.TrustManifest(dest); err != nil {
+				return saved, fmt.Errorf("DedupeI2PTree: %s", err)
+			}
+		}
+	}
+	log.Printf("DedupeI2PTree: freed %d bytes in %s", saved, dest)
+	return saved, nil
+}
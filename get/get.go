@@ -2,6 +2,7 @@ package tbget
 
 import (
 	"archive/tar"
+	"compress/gzip"
 	"context"
 	"embed"
 	"encoding/json"
@@ -29,8 +30,9 @@ import (
 	"github.com/itchio/damage/hdiutil"
 	"github.com/itchio/headway/state"
 	"github.com/magisterquis/connectproxy"
-	cp "github.com/otiai10/copy"
 	"github.com/ulikunitz/xz"
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
+	tbready "i2pgit.org/idk/i2p.plugins.tor-manager/ready"
 
 	"golang.org/x/net/proxy"
 )
@@ -105,7 +107,18 @@ type TBDownloader struct {
 	Verbose      bool
 	NoUnpack     bool
 	Profile      *embed.FS
-	listener     net.Listener
+	Product      *Product
+	Channel      string
+	// AllowDowngrade lets the TBDownloader install releases older than the newest one it has verified.
+	AllowDowngrade bool
+	// FreezeWindow is how long the feed may go without a new release before the TBDownloader warns about it.
+	FreezeWindow time.Duration
+	// FeedWarning is set when the feed looks stale, see CheckFeedFreshness.
+	FeedWarning string
+	// Consensus is the number of ConsensusMirrors which must confirm a download before it is unpacked.
+	Consensus        int
+	ConsensusMirrors []ConsensusMirror
+	listener         net.Listener
 }
 
 // OS is the operating system of the TBDownloader.
@@ -116,31 +129,60 @@ var ARCH = "64"
 
 // NewTBDownloader returns a new TBDownloader with the given language, using the TBDownloader's OS/ARCH pair
 func NewTBDownloader(lang string, os, arch string, content *embed.FS) *TBDownloader {
+	return NewProductDownloader(TorBrowser, lang, os, arch, content)
+}
+
+// NewProductDownloader returns a new TBDownloader for the given product and language, using the TBDownloader's OS/ARCH pair
+func NewProductDownloader(product *Product, lang string, os, arch string, content *embed.FS) *TBDownloader {
 	OS = os
 	ARCH = arch
 	return &TBDownloader{
 		Lang:         lang,
-		DownloadPath: DOWNLOAD_PATH(),
-		UnpackPath:   UNPACK_PATH(),
+		DownloadPath: ChannelPath(DOWNLOAD_PATH(), CHANNEL),
+		UnpackPath:   ChannelPath(UNPACK_PATH(), CHANNEL),
 		OS:           os,
 		ARCH:         arch,
 		Verbose:      false,
 		Profile:      content,
+		Product:      product,
+		Channel:      CHANNEL,
+
+		AllowDowngrade: ALLOW_DOWNGRADE,
+		FreezeWindow:   FREEZE_WINDOW,
+
+		Consensus:        CONSENSUS,
+		ConsensusMirrors: CONSENSUS_MIRRORS,
 	}
 }
 
+// GetProduct returns the product the TBDownloader manages, Tor Browser if none is set.
+func (t *TBDownloader) GetProduct() *Product {
+	if t.Product == nil {
+		return TorBrowser
+	}
+	return t.Product
+}
+
 // ServeHTTP serves the DOWNLOAD_PATH as a mirror
 func (t *TBDownloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.URL.Path = path.Clean(r.URL.Path)
+	downloadPath := t.DownloadPath
+	for _, channel := range Channels {
+		if prefix := ChannelPrefix(channel); prefix != "" && strings.HasPrefix(r.URL.Path, "/"+prefix) {
+			downloadPath = ChannelPath(DOWNLOAD_PATH(), channel)
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, "/"+strings.TrimSuffix(prefix, "/"))
+			break
+		}
+	}
 	ext := filepath.Ext(r.URL.Path)
 	if ext == ".json" {
 		w.Header().Set("Content-Type", "application/json")
-		if FileExists(filepath.Join(t.DownloadPath, "mirror.json")) {
-			http.ServeFile(w, r, filepath.Join(t.DownloadPath, "mirror.json"))
+		if FileExists(filepath.Join(downloadPath, "mirror.json")) {
+			http.ServeFile(w, r, filepath.Join(downloadPath, "mirror.json"))
 		}
 	}
-	if FileExists(filepath.Join(t.DownloadPath, r.URL.Path)) {
-		http.ServeFile(w, r, filepath.Join(t.DownloadPath, r.URL.Path))
+	if FileExists(filepath.Join(downloadPath, r.URL.Path)) {
+		http.ServeFile(w, r, filepath.Join(downloadPath, r.URL.Path))
 		return
 	}
 }
@@ -148,7 +190,7 @@ func (t *TBDownloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Serve runs ServeHTTP on an I2P listener
 func (t *TBDownloader) Serve() {
 	var err error
-	t.listener, err = sam.I2PListener("torbrowser-mirror", "127.0.0.1:7656", filepath.Join(t.UnpackPath, "torbrowser-mirror"))
+	t.listener, err = sam.I2PListener("torbrowser-mirror", tbdiscover.Default().SAM.Addr(), filepath.Join(t.UnpackPath, "torbrowser-mirror"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -194,7 +236,7 @@ func (t *TBDownloader) GetUpdater() (string, string, error) {
 // GetUpdaterForLang returns the updater for the given language, using the TBDownloader's OS/ARCH pair
 // it expects ietf to be a language. It returns the URL of the updater and the detatched signature, or an error if one is not found.
 func (t *TBDownloader) GetUpdaterForLang(ietf string) (string, string, error) {
-	jsonText, err := http.Get(TOR_UPDATES_URL)
+	jsonText, err := http.Get(t.UpdatesURL())
 	if err != nil {
 		return "", "", fmt.Errorf("t.GetUpdaterForLang: %s", err)
 	}
@@ -211,7 +253,7 @@ func (t *TBDownloader) GetUpdaterForLangFromJSON(body io.ReadCloser, ietf string
 		return "", "", fmt.Errorf("t.GetUpdaterForLangFromJSON: %s", err)
 	}
 	t.MakeTBDirectory()
-	if err = ioutil.WriteFile(filepath.Join(t.DownloadPath, "downloads.json"), jsonBytes, 0644); err != nil {
+	if err = ioutil.WriteFile(filepath.Join(t.DownloadPath, t.FeedFile()), jsonBytes, 0644); err != nil {
 		return "", "", fmt.Errorf("t.GetUpdaterForLangFromJSON: %s", err)
 	}
 	return t.GetUpdaterForLangFromJSONBytes(jsonBytes, ietf)
@@ -228,10 +270,7 @@ func (t *TBDownloader) Log(function, message string) {
 func (t *TBDownloader) MakeTBDirectory() {
 	os.MkdirAll(t.DownloadPath, 0755)
 
-	tpk := "TPO-signing-key.pub"
-	if t.OS == "linux" && runtime.GOARCH == "arm64" {
-		tpk = "NOT-TPO-signing-key.pub"
-	}
+	tpk := t.SigningKey()
 
 	empath := path.Join("tor-browser", tpk)
 	opath := filepath.Join(t.DownloadPath, tpk)
@@ -272,6 +311,14 @@ func (t *TBDownloader) MakeTBDirectory() {
 	}
 }
 
+// SigningKey returns the name of the key which signs the product for this platform.
+func (t *TBDownloader) SigningKey() string {
+	if t.OS == "linux" && runtime.GOARCH == "arm64" && t.GetProduct() == TorBrowser {
+		return "NOT-TPO-signing-key.pub"
+	}
+	return t.GetProduct().SigningKey
+}
+
 // GetUpdaterForLangFromJSONBytes returns the updater for the given language, using the TBDownloader's OS/ARCH pair
 // it expects jsonBytes to be a valid json string and ietf to be a language. It returns the URL of the updater and
 // the detatched signature, or an error if one is not found.
@@ -283,14 +330,21 @@ func (t *TBDownloader) GetUpdaterForLangFromJSONBytes(jsonBytes []byte, ietf str
 		return "", "", fmt.Errorf("func (t *TBDownloader)Name: %s", err)
 	}
 	t.Log("GetUpdaterForLangFromJSONBytes()", "Parsing JSON complete")
+	product := t.GetProduct()
+	if product.Lang != "" {
+		ietf = product.Lang
+	}
 	if platform, ok := dat["downloads"]; ok {
 		rtp := t.GetRuntimePair()
+		if product.UpdatesURL != TOR_UPDATES_URL {
+			rtp = product.Platform(rtp)
+		}
 		if updater, ok := platform.(map[string]interface{})[rtp]; ok {
 			if langUpdater, ok := updater.(map[string]interface{})[ietf]; ok {
 				t.Log("GetUpdaterForLangFromJSONBytes()", "Found updater for language")
 				bin := langUpdater.(map[string]interface{})["binary"].(string)
 				sig := langUpdater.(map[string]interface{})["sig"].(string)
-				return t.MirrorIze(bin), t.MirrorIze(sig), nil
+				return t.productUpdater(bin, sig)
 			}
 			// If we didn't find the language, try splitting at the hyphen
 			lang := strings.Split(ietf, "-")[0]
@@ -298,9 +352,14 @@ func (t *TBDownloader) GetUpdaterForLangFromJSONBytes(jsonBytes []byte, ietf str
 				t.Log("GetUpdaterForLangFromJSONBytes()", "Found updater for backup language")
 				bin := langUpdater.(map[string]interface{})["binary"].(string)
 				sig := langUpdater.(map[string]interface{})["sig"].(string)
-				return t.MirrorIze(bin), t.MirrorIze(sig), nil
+				return t.productUpdater(bin, sig)
+			}
+			// If we didn't find the language after splitting at the hyphen, try the default,
+			// unless it was just tried. Products with a language of their own only have
+			// that one.
+			if ietf == t.Lang || product.Lang != "" {
+				return "", "", fmt.Errorf("t.GetUpdaterForLangFromJSONBytes: no updater for language %s", ietf)
 			}
-			// If we didn't find the language after splitting at the hyphen, try the default
 			t.Log("GetUpdaterForLangFromJSONBytes()", "Last attempt, trying default language")
 			return t.GetUpdaterForLangFromJSONBytes(jsonBytes, t.Lang)
 		}
@@ -309,6 +368,24 @@ func (t *TBDownloader) GetUpdaterForLangFromJSONBytes(jsonBytes []byte, ietf str
 	return "", "", fmt.Errorf("t.GetUpdaterForLangFromJSONBytes: %s", ietf)
 }
 
+// productUpdater turns the updater URLs found in a product's feed into the URLs of the
+// product's release artifact. Products which are released alongside Tor Browser
+// share its feed, so their URLs are derived from the Tor Browser release directory.
+func (t *TBDownloader) productUpdater(bin, sig string) (string, string, error) {
+	product := t.GetProduct()
+	if product.UpdatesURL == TOR_UPDATES_URL && product != TorBrowser {
+		spl := strings.Split(bin, "/")
+		if len(spl) < 2 {
+			return "", "", fmt.Errorf("t.productUpdater: unexpected updater URL %s", bin)
+		}
+		version := spl[len(spl)-2]
+		name := product.FileName(t.OS, t.GetRuntimePair(), version, t.Lang)
+		bin = strings.Join(append(spl[:len(spl)-1], name), "/")
+		sig = bin + ".asc"
+	}
+	return t.MirrorIze(bin), t.MirrorIze(sig), nil
+}
+
 func (t *TBDownloader) MirrorIze(replaceStr string) string {
 	log.Println("MirrorIze()", "Replacing", replaceStr, t.Mirror)
 	if t.OS == "linux" && runtime.GOARCH == "arm64" {
@@ -332,7 +409,11 @@ func (t *TBDownloader) MirrorIze(replaceStr string) string {
 		return newurl
 	}
 	if t.Mirror != "" {
-		return strings.Replace(replaceStr, "https://dist.torproject.org/torbrowser/", t.Mirror, 1)
+		mirror := t.Mirror
+		if prefix := ChannelPrefix(t.GetChannel()); prefix != "" && !strings.Contains(mirror, "dist.torproject.org") {
+			mirror = strings.TrimSuffix(mirror, "/") + "/" + prefix
+		}
+		return strings.Replace(replaceStr, "https://dist.torproject.org/torbrowser/", mirror, 1)
 	}
 	log.Println("MirrorIze()", "Final URL", replaceStr)
 	return replaceStr
@@ -400,71 +481,94 @@ func unSetupProxy() {
 var t *tor.Tor
 
 func SetupProxy(mirror, tp string) error {
-	var d proxy.Dialer
 	http.DefaultClient.Transport = nil
 	defer unSetupProxy()
+	tr, err := ProxyTransport(mirror, tp)
+	if err != nil {
+		return err
+	}
+	if tr != nil {
+		http.DefaultClient.Transport = tr
+	}
+	return nil
+}
+
+// ProxyTransport returns a transport which follows the network policy for
+// downloading from mirror: I2P mirrors are reached through the I2P HTTP proxy,
+// everything else goes through Tor if it's available. It returns nil if the
+// download should be made directly.
+func ProxyTransport(mirror, tp string) (*http.Transport, error) {
+	var d proxy.Dialer
 	if MirrorIsI2P(mirror) {
 		log.Println("Using I2P mirror, setting up proxy")
 		var err error
-		proxyURL, err := url.Parse("http://127.0.0.1:4444")
+		proxyURL, err := url.Parse(tbdiscover.Default().HTTPProxy.URL())
 		if err != nil {
-			return err
+			return nil, err
 		}
 		d, err = connectproxy.New(proxyURL, proxy.Direct)
 		if nil != err {
-			return err
+			return nil, err
 		}
 		tr := &http.Transport{
 			Dial: d.Dial,
 		}
-		http.DefaultClient.Transport = tr
-	} else {
-		nut := os.Getenv("TOR_MANAGER_NEVER_USE_TOR")
-		if nut != "true" {
-			if !strings.Contains(mirror, "127.0.0.1") && !strings.Contains(mirror, "localhost") {
-				if tmp, torerr := net.Listen("tcp", "127.0.0.1:9050"); torerr != nil {
-					log.Println("System Tor is running, downloading over that because obviously.")
-					is_flatpak := os.Getenv("APP_ID") != ""
-					if is_flatpak {
-						log.Println("Flatpak detected, using Tor without bine")
-						url_i := url.URL{}
-						url_proxy, err := url_i.Parse("socks5://127.0.0.1:9050")
-						if err != nil {
-							return err
-						}
-
-						tr := &http.Transport{}
-						tr.Proxy = http.ProxyURL(url_proxy) // set proxy
-						http.DefaultClient.Transport = tr
-						return nil
-					}
-					var err error
-					if t == nil {
-						t, err = tor.Start(context.Background(), StartConf(tp))
-						if err != nil {
-							if t == nil {
-								return err
-							}
-						}
+		return tr, nil
+	}
+	nut := os.Getenv("TOR_MANAGER_NEVER_USE_TOR")
+	if nut != "true" {
+		if !strings.Contains(mirror, "127.0.0.1") && !strings.Contains(mirror, "localhost") {
+			if torerr := tbready.Check(time.Second, tbready.SOCKS("127.0.0.1:9050")); torerr == nil {
+				log.Println("System Tor is running, downloading over that because obviously.")
+				is_flatpak := os.Getenv("APP_ID") != ""
+				if is_flatpak {
+					log.Println("Flatpak detected, using Tor without bine")
+					url_i := url.URL{}
+					url_proxy, err := url_i.Parse("socks5://127.0.0.1:9050")
+					if err != nil {
+						return nil, err
 					}
-					//defer t.Close()
-					// Wait at most a minute to start network and get
-					dialCtx, _ := context.WithTimeout(context.Background(), time.Minute)
-					//defer dialCancel()
-					// Make connection
-					dialer, err := t.Dialer(dialCtx, nil)
+
+					tr := &http.Transport{}
+					tr.Proxy = http.ProxyURL(url_proxy) // set proxy
+					return tr, nil
+				}
+				var err error
+				if t == nil {
+					t, err = tor.Start(context.Background(), StartConf(tp))
 					if err != nil {
-						return err
+						if t == nil {
+							return nil, err
+						}
 					}
-					tr := &http.Transport{DialContext: dialer.DialContext}
-					http.DefaultClient.Transport = tr
-				} else {
-					tmp.Close()
 				}
+				//defer t.Close()
+				// Wait at most a minute to start network and get
+				dialCtx, dialCancel := context.WithTimeout(context.Background(), time.Minute)
+				defer dialCancel()
+				// Make connection
+				dialer, err := t.Dialer(dialCtx, nil)
+				if err != nil {
+					return nil, err
+				}
+				tr := &http.Transport{DialContext: dialer.DialContext}
+				return tr, nil
 			}
 		}
 	}
-	return nil
+	return nil, nil
+}
+
+// HTTPClient returns an HTTP client which follows the network policy for the TBDownloader's mirror.
+func (t *TBDownloader) HTTPClient() (*http.Client, error) {
+	tr, err := ProxyTransport(t.Mirror, t.TorPath())
+	if err != nil {
+		return nil, err
+	}
+	if tr == nil {
+		return &http.Client{}, nil
+	}
+	return &http.Client{Transport: tr}, nil
 }
 
 // SingleFileDownload downloads a single file from the given URL to the given path.
@@ -481,7 +585,7 @@ func (t *TBDownloader) SingleFileDownload(dl, name string, rangebottom int64) (s
 		t.Log("SingleFileDownload()", "File already exists, skipping download")
 		return path, nil
 	}
-	err := t.SetupProxy()
+	client, err := t.HTTPClient()
 	if err != nil {
 		return "", err
 	}
@@ -506,7 +610,7 @@ func (t *TBDownloader) SingleFileDownload(dl, name string, rangebottom int64) (s
 	}
 	t.Log("SingleFileDownload()", "Downloading file "+dl)
 	//file, err := http.Get(dl)
-	file, err := http.DefaultClient.Do(&req)
+	file, err := client.Do(&req)
 	//Do(&req, nil)
 	if err != nil {
 		return "", fmt.Errorf("SingleFileDownload: Request Error %s", err)
@@ -557,14 +661,26 @@ func FileExists(path string) bool {
 
 func (t *TBDownloader) FetchContentLength(dl, name string) (int64, error) {
 	t.MakeTBDirectory()
-	return FetchContentLength(dl, name)
+	client, err := t.HTTPClient()
+	if err != nil {
+		return 0, err
+	}
+	return fetchContentLength(client, dl, name)
 }
 func FetchContentLength(dl, name string) (int64, error) {
-	log.Println("FetchContentLength():", fmt.Sprintf("Checking for updates %s to %s", dl, name))
-	err := SetupProxy(dl, "")
+	tr, err := ProxyTransport(dl, "")
 	if err != nil {
 		return 0, err
 	}
+	client := &http.Client{}
+	if tr != nil {
+		client.Transport = tr
+	}
+	return fetchContentLength(client, dl, name)
+}
+
+func fetchContentLength(client *http.Client, dl, name string) (int64, error) {
+	log.Println("FetchContentLength():", fmt.Sprintf("Checking for updates %s to %s", dl, name))
 	dlurl, err := url.Parse(dl)
 	if err != nil {
 		return 0, err
@@ -575,7 +691,7 @@ func FetchContentLength(dl, name string) (int64, error) {
 	}
 	log.Println("FetchContentLength()", "Downloading file "+dl)
 	//file, err := http.Get(dl)
-	file, err := http.DefaultClient.Do(&req)
+	file, err := client.Do(&req)
 	//Do(&req, nil)
 	if err != nil {
 		return 0, fmt.Errorf("FetchContentLength: Request Error %s", err)
@@ -633,17 +749,7 @@ func (t *TBDownloader) BotherToDownload(dl, name string) bool {
 
 // NamePerPlatform returns the name of the updater for the given platform with appropriate extensions.
 func (t *TBDownloader) NamePerPlatform(ietf, version string) string {
-	extension := "tar.xz"
-	windowsonly := ""
-	switch t.OS {
-	case "osx":
-		extension = "dmg"
-	case "win":
-		windowsonly = "-installer"
-		extension = "exe"
-	}
-	//version, err := t.Get
-	return fmt.Sprintf("tor-browser%s-%s-%s_%s.%s", windowsonly, t.GetRuntimePair(), version, ietf, extension)
+	return t.GetProduct().FileName(t.OS, t.GetRuntimePair(), version, ietf)
 }
 
 func (t *TBDownloader) GetVersion() string {
@@ -675,7 +781,11 @@ func (t *TBDownloader) DownloadUpdaterForLang(ietf string) (string, string, stri
 		return "", "", "", fmt.Errorf("DownloadUpdaterForLang: %s", err)
 	}
 	version := t.GetVersion()
-	if strings.Contains(t.Mirror, "i2psnark") {
+	if err := t.CheckDowngrade(version); err != nil {
+		return "", "", "", fmt.Errorf("DownloadUpdaterForLang: %s", err)
+	}
+	t.FeedWarning = t.CheckFeedFreshness(version)
+	if strings.Contains(t.Mirror, "i2psnark") && t.GetProduct() == TorBrowser {
 		if !TorrentDownloaded(ietf, t.GetRuntimePair()) {
 			t.Log("DownloadUpdaterForLang()", "Downloading torrent")
 			SetupProxy("http://idk.i2p/", "")
@@ -687,13 +797,13 @@ func (t *TBDownloader) DownloadUpdaterForLang(ietf string) (string, string, stri
 			log.Println("Downloading torrent from", i2psnark)
 			asctorrent := filepath.Join(t.NamePerPlatform(ietf, version) + ".asc" + ".torrent")
 			fmt.Println("Downloading", asctorrent)
-			_, err = t.SingleFileDownload("http://idk.i2p/torbrowser/"+asctorrent, filepath.Join(i2psnark, asctorrent), 0)
+			_, err = t.SingleFileDownload("http://idk.i2p/torbrowser/"+ChannelPrefix(t.GetChannel())+asctorrent, filepath.Join(i2psnark, asctorrent), 0)
 			if err != nil {
 				return "", "", "", fmt.Errorf("DownloadUpdaterForLang: %s", err)
 			}
 			bintorrent := filepath.Join(t.NamePerPlatform(ietf, version) + ".torrent")
 			fmt.Println("Downloading", bintorrent)
-			_, err = t.SingleFileDownload("http://idk.i2p/torbrowser/"+bintorrent, filepath.Join(i2psnark, bintorrent), 0)
+			_, err = t.SingleFileDownload("http://idk.i2p/torbrowser/"+ChannelPrefix(t.GetChannel())+bintorrent, filepath.Join(i2psnark, bintorrent), 0)
 			if err != nil {
 				return "", "", "", fmt.Errorf("DownloadUpdaterForLang: %s", err)
 			}
@@ -725,20 +835,56 @@ func (t *TBDownloader) DownloadUpdaterForLang(ietf string) (string, string, stri
 
 // BrowserDir returns the path to the directory where the browser is installed.
 func (t *TBDownloader) BrowserDir() string {
-	return filepath.Join(t.UnpackPath, "tor-browser_"+t.Lang)
+	return filepath.Join(t.UnpackPath, t.GetProduct().InstallDir(t.Lang))
 }
 
 func (t *TBDownloader) I2PBrowserDir() string {
 	return filepath.Join(t.UnpackPath, "i2p-browser_"+t.Lang)
 }
 
-// UnpackUpdater unpacks the updater to the given path.
+// UnpackUpdater unpacks the updater to the given path, and writes an integrity
+// manifest for each tree it creates, which is trusted as the updater's
+// signature has been checked by the caller.
 // it returns the path or an erorr if one is encountered.
 func (t *TBDownloader) UnpackUpdater(binpath string) (string, error) {
 	if t.NoUnpack {
 		return binpath, nil
 	}
+	t.unlinkI2PTree()
+	var fresh []string
+	for _, tree := range t.InstallTrees() {
+		if !FileExists(tree) {
+			fresh = append(fresh, tree)
+		}
+	}
+	home, err := t.unpackUpdater(binpath)
+	if err != nil {
+		return home, err
+	}
+	for _, tree := range fresh {
+		if FileExists(tree) {
+			if err := WriteManifest(tree, binpath); err != nil {
+				log.Println("UnpackUpdater:", err)
+			} else if err := t.TrustManifest(tree); err != nil {
+				log.Println("UnpackUpdater:", err)
+			}
+		}
+	}
+	return home, nil
+}
+
+func (t *TBDownloader) unpackUpdater(binpath string) (string, error) {
 	t.Log("UnpackUpdater()", fmt.Sprintf("Unpacking %s", binpath))
+	product := t.GetProduct()
+	if product.Archive != "" {
+		if FileExists(t.BrowserDir()) {
+			return t.BrowserDir(), nil
+		}
+		if err := t.UnpackArchive(binpath, t.BrowserDir()); err != nil {
+			return "", fmt.Errorf("UnpackUpdater: %s", err)
+		}
+		return t.BrowserDir(), nil
+	}
 	if t.OS == "win" {
 		installPath := t.BrowserDir()
 		if !FileExists(installPath) {
@@ -751,16 +897,21 @@ func (t *TBDownloader) UnpackUpdater(binpath string) (string, error) {
 			if err != nil {
 				return "", fmt.Errorf("UnpackUpdater: windows exec fail %s", err)
 			}
-			if err := cp.Copy(t.BrowserDir(), t.I2PBrowserDir()); err != nil {
-				return "", fmt.Errorf("UnpackUpdater: copy fail %s", err)
+		}
+		// link BrowserDir() to I2PBrowserDir()
+		if product.I2P && !FileExists(t.I2PBrowserDir()) {
+			if err := t.linkI2PTree(); err != nil {
+				return "", fmt.Errorf("UnpackUpdater: link fail %s", err)
 			}
+		} else if _, err := t.DedupeI2PTree(); err != nil {
+			log.Println("UnpackUpdater:", err)
 		}
-		// copy BrowserDir() to I2PBrowserDir()
-
 		return installPath, nil
 	}
 	if t.OS == "osx" {
-		binpath = "tor-browser/torbrowser-osx64-en-US.dmg"
+		if product == TorBrowser {
+			binpath = "tor-browser/torbrowser-osx64-en-US.dmg"
+		}
 		log.Println("hdiutil", "mount", "\""+binpath+"\"")
 		//cmd := exec.Command("open", "-W", "-n", "-a", "\""+binpath+"\"")
 		//cmd := exec.Command("hdiutil", "attach", "\""+binpath+"\"")
@@ -775,9 +926,9 @@ func (t *TBDownloader) UnpackUpdater(binpath string) (string, error) {
 				return "", fmt.Errorf("UnpackUpdater: osx open/mount fail %s", err)
 			}
 		}
-		if !FileExists(t.I2PBrowserDir()) {
-			if _, err := damage.Mount(host, binpath, t.I2PBrowserDir()); err != nil {
-				return "", fmt.Errorf("UnpackUpdater: osx open/mount fail %s", err)
+		if product.I2P && !FileExists(t.I2PBrowserDir()) {
+			if err := t.linkI2PTree(); err != nil {
+				return "", fmt.Errorf("UnpackUpdater: link fail %s", err)
 			}
 		}
 		//cmd.Stdout = os.Stdout
@@ -787,68 +938,98 @@ func (t *TBDownloader) UnpackUpdater(binpath string) (string, error) {
 		return t.BrowserDir(), nil
 	}
 	if FileExists(t.BrowserDir()) {
-		if !FileExists(t.I2PBrowserDir()) {
-			if err := cp.Copy(t.BrowserDir(), t.I2PBrowserDir()); err != nil {
-				return "", fmt.Errorf("UnpackUpdater: copy fail %s", err)
+		if product.I2P && !FileExists(t.I2PBrowserDir()) {
+			if err := t.linkI2PTree(); err != nil {
+				return "", fmt.Errorf("UnpackUpdater: link fail %s", err)
 			}
+		} else if _, err := t.DedupeI2PTree(); err != nil {
+			log.Println("UnpackUpdater:", err)
 		}
 		return t.BrowserDir(), nil
 	}
-	fmt.Fprintf(os.Stderr, "Unpacking %s %s\n", binpath, t.UnpackPath)
-	os.MkdirAll(t.UnpackPath, 0755)
-	UNPACK_DIRECTORY, err := os.Open(t.UnpackPath)
+	if err := t.UnpackArchive(binpath, t.UnpackPath); err != nil {
+		return "", fmt.Errorf("UnpackUpdater: %s", err)
+	}
+	if product.I2P && !FileExists(t.I2PBrowserDir()) {
+		if err := t.linkI2PTree(); err != nil {
+			return "", fmt.Errorf("UnpackUpdater: link fail %s", err)
+		}
+	}
+	return t.BrowserDir(), nil
+}
+
+// UnpackArchive unpacks a .tar.xz or .tar.gz archive into the directory dest.
+func (t *TBDownloader) UnpackArchive(binpath, dest string) error {
+	fmt.Fprintf(os.Stderr, "Unpacking %s %s\n", binpath, dest)
+	os.MkdirAll(dest, 0755)
+	UNPACK_DIRECTORY, err := os.Open(dest)
 	if err != nil {
-		return "", fmt.Errorf("UnpackUpdater: directory error %s", err)
+		return fmt.Errorf("UnpackArchive: directory error %s", err)
 	}
 	defer UNPACK_DIRECTORY.Close()
-	xzfile, err := os.Open(binpath)
+	archive, err := os.Open(binpath)
 	if err != nil {
-		return "", fmt.Errorf("UnpackUpdater: XZFile error %s", err)
+		return fmt.Errorf("UnpackArchive: archive error %s", err)
 	}
-	defer xzfile.Close()
-	xzReader, err := xz.NewReader(xzfile)
-	if err != nil {
-		return "", fmt.Errorf("UnpackUpdater: XZReader error %s", err)
+	defer archive.Close()
+	var archiveReader io.Reader
+	if strings.HasSuffix(binpath, ".gz") {
+		gzReader, err := gzip.NewReader(archive)
+		if err != nil {
+			return fmt.Errorf("UnpackArchive: GZReader error %s", err)
+		}
+		defer gzReader.Close()
+		archiveReader = gzReader
+	} else {
+		archiveReader, err = xz.NewReader(archive)
+		if err != nil {
+			return fmt.Errorf("UnpackArchive: XZReader error %s", err)
+		}
 	}
-	tarReader := tar.NewReader(xzReader)
+	tarReader := tar.NewReader(archiveReader)
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return "", fmt.Errorf("UnpackUpdater: Tar looper Error %s", err)
+			return fmt.Errorf("UnpackArchive: Tar looper Error %s", err)
 		}
 		if header.Typeflag == tar.TypeDir {
 			os.MkdirAll(filepath.Join(UNPACK_DIRECTORY.Name(), header.Name), 0755)
 			continue
 		}
 		filename := filepath.Join(UNPACK_DIRECTORY.Name(), header.Name)
+		os.MkdirAll(filepath.Dir(filename), 0755)
 		file, err := os.Create(filename)
 		if err != nil {
-			return "", fmt.Errorf("UnpackUpdater: Tar unpacker error %s", err)
+			return fmt.Errorf("UnpackArchive: Tar unpacker error %s", err)
 		}
-		defer file.Close()
 		io.Copy(file, tarReader)
 		mode := header.FileInfo().Mode()
 		//remember to chmod the file afterwards
 		file.Chmod(mode)
+		file.Close()
 		if t.Verbose {
 			fmt.Fprintf(os.Stderr, "Unpacked %s\n", header.Name)
 		}
 	}
-	if !FileExists(t.I2PBrowserDir()) {
-		if err := cp.Copy(t.BrowserDir(), t.I2PBrowserDir()); err != nil {
-			return "", fmt.Errorf("UnpackUpdater: copy fail %s", err)
-		}
-	}
-	return t.BrowserDir(), nil
+	return nil
 }
 
 // TorPath returns the path to the Tor executable
 func (s *TBDownloader) TorPath() string {
-	if s.OS == "osx" {
+	if s.GetProduct() == TorExpertBundle {
+		if s.OS == "win" {
+			return filepath.Join(s.BrowserDir(), "tor", "tor.exe")
+		}
+		return filepath.Join(s.BrowserDir(), "tor", "tor")
+	}
+	switch s.OS {
+	case "osx":
 		return filepath.Join(s.UnpackPath, "Tor Browser.app", "Contents", "Resources", "TorBrowser", "Tor", "tor")
+	case "win":
+		return filepath.Join(s.UnpackPath, "Browser", "TorBrowser", "Tor", "tor.exe")
 	}
 	return filepath.Join(s.UnpackPath, "Browser", "TorBrowser", "Tor", "tor")
 }
@@ -857,13 +1038,20 @@ func (s *TBDownloader) TorPath() string {
 // it returns an error if one is encountered. If not, it
 // runs the updater and returns an error if one is encountered.
 func (t *TBDownloader) CheckSignature(binpath, sigpath string) (string, error) {
-	pk := filepath.Join(t.DownloadPath, "TPO-signing-key.pub")
-	if t.OS == "linux" && runtime.GOARCH == "arm64" {
-		pk = filepath.Join(t.DownloadPath, "NOT-TPO-signing-key.pub")
+	pk := filepath.Join(t.DownloadPath, t.SigningKey())
+	version := t.VersionFromName(binpath)
+	if err := t.CheckDowngrade(version); err != nil {
+		return "", fmt.Errorf("CheckSignature: %s", err)
 	}
 	var err error
 	if err = Verify(pk, sigpath, binpath); err == nil {
 		log.Println("CheckSignature: signature", "verified successfully")
+		if err := t.CheckConsensus(binpath); err != nil {
+			return "", fmt.Errorf("CheckSignature: %s", err)
+		}
+		if err := t.RecordVerifiedVersion(version); err != nil {
+			log.Println("CheckSignature:", err)
+		}
 		if !t.NoUnpack {
 			return t.UnpackUpdater(binpath)
 		}
@@ -879,80 +1067,55 @@ func (t *TBDownloader) BoolCheckSignature(binpath, sigpath string) bool {
 	return err == nil
 }
 
-// TestHTTPDefaultProxy returns true if the I2P proxy is up or blocks until it is.
-func TestHTTPDefaultProxy() bool {
-	return TestHTTPProxy("127.0.0.1", "4444")
-}
+// PROXY_TIMEOUT is how long TestHTTPDefaultProxy, TestHTTPBackupProxy and
+// TestHTTPProxy wait for a proxy to come up.
+var PROXY_TIMEOUT = 40 * time.Second
 
-// Seconds increments the seconds and displays the number of seconds every 10 seconds
-func Seconds(now int) int {
-	time.Sleep(time.Second)
-	if now == 3 {
-		return 0
-	}
-	return now + 1
+// TestHTTPDefaultProxy returns true if the I2P router's HTTP proxy is up or blocks until it is.
+func TestHTTPDefaultProxy() bool {
+	proxy := tbdiscover.Default().HTTPProxy
+	return TestHTTPProxy(proxy.Host, proxy.PortString())
 }
 
 // TestHTTPBackupProxy returns true if the I2P backup proxy is up or blocks until it is.
 func TestHTTPBackupProxy() bool {
-	now := 0
-	limit := 0
-	for {
-		_, err := net.Listen("tcp", "127.0.0.1:4444")
-		if err != nil {
-			log.Println("SAM HTTP proxy is open", err)
-			return true
-		} else {
-			if now == 0 {
-				log.Println("Waiting for HTTP Proxy", (10 - limit), "remaining attempts")
-				limit++
-			}
-			now = Seconds(now)
-		}
-		if limit == 10 {
-			break
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), PROXY_TIMEOUT)
+	defer cancel()
+	addr := tbdiscover.Default().HTTPProxy.Addr()
+	log.Println("Waiting for the backup HTTP proxy on", addr)
+	if err := tbready.Wait(ctx, tbready.Listening(addr)); err != nil {
+		log.Println("TestHTTPBackupProxy:", err)
+		return false
 	}
-	return false
+	log.Println("SAM HTTP proxy is open on", addr)
+	return true
 }
 
 // TestHTTPProxy returns true if the proxy at host:port is up or blocks until it is.
 func TestHTTPProxy(host, port string) bool {
-	now := 0
-	limit := 0
-	for {
-		proxy := hTTPProxy(host, port)
-		if proxy {
-			return true
-		} else {
-			if now == 0 {
-				log.Println("Waiting for HTTP Proxy", (10 - limit), "remaining attempts")
-				limit++
-			}
-			now = Seconds(now)
-		}
-		if limit == 10 {
-			break
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), PROXY_TIMEOUT)
+	defer cancel()
+	if err := WaitHTTPProxy(ctx, net.JoinHostPort(host, port)); err != nil {
+		log.Println(err)
+		return false
 	}
-	return false
+	return true
 }
 
-func hTTPProxy(host, port string) bool {
-	proxyURL, err := url.Parse("http://" + host + ":" + port)
-	if err != nil {
-		log.Panic(err)
-	}
-	myClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
-	resp, err := myClient.Get("http://proxy.i2p/")
-	if err == nil {
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
-		if err == nil {
-			return strings.Contains(string(body), "I2P HTTP proxy OK")
-		}
+// WaitHTTPDefaultProxy waits until the I2P router's HTTP proxy answers or the
+// context is done.
+func WaitHTTPDefaultProxy(ctx context.Context) error {
+	return WaitHTTPProxy(ctx, tbdiscover.Default().HTTPProxy.Addr())
+}
+
+// WaitHTTPProxy waits until the I2P HTTP proxy at addr answers for proxy.i2p
+// or the context is done.
+func WaitHTTPProxy(ctx context.Context, addr string) error {
+	log.Println("Waiting for the HTTP proxy on", addr)
+	if err := tbready.Wait(ctx, tbready.HTTPProxy(addr)); err != nil {
+		return fmt.Errorf("WaitHTTPProxy: %s", err)
 	}
-	return false
+	return nil
 }
 
 func (t *TBDownloader) MirrorIsI2P() bool {
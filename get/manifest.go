@@ -0,0 +1,463 @@
+package tbget
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itchio/damage"
+	"github.com/itchio/damage/hdiutil"
+	"github.com/itchio/headway/state"
+)
+
+// ManifestEntry records a file in an installed tree.
+type ManifestEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	SHA256  string `json:"sha256"`
+}
+
+// Manifest records every file unpacked into an installed tree, so that changes
+// made to the tree after it was unpacked can be found before it is launched.
+type Manifest struct {
+	// Archive is the verified archive the tree was unpacked from.
+	Archive string    `json:"archive"`
+	Created time.Time `json:"created"`
+	// Files maps slash-separated paths relative to the tree to their entries.
+	Files map[string]ManifestEntry `json:"files"`
+}
+
+// browserMutable are the parts of an installed tree which the browser writes to
+// at runtime.
+var browserMutable = []string{
+	"Browser/TorBrowser/Data",
+	"Browser/TorBrowser/UpdateInfo",
+	"Browser/.cache",
+	"Browser/.config",
+	"Browser/.local",
+	"Browser/Desktop",
+	"Browser/Downloads",
+}
+
+// policiesFile is the policies.json the supervisor writes into an installed
+// tree for the mode a browser is launched in. While it is there, the tree's
+// own policies.json is kept at policiesFile+".orig", and PoliciesOwner records
+// the hash of what the supervisor wrote.
+const policiesFile = "Browser/distribution/policies.json"
+
+// manifestSkip are the parts of an installed tree which the browser or the
+// supervisor write to at runtime, so they aren't covered by the manifest.
+var manifestSkip = append(append([]string{}, browserMutable...),
+	PoliciesOwner(policiesFile),
+	policiesFile+".tmp",
+)
+
+// PoliciesOwner returns the path of the file which marks the policies.json at
+// policies as written by the supervisor. It holds the SHA256 hash of what was
+// written.
+func PoliciesOwner(policies string) string {
+	return policies + ".tor-manager"
+}
+
+// MutablePaths returns the slash-separated paths, relative to an installed
+// tree, which the browser writes to at runtime.
+func MutablePaths() []string {
+	return append([]string{}, browserMutable...)
+}
+
+func manifestSkipped(rel string) bool {
+	for _, skip := range manifestSkip {
+		if rel == skip || strings.HasPrefix(rel, skip+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ManifestFile returns the path of the manifest of the installed tree at dir.
+func ManifestFile(dir string) string {
+	return strings.TrimSuffix(dir, string(os.PathSeparator)) + ".manifest.json"
+}
+
+// walkTree calls fn with the path relative to dir and the path of each regular
+// file in the installed tree at dir which is covered by the manifest. While
+// the supervisor's policies.json is in the tree, it must be the one the
+// supervisor wrote, and the tree's own one is passed to fn in its place.
+func walkTree(dir string, fn func(rel, path string, info os.FileInfo) error) error {
+	owner, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(PoliciesOwner(policiesFile))))
+	supervised := err == nil
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if manifestSkipped(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if supervised {
+			switch rel {
+			case policiesFile:
+				sum, err := fileSHA256(path)
+				if err != nil {
+					return err
+				}
+				if sum != strings.TrimSpace(string(owner)) {
+					return fmt.Errorf("%s isn't the one tor-manager wrote", path)
+				}
+				return nil
+			case policiesFile + ".orig":
+				rel = policiesFile
+			}
+		}
+		return fn(rel, path, info)
+	})
+}
+
+// WriteManifest hashes every file in the installed tree at dir and writes the
+// manifest next to it. archive is the verified archive the tree came from.
+func WriteManifest(dir, archive string) error {
+	manifest, err := hashTree(dir, archive)
+	if err != nil {
+		return fmt.Errorf("WriteManifest: %s", err)
+	}
+	bytes, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("WriteManifest: %s", err)
+	}
+	log.Printf("WriteManifest: recorded %d files in %s", len(manifest.Files), ManifestFile(dir))
+	return ioutil.WriteFile(ManifestFile(dir), bytes, 0644)
+}
+
+// ReadManifest reads the manifest of the installed tree at dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	bytes, err := ioutil.ReadFile(ManifestFile(dir))
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(bytes, &manifest); err != nil {
+		return nil, fmt.Errorf("ReadManifest: %s", err)
+	}
+	return &manifest, nil
+}
+
+// IntegrityReport lists the differences between an installed tree and its manifest.
+type IntegrityReport struct {
+	Dir      string
+	Missing  []string
+	Modified []string
+	Added    []string
+}
+
+// OK returns true if the tree matches its manifest.
+func (r *IntegrityReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Modified) == 0 && len(r.Added) == 0
+}
+
+func (r *IntegrityReport) String() string {
+	if r.OK() {
+		return fmt.Sprintf("%s matches its manifest", r.Dir)
+	}
+	report := fmt.Sprintf("%s does not match its manifest:", r.Dir)
+	for _, list := range []struct {
+		name  string
+		files []string
+	}{{"missing", r.Missing}, {"modified", r.Modified}, {"added", r.Added}} {
+		for _, file := range list.files {
+			report += fmt.Sprintf("\n\t%s: %s", list.name, file)
+		}
+	}
+	return report
+}
+
+// VerifyManifest compares the installed tree at dir with its manifest. Files
+// whose size and modification time match the manifest are trusted unless full
+// is set, in which case every file is hashed. It returns an error if the tree
+// has no manifest.
+func VerifyManifest(dir string, full bool) (*IntegrityReport, error) {
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		return nil, fmt.Errorf("VerifyManifest: %s", err)
+	}
+	report := &IntegrityReport{Dir: dir}
+	seen := make(map[string]bool)
+	err = walkTree(dir, func(rel, path string, info os.FileInfo) error {
+		seen[rel] = true
+		entry, ok := manifest.Files[rel]
+		if !ok {
+			report.Added = append(report.Added, rel)
+			return nil
+		}
+		if !full && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() {
+			return nil
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		if sum != entry.SHA256 {
+			report.Modified = append(report.Modified, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("VerifyManifest: %s", err)
+	}
+	for rel := range manifest.Files {
+		if !seen[rel] {
+			report.Missing = append(report.Missing, rel)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Modified)
+	sort.Strings(report.Added)
+	return report, nil
+}
+
+// InstallTrees returns the installed trees managed by the TBDownloader.
+func (t *TBDownloader) InstallTrees() []string {
+	trees := []string{t.BrowserDir()}
+	if t.GetProduct().I2P {
+		trees = append(trees, t.I2PBrowserDir())
+	}
+	return trees
+}
+
+// RepairInstall restores the installed tree at dir from the archive recorded
+// in its manifest, after checking the archive's signature again. If the tree
+// has no manifest, or its archive is no longer cached, archive is used instead.
+// The tree's TorBrowser/Data directory is kept.
+func (t *TBDownloader) RepairInstall(dir, archive string) error {
+	if manifest, err := ReadManifest(dir); err == nil && FileExists(manifest.Archive) {
+		archive = manifest.Archive
+	}
+	if !FileExists(archive) {
+		return fmt.Errorf("RepairInstall: the archive %s is not cached, download it again", archive)
+	}
+	if err := Verify(filepath.Join(t.DownloadPath, t.SigningKey()), archive+".asc", archive); err != nil {
+		return fmt.Errorf("RepairInstall: %s", err)
+	}
+	staging := t.stage(".repair")
+	defer staging.removeStaging()
+	if _, err := staging.UnpackUpdater(archive); err != nil {
+		return fmt.Errorf("RepairInstall: %s", err)
+	}
+	if err := swapTree(staging.treeFor(t, dir), dir); err != nil {
+		return fmt.Errorf("RepairInstall: %s", err)
+	}
+	log.Println("RepairInstall: restored", dir, "from", archive)
+	return nil
+}
+
+// stage returns a copy of the TBDownloader which unpacks into the named
+// directory beside the installed trees, after removing what was left there.
+func (t *TBDownloader) stage(name string) *TBDownloader {
+	staging := *t
+	staging.UnpackPath = filepath.Join(t.UnpackPath, name)
+	staging.NoUnpack = false
+	staging.removeStaging()
+	return &staging
+}
+
+// treeFor returns the tree unpacked by the staging TBDownloader which
+// corresponds to the installed tree dir of t.
+func (staging *TBDownloader) treeFor(t *TBDownloader, dir string) string {
+	if filepath.Clean(dir) == filepath.Clean(t.I2PBrowserDir()) {
+		return staging.I2PBrowserDir()
+	}
+	return staging.BrowserDir()
+}
+
+// removeStaging removes the trees unpacked by a staging TBDownloader. On macOS
+// the browser's tree is the mounted disk image, which is detached first, and
+// left alone if it can't be.
+func (staging *TBDownloader) removeStaging() {
+	if staging.OS == "osx" && staging.GetProduct().Archive == "" && FileExists(staging.BrowserDir()) {
+		host := hdiutil.NewHost(&state.Consumer{
+			OnMessage: func(lvl string, msg string) {
+				log.Printf("[%s] %s", lvl, msg)
+			},
+		})
+		if err := damage.Unmount(host, staging.BrowserDir()); err != nil {
+			log.Println("removeStaging: not removing", staging.UnpackPath, err)
+			return
+		}
+	}
+	os.RemoveAll(staging.UnpackPath)
+}
+
+// TrustedManifestsFile returns the path of the file which records the hashes of
+// the manifests written from verified archives.
+func (t *TBDownloader) TrustedManifestsFile() string {
+	return filepath.Join(t.DownloadPath, "manifests.trusted.json")
+}
+
+// trustedMutex guards the trusted manifests file, anchorMutex lets one archive
+// be unpacked aside by AnchorManifest at a time.
+var trustedMutex, anchorMutex sync.Mutex
+
+// trustedManifests returns the hashes of the trusted manifests, mapped to the
+// archives they were written from.
+func (t *TBDownloader) trustedManifests() map[string]string {
+	trusted := make(map[string]string)
+	if bytes, err := ioutil.ReadFile(t.TrustedManifestsFile()); err == nil {
+		if err := json.Unmarshal(bytes, &trusted); err != nil {
+			log.Println("trustedManifests:", err)
+		}
+	}
+	return trusted
+}
+
+// ManifestTrusted returns true if the manifest of the installed tree at dir was
+// written from a verified archive.
+func (t *TBDownloader) ManifestTrusted(dir string) bool {
+	sum, err := fileSHA256(ManifestFile(dir))
+	if err != nil {
+		return false
+	}
+	trustedMutex.Lock()
+	defer trustedMutex.Unlock()
+	return t.trustedManifests()[sum] != ""
+}
+
+// TrustManifest records the manifest of the installed tree at dir as written
+// from a verified archive, so AnchorManifest accepts it without unpacking the
+// archive again. It must only be called once the archive the manifest names
+// has been verified. Manifests of archives which are no longer cached are
+// forgotten.
+func (t *TBDownloader) TrustManifest(dir string) error {
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		return fmt.Errorf("TrustManifest: %s", err)
+	}
+	sum, err := fileSHA256(ManifestFile(dir))
+	if err != nil {
+		return fmt.Errorf("TrustManifest: %s", err)
+	}
+	trustedMutex.Lock()
+	defer trustedMutex.Unlock()
+	trusted := t.trustedManifests()
+	for known, archive := range trusted {
+		if !FileExists(archive) {
+			delete(trusted, known)
+		}
+	}
+	trusted[sum] = manifest.Archive
+	bytes, err := json.MarshalIndent(trusted, "", "  ")
+	if err != nil {
+		return fmt.Errorf("TrustManifest: %s", err)
+	}
+	return ioutil.WriteFile(t.TrustedManifestsFile(), bytes, 0644)
+}
+
+// AnchorManifest checks that the manifest of the installed tree at dir is one
+// written from a verified archive, so that a manifest rewritten to match a
+// modified tree is caught. Manifests are trusted when their tree is unpacked
+// or repaired, so this is usually a lookup. A manifest which isn't trusted
+// yet, or a missing one, is checked once against the archive it names, or the
+// cached archive of the installed version: the archive's signature must verify,
+// and it is unpacked aside and hashed again.
+func (t *TBDownloader) AnchorManifest(dir string) error {
+	if t.ManifestTrusted(dir) {
+		return nil
+	}
+	anchorMutex.Lock()
+	defer anchorMutex.Unlock()
+	if t.ManifestTrusted(dir) {
+		return nil
+	}
+	manifest, err := ReadManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("AnchorManifest: %s", err)
+	}
+	archive := filepath.Join(t.DownloadPath, t.NamePerPlatform(t.Lang, t.InstalledVersion()))
+	if manifest != nil {
+		archive = filepath.Clean(manifest.Archive)
+	}
+	if filepath.Dir(archive) != filepath.Clean(t.DownloadPath) {
+		return fmt.Errorf("AnchorManifest: the manifest of %s names the archive %s, which isn't in %s", dir, archive, t.DownloadPath)
+	}
+	if !FileExists(archive) {
+		return fmt.Errorf("AnchorManifest: the archive %s is not cached, download it again", archive)
+	}
+	if err := Verify(filepath.Join(t.DownloadPath, t.SigningKey()), archive+".asc", archive); err != nil {
+		return fmt.Errorf("AnchorManifest: %s", err)
+	}
+	staging := t.stage(".anchor")
+	defer staging.removeStaging()
+	if _, err := staging.UnpackUpdater(archive); err != nil {
+		return fmt.Errorf("AnchorManifest: %s", err)
+	}
+	derived, err := ReadManifest(staging.treeFor(t, dir))
+	if err != nil {
+		return fmt.Errorf("AnchorManifest: %s", err)
+	}
+	if manifest == nil {
+		// The tree was unpacked before manifests were written, so it is
+		// hashed and compared with the archive before one is written for it.
+		if manifest, err = hashTree(dir, archive); err != nil {
+			return fmt.Errorf("AnchorManifest: %s", err)
+		}
+	}
+	if len(derived.Files) != len(manifest.Files) {
+		return fmt.Errorf("AnchorManifest: the manifest of %s lists %d files, %s has %d", dir, len(manifest.Files), archive, len(derived.Files))
+	}
+	for rel, entry := range derived.Files {
+		if recorded, ok := manifest.Files[rel]; !ok || recorded.SHA256 != entry.SHA256 || recorded.Size != entry.Size {
+			return fmt.Errorf("AnchorManifest: the manifest of %s doesn't match %s at %s", dir, archive, rel)
+		}
+	}
+	if !FileExists(ManifestFile(dir)) {
+		if err := WriteManifest(dir, archive); err != nil {
+			return fmt.Errorf("AnchorManifest: %s", err)
+		}
+	}
+	if err := t.TrustManifest(dir); err != nil {
+		return fmt.Errorf("AnchorManifest: %s", err)
+	}
+	log.Println("AnchorManifest: the manifest of", dir, "matches", archive)
+	return nil
+}
+
+// hashTree hashes every file in the installed tree at dir, as WriteManifest
+// does, without writing the manifest.
+func hashTree(dir, archive string) (*Manifest, error) {
+	manifest := &Manifest{
+		Archive: archive,
+		Created: time.Now(),
+		Files:   make(map[string]ManifestEntry),
+	}
+	err := walkTree(dir, func(rel, path string, info os.FileInfo) error {
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		manifest.Files[rel] = ManifestEntry{
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+			SHA256:  sum,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
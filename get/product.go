@@ -0,0 +1,179 @@
+package tbget
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Product describes a piece of software tbget knows how to download,
+// verify and unpack. Each product has its own update feed, file naming,
+// signing key and unpack layout.
+type Product struct {
+	// Name is the short name of the product, used on the command line.
+	Name string
+	// Title is the human-readable name of the product.
+	Title string
+	// UpdatesURL is the URL of the downloads.json feed for the product.
+	UpdatesURL string
+	// FeedFile is the name the downloads.json feed is cached under in the download directory.
+	FeedFile string
+	// Prefix is the file name prefix used by the release artifacts.
+	Prefix string
+	// SigningKey is the name of the embedded key which signs the release.
+	SigningKey string
+	// Lang is set when the product only ships a single multi-locale build.
+	Lang string
+	// Archive is the archive extension used on every platform, if the product
+	// doesn't ship installers or disk images.
+	Archive string
+	// Browser is the name of the browser executable, without extension. It is
+	// empty for products which don't contain a browser.
+	Browser string
+	// Platforms maps tbget's runtime pairs to the keys the product's feed uses.
+	Platforms map[string]string
+	// Subdir is true if the archive has no top-level directory of its own and
+	// must be unpacked into InstallDir.
+	Subdir bool
+	// I2P is true if an I2P Browser tree should be made from this product.
+	I2P bool
+}
+
+// TorBrowser is the Tor Browser Bundle.
+var TorBrowser = &Product{
+	Name:       "torbrowser",
+	Title:      "Tor Browser",
+	UpdatesURL: TOR_UPDATES_URL,
+	FeedFile:   "downloads.json",
+	Prefix:     "tor-browser",
+	SigningKey: "TPO-signing-key.pub",
+	Browser:    "firefox",
+	I2P:        true,
+}
+
+// TorExpertBundle is the tor daemon and pluggable transports without a browser.
+// It doesn't have a feed of its own, it is released alongside Tor Browser so the
+// Tor Browser feed is used to find the current version.
+var TorExpertBundle = &Product{
+	Name:       "tor-expert-bundle",
+	Title:      "Tor Expert Bundle",
+	UpdatesURL: TOR_UPDATES_URL,
+	FeedFile:   "downloads.json",
+	Prefix:     "tor-expert-bundle",
+	SigningKey: "TPO-signing-key.pub",
+	Archive:    "tar.gz",
+	Platforms: map[string]string{
+		"linux64": "linux-x86_64",
+		"linux32": "linux-i686",
+		"win64":   "windows-x86_64",
+		"win32":   "windows-i686",
+		"osx64":   "osx-x86_64",
+		"osx":     "osx-x86_64",
+	},
+	Subdir: true,
+}
+
+// MULLVAD_UPDATES_URL is the URL of the Mullvad Browser update list.
+const MULLVAD_UPDATES_URL string = "https://cdn.mullvad.net/browser/update_responses/update_1/release/downloads.json"
+
+// MullvadBrowser is the Mullvad Browser, a Tor Browser without Tor. It is
+// built and signed by the Tor Browser team.
+var MullvadBrowser = &Product{
+	Name:       "mullvad-browser",
+	Title:      "Mullvad Browser",
+	UpdatesURL: MULLVAD_UPDATES_URL,
+	FeedFile:   "mullvad-downloads.json",
+	Prefix:     "mullvad-browser",
+	SigningKey: "TPO-signing-key.pub",
+	Lang:       "ALL",
+	Browser:    "mullvadbrowser",
+	Platforms: map[string]string{
+		"linux64": "linux-x86_64",
+		"linux32": "linux-i686",
+		"win64":   "win64",
+		"win32":   "win-i686",
+		"osx64":   "macos",
+		"osx":     "macos",
+	},
+}
+
+// Products is every product tbget knows about, keyed by name.
+var Products = map[string]*Product{
+	TorBrowser.Name:      TorBrowser,
+	TorExpertBundle.Name: TorExpertBundle,
+	MullvadBrowser.Name:  MullvadBrowser,
+}
+
+// ProductNames returns the names of every known product.
+func ProductNames() []string {
+	var names []string
+	for name := range Products {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetProduct returns the product with the given name, or an error if there isn't one.
+func GetProduct(name string) (*Product, error) {
+	if name == "" {
+		return TorBrowser, nil
+	}
+	if p, ok := Products[name]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("GetProduct: unknown product %s, choose one of %s", name, strings.Join(ProductNames(), ", "))
+}
+
+// Platform returns the key the product's feed uses for the given runtime pair.
+func (p *Product) Platform(rtp string) string {
+	if p.Platforms == nil {
+		return rtp
+	}
+	if platform, ok := p.Platforms[rtp]; ok {
+		return platform
+	}
+	return rtp
+}
+
+// InstallDir returns the name of the directory the product is unpacked to, relative to the unpack path.
+func (p *Product) InstallDir(lang string) string {
+	if p.Lang != "" || p.Subdir {
+		return p.Prefix
+	}
+	return p.Prefix + "_" + lang
+}
+
+// FileName returns the name the product's release artifact is stored under.
+func (p *Product) FileName(os, rtp, version, ietf string) string {
+	if p.Archive != "" {
+		return fmt.Sprintf("%s-%s-%s.%s", p.Prefix, version, p.Platform(rtp), p.Archive)
+	}
+	extension := "tar.xz"
+	windowsonly := ""
+	switch os {
+	case "osx":
+		extension = "dmg"
+	case "win":
+		if p == TorBrowser {
+			windowsonly = "-installer"
+		}
+		extension = "exe"
+	}
+	if p.Lang != "" {
+		ietf = p.Lang
+	}
+	return fmt.Sprintf("%s%s-%s-%s_%s.%s", p.Prefix, windowsonly, rtp, version, ietf, extension)
+}
+
+// BrowserBinary returns the name of the browser executable for the given OS.
+func (p *Product) BrowserBinary(os string) string {
+	switch os {
+	case "linux":
+		return p.Browser + ".real"
+	case "win", "windows":
+		return p.Browser + ".exe"
+	default:
+		return p.Browser
+	}
+}
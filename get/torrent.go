@@ -17,6 +17,7 @@ import (
 	cp "github.com/otiai10/copy"
 	"github.com/xgfone/bt/bencode"
 	"github.com/xgfone/bt/metainfo"
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
 )
 
 func (t *TBDownloader) DownloadedFilesList() ([]string, error) {
@@ -99,7 +100,7 @@ func (t *TBDownloader) GenerateTorrent(file string, announces []string) (*metain
 	default:
 		mi.AnnounceList = metainfo.AnnounceList{announces}
 	}
-	url, err := url.Parse("http://idk.i2p/torbrowser/" + filepath.Base(file))
+	url, err := url.Parse("http://idk.i2p/torbrowser/" + ChannelPrefix(t.GetChannel()) + filepath.Base(file))
 	if err != nil {
 		return nil, fmt.Errorf("GenerateTorrent: %s", err)
 	}
@@ -113,7 +114,7 @@ func (t *TBDownloader) GenerateTorrent(file string, announces []string) (*metain
 			mi.URLList = append(mi.URLList, url.String())
 		}
 	}
-	clearurl, err := url.Parse("https://eyedeekay.github.io/torbrowser/" + filepath.Base(file))
+	clearurl, err := url.Parse("https://eyedeekay.github.io/torbrowser/" + ChannelPrefix(t.GetChannel()) + filepath.Base(file))
 	if err != nil {
 		return nil, fmt.Errorf("GenerateTorrent: %s", err)
 	}
@@ -121,71 +122,11 @@ func (t *TBDownloader) GenerateTorrent(file string, announces []string) (*metain
 	return &mi, nil
 }
 
+// FindSnarkDirectory returns the directory the I2P router's i2psnark keeps its
+// torrents in.
 func FindSnarkDirectory() (string, error) {
-	// Snark could be at:
-	// or: $I2P_CONFIG/i2psnark/
-	// or: $I2P/i2psnark/
-	// or: $HOME/.i2p/i2psnark/
-	// or: /var/lib/i2p/i2p-config/i2psnark/
-	// or: %LOCALAPPDATA\i2p\i2psnark\
-	// or: %APPDATA\i2p\i2psnark\
-
-	SNARK_CONFIG := os.Getenv("SNARK_CONFIG")
-	if SNARK_CONFIG != "" {
-		checkfori2pcustom := filepath.Join(SNARK_CONFIG)
-		if FileExists(checkfori2pcustom) {
-			//log.Println("Found snark directory at $SNARK_CONFIG", checkfori2pcustom)
-			return checkfori2pcustom, nil
-		}
-	}
-
-	I2P_CONFIG := os.Getenv("I2P_CONFIG")
-	if I2P_CONFIG != "" {
-		checkfori2pcustom := filepath.Join(I2P_CONFIG, "i2psnark")
-		if FileExists(checkfori2pcustom) {
-			//log.Println("Found snark directory at $I2P_CONFIG", checkfori2pcustom)
-			return checkfori2pcustom, nil
-		}
-	}
-
-	I2P := os.Getenv("I2P")
-	if I2P != "" {
-		checkfori2p := filepath.Join(I2P, "i2psnark")
-		if FileExists(checkfori2p) {
-			//log.Println("Found snark directory at $I2P", checkfori2p)
-			return checkfori2p, nil
-		}
-	}
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return "", err
-	}
-	// Start by getting the home directory
-	switch runtime.GOOS {
-	case "windows":
-		checkfori2plocal := filepath.Join(home, "AppData", "Local", "i2p", "i2psnark")
-		if FileExists(checkfori2plocal) {
-			//log.Println("Found snark directory at %APPDATA%\\i2p\\i2psnark", "%APPDATA%\\i2p\\i2psnark")
-			return checkfori2plocal, nil
-		}
-		checkfori2proaming := filepath.Join(home, "AppData", "Roaming", "i2p", "i2psnark")
-		if FileExists(checkfori2proaming) {
-			//log.Println("Found snark directory at %APPDATA%\\i2p\\i2psnark", "%APPDATA%\\i2p\\i2psnark")
-			return checkfori2proaming, nil
-		}
-	case "linux":
-		checkfori2phome := filepath.Join(home, ".i2p", "i2psnark")
-		if FileExists(checkfori2phome) {
-			//log.Println("Found snark directory at $HOME/.i2p/i2psnark", "$HOME/.i2p/i2psnark")
-			return checkfori2phome, nil
-		}
-		checkfori2pservice := filepath.Join("/var/lib/i2p/i2p-config", "i2psnark")
-		if FileExists(checkfori2pservice) {
-			//log.Println("Found snark directory at /var/lib/i2p/i2p-config/i2psnark", checkfori2pservice)
-			return checkfori2pservice, nil
-		}
-	case "darwin":
-		return "", fmt.Errorf("FindSnarkDirectory: Automatic torrent generation is not supported on MacOS, for now copy the files manually")
+	if dir := tbdiscover.Default().SnarkDir; dir != "" {
+		return dir, nil
 	}
 	return "", fmt.Errorf("FindSnarkDirectory: Unable to find snark directory")
 }
@@ -212,14 +153,20 @@ func TorrentPath() (string, string) {
 }
 
 func GetTorBrowserVersionFromUpdateURL() (string, error) {
-	// download the json file from TOR_UPDATES_URL
+	return GetTorBrowserVersionFromChannel(CHANNEL)
+}
+
+// GetTorBrowserVersionFromChannel returns the latest Tor Browser version on the given release channel.
+func GetTorBrowserVersionFromChannel(channel string) (string, error) {
+	// download the json file from the channel's updates URL
 	// parse the json file to get the latest version
 	// return the latest version
-	err := SetupProxy(TOR_UPDATES_URL, "")
+	updatesURL := ChannelURL(TOR_UPDATES_URL, channel)
+	err := SetupProxy(updatesURL, "")
 	if err != nil {
 		return "", err
 	}
-	resp, err := http.Get(TOR_UPDATES_URL)
+	resp, err := http.Get(updatesURL)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,257 @@
+package tbget
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StagedUpdate is a release which has been downloaded and verified in the
+// background, and is waiting to be unpacked over the installed one.
+type StagedUpdate struct {
+	Version   string `json:"version"`
+	Binary    string `json:"binary"`
+	Signature string `json:"signature"`
+}
+
+// VersionFile returns the path of the file which records the installed version of the product.
+func (t *TBDownloader) VersionFile() string {
+	return t.BrowserDir() + ".version"
+}
+
+// StagedFile returns the path of the file which records a staged update.
+func (t *TBDownloader) StagedFile() string {
+	return t.BrowserDir() + ".staged.json"
+}
+
+// InstalledVersion returns the version of the product which is unpacked in
+// BrowserDir(), or an empty string if it isn't known. Installs which were
+// unpacked before their version was recorded get it from the tree, see
+// TreeVersion.
+func (t *TBDownloader) InstalledVersion() string {
+	bytes, err := ioutil.ReadFile(t.VersionFile())
+	if err == nil {
+		return strings.TrimSpace(string(bytes))
+	}
+	version := t.TreeVersion()
+	if version != "" {
+		if err := t.SetInstalledVersion(version); err != nil {
+			log.Println("InstalledVersion:", err)
+		}
+	}
+	return version
+}
+
+// TreeVersion returns the version of the tree unpacked in BrowserDir(), from the
+// name of the archive its manifest records, or from the tbb_version.json Tor
+// Browser ships. It returns an empty string if neither is there.
+func (t *TBDownloader) TreeVersion() string {
+	if !FileExists(t.BrowserDir()) {
+		return ""
+	}
+	if manifest, err := ReadManifest(t.BrowserDir()); err == nil {
+		if version := t.VersionFromName(manifest.Archive); version != "" {
+			return version
+		}
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(t.BrowserDir(), "Browser", "tbb_version.json"))
+	if err != nil {
+		return ""
+	}
+	var tbbVersion struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(bytes, &tbbVersion); err != nil {
+		return ""
+	}
+	return tbbVersion.Version
+}
+
+// SetInstalledVersion records the version of the product which is unpacked in BrowserDir().
+func (t *TBDownloader) SetInstalledVersion(version string) error {
+	return ioutil.WriteFile(t.VersionFile(), []byte(version), 0644)
+}
+
+// VersionFromURL returns the version segment of a release artifact URL.
+func VersionFromURL(binary string) string {
+	spl := strings.Split(binary, "/")
+	if len(spl) < 2 {
+		return ""
+	}
+	return spl[len(spl)-2]
+}
+
+// CheckForUpdate fetches the update feed through the network policy for the
+// TBDownloader's mirror. It returns the URLs of the latest release and its
+// detatched signature, its version, and whether it differs from the installed one.
+func (t *TBDownloader) CheckForUpdate() (string, string, string, bool, error) {
+	client, err := t.HTTPClient()
+	if err != nil {
+		return "", "", "", false, fmt.Errorf("CheckForUpdate: %s", err)
+	}
+	resp, err := client.Get(t.UpdatesURL())
+	if err != nil {
+		return "", "", "", false, fmt.Errorf("CheckForUpdate: %s", err)
+	}
+	defer resp.Body.Close()
+	jsonBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", "", false, fmt.Errorf("CheckForUpdate: %s", err)
+	}
+	bin, sig, err := t.GetUpdaterForLangFromJSONBytes(jsonBytes, t.Lang)
+	if err != nil {
+		return "", "", "", false, fmt.Errorf("CheckForUpdate: %s", err)
+	}
+	version := VersionFromURL(bin)
+	t.FeedWarning = t.CheckFeedFreshness(version)
+	installed := t.InstalledVersion()
+	newer := installed == "" || CompareVersions(version, installed) > 0
+	return bin, sig, version, newer, nil
+}
+
+// StageUpdate downloads and verifies the latest release without unpacking it.
+// If it succeeds, the release is recorded as staged so it can be applied with
+// ApplyStagedUpdate once nothing is using the installed one. It returns the
+// staged update, or nil if the installed version is already the latest.
+func (t *TBDownloader) StageUpdate() (*StagedUpdate, error) {
+	bin, sig, version, newer, err := t.CheckForUpdate()
+	if err != nil {
+		return nil, err
+	}
+	if !newer {
+		t.Log("StageUpdate()", "Installed version is the latest "+version)
+		return nil, nil
+	}
+	if staged, err := t.GetStagedUpdate(); err == nil && staged.Version == version {
+		return staged, nil
+	}
+	// SingleFileDownload follows the network policy for the mirror, like the
+	// feed check above.
+	name := t.NamePerPlatform(t.Lang, version)
+	sigpath, err := t.SingleFileDownload(sig, name+".asc", 0)
+	if err != nil {
+		return nil, fmt.Errorf("StageUpdate: %s", err)
+	}
+	binpath, err := t.SingleFileDownload(bin, name, 0)
+	if err != nil {
+		return nil, fmt.Errorf("StageUpdate: %s", err)
+	}
+	return t.Stage(version, binpath, sigpath)
+}
+
+// Stage verifies a downloaded release and records it as staged, so it is
+// unpacked over the installed one by ApplyStagedUpdate.
+func (t *TBDownloader) Stage(version, binpath, sigpath string) (*StagedUpdate, error) {
+	if err := t.CheckDowngrade(version); err != nil {
+		return nil, fmt.Errorf("Stage: %s", err)
+	}
+	if err := Verify(filepath.Join(t.DownloadPath, t.SigningKey()), sigpath, binpath); err != nil {
+		return nil, fmt.Errorf("Stage: %s", err)
+	}
+	if err := t.CheckConsensus(binpath); err != nil {
+		return nil, fmt.Errorf("Stage: %s", err)
+	}
+	if err := t.RecordVerifiedVersion(version); err != nil {
+		log.Println("Stage:", err)
+	}
+	staged := &StagedUpdate{
+		Version:   version,
+		Binary:    binpath,
+		Signature: sigpath,
+	}
+	bytes, err := json.MarshalIndent(staged, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Stage: %s", err)
+	}
+	if err := ioutil.WriteFile(t.StagedFile(), bytes, 0644); err != nil {
+		return nil, fmt.Errorf("Stage: %s", err)
+	}
+	log.Println("Stage: update", version, "is ready")
+	return staged, nil
+}
+
+// GetStagedUpdate returns the staged update, or an error if there isn't one.
+func (t *TBDownloader) GetStagedUpdate() (*StagedUpdate, error) {
+	bytes, err := ioutil.ReadFile(t.StagedFile())
+	if err != nil {
+		return nil, err
+	}
+	var staged StagedUpdate
+	if err := json.Unmarshal(bytes, &staged); err != nil {
+		return nil, fmt.Errorf("GetStagedUpdate: %s", err)
+	}
+	return &staged, nil
+}
+
+// ApplyStagedUpdate unpacks the staged update next to the installed product, then
+// swaps it into place. The per-install data in TorBrowser/Data is carried over
+// to the new tree. The caller must make sure nothing is running from the install.
+func (t *TBDownloader) ApplyStagedUpdate() error {
+	staged, err := t.GetStagedUpdate()
+	if err != nil {
+		return fmt.Errorf("ApplyStagedUpdate: %s", err)
+	}
+	if err := t.CheckDowngrade(staged.Version); err != nil {
+		return fmt.Errorf("ApplyStagedUpdate: %s", err)
+	}
+	if err := Verify(filepath.Join(t.DownloadPath, t.SigningKey()), staged.Signature, staged.Binary); err != nil {
+		return fmt.Errorf("ApplyStagedUpdate: %s", err)
+	}
+	staging := t.stage(".staging")
+	defer staging.removeStaging()
+	if _, err := staging.UnpackUpdater(staged.Binary); err != nil {
+		return fmt.Errorf("ApplyStagedUpdate: %s", err)
+	}
+	trees := [][2]string{{staging.BrowserDir(), t.BrowserDir()}}
+	if t.GetProduct().I2P {
+		trees = append(trees, [2]string{staging.I2PBrowserDir(), t.I2PBrowserDir()})
+	}
+	for _, tree := range trees {
+		if err := swapTree(tree[0], tree[1]); err != nil {
+			return fmt.Errorf("ApplyStagedUpdate: %s", err)
+		}
+	}
+	if err := t.SetInstalledVersion(staged.Version); err != nil {
+		return fmt.Errorf("ApplyStagedUpdate: %s", err)
+	}
+	log.Println("ApplyStagedUpdate: installed update", staged.Version)
+	return os.Remove(t.StagedFile())
+}
+
+// swapTree moves the freshly unpacked tree at src and its manifest over the
+// installed tree at dest, keeping the installed tree's TorBrowser/Data directory.
+func swapTree(src, dest string) error {
+	if !FileExists(src) {
+		return fmt.Errorf("swapTree: %s was not unpacked", src)
+	}
+	old := dest + ".old"
+	os.RemoveAll(old)
+	if FileExists(dest) {
+		if err := os.Rename(dest, old); err != nil {
+			return err
+		}
+		data := filepath.Join("Browser", "TorBrowser", "Data")
+		if FileExists(filepath.Join(old, data)) {
+			os.RemoveAll(filepath.Join(src, data))
+			os.MkdirAll(filepath.Dir(filepath.Join(src, data)), 0755)
+			if err := os.Rename(filepath.Join(old, data), filepath.Join(src, data)); err != nil {
+				os.Rename(old, dest)
+				return err
+			}
+		}
+	}
+	if err := os.Rename(src, dest); err != nil {
+		os.Rename(old, dest)
+		return err
+	}
+	if FileExists(ManifestFile(src)) {
+		if err := os.Rename(ManifestFile(src), ManifestFile(dest)); err != nil {
+			log.Println("swapTree:", err)
+		}
+	}
+	return os.RemoveAll(old)
+}
@@ -0,0 +1,217 @@
+package tbget
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ALLOW_DOWNGRADE lets new TBDownloaders install releases older than the newest
+// one they have ever verified. It can be set with TOR_MANAGER_ALLOW_DOWNGRADE.
+var ALLOW_DOWNGRADE = os.Getenv("TOR_MANAGER_ALLOW_DOWNGRADE") != ""
+
+// FREEZE_WINDOW is how long the update feed may go without advancing before
+// new TBDownloaders warn that it might be frozen by a malicious or stale mirror.
+var FREEZE_WINDOW = 6 * 7 * 24 * time.Hour
+
+// VersionState is the downgrade and freeze protection state of a product on a
+// release channel. It is kept in the download directory.
+type VersionState struct {
+	// Highest is the newest version which has ever passed signature verification.
+	Highest string `json:"highest"`
+	// Verified is the last time Highest was verified.
+	Verified time.Time `json:"verified"`
+	// Advanced is the last time the feed offered a version newer than Highest.
+	Advanced time.Time `json:"advanced"`
+}
+
+// CompareVersions compares two release versions, returning -1, 0 or 1 if a is
+// older than, the same as or newer than b. Runs of digits are compared as numbers
+// and everything else as text, so 11.0.10 is newer than 11.0.9 and 11.5a4 is
+// newer than 11.5a3. Letters mark a pre-release, so 12.0a1 is older than 12.0
+// and 12.0.1.
+func CompareVersions(a, b string) int {
+	ac, bc := versionChunks(a), versionChunks(b)
+	for i := 0; i < len(ac) && i < len(bc); i++ {
+		an, aerr := strconv.Atoi(ac[i])
+		bn, berr := strconv.Atoi(bc[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aerr == nil:
+			// b is a pre-release of the version a has moved past.
+			return 1
+		case berr == nil:
+			return -1
+		case ac[i] != bc[i]:
+			if ac[i] < bc[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(ac) < len(bc):
+		if isPreRelease(bc[len(ac)]) {
+			return 1
+		}
+		return -1
+	case len(ac) > len(bc):
+		if isPreRelease(ac[len(bc)]) {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// isPreRelease returns true if the version chunk is a pre-release marker such
+// as "a", "b", "alpha", "beta" or "rc" rather than a number.
+func isPreRelease(chunk string) bool {
+	_, err := strconv.Atoi(chunk)
+	return err != nil
+}
+
+// versionChunks splits a version into runs of digits and runs of letters,
+// dropping the separators.
+func versionChunks(version string) []string {
+	var chunks []string
+	current := ""
+	digits := false
+	for _, r := range version {
+		if !unicode.IsDigit(r) && !unicode.IsLetter(r) {
+			if current != "" {
+				chunks = append(chunks, current)
+			}
+			current = ""
+			continue
+		}
+		if current != "" && unicode.IsDigit(r) != digits {
+			chunks = append(chunks, current)
+			current = ""
+		}
+		digits = unicode.IsDigit(r)
+		current += string(r)
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// VersionStateFile returns the path of the file which holds the VersionState of
+// the TBDownloader's product and channel.
+func (t *TBDownloader) VersionStateFile() string {
+	return filepath.Join(t.DownloadPath, t.GetProduct().Name+".versions.json")
+}
+
+// GetVersionState returns the VersionState of the TBDownloader's product and
+// channel. It is empty if no release has been verified yet.
+func (t *TBDownloader) GetVersionState() VersionState {
+	var state VersionState
+	bytes, err := ioutil.ReadFile(t.VersionStateFile())
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		log.Println("GetVersionState:", err)
+	}
+	return state
+}
+
+func (t *TBDownloader) writeVersionState(state VersionState) error {
+	bytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.VersionStateFile(), bytes, 0644)
+}
+
+// CheckDowngrade returns an error if version is older than the newest version
+// the TBDownloader has ever verified, or empty, unless AllowDowngrade is set.
+func (t *TBDownloader) CheckDowngrade(version string) error {
+	if version == "" {
+		// A release whose version can't be read can't be checked, so it is
+		// refused like an old one.
+		if t.AllowDowngrade {
+			log.Println("CheckDowngrade: installing a release of unknown version, because downgrades are allowed")
+			return nil
+		}
+		return fmt.Errorf("CheckDowngrade: refusing to install a %s release whose version isn't known, use --allow-downgrade to install it anyway", t.GetProduct().Title)
+	}
+	state := t.GetVersionState()
+	if state.Highest == "" || CompareVersions(version, state.Highest) >= 0 {
+		return nil
+	}
+	if t.AllowDowngrade {
+		log.Printf("CheckDowngrade: installing %s which is older than %s, because downgrades are allowed", version, state.Highest)
+		return nil
+	}
+	return fmt.Errorf("CheckDowngrade: refusing to install %s %s, %s has already been verified. The mirror or feed may be serving an old release, use --allow-downgrade to install it anyway", t.GetProduct().Title, version, state.Highest)
+}
+
+// RecordVerifiedVersion records that version has passed signature verification,
+// raising the newest verified version if it is newer.
+func (t *TBDownloader) RecordVerifiedVersion(version string) error {
+	if version == "" {
+		return nil
+	}
+	state := t.GetVersionState()
+	if state.Highest != "" && CompareVersions(version, state.Highest) < 0 {
+		return nil
+	}
+	if CompareVersions(version, state.Highest) > 0 {
+		state.Advanced = time.Now()
+	}
+	state.Highest = version
+	state.Verified = time.Now()
+	return t.writeVersionState(state)
+}
+
+// CheckFeedFreshness notes when the feed offers a version newer than the newest
+// verified one, and returns a warning if it hasn't done so for longer than the
+// TBDownloader's FreezeWindow, or an empty string if the feed looks fresh.
+func (t *TBDownloader) CheckFeedFreshness(version string) string {
+	state := t.GetVersionState()
+	if state.Highest == "" || t.FreezeWindow <= 0 {
+		return ""
+	}
+	if CompareVersions(version, state.Highest) > 0 {
+		return ""
+	}
+	if state.Advanced.IsZero() || time.Since(state.Advanced) < t.FreezeWindow {
+		return ""
+	}
+	warning := fmt.Sprintf("The %s update feed has not offered a new release since %s. It may be stale, or a mirror may be withholding updates.", t.GetProduct().Title, state.Advanced.Format("2006-01-02"))
+	log.Println("CheckFeedFreshness:", warning)
+	return warning
+}
+
+// VersionFromName returns the version of a release artifact of the TBDownloader's
+// product from its file name, or an empty string if the name isn't recognized.
+// The name may be of any language, as the download falls back to another
+// language when the feed has no release in t.Lang.
+func (t *TBDownloader) VersionFromName(binpath string) string {
+	name := strings.TrimSuffix(filepath.Base(binpath), ".sha256sums")
+	template := regexp.QuoteMeta(t.GetProduct().FileName(t.OS, t.GetRuntimePair(), "\x00", "\x01"))
+	template = strings.Replace(template, "\x00", `(.+?)`, 1)
+	template = strings.Replace(template, "\x01", `[A-Za-z]{2,3}(?:-[A-Za-z0-9]+)*`, 1)
+	match := regexp.MustCompile("^" + template + "$").FindStringSubmatch(name)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
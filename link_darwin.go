@@ -1,13 +1,22 @@
 package main
 
 import (
+	"fmt"
 	"i2pgit.org/idk/i2p.plugins.tor-manager/get"
 	"os"
 	"path/filepath"
 )
 
-func GenerateAppArmor() error {
-	return nil
+func GenerateAppArmor() (string, error) {
+	return "", fmt.Errorf("AppArmor is only available on Linux")
+}
+
+func InstallAppArmor(root string) error {
+	return fmt.Errorf("AppArmor is only available on Linux")
+}
+
+func UninstallAppArmor(root string) error {
+	return fmt.Errorf("AppArmor is only available on Linux")
 }
 
 func CreateShortcuts() error {
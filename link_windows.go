@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/go-ole/go-ole"
@@ -9,8 +10,16 @@ import (
 	"path/filepath"
 )
 
-func GenerateAppArmor() error {
-	return nil
+func GenerateAppArmor() (string, error) {
+	return "", fmt.Errorf("AppArmor is only available on Linux")
+}
+
+func InstallAppArmor(root string) error {
+	return fmt.Errorf("AppArmor is only available on Linux")
+}
+
+func UninstallAppArmor(root string) error {
+	return fmt.Errorf("AppArmor is only available on Linux")
 }
 
 func DesktopDirectory() (string, error) {
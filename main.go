@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"io/ioutil"
@@ -10,7 +11,9 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
 
@@ -20,7 +23,10 @@ import (
 	"github.com/itchio/damage/hdiutil"
 	"github.com/itchio/headway/state"
 	"github.com/ncruces/zenity"
+	tbcontrol "i2pgit.org/idk/i2p.plugins.tor-manager/control"
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
 	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+	tbready "i2pgit.org/idk/i2p.plugins.tor-manager/ready"
 	tbserve "i2pgit.org/idk/i2p.plugins.tor-manager/serve"
 	tbsupervise "i2pgit.org/idk/i2p.plugins.tor-manager/supervise"
 
@@ -101,12 +107,17 @@ func defaultLang() string {
 	return lang
 }
 
+// openRouterControl returns the i2pcontrol client of the control panel, with
+// its settings saved in the working directory.
+func openRouterControl() (*tbcontrol.Client, error) {
+	router := tbdiscover.Default()
+	return tbcontrol.Open(filepath.Join(*directory, "i2pcontrol.json"),
+		tbcontrol.Settings{URL: router.I2PControl.URL(), Password: router.I2PControlPassword},
+		tbcontrol.Settings{URL: *i2pcontrol, Password: os.Getenv("TOR_MANAGER_I2PCONTROL_PASSWORD")})
+}
+
 func defaultTor() bool {
-	_, err := net.Listen("TCP", "127.0.0.1:9050")
-	if err != nil {
-		return true
-	}
-	return false
+	return tbready.Check(time.Second, tbsupervise.TorReady) == nil
 }
 
 var (
@@ -117,21 +128,28 @@ var (
 	i2pconfig  = flag.Bool("i2pconfig", false, "Open I2P routerconsole in Tor Browser with javscript enabled and non-routerconsole sites disabled")
 	torbrowser = flag.Bool("torbrowser", false, "Open Tor Browser")
 	i2peditor  = flag.Bool("i2peditor", false, "Open I2P Site Editor in Tor Browser")
+	editoraddr = flag.String("editor-addr", tbsupervise.EDITOR_ADDR, "Address to serve the I2P Site Editor on")
 	verbose    = flag.Bool("verbose", false, "Verbose output")
 	directory  = flag.String("directory", DefaultDir(), "Directory operate in")
 	host       = flag.String("host", "127.0.0.1", "Host to serve on")
 	port       = flag.Int("port", 7695, "Port to serve on")
 	bemirror   = flag.Bool("bemirror", false, "Act as an in-I2P mirror when you're done downloading")
 	shortcuts  = flag.Bool("shortcuts", false, "Create desktop shortcuts")
-	apparmor   = flag.Bool("apparmor", false, "Generate apparmor rules")
+	apparmor   = flag.Bool("apparmor", false, "Generate and validate AppArmor profiles for every install and profile mode in the working directory")
+	aainstall  = flag.Bool("apparmor-install", false, "Generate, validate and install AppArmor profiles into -apparmor-root, loading them if it is the system's, and exit. Run as the browsers' owner with sudo -E")
+	aaremove   = flag.Bool("apparmor-uninstall", false, "Remove the AppArmor profiles tor-manager installed into -apparmor-root and exit")
+	aaroot     = flag.String("apparmor-root", AppArmorRoot(), "Directory AppArmor profiles are installed into")
 	offline    = flag.Bool("offline", false, "Work offline. Differs from Firefox's offline mode in that cannot be disabled until the browser is closed.")
 	clearnet   = flag.Bool("clearnet", Clearnet(), "Use clearnet (no Tor or I2P) in Tor Browser")
-	profile    = flag.String("profile", "", "use a custom profile path, normally blank")
+	profile    = flag.String("profile", "", "Name of a managed profile to launch, or a custom profile path, normally blank")
 	help       = flag.Bool("help", false, "Print help and quit")
 	mirror     = flag.String("mirror", Mirror(), "Mirror to use. I2P will be used if an I2P proxy is present, if system Tor is available, it will be downloaded over the Tor proxy.")
 	solidarity = flag.Bool("onion", defaultTor(), "Serve an onion site which shows some I2P propaganda")
 	torrent    = flag.Bool("torrent", tbget.TorrentReady(), "Create a torrent of the downloaded files and seed it over I2P using an Open Tracker")
 	destruct   = flag.Bool("destruct", false, "Destructively delete the working directory when finished")
+	ephemeral  = flag.Bool("ephemeral", tbsupervise.EPHEMERAL, "Launch a throwaway copy of the profile's template, wiped when the browser exits. The browser bundle and downloads are kept")
+	logKeep    = flag.Int("log-keep", tbsupervise.LOG_KEEP, "How many browser launch logs to keep")
+	crashLines = flag.Int("crash-lines", tbsupervise.CRASH_LINES, "How many of the last lines of a crashed browser's output to keep in its crash report")
 	password   = flag.String("password", Password(), "Password to encrypt the working directory with. Implies -destruct, only the encrypted container will be saved.")
 	chat       = flag.Bool("chat", false, "Open a WebChat client")
 	notor      = flag.Bool("notor", false, "Do not automatically start Tor")
@@ -142,8 +160,44 @@ var (
 	nevertor   = flag.Bool("nevertor", false, "Never use Tor for downloading Tor Browser")
 	license    = flag.Bool("license", false, "Print the license and exit")
 	rsystray   = flag.Bool("systray", false, "Create a systray icon")
+	product    = flag.String("product", "torbrowser", "Product to download and manage: "+strings.Join(tbget.ProductNames(), ", "))
+	products   = flag.String("products", "", "Additional products to download alongside the main product, comma-separated")
+	channel    = flag.String("channel", tbget.CHANNEL, "Release channel to download from: stable, alpha or nightly. Non-stable channels are installed in their own directories.")
+	downgrade  = flag.Bool("allow-downgrade", tbget.ALLOW_DOWNGRADE, "Allow installing a release older than the newest one which has been verified before")
+	freeze     = flag.Duration("freeze-window", tbget.FREEZE_WINDOW, "Warn when the update feed hasn't offered a new release for longer than this, 0 to disable")
+	consensus  = flag.Int("consensus", tbget.CONSENSUS, "Require this many other mirrors, reached over different routes, to confirm a download before unpacking it. At most the number of routes the consensus mirrors use. 0 disables the check")
+	cmirrors   = flag.String("consensus-mirrors", "", "Mirrors used to confirm downloads, as comma-separated route=url pairs where route is clearnet, tor or i2p")
+	verify     = flag.Bool("verify", false, "Hash every file of the installed browsers, compare them with the manifests written when they were unpacked and exit")
+	repair     = flag.Bool("repair", false, "With -verify, restore installed browsers which fail verification from the downloaded archive")
+	lsprofiles = flag.Bool("list-profiles", false, "List the managed browser profiles and exit")
+	mkprofile  = flag.String("create-profile", "", "Create a managed profile with this name, using -profile-mode and -profile-template, and exit")
+	cpprofile  = flag.String("clone-profile", "", "Create a managed profile with this name as a copy of -profile-from and exit")
+	rsprofile  = flag.String("reset-profile", "", "Reset the named managed profile to its template and exit")
+	rmprofile  = flag.String("delete-profile", "", "Delete the named managed profile and exit")
+	pmode      = flag.String("profile-mode", "clearnet", "Mode of a profile created with -create-profile: tor, i2p, clearnet, offline or app")
+	ptemplate  = flag.String("profile-template", "", "Template of a profile created with -create-profile, defaults to the mode's template")
+	pfrom      = flag.String("profile-from", "", "Profile copied by -clone-profile")
+	updates    = flag.Duration("update-interval", 6*time.Hour, "How often to check for updates while serving the control panel, 0 to disable. New releases are installed when no browser is running.")
+	extsource  = flag.String("extension-source", tbsupervise.EXTENSION_SOURCE, "URL of an extension index to upgrade the browser extensions from, .i2p and .onion sources are fetched over I2P and Tor")
+	offproxy   = flag.String("offline-proxy", tbsupervise.OFFLINE_PROXY, "Address of the proxy which limits offline profiles to the -offline-allowlist")
+	offallow   = flag.String("offline-allowlist", strings.Join(tbsupervise.OFFLINE_ALLOWLIST, ","), "Comma-separated host:port pairs offline profiles may reach")
+	offnetns   = flag.Bool("offline-netns", tbsupervise.OFFLINE_NETNS, "On Linux, run offline browsers in their own network namespace which can only reach the offline proxy")
+	sandbox    = flag.Bool("sandbox", tbsupervise.SANDBOX, "On Linux, run browsers in a sandbox with a private /tmp, a read-only install and only their profile writable, unless their profile says otherwise")
+	sbdevices  = flag.String("sandbox-devices", strings.Join(tbsupervise.SANDBOX_DEVICES, ","), "Comma-separated entries of /dev sandboxed browsers can use")
+	sbprofile  = flag.String("set-sandbox", "", "Set whether a managed profile runs in the sandbox, as name=on, name=off or name=default, and exit")
+	routerMode = flag.String("router", os.Getenv("TOR_MANAGER_ROUTER"), "I2P router to use: auto, external, embedded or never. Defaults to the one chosen in the control panel, then auto, which uses an installed router and the embedded one if there is none")
+	i2pcontrol = flag.String("i2pcontrol", os.Getenv("TOR_MANAGER_I2PCONTROL"), "URL of the I2P router's i2pcontrol API. Defaults to the one saved in the control panel, then the router's. Set the password with TOR_MANAGER_I2PCONTROL_PASSWORD or in the control panel")
 )
 
+// AppArmorRoot returns the AppArmor root configured with
+// TOR_MANAGER_APPARMOR_ROOT, or the system's.
+func AppArmorRoot() string {
+	if root := os.Getenv("TOR_MANAGER_APPARMOR_ROOT"); root != "" {
+		return root
+	}
+	return "/etc/apparmor.d"
+}
+
 func Clearnet() bool {
 	if tmc := os.Getenv("TOR_MANAGER_CLEARNET"); tmc != "" {
 		switch tmc {
@@ -211,7 +265,7 @@ func Mirror() string {
 	}
 	if tbget.Torrent(*lang, OS()+ARCH()) {
 		fmt.Fprintf(os.Stderr, "Using torrent mirror")
-		return "http://localhost:7657/i2psnark/"
+		return tbdiscover.Default().Console.URL() + "i2psnark/"
 	}
 	if tbget.TestHTTPDefaultProxy() {
 		//fmt.Fprintf(os.Stderr,"Using I2P mirror")
@@ -228,6 +282,24 @@ var snowflake *bool
 var client *tbserve.Client
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == tbsupervise.NETNS_HELPER {
+		if err := tbsupervise.RunNetnsHelper(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == tbsupervise.EPHEMERAL_HELPER {
+		if err := tbsupervise.RunEphemeralHelper(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == tbsupervise.SANDBOX_HELPER {
+		if err := tbsupervise.RunSandboxHelper(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	for _, arg := range os.Args {
 		if arg == "-license" {
 			LICENSE()
@@ -241,7 +313,7 @@ func main() {
 	SnowflakeFlag()
 	usage := flag.Usage
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stdout, "Usage: %s %s\n", filename, "[options]")
+		fmt.Fprintf(os.Stdout, "Usage: %s %s\n", filename, "[options] [-- browser options]")
 		fmt.Fprintf(os.Stdout, "\n")
 		printversion()
 		fmt.Fprintf(os.Stdout, "\n")
@@ -265,10 +337,38 @@ func main() {
 	args, trailers := CleanupArgs()
 	log.Printf("Args: %v\n", args)
 	log.Printf("Trailers: %v\n", trailers)
+	if err := validTrailers(trailers); err != nil {
+		log.Fatal(err)
+	}
 	if len(args) > 0 {
 		os.Args = args
 	}
 	flag.Parse()
+	var err error
+	if tbget.CHANNEL, err = tbget.NormalizeChannel(*channel); err != nil {
+		log.Fatal(err)
+	}
+	tbget.ALLOW_DOWNGRADE = *downgrade
+	tbget.FREEZE_WINDOW = *freeze
+	tbget.CONSENSUS = *consensus
+	tbsupervise.EXTENSION_SOURCE = *extsource
+	tbsupervise.OFFLINE_PROXY = *offproxy
+	tbsupervise.EDITOR_ADDR = *editoraddr
+	tbsupervise.OFFLINE_ALLOWLIST = tbsupervise.ParseOfflineAllowlist(*offallow)
+	tbsupervise.OFFLINE_NETNS = *offnetns
+	tbsupervise.SANDBOX = *sandbox
+	tbsupervise.EPHEMERAL = *ephemeral
+	tbsupervise.LOG_KEEP = *logKeep
+	tbsupervise.CRASH_LINES = *crashLines
+	tbsupervise.SANDBOX_DEVICES = tbsupervise.ParseOfflineAllowlist(*sbdevices)
+	if *cmirrors != "" {
+		if tbget.CONSENSUS_MIRRORS, err = tbget.ParseConsensusMirrors(*cmirrors); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := tbget.CheckConsensusSetting(tbget.CONSENSUS, tbget.CONSENSUS_MIRRORS); err != nil {
+		log.Fatal(err)
+	}
 	if *nevertor {
 		err := os.Setenv("TOR_MANAGER_NEVER_USE_TOR", "true")
 		if err != nil {
@@ -296,7 +396,7 @@ func main() {
 	}
 	if *ptop {
 		log.Println("Using p2p")
-		*mirror = "http://localhost:7657/i2psnark/"
+		*mirror = tbdiscover.Default().Console.URL() + "i2psnark/"
 	}
 	if *password != "" {
 		log.Println("Looking for directory with password")
@@ -337,17 +437,6 @@ func main() {
 	} else if filename == "firefox" || *clearnet || *offline {
 		*clearnet = true
 	}
-	if *profile == "" {
-		if *offline {
-			*profile = filepath.Join(tbget.WORKING_DIR, "profile.firefox.offline")
-		} else if *clearnet {
-			*profile = filepath.Join(tbget.WORKING_DIR, "profile.firefox")
-		} else {
-			*profile = filepath.Join(tbget.WORKING_DIR, "profile.firefox.default")
-		}
-	} else {
-		*profile = filepath.Join(tbget.WORKING_DIR, *profile)
-	}
 	if *i2pbrowser && *torbrowser {
 		log.Fatal("Please don't open I2P and Tor Browser at the same time when running from the terminal.")
 	}
@@ -359,35 +448,52 @@ func main() {
 		}
 		log.Println("Using auto-detected language", *lang)
 	}
-	if I2PDaemon, err := StartI2P(*directory); err != nil {
+	if err := openProxies(); err != nil {
+		log.Fatal("Couldn't open the I2P proxy settings ", err)
+	}
+	defer proxies.Close()
+	if err := StartI2P(*directory); err != nil {
 		log.Fatal(err)
-	} else {
-		if I2PDaemon != nil {
-			defer I2PDaemon.Stop()
-		}
 	}
-	var err error
-	client, err = tbserve.NewClient(*verbose, *lang, *system, *arch, *mirror, &content, *nounpack)
+	defer routers.Stop()
+	client, err = tbserve.NewProductClient(*verbose, *product, *lang, *system, *arch, *mirror, &content, *nounpack)
 	if err != nil {
 		log.Fatal("Couldn't create client", err)
 	}
+	for _, p := range strings.Split(*products, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		log.Println("Downloading additional product", p)
+		if _, err := client.DownloadProduct(p); err != nil {
+			log.Fatal("Couldn't download ", p, err)
+		}
+	}
 	if *apparmor {
-		err := GenerateAppArmor()
+		dir, err := GenerateAppArmor()
 		if err != nil {
 			log.Fatal("Couldn't generate apparmor rules", err)
 		}
 		log.Println("################################################################")
 		log.Println("#             AppArmor rules generated successfully            #")
 		log.Println("################################################################")
-		log.Println("!IMPORTANT! You must now run the following commands:")
-		log.Println("sudo mkdir -p /etc/apparmor.d/tunables/")
-		log.Println("sudo cp tunables.torbrowser.apparmor /etc/apparmor.d/tunables/torbrowser")
-		log.Println("sudo cp torbrowser.Tor.tor.apparmor /etc/apparmor.d/torbrowser.Tor.tor")
-		log.Println("sudo cp torbrowser.Browser.firefox.apparmor /etc/apparmor.d/torbrowser.Browser.firefox")
-		log.Println("sudo apparmor_parser -r /etc/apparmor.d/tunables/torbrowser")
-		log.Println("sudo apparmor_parser -r /etc/apparmor.d/torbrowser.Tor.tor")
-		log.Println("sudo apparmor_parser -r /etc/apparmor.d/torbrowser.Browser.firefox")
-		log.Println("To copy them to apparmor profiles directory and reload AppArmor")
+		log.Println("The profiles are in", dir)
+		log.Println("!IMPORTANT! To install and load them, run:")
+		log.Println("sudo -E", os.Args[0], "-apparmor-install")
+		return
+	}
+	if *aainstall {
+		if err := InstallAppArmor(*aaroot); err != nil {
+			log.Fatal("Couldn't install apparmor rules ", err)
+		}
+		log.Println("AppArmor profiles installed in", *aaroot)
+		return
+	}
+	if *aaremove {
+		if err := UninstallAppArmor(*aaroot); err != nil {
+			log.Fatal("Couldn't uninstall apparmor rules ", err)
+		}
+		log.Println("AppArmor profiles removed from", *aaroot)
 		return
 	}
 	if *shortcuts {
@@ -398,8 +504,15 @@ func main() {
 	}
 	client.Host = *host
 	client.Port = *port
+	client.UpdateInterval = *updates
 	client.TBS.Profile = &content
 	client.TBS.PassThroughArgs = trailers
+	client.Routers = routers
+	client.Proxies = proxies
+	client.TBS.ProfileProxy = proxies.Profile
+	if client.Router, err = openRouterControl(); err != nil {
+		log.Println("Couldn't open the i2pcontrol settings", err)
+	}
 	if runtime.GOOS == "darwin" {
 		consumer := &state.Consumer{
 			OnMessage: func(lvl string, msg string) {
@@ -410,6 +523,28 @@ func main() {
 		defer damage.Unmount(host, client.TBD.BrowserDir())
 	}
 	//	log.Fatalf("%s", client.TBS.PassThroughArgs)
+	if done, err := profileCommands(); done {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	tbsupervise.ReapEphemeralProfiles()
+	// named is set if -profile names a managed profile rather than a path
+	named := ""
+	if *profile != "" {
+		if _, err := client.TBS.GetProfile(*profile); err == nil {
+			named = *profile
+		} else {
+			*profile = filepath.Join(tbget.WORKING_DIR, *profile)
+		}
+	}
+	if *verify {
+		if err := verifyInstalls(*repair); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if *help {
 		log.Println("Usage:")
 		flag.Usage()
@@ -435,7 +570,9 @@ func main() {
 	if !(*clearnet || *notor) {
 		log.Println("CLEARNET", *clearnet)
 		log.Println("NOTOR", *notor)
-		client.TBS.RunTorWithLang()
+		if err := client.TBS.StartTor(context.Background()); err != nil {
+			log.Println(err)
+		}
 	}
 
 	if *chat {
@@ -444,29 +581,43 @@ func main() {
 	}
 	go ServeEditor()
 	if *i2pbrowser {
-		if err := client.TBS.RunI2PBWithLang(); err != nil {
+		if err := client.TBS.RunProfile(profileOr(named, "i2p")); err != nil {
 			log.Fatal(err)
 		}
 	} else if *i2pconfig {
-		if err := client.TBS.RunI2PBAppWithLang(); err != nil {
+		if err := client.TBS.RunProfile(profileOr(named, "i2p-app")); err != nil {
 			log.Fatal(err)
 		}
 	} else if *i2peditor {
-		if err := client.TBS.RunI2PSiteEditorWithOfflineClearnetProfile(filepath.Join(client.TBD.UnpackPath, "i2p.firefox.editor")); err != nil {
+		if err := client.TBS.RunI2PSiteEditorWithProfile(profileOr(named, "i2p-editor")); err != nil {
 			log.Fatal(err)
 		}
 	} else if *torbrowser {
-		if err := client.TBS.RunTBWithLang(); err != nil {
+		if err := client.TBS.RunProfile(profileOr(named, "tor")); err != nil {
+			log.Fatal(err)
+		}
+	} else if named != "" {
+		if err := client.TBS.RunProfile(named); err != nil {
 			log.Fatal(err)
 		}
 	} else if *offline {
 		log.Println("Working offline")
-		if err := client.TBS.RunTBBWithOfflineClearnetProfile(*profile, *offline, *clearnet); err != nil {
+		if *profile == "" {
+			err = client.TBS.RunProfile("offline")
+		} else {
+			err = client.TBS.RunTBBWithOfflineClearnetProfile(*profile, *offline, *clearnet)
+		}
+		if err != nil {
 			log.Fatal(err)
 		}
 	} else if *clearnet {
 		log.Println("Using a custom profile")
-		if err := client.TBS.RunTBBWithOfflineClearnetProfile(*profile, *offline, *clearnet); err != nil {
+		if *profile == "" {
+			err = client.TBS.RunProfile("clearnet")
+		} else {
+			err = client.TBS.RunTBBWithOfflineClearnetProfile(*profile, *offline, *clearnet)
+		}
+		if err != nil {
 			log.Fatal(err)
 		}
 	} else {
@@ -498,7 +649,15 @@ func ServeEditor() error {
 	if err != nil {
 		return err
 	}
-	if err := tinymce.Serve("127.0.0.1", docroot, "index.html", 7685); err != nil {
+	host, port, err := net.SplitHostPort(tbsupervise.EDITOR_ADDR)
+	if err != nil {
+		return err
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	if err := tinymce.Serve(host, docroot, "index.html", portnum); err != nil {
 		log.Println("Couldn't serve editor", err)
 	}
 	return nil
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// profileOr returns named if it is set, and def otherwise.
+func profileOr(named, def string) string {
+	if named != "" {
+		return named
+	}
+	return def
+}
+
+// profileCommands runs the profile management flags. It returns true if one
+// was given, in which case tor-manager should exit.
+func profileCommands() (bool, error) {
+	switch {
+	case *lsprofiles:
+		profiles, err := client.TBS.Profiles()
+		if err != nil {
+			return true, err
+		}
+		for _, p := range profiles {
+			dir := client.TBS.ProfileDir(p)
+			if dir == "" {
+				dir = "(Tor Browser's own profile)"
+			}
+			sandbox := "default"
+			if p.Sandbox != nil && *p.Sandbox {
+				sandbox = "on"
+			} else if p.Sandbox != nil {
+				sandbox = "off"
+			}
+			fmt.Printf("%s\t%s\t%s\tsandbox=%s\t%s\n", p.Name, p.Mode, p.Created.Format("2006-01-02"), sandbox, dir)
+		}
+	case *mkprofile != "":
+		p, err := client.TBS.CreateProfile(*mkprofile, *pmode, *ptemplate)
+		if err != nil {
+			return true, err
+		}
+		fmt.Println("Created profile", p.Name, "at", client.TBS.ProfileDir(p))
+	case *cpprofile != "":
+		p, err := client.TBS.CloneProfile(*pfrom, *cpprofile)
+		if err != nil {
+			return true, err
+		}
+		fmt.Println("Cloned profile", *pfrom, "to", p.Name, "at", client.TBS.ProfileDir(p))
+	case *rsprofile != "":
+		if err := client.TBS.ResetProfile(*rsprofile); err != nil {
+			return true, err
+		}
+		fmt.Println("Reset profile", *rsprofile)
+	case *rmprofile != "":
+		if err := client.TBS.DeleteProfile(*rmprofile); err != nil {
+			return true, err
+		}
+		fmt.Println("Deleted profile", *rmprofile)
+	case *sbprofile != "":
+		name, setting := *sbprofile, "on"
+		if i := strings.LastIndex(name, "="); i >= 0 {
+			name, setting = name[:i], name[i+1:]
+		}
+		if err := client.TBS.SetProfileSandbox(name, setting); err != nil {
+			return true, err
+		}
+		fmt.Println("Set the sandbox of profile", name, "to", setting)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
@@ -1,157 +1,157 @@
 package main
 
 import (
-	"context"
 	"log"
 	"net"
-	"net/http"
 	"os"
-	"os/signal"
-	"strings"
-	"time"
 
 	flag "github.com/spf13/pflag"
 
-	i2phttpproxy "github.com/eyedeekay/httptunnel"
 	i2pbrowserproxy "github.com/eyedeekay/httptunnel/multiproxy"
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
+	tbproxy "i2pgit.org/idk/i2p.plugins.tor-manager/proxy"
 )
 
+// proxies are tor-manager's own HTTP proxies into I2P, one for every I2P and
+// app profile, and the one served on the router's HTTP proxy port when the
+// router doesn't answer there, and its SOCKS proxy into I2P.
+var proxies *tbproxy.Manager
+
+var proxyDefaults = tbproxy.DefaultSettings()
+
 var (
-	watchProfiles        = flag.String("watch-profiles", "", "Monitor and control these Firefox profiles. Temporarily Unused.")
-	aggressiveIsolation  = false
-	samHostString        = "127.0.0.1" //flag.String("bridge-host", "127.0.0.1", "host: of the SAM bridge")
-	samPortString        = "7656"      //flag.String("bridge-port", "7656", ":port of the SAM bridge")
-	destfile             = "invalid.tunkey"
-	debugConnection      = false
-	inboundTunnelLength  = 3
-	outboundTunnelLength = 3
-	inboundTunnels       = 4
-	outboundTunnels      = 4
-	inboundBackups       = 2
-	outboundBackups      = 2
-	inboundVariance      = 0
-	outboundVariance     = 0
-	dontPublishLease     = true
-	reduceIdle           = false
-	useCompression       = true
-	reduceIdleTime       = 2000000
-	reduceIdleQuantity   = 1
-	runQuiet             = false
+	proxyInLength       = flag.Int("proxy-in-length", proxyDefaults.InLength, "Hops of the inbound tunnels of tor-manager's I2P proxies")
+	proxyOutLength      = flag.Int("proxy-out-length", proxyDefaults.OutLength, "Hops of the outbound tunnels of tor-manager's I2P proxies")
+	proxyInQuantity     = flag.Int("proxy-in-quantity", proxyDefaults.InQuantity, "Inbound tunnels of tor-manager's I2P proxies")
+	proxyOutQuantity    = flag.Int("proxy-out-quantity", proxyDefaults.OutQuantity, "Outbound tunnels of tor-manager's I2P proxies")
+	proxyInBackups      = flag.Int("proxy-in-backups", proxyDefaults.InBackups, "Inbound backup tunnels of tor-manager's I2P proxies")
+	proxyOutBackups     = flag.Int("proxy-out-backups", proxyDefaults.OutBackups, "Outbound backup tunnels of tor-manager's I2P proxies")
+	proxyInVariance     = flag.Int("proxy-in-variance", proxyDefaults.InVariance, "Random variance of the inbound tunnels' hops of tor-manager's I2P proxies")
+	proxyOutVariance    = flag.Int("proxy-out-variance", proxyDefaults.OutVariance, "Random variance of the outbound tunnels' hops of tor-manager's I2P proxies")
+	proxyUnpublished    = flag.Bool("proxy-unpublished", proxyDefaults.Unpublished, "Don't publish the leasesets of tor-manager's I2P proxies")
+	proxyReduceIdle     = flag.Bool("proxy-reduce-idle", proxyDefaults.ReduceIdle, "Reduce the tunnels of idle I2P proxies")
+	proxyReduceTime     = flag.Int("proxy-reduce-idle-time", proxyDefaults.ReduceIdleTime, "Milliseconds an I2P proxy is idle before its tunnels are reduced")
+	proxyReduceQuantity = flag.Int("proxy-reduce-idle-quantity", proxyDefaults.ReduceIdleQuantity, "Tunnels an idle I2P proxy is reduced to")
+	proxyCompression    = flag.Bool("proxy-compression", proxyDefaults.Compression, "Compress the traffic of tor-manager's I2P proxies")
+	proxyAggressive     = flag.Bool("proxy-aggressive-isolation", proxyDefaults.AggressiveIsolation, "Give every site a profile visits its own I2P identity")
+	proxyPersistKeys    = flag.Bool("proxy-persist-keys", proxyDefaults.PersistKeys, "Keep the I2P identities of the profiles' proxies across restarts")
+	proxyIsolate        = flag.Bool("proxy-isolate", proxyDefaults.Isolate, "Give every I2P and app profile its own I2P proxy and identity instead of using the router's HTTP proxy")
+	proxyDebug          = flag.Bool("proxy-debug", proxyDefaults.Debug, "Log the connections of tor-manager's I2P proxies")
+	proxyControl        = flag.String("proxy-control", envDefault("TOR_MANAGER_PROXY_CONTROL", proxyDefaults.ControlAddr), "Address of the control server of tor-manager's I2P proxies")
+	proxyPort           = flag.Int("proxy-port", proxyDefaults.Port, "First port tried for the I2P proxy of a profile which doesn't have one yet")
+	socksAddr           = flag.String("socks", os.Getenv("TOR_MANAGER_SOCKS"), "Address of a SOCKS5 proxy into I2P for other applications, such as 127.0.0.1:4446. Clients which authenticate with different usernames and passwords get different I2P identities. Defaults to the one saved in the control panel, off if empty")
+	socksRequireAuth    = flag.Bool("socks-require-auth", proxyDefaults.SOCKSRequireAuth, "Refuse SOCKS clients which don't authenticate with a username and password")
+	watchProfiles       = flag.String("watch-profiles", "", "Unused, every I2P and app profile gets its own proxy")
 )
 
-func proxy() {
-	ln, err := net.Listen("tcp", "127.0.0.1:4444")
-	if err != nil {
-		log.Fatal(err)
-	}
-	cln, err := net.Listen("tcp", "127.0.0.1:7696")
-	if err != nil {
-		log.Fatal(err)
-	}
-	ctx, cancel := context.WithCancel(context.Background())
-	go proxyMain(ctx, ln, cln)
-	<-ctx.Done()
-	cancel()
+func init() {
+	flag.CommandLine.MarkDeprecated("watch-profiles", "every I2P and app profile gets its own proxy")
 }
 
-func proxyMain(ctx context.Context, ln net.Listener, cln net.Listener) {
-	flag.Parse()
-	for {
-		_, err := net.Listen("tcp", samHostString+":"+samPortString)
-		if err != nil {
-			break
-		}
+// envDefault returns the environment variable, or def if it isn't set.
+func envDefault(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
 	}
-	profiles := strings.Split(*watchProfiles, ",")
+	return def
+}
 
-	srv := &http.Server{
-		ReadTimeout:  600 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		Addr:         ln.Addr().String(),
-	}
+// openProxies opens the I2P proxies' settings saved in the working directory.
+// Settings given on the command line are used instead of the saved ones
+// without being saved.
+func openProxies() error {
 	var err error
-	srv.Handler, err = i2pbrowserproxy.NewHttpProxy(
-		i2pbrowserproxy.SetHost(samHostString),
-		i2pbrowserproxy.SetPort(samPortString),
-		i2pbrowserproxy.SetProxyAddr(ln.Addr().String()),
-		i2pbrowserproxy.SetControlAddr(cln.Addr().String()),
-		i2pbrowserproxy.SetDebug(debugConnection),
-		i2pbrowserproxy.SetInLength(uint(inboundTunnelLength)),
-		i2pbrowserproxy.SetOutLength(uint(outboundTunnelLength)),
-		i2pbrowserproxy.SetInQuantity(uint(inboundTunnels)),
-		i2pbrowserproxy.SetOutQuantity(uint(outboundTunnels)),
-		i2pbrowserproxy.SetInBackups(uint(inboundBackups)),
-		i2pbrowserproxy.SetOutBackups(uint(outboundBackups)),
-		i2pbrowserproxy.SetInVariance(inboundVariance),
-		i2pbrowserproxy.SetOutVariance(outboundVariance),
-		i2pbrowserproxy.SetUnpublished(dontPublishLease),
-		i2pbrowserproxy.SetReduceIdle(reduceIdle),
-		i2pbrowserproxy.SetCompression(useCompression),
-		i2pbrowserproxy.SetReduceIdleTime(uint(reduceIdleTime)),
-		i2pbrowserproxy.SetReduceIdleQuantity(uint(reduceIdleQuantity)),
-		i2pbrowserproxy.SetKeysPath(destfile),
-		i2pbrowserproxy.SetProxyMode(aggressiveIsolation),
-	)
-	i2pbrowserproxy.Quiet = runQuiet
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	ctrlsrv := &http.Server{
-		ReadHeaderTimeout: 600 * time.Second,
-		WriteTimeout:      600 * time.Second,
-		Addr:              cln.Addr().String(),
-	}
-	ctrlsrv.Handler, err = i2phttpproxy.NewSAMHTTPController(profiles, srv)
-	if err != nil {
-		log.Fatal(err)
+	if proxies, err = tbproxy.Open(*directory, proxyDefaults, newProxyHandler); err != nil {
+		return err
 	}
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-
-	go func() {
-		for sig := range c {
-			if sig == os.Interrupt {
-				srv.Handler.(*i2pbrowserproxy.SAMMultiProxy).Close()
-				srv.Shutdown(ctx)
-				ctrlsrv.Shutdown(ctx)
+	changed := flag.CommandLine.Changed
+	proxies.Override = func(s *tbproxy.Settings) {
+		for name, set := range map[string]func(){
+			"proxy-in-length":            func() { s.InLength = *proxyInLength },
+			"proxy-out-length":           func() { s.OutLength = *proxyOutLength },
+			"proxy-in-quantity":          func() { s.InQuantity = *proxyInQuantity },
+			"proxy-out-quantity":         func() { s.OutQuantity = *proxyOutQuantity },
+			"proxy-in-backups":           func() { s.InBackups = *proxyInBackups },
+			"proxy-out-backups":          func() { s.OutBackups = *proxyOutBackups },
+			"proxy-in-variance":          func() { s.InVariance = *proxyInVariance },
+			"proxy-out-variance":         func() { s.OutVariance = *proxyOutVariance },
+			"proxy-unpublished":          func() { s.Unpublished = *proxyUnpublished },
+			"proxy-reduce-idle":          func() { s.ReduceIdle = *proxyReduceIdle },
+			"proxy-reduce-idle-time":     func() { s.ReduceIdleTime = *proxyReduceTime },
+			"proxy-reduce-idle-quantity": func() { s.ReduceIdleQuantity = *proxyReduceQuantity },
+			"proxy-compression":          func() { s.Compression = *proxyCompression },
+			"proxy-aggressive-isolation": func() { s.AggressiveIsolation = *proxyAggressive },
+			"proxy-persist-keys":         func() { s.PersistKeys = *proxyPersistKeys },
+			"proxy-isolate":              func() { s.Isolate = *proxyIsolate },
+			"proxy-debug":                func() { s.Debug = *proxyDebug },
+			"proxy-port":                 func() { s.Port = *proxyPort },
+			"socks-require-auth":         func() { s.SOCKSRequireAuth = *socksRequireAuth },
+		} {
+			if changed(name) {
+				set()
 			}
 		}
-	}()
-
-	go func() {
-		log.Println("Starting control server on", cln.Addr())
-		if err := ctrlsrv.Serve(cln); err != nil {
-			if err == http.ErrServerClosed {
-				return
-			}
-			log.Fatal("Serve:", err)
+		if changed("proxy-control") || os.Getenv("TOR_MANAGER_PROXY_CONTROL") != "" {
+			s.ControlAddr = *proxyControl
 		}
-		log.Println("Stopping control server on", cln.Addr())
-	}()
-
-	go func() {
-		log.Println("Starting proxy server on", ln.Addr())
-		if err := srv.Serve(ln); err != nil {
-			if err == http.ErrServerClosed {
-				return
-			}
-			log.Fatal("Serve:", err)
+		if changed("socks") || os.Getenv("TOR_MANAGER_SOCKS") != "" {
+			s.SOCKSAddr = *socksAddr
 		}
-		log.Println("Stopping proxy server on", ln.Addr())
-	}()
-
-	counter()
+	}
+	settings := proxies.Settings()
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	if err := proxies.ServeControl(); err != nil {
+		log.Println("The I2P proxies' control server isn't running:", err)
+	}
+	if err := proxies.StartSOCKS(); err != nil {
+		log.Println("The SOCKS proxy into I2P isn't running:", err)
+	}
+	return nil
+}
 
-	<-ctx.Done()
+// proxy serves tor-manager's own HTTP proxy on the router's HTTP proxy port.
+func proxy() error {
+	return proxies.Listen(tbdiscover.Default().HTTPProxy.Addr())
 }
 
-func counter() {
-	var x int
-	for {
-		log.Println("Identity is", x, "minute(s) old")
-		time.Sleep(1 * time.Minute)
-		x++
+// newProxyHandler creates an HTTP proxy into I2P with its own identity.
+func newProxyHandler(o tbproxy.Options) (tbproxy.Handler, error) {
+	host, port, err := net.SplitHostPort(o.SAM)
+	if err != nil {
+		return nil, err
+	}
+	keys := o.KeysPath
+	if keys == "" {
+		// The proxy doesn't save or load keys from this path.
+		keys = "invalid.tunkey"
+	}
+	p, err := i2pbrowserproxy.NewHttpProxy(
+		i2pbrowserproxy.SetName(o.Name),
+		i2pbrowserproxy.SetHost(host),
+		i2pbrowserproxy.SetPort(port),
+		i2pbrowserproxy.SetProxyAddr(o.ProxyAddr),
+		i2pbrowserproxy.SetControlAddr(o.ControlAddr),
+		i2pbrowserproxy.SetDebug(o.Debug),
+		i2pbrowserproxy.SetInLength(uint(o.InLength)),
+		i2pbrowserproxy.SetOutLength(uint(o.OutLength)),
+		i2pbrowserproxy.SetInQuantity(uint(o.InQuantity)),
+		i2pbrowserproxy.SetOutQuantity(uint(o.OutQuantity)),
+		i2pbrowserproxy.SetInBackups(uint(o.InBackups)),
+		i2pbrowserproxy.SetOutBackups(uint(o.OutBackups)),
+		i2pbrowserproxy.SetInVariance(o.InVariance),
+		i2pbrowserproxy.SetOutVariance(o.OutVariance),
+		i2pbrowserproxy.SetUnpublished(o.Unpublished),
+		i2pbrowserproxy.SetReduceIdle(o.ReduceIdle),
+		i2pbrowserproxy.SetCompression(o.Compression),
+		i2pbrowserproxy.SetReduceIdleTime(uint(o.ReduceIdleTime)),
+		i2pbrowserproxy.SetReduceIdleQuantity(uint(o.ReduceIdleQuantity)),
+		i2pbrowserproxy.SetKeysPath(keys),
+		i2pbrowserproxy.SetProxyMode(o.AggressiveIsolation),
+	)
+	if err != nil {
+		return nil, err
 	}
+	return p, nil
 }
@@ -0,0 +1,559 @@
+package tbproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
+	tbready "i2pgit.org/idk/i2p.plugins.tor-manager/ready"
+)
+
+// Handler is an HTTP proxy into I2P with its own client identity.
+type Handler interface {
+	http.Handler
+	// Close closes the proxy's tunnels.
+	Close() error
+	// Base32 returns the address of the proxy's identity.
+	Base32() string
+}
+
+// Options are what a Handler is created with.
+type Options struct {
+	Settings
+	// Name is the name of the handler's tunnels.
+	Name string
+	// SAM is the address of the SAM bridge the handler connects to.
+	SAM string
+	// ProxyAddr is the address the handler is served on.
+	ProxyAddr string
+	// ControlAddr is the address of the control server.
+	ControlAddr string
+	// KeysPath is where the handler keeps its keys. It is empty unless
+	// PersistKeys is set, and the handler gets a new identity every time.
+	KeysPath string
+}
+
+// SHARED is the name of the listener which isn't any profile's, which
+// tor-manager serves on the router's HTTP proxy port when the router doesn't.
+const SHARED = ""
+
+// Manager runs the proxies' listeners and their control server.
+type Manager struct {
+	// NewHandler creates the proxy of a listener.
+	NewHandler func(o Options) (Handler, error)
+	// Override changes the saved settings before they are used, without
+	// saving the change. It is used for the settings given on the command
+	// line.
+	Override  func(s *Settings)
+	path      string
+	keys      string
+	mutex     sync.Mutex
+	saved     Settings
+	listeners map[string]*listener
+	socks     *SOCKS
+	control   *http.Server
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// Status is the state of a listener.
+type Status struct {
+	Profile string `json:"profile"`
+	Addr    string `json:"addr"`
+	// Base32 is the address of the listener's identity, empty until it has
+	// connected to SAM.
+	Base32 string `json:"base32,omitempty"`
+	// Since is when the listener got its identity.
+	Since time.Time `json:"since,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Open returns a Manager with the settings saved in workdir, or defaults if
+// none were saved. Its handlers are created with newHandler.
+func Open(workdir string, defaults Settings, newHandler func(o Options) (Handler, error)) (*Manager, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		NewHandler: newHandler,
+		path:       filepath.Join(workdir, "proxy.json"),
+		keys:       filepath.Join(workdir, "proxy-keys"),
+		listeners:  make(map[string]*listener),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	m.socks = NewSOCKS(m.Settings, func() string { return tbdiscover.Default().SAM.Addr() })
+	var err error
+	if m.saved, err = loadSettings(m.path, defaults); err != nil {
+		cancel()
+		return nil, fmt.Errorf("Open: %s", err)
+	}
+	return m, nil
+}
+
+// Settings returns the settings in use.
+func (m *Manager) Settings() Settings {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.settings()
+}
+
+// SavedSettings returns the saved settings, without the Override. They are
+// what Configure starts from, so overrides aren't saved by accident.
+func (m *Manager) SavedSettings() Settings {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.saved
+	s.Listeners = make(map[string]string)
+	for name, addr := range m.saved.Listeners {
+		s.Listeners[name] = addr
+	}
+	return s
+}
+
+func (m *Manager) settings() Settings {
+	s := m.saved
+	s.Listeners = make(map[string]string)
+	for name, addr := range m.saved.Listeners {
+		s.Listeners[name] = addr
+	}
+	if m.Override != nil {
+		m.Override(&s)
+	}
+	return s
+}
+
+// Configure saves the settings and reconnects the listeners with them. The
+// listeners keep their addresses, and their identities if PersistKeys is set.
+// The SOCKS proxy is moved to its new address, and its identities are replaced.
+func (m *Manager) Configure(s Settings) error {
+	if err := s.Validate(); err != nil {
+		return fmt.Errorf("Configure: %s", err)
+	}
+	m.mutex.Lock()
+	socksAddr := m.settings().SOCKSAddr
+	s.Listeners = m.saved.Listeners
+	if err := saveSettings(m.path, s); err != nil {
+		m.mutex.Unlock()
+		return fmt.Errorf("Configure: %s", err)
+	}
+	m.saved = s
+	listeners := m.sortedListeners()
+	m.mutex.Unlock()
+	for _, l := range listeners {
+		m.reconnect(l, !s.PersistKeys)
+	}
+	if addr := m.Settings().SOCKSAddr; addr != socksAddr {
+		m.socks.Close()
+		if addr != "" {
+			if err := m.socks.Listen(addr); err != nil {
+				return fmt.Errorf("Configure: %s", err)
+			}
+		}
+		return nil
+	}
+	m.socks.Reset()
+	return nil
+}
+
+// StartSOCKS starts the SOCKS proxy on the SOCKSAddr, unless it is empty.
+func (m *Manager) StartSOCKS() error {
+	addr := m.Settings().SOCKSAddr
+	if addr == "" || m.socks.Addr() != "" {
+		return nil
+	}
+	if err := m.socks.Listen(addr); err != nil {
+		return fmt.Errorf("StartSOCKS: %s", err)
+	}
+	return nil
+}
+
+// SOCKSStatus returns the statistics of the SOCKS proxy, or nil if it isn't
+// running.
+func (m *Manager) SOCKSStatus() *SOCKSStatus {
+	if m.socks.Addr() == "" {
+		return nil
+	}
+	status := m.socks.Status()
+	return &status
+}
+
+// Profile returns the address of the profile's listener, starting it if it
+// isn't running. It returns an empty address if profiles aren't isolated or the
+// router has no SAM bridge, and the profile should use the router's HTTP proxy.
+func (m *Manager) Profile(name string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.settings()
+	if !s.Isolate {
+		return "", nil
+	}
+	if !tbdiscover.Default().SAM.Enabled {
+		log.Println("Profile: the I2P router's SAM bridge isn't enabled,", name, "uses the router's HTTP proxy")
+		return "", nil
+	}
+	if l, ok := m.listeners[name]; ok {
+		return l.addr, nil
+	}
+	if addr, ok := s.Listeners[name]; ok {
+		err := m.listen(name, addr)
+		if err == nil {
+			return addr, nil
+		}
+		log.Println("Profile:", err, "moving", name, "to another port")
+	}
+	for port := s.Port; port <= 65535; port++ {
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		if m.taken(addr) {
+			continue
+		}
+		if err := m.listen(name, addr); err != nil {
+			continue
+		}
+		if m.saved.Listeners == nil {
+			m.saved.Listeners = make(map[string]string)
+		}
+		m.saved.Listeners[name] = addr
+		if err := saveSettings(m.path, m.saved); err != nil {
+			log.Println("Profile:", err)
+		}
+		return addr, nil
+	}
+	return "", fmt.Errorf("Profile: no free port for %s from %d", name, s.Port)
+}
+
+// taken returns true if the address is saved for another listener.
+func (m *Manager) taken(addr string) bool {
+	for _, a := range m.saved.Listeners {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Listen starts the shared listener on the address.
+func (m *Manager) Listen(addr string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.listeners[SHARED]; ok {
+		return nil
+	}
+	return m.listen(SHARED, addr)
+}
+
+// listen starts a listener on the address and connects it in the background.
+func (m *Manager) listen(name, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Listen: %s", err)
+	}
+	l := &listener{name: name, addr: ln.Addr().String()}
+	l.srv = &http.Server{
+		ReadTimeout:  600 * time.Second,
+		WriteTimeout: 600 * time.Second,
+		Handler:      l,
+	}
+	m.listeners[name] = l
+	go func() {
+		log.Println("Starting the I2P proxy of", l.label(), "on", l.addr)
+		if err := l.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("Listen:", err)
+		}
+	}()
+	m.connect(l)
+	return nil
+}
+
+// keysPath returns where the listener's keys are kept.
+func (m *Manager) keysPath(l *listener) string {
+	name := l.name
+	if name == SHARED {
+		name = "shared"
+	}
+	return filepath.Join(m.keys, name+".i2pkeys")
+}
+
+// connect creates the listener's handler in the background, waiting for SAM
+// and retrying with backoff until it succeeds or the Manager is closed.
+func (m *Manager) connect(l *listener) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	l.mutex.Lock()
+	l.cancel = cancel
+	l.err = "connecting to the SAM bridge"
+	l.mutex.Unlock()
+	go func() {
+		var handler Handler
+		err := tbready.Wait(ctx, func(ctx context.Context) error {
+			s := m.Settings()
+			o := Options{
+				Settings:    s,
+				Name:        "tor-manager-" + l.label(),
+				SAM:         tbdiscover.Default().SAM.Addr(),
+				ProxyAddr:   l.addr,
+				ControlAddr: s.ControlAddr,
+			}
+			if s.PersistKeys {
+				if err := os.MkdirAll(m.keys, 0700); err != nil {
+					return err
+				}
+				o.KeysPath = m.keysPath(l)
+			}
+			if err := tbready.SAM(o.SAM)(ctx); err != nil {
+				l.setError(err)
+				return err
+			}
+			h, err := m.NewHandler(o)
+			if err != nil {
+				l.setError(err)
+				return err
+			}
+			handler = h
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		if !l.setHandler(ctx, handler) {
+			handler.Close()
+			return
+		}
+		log.Println("The I2P proxy of", l.label(), "has the identity", handler.Base32())
+	}()
+}
+
+// reconnect closes the listener's handler and connects it again, with a new
+// identity if dropKeys is set.
+func (m *Manager) reconnect(l *listener, dropKeys bool) {
+	l.mutex.Lock()
+	if l.cancel != nil {
+		l.cancel()
+	}
+	handler := l.handler
+	l.handler = nil
+	l.mutex.Unlock()
+	if handler != nil {
+		if err := handler.Close(); err != nil {
+			log.Println("reconnect:", err)
+		}
+	}
+	if dropKeys {
+		if err := os.Remove(m.keysPath(l)); err != nil && !os.IsNotExist(err) {
+			log.Println("reconnect:", err)
+		}
+	}
+	m.connect(l)
+}
+
+// NewIdentity replaces the identity of the profile's listener with a new one.
+func (m *Manager) NewIdentity(name string) error {
+	m.mutex.Lock()
+	l, ok := m.listeners[name]
+	m.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("NewIdentity: %s has no I2P proxy running", name)
+	}
+	log.Println("Replacing the identity of the I2P proxy of", l.label())
+	m.reconnect(l, true)
+	return nil
+}
+
+// Status returns the state of the listeners, the shared one first, then the
+// profiles' by name.
+func (m *Manager) Status() []Status {
+	m.mutex.Lock()
+	listeners := m.sortedListeners()
+	m.mutex.Unlock()
+	var statuses []Status
+	for _, l := range listeners {
+		statuses = append(statuses, l.status())
+	}
+	return statuses
+}
+
+func (m *Manager) sortedListeners() []*listener {
+	var listeners []*listener
+	for _, l := range m.listeners {
+		listeners = append(listeners, l)
+	}
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].name < listeners[j].name })
+	return listeners
+}
+
+// ServeControl starts the control server on the ControlAddr.
+func (m *Manager) ServeControl() error {
+	addr := m.Settings().ControlAddr
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("ServeControl: %s", err)
+	}
+	control := &http.Server{ReadHeaderTimeout: 10 * time.Second, Handler: m}
+	m.mutex.Lock()
+	m.control = control
+	m.mutex.Unlock()
+	go func() {
+		log.Println("Starting the I2P proxies' control server on", ln.Addr())
+		if err := control.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("ServeControl:", err)
+		}
+	}()
+	return nil
+}
+
+// ServeHTTP is the control server. GET /status answers with the state of the
+// listeners, and POST /new-identity replaces the identity of the listener of
+// the profile named by the JSON body's profile, such as {"profile": "i2p"}.
+// Pages can only POST JSON after a CORS preflight, which the control server
+// never answers, and names which resolve to another address are refused, so
+// pages the browsers open can't change identities.
+func (m *Manager) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	switch rq.URL.Path {
+	case "/", "/status":
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(m.Status())
+	case "/new-identity":
+		if rq.Method != "POST" {
+			http.Error(rw, "new-identity must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !loopbackHost(rq.Host) {
+			http.Error(rw, "new-identity must be sent to a loopback address", http.StatusForbidden)
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(rq.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(rw, "new-identity takes a JSON body", http.StatusUnsupportedMediaType)
+			return
+		}
+		var body struct {
+			Profile string `json:"profile"`
+		}
+		if err := json.NewDecoder(io.LimitReader(rq.Body, 4096)).Decode(&body); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.NewIdentity(body.Profile); err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	default:
+		http.NotFound(rw, rq)
+	}
+}
+
+// loopbackHost returns true if the Host of a request is a loopback address or
+// localhost.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Close stops the listeners, their handlers, the SOCKS proxy and the control
+// server.
+func (m *Manager) Close() error {
+	m.cancel()
+	m.socks.Close()
+	m.mutex.Lock()
+	listeners := m.sortedListeners()
+	m.listeners = make(map[string]*listener)
+	control := m.control
+	m.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, l := range listeners {
+		l.close(ctx)
+	}
+	if control != nil {
+		control.Shutdown(ctx)
+	}
+	return nil
+}
+
+// listener is an HTTP proxy listener, which serves its handler once it has
+// connected.
+type listener struct {
+	name    string
+	addr    string
+	srv     *http.Server
+	mutex   sync.Mutex
+	handler Handler
+	since   time.Time
+	err     string
+	cancel  context.CancelFunc
+}
+
+func (l *listener) label() string {
+	if l.name == SHARED {
+		return "tor-manager"
+	}
+	return l.name
+}
+
+func (l *listener) setError(err error) {
+	l.mutex.Lock()
+	l.err = err.Error()
+	l.mutex.Unlock()
+}
+
+// setHandler makes the listener serve the handler, unless the context it was
+// connected with is done.
+func (l *listener) setHandler(ctx context.Context, handler Handler) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	l.handler, l.since, l.err = handler, time.Now(), ""
+	return true
+}
+
+func (l *listener) status() Status {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	s := Status{Profile: l.name, Addr: l.addr, Error: l.err}
+	if l.handler != nil {
+		s.Base32, s.Since = l.handler.Base32(), l.since
+	}
+	return s
+}
+
+func (l *listener) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	l.mutex.Lock()
+	handler, err := l.handler, l.err
+	l.mutex.Unlock()
+	if handler == nil {
+		http.Error(rw, "The I2P proxy isn't connected yet: "+err, http.StatusServiceUnavailable)
+		return
+	}
+	handler.ServeHTTP(rw, rq)
+}
+
+func (l *listener) close(ctx context.Context) {
+	l.mutex.Lock()
+	if l.cancel != nil {
+		l.cancel()
+	}
+	handler := l.handler
+	l.handler = nil
+	l.mutex.Unlock()
+	if handler != nil {
+		handler.Close()
+	}
+	l.srv.Shutdown(ctx)
+}
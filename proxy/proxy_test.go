@@ -0,0 +1,38 @@
+package tbproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewIdentityRefusesPages(t *testing.T) {
+	m, err := Open(t.TempDir(), DefaultSettings(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	cases := []struct {
+		host, contentType, body string
+		status                  int
+	}{
+		// What a form on any page can send.
+		{"127.0.0.1:7697", "application/x-www-form-urlencoded", "profile=i2p", http.StatusUnsupportedMediaType},
+		{"127.0.0.1:7697", "text/plain", `{"profile": "i2p"}`, http.StatusUnsupportedMediaType},
+		// A page whose name was rebound to the control server.
+		{"attacker.example:7697", "application/json", `{"profile": "i2p"}`, http.StatusForbidden},
+		{"localhost:7697", "application/json", `{"profile": "i2p"}`, http.StatusNotFound},
+		{"127.0.0.1:7697", "application/json; charset=utf-8", `{"profile": "i2p"}`, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		rq := httptest.NewRequest("POST", "/new-identity", strings.NewReader(c.body))
+		rq.Host = c.host
+		rq.Header.Set("Content-Type", c.contentType)
+		rw := httptest.NewRecorder()
+		m.ServeHTTP(rw, rq)
+		if rw.Code != c.status {
+			t.Errorf("%s %s %s: got %d, want %d", c.host, c.contentType, c.body, rw.Code, c.status)
+		}
+	}
+}
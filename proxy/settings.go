@@ -0,0 +1,179 @@
+// Package tbproxy runs tor-manager's own HTTP proxies into I2P. Every browser
+// profile gets its own listener with its own I2P client identity, which can be
+// replaced with a new one from the control panel or the proxies' control
+// server. Other applications can use a SOCKS5 proxy into I2P.
+package tbproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Settings are the options of the proxies' tunnels and listeners.
+type Settings struct {
+	// InLength and OutLength are the number of hops of the tunnels.
+	InLength  int `json:"in_length"`
+	OutLength int `json:"out_length"`
+	// InQuantity and OutQuantity are the number of tunnels.
+	InQuantity  int `json:"in_quantity"`
+	OutQuantity int `json:"out_quantity"`
+	// InBackups and OutBackups are the number of tunnels kept in reserve.
+	InBackups  int `json:"in_backups"`
+	OutBackups int `json:"out_backups"`
+	// InVariance and OutVariance randomize the length of the tunnels by up
+	// to this many hops.
+	InVariance  int `json:"in_variance"`
+	OutVariance int `json:"out_variance"`
+	// Unpublished keeps the identities' leasesets out of the network database.
+	Unpublished bool `json:"unpublished"`
+	// ReduceIdle reduces the tunnels to ReduceIdleQuantity after
+	// ReduceIdleTime milliseconds without traffic.
+	ReduceIdle         bool `json:"reduce_idle"`
+	ReduceIdleTime     int  `json:"reduce_idle_time"`
+	ReduceIdleQuantity int  `json:"reduce_idle_quantity"`
+	Compression        bool `json:"compression"`
+	// AggressiveIsolation gives every site a profile visits its own identity,
+	// rather than one identity for the whole profile.
+	AggressiveIsolation bool `json:"aggressive_isolation"`
+	// PersistKeys keeps the identities across restarts of tor-manager.
+	// Otherwise every start gets new ones.
+	PersistKeys bool `json:"persist_keys"`
+	// Isolate gives every I2P and app profile its own listener and identity.
+	// Otherwise they use the router's HTTP proxy.
+	Isolate bool `json:"isolate"`
+	Debug   bool `json:"debug"`
+	// ControlAddr is the address of the proxies' control server.
+	ControlAddr string `json:"control_addr"`
+	// Port is the first port tried for a profile which doesn't have a
+	// listener yet.
+	Port int `json:"port"`
+	// SOCKSAddr is the address of the SOCKS5 proxy into I2P for other
+	// applications. It isn't run if it is empty.
+	SOCKSAddr string `json:"socks_addr,omitempty"`
+	// SOCKSRequireAuth refuses SOCKS clients which don't authenticate, so that
+	// every client has to pick the identity it uses.
+	SOCKSRequireAuth bool `json:"socks_require_auth"`
+	// Listeners are the addresses of the profiles' listeners, by profile name,
+	// so a profile's proxy keeps its port.
+	Listeners map[string]string `json:"listeners,omitempty"`
+}
+
+// DefaultSettings returns the settings tor-manager uses unless they are
+// changed.
+func DefaultSettings() Settings {
+	return Settings{
+		InLength:           3,
+		OutLength:          3,
+		InQuantity:         4,
+		OutQuantity:        4,
+		InBackups:          2,
+		OutBackups:         2,
+		Unpublished:        true,
+		ReduceIdleTime:     2000000,
+		ReduceIdleQuantity: 1,
+		Compression:        true,
+		Isolate:            true,
+		ControlAddr:        "127.0.0.1:7697",
+		Port:               4450,
+	}
+}
+
+// Validate checks the settings against the limits of the router's tunnel
+// options.
+func (s *Settings) Validate() error {
+	for _, o := range []struct {
+		name     string
+		value    int
+		min, max int
+	}{
+		{"inbound length", s.InLength, 0, 7},
+		{"outbound length", s.OutLength, 0, 7},
+		{"inbound quantity", s.InQuantity, 1, 16},
+		{"outbound quantity", s.OutQuantity, 1, 16},
+		{"inbound backups", s.InBackups, 0, 16},
+		{"outbound backups", s.OutBackups, 0, 16},
+		{"inbound variance", s.InVariance, -7, 7},
+		{"outbound variance", s.OutVariance, -7, 7},
+		{"reduce idle quantity", s.ReduceIdleQuantity, 1, 16},
+		{"port", s.Port, 1, 65535},
+	} {
+		if o.value < o.min || o.value > o.max {
+			return fmt.Errorf("Validate: the %s is %d, it must be between %d and %d", o.name, o.value, o.min, o.max)
+		}
+	}
+	if s.SOCKSAddr != "" {
+		host, _, err := net.SplitHostPort(s.SOCKSAddr)
+		if err != nil {
+			return fmt.Errorf("Validate: the SOCKS address %q is not host:port", s.SOCKSAddr)
+		}
+		// The SOCKS proxy doesn't check credentials, so anyone who can reach
+		// it can use its identities.
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("Validate: the SOCKS address %q is not on loopback, use 127.0.0.1 or localhost", s.SOCKSAddr)
+		}
+	}
+	if s.ReduceIdle && s.ReduceIdleTime < 300000 {
+		return fmt.Errorf("Validate: the reduce idle time is %dms, it must be at least 300000ms", s.ReduceIdleTime)
+	}
+	return nil
+}
+
+// loadSettings returns defaults with the settings saved at path in place of
+// them.
+func loadSettings(path string, defaults Settings) (Settings, error) {
+	s := defaults
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+// saveSettings replaces the settings at path in one step.
+func saveSettings(path string, s Settings) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".proxy-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SAMOptions returns the tunnel options of the settings as SAM session
+// options.
+func (s *Settings) SAMOptions() []string {
+	return []string{
+		fmt.Sprintf("inbound.length=%d", s.InLength),
+		fmt.Sprintf("outbound.length=%d", s.OutLength),
+		fmt.Sprintf("inbound.lengthVariance=%d", s.InVariance),
+		fmt.Sprintf("outbound.lengthVariance=%d", s.OutVariance),
+		fmt.Sprintf("inbound.quantity=%d", s.InQuantity),
+		fmt.Sprintf("outbound.quantity=%d", s.OutQuantity),
+		fmt.Sprintf("inbound.backupQuantity=%d", s.InBackups),
+		fmt.Sprintf("outbound.backupQuantity=%d", s.OutBackups),
+		fmt.Sprintf("i2cp.dontPublishLeaseSet=%t", s.Unpublished),
+		fmt.Sprintf("i2cp.reduceOnIdle=%t", s.ReduceIdle),
+		fmt.Sprintf("i2cp.reduceIdleTime=%d", s.ReduceIdleTime),
+		fmt.Sprintf("i2cp.reduceQuantity=%d", s.ReduceIdleQuantity),
+		fmt.Sprintf("i2cp.gzip=%t", s.Compression),
+	}
+}
@@ -0,0 +1,559 @@
+package tbproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eyedeekay/sam3"
+)
+
+// SOCKS_MAX_IDENTITIES is how many identities the SOCKS proxy keeps. When a
+// new credential needs one, the identity which has been idle longest is
+// closed, and the client is refused if none is idle.
+var SOCKS_MAX_IDENTITIES = 16
+
+// SOCKS_DIAL_TIMEOUT is how long the SOCKS proxy waits for an identity's
+// tunnels and a stream to connect.
+var SOCKS_DIAL_TIMEOUT = 2 * time.Minute
+
+// SOCKS replies, RFC 1928 section 6.
+const (
+	socksSucceeded          = 0x00
+	socksFailure            = 0x01
+	socksNotAllowed         = 0x02
+	socksHostUnreachable    = 0x04
+	socksTTLExpired         = 0x06
+	socksCommandUnsupported = 0x07
+	socksAddressUnsupported = 0x08
+)
+
+// SOCKS is a SOCKS5 proxy into I2P for applications other than the browser.
+// It resolves .i2p and .b32.i2p names and connects to them over SAM streaming.
+// Every username and password pair a client authenticates with (RFC 1929) gets
+// an identity of its own, so applications which use different credentials
+// can't be linked to each other. The credentials aren't checked.
+type SOCKS struct {
+	// Settings returns the tunnel options of the identities.
+	Settings func() Settings
+	// SAM returns the address of the SAM bridge.
+	SAM        func() string
+	ln         net.Listener
+	mutex      sync.Mutex
+	identities map[string]*socksIdentity
+	counters   socksCounters
+	started    time.Time
+}
+
+// SOCKSStatus is the state of the SOCKS proxy and its connections.
+type SOCKSStatus struct {
+	Addr       string                `json:"addr"`
+	Since      time.Time             `json:"since"`
+	Identities []SOCKSIdentityStatus `json:"identities"`
+	socksCounts
+}
+
+// SOCKSIdentityStatus is the state of one of the SOCKS proxy's identities.
+type SOCKSIdentityStatus struct {
+	// User is the username the identity belongs to, empty for clients which
+	// didn't authenticate.
+	User string `json:"user"`
+	// Base32 is the address of the identity, empty until its tunnels are
+	// built.
+	Base32   string    `json:"base32,omitempty"`
+	LastUsed time.Time `json:"last_used"`
+	Error    string    `json:"error,omitempty"`
+	socksCounts
+}
+
+// socksCounts are the connection statistics of the proxy or an identity.
+type socksCounts struct {
+	// Active is how many streams are open.
+	Active int64 `json:"active"`
+	// Total is how many streams were opened.
+	Total int64 `json:"total"`
+	// Failed is how many requests couldn't be connected.
+	Failed   int64 `json:"failed"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+type socksCounters struct {
+	active, total, failed, in, out int64
+}
+
+func (c *socksCounters) counts() socksCounts {
+	return socksCounts{
+		Active:   atomic.LoadInt64(&c.active),
+		Total:    atomic.LoadInt64(&c.total),
+		Failed:   atomic.LoadInt64(&c.failed),
+		BytesIn:  atomic.LoadInt64(&c.in),
+		BytesOut: atomic.LoadInt64(&c.out),
+	}
+}
+
+// NewSOCKS returns a SOCKS proxy which uses the SAM bridge at the address sam
+// returns, with the tunnel options settings returns.
+func NewSOCKS(settings func() Settings, sam func() string) *SOCKS {
+	return &SOCKS{
+		Settings:   settings,
+		SAM:        sam,
+		identities: make(map[string]*socksIdentity),
+	}
+}
+
+// Listen starts serving the proxy on the address.
+func (s *SOCKS) Listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Listen: %s", err)
+	}
+	s.mutex.Lock()
+	s.ln, s.started = ln, time.Now()
+	s.mutex.Unlock()
+	log.Println("Starting the SOCKS proxy into I2P on", ln.Addr())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the proxy is served on.
+func (s *SOCKS) Addr() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ln == nil {
+		return ""
+	}
+	return s.ln.Addr().String()
+}
+
+// Status returns the statistics of the proxy and its identities.
+func (s *SOCKS) Status() SOCKSStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := SOCKSStatus{Since: s.started, socksCounts: s.counters.counts()}
+	if s.ln != nil {
+		status.Addr = s.ln.Addr().String()
+	}
+	for _, id := range s.identities {
+		status.Identities = append(status.Identities, id.status())
+	}
+	sort.Slice(status.Identities, func(i, j int) bool { return status.Identities[i].User < status.Identities[j].User })
+	return status
+}
+
+// Reset closes the identities, so new streams get new ones with the current
+// settings. Their open streams are closed with them.
+func (s *SOCKS) Reset() {
+	s.mutex.Lock()
+	identities := s.identities
+	s.identities = make(map[string]*socksIdentity)
+	s.mutex.Unlock()
+	for _, id := range identities {
+		id.close()
+	}
+}
+
+// Close stops the proxy and closes its identities.
+func (s *SOCKS) Close() error {
+	s.mutex.Lock()
+	ln := s.ln
+	s.ln = nil
+	s.mutex.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+	s.Reset()
+	return nil
+}
+
+// serve handles a SOCKS5 client: the method negotiation, the optional
+// username and password, and a CONNECT request to an I2P name.
+func (s *SOCKS) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	user, pass, err := s.handshake(conn)
+	if err != nil {
+		log.Println("SOCKS:", err)
+		return
+	}
+	host, code, err := readRequest(conn)
+	if err != nil {
+		log.Println("SOCKS:", err)
+		atomic.AddInt64(&s.counters.failed, 1)
+		if code != socksSucceeded {
+			writeReply(conn, code)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	id, err := s.identity(user, pass)
+	if err != nil {
+		log.Println("SOCKS:", err)
+		atomic.AddInt64(&s.counters.failed, 1)
+		writeReply(conn, socksFailure)
+		return
+	}
+	defer id.release()
+	ctx, cancel := context.WithTimeout(context.Background(), SOCKS_DIAL_TIMEOUT)
+	stream, code, err := id.dial(ctx, host)
+	cancel()
+	if err != nil {
+		log.Println("SOCKS:", err)
+		atomic.AddInt64(&s.counters.failed, 1)
+		atomic.AddInt64(&id.counters.failed, 1)
+		writeReply(conn, code)
+		return
+	}
+	defer stream.Close()
+	if err := writeReply(conn, socksSucceeded); err != nil {
+		return
+	}
+	for _, c := range []*socksCounters{&s.counters, &id.counters} {
+		atomic.AddInt64(&c.active, 1)
+		atomic.AddInt64(&c.total, 1)
+		defer atomic.AddInt64(&c.active, -1)
+	}
+	done := make(chan struct{})
+	go func() {
+		n, _ := io.Copy(stream, conn)
+		atomic.AddInt64(&s.counters.out, n)
+		atomic.AddInt64(&id.counters.out, n)
+		stream.Close()
+		close(done)
+	}()
+	n, _ := io.Copy(conn, stream)
+	atomic.AddInt64(&s.counters.in, n)
+	atomic.AddInt64(&id.counters.in, n)
+	conn.Close()
+	<-done
+}
+
+// handshake negotiates the authentication method and returns the credentials
+// the client sent, if any.
+func (s *SOCKS) handshake(conn net.Conn) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != 5 {
+		return "", "", fmt.Errorf("SOCKS version %d isn't supported", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", err
+	}
+	method := byte(0xff)
+	for _, m := range methods {
+		if m == 0x02 {
+			method = 0x02
+			break
+		}
+		if m == 0x00 && !s.Settings().SOCKSRequireAuth {
+			method = 0x00
+		}
+	}
+	if _, err := conn.Write([]byte{5, method}); err != nil {
+		return "", "", err
+	}
+	switch method {
+	case 0x00:
+		return "", "", nil
+	case 0x02:
+		return readCredentials(conn)
+	}
+	return "", "", fmt.Errorf("the client offered no acceptable authentication method")
+}
+
+// readCredentials reads a username and password request, RFC 1929, and
+// accepts it.
+func readCredentials(conn net.Conn) (string, string, error) {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return "", "", err
+	}
+	if version[0] != 1 {
+		return "", "", fmt.Errorf("username and password version %d isn't supported", version[0])
+	}
+	var fields [2]string
+	for i := range fields {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", "", err
+		}
+		field := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, field); err != nil {
+			return "", "", err
+		}
+		fields[i] = string(field)
+	}
+	if _, err := conn.Write([]byte{1, 0}); err != nil {
+		return "", "", err
+	}
+	return fields[0], fields[1], nil
+}
+
+// readRequest reads a request and returns the I2P host it asks to connect
+// to, or the reply it has to be refused with.
+func readRequest(conn net.Conn) (string, byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", socksSucceeded, err
+	}
+	if header[0] != 5 {
+		return "", socksSucceeded, fmt.Errorf("SOCKS version %d isn't supported", header[0])
+	}
+	var host string
+	switch header[3] {
+	case 0x01, 0x04:
+		size := net.IPv4len
+		if header[3] == 0x04 {
+			size = net.IPv6len
+		}
+		addr := make([]byte, size+2)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", socksSucceeded, err
+		}
+		return "", socksAddressUnsupported, fmt.Errorf("%s is an IP address, only I2P names can be reached", net.IP(addr[:size]))
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", socksSucceeded, err
+		}
+		name := make([]byte, int(length[0])+2)
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", socksSucceeded, err
+		}
+		port := binary.BigEndian.Uint16(name[length[0]:])
+		host = net.JoinHostPort(strings.ToLower(string(name[:length[0]])), strconv.Itoa(int(port)))
+	default:
+		return "", socksAddressUnsupported, fmt.Errorf("address type %d isn't supported", header[3])
+	}
+	if header[1] != 0x01 {
+		return "", socksCommandUnsupported, fmt.Errorf("command %d to %s isn't supported, only CONNECT is", header[1], host)
+	}
+	if name, _, _ := net.SplitHostPort(host); !strings.HasSuffix(name, ".i2p") {
+		return "", socksNotAllowed, fmt.Errorf("%s isn't an I2P name", name)
+	}
+	return host, socksSucceeded, nil
+}
+
+// writeReply sends a reply with an empty bound address.
+func writeReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// identity returns the identity of the credentials, creating it if it doesn't
+// exist. It is counted as in use before s.mutex is released, so it can't be
+// closed to make room for another before the caller is done with it and
+// calls its release.
+func (s *SOCKS) identity(user, pass string) (*socksIdentity, error) {
+	key := user + "\x00" + pass
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if id, ok := s.identities[key]; ok && !id.failed() {
+		id.touch()
+		atomic.AddInt64(&id.users, 1)
+		return id, nil
+	}
+	delete(s.identities, key)
+	if len(s.identities) >= SOCKS_MAX_IDENTITIES {
+		var idlest string
+		var last time.Time
+		for k, id := range s.identities {
+			if atomic.LoadInt64(&id.users) > 0 {
+				continue
+			}
+			if used := id.lastUsed(); idlest == "" || used.Before(last) {
+				idlest, last = k, used
+			}
+		}
+		if idlest == "" {
+			return nil, fmt.Errorf("all %d SOCKS identities are in use", SOCKS_MAX_IDENTITIES)
+		}
+		go s.identities[idlest].close()
+		delete(s.identities, idlest)
+	}
+	id := &socksIdentity{user: user, ready: make(chan struct{}), used: time.Now(), users: 1}
+	s.identities[key] = id
+	settings := s.Settings()
+	go id.open(s.SAM(), settings.SAMOptions())
+	return id, nil
+}
+
+// socksIdentity is the SAM stream session of a credential.
+type socksIdentity struct {
+	// users is how many clients are using or waiting for the identity. It
+	// is only incremented under the SOCKS proxy's mutex.
+	users    int64
+	user     string
+	ready    chan struct{}
+	session  *sam3.StreamSession
+	err      error
+	counters socksCounters
+	mutex    sync.Mutex
+	used     time.Time
+	closed   bool
+}
+
+// open creates the identity's session and builds its tunnels.
+func (id *socksIdentity) open(addr string, options []string) {
+	defer close(id.ready)
+	sam, err := sam3.NewSAM(addr)
+	if err != nil {
+		id.fail(err)
+		return
+	}
+	// sam3 replaces the bridge's address with the default one, which the
+	// session would then dial its streams and lookups from.
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		sam.Config.I2PConfig.SamHost, sam.Config.I2PConfig.SamPort = host, port
+	}
+	keys, err := sam.NewKeys()
+	if err != nil {
+		sam.Close()
+		id.fail(err)
+		return
+	}
+	session, err := sam.NewStreamSession("tor-manager-socks-"+sam3.RandString(), keys, options)
+	if err != nil {
+		sam.Close()
+		id.fail(err)
+		return
+	}
+	id.mutex.Lock()
+	defer id.mutex.Unlock()
+	if id.closed {
+		session.Close()
+		id.err = fmt.Errorf("the identity was closed")
+		return
+	}
+	id.session = session
+	log.Println("SOCKS: the identity of", id.label(), "is", session.Addr().Base32())
+}
+
+func (id *socksIdentity) fail(err error) {
+	id.mutex.Lock()
+	id.err = fmt.Errorf("couldn't create the identity of %s: %s", id.label(), err)
+	id.mutex.Unlock()
+}
+
+// failed returns true if the identity couldn't be created, so that the next
+// stream tries again.
+func (id *socksIdentity) failed() bool {
+	select {
+	case <-id.ready:
+	default:
+		return false
+	}
+	id.mutex.Lock()
+	defer id.mutex.Unlock()
+	return id.session == nil && id.err != nil
+}
+
+func (id *socksIdentity) label() string {
+	if id.user == "" {
+		return "unauthenticated clients"
+	}
+	return fmt.Sprintf("%q", id.user)
+}
+
+// release marks the identity as no longer used by a client which got it from
+// SOCKS.identity.
+func (id *socksIdentity) release() {
+	atomic.AddInt64(&id.users, -1)
+}
+
+func (id *socksIdentity) touch() {
+	id.mutex.Lock()
+	id.used = time.Now()
+	id.mutex.Unlock()
+}
+
+func (id *socksIdentity) lastUsed() time.Time {
+	id.mutex.Lock()
+	defer id.mutex.Unlock()
+	return id.used
+}
+
+// dial waits for the identity's tunnels and connects a stream to the host,
+// returning the reply to send if it can't.
+func (id *socksIdentity) dial(ctx context.Context, host string) (net.Conn, byte, error) {
+	select {
+	case <-id.ready:
+	case <-ctx.Done():
+		return nil, socksTTLExpired, fmt.Errorf("the identity of %s isn't ready: %s", id.label(), ctx.Err())
+	}
+	id.mutex.Lock()
+	session, err := id.session, id.err
+	id.mutex.Unlock()
+	if session == nil {
+		if err == nil {
+			err = fmt.Errorf("the identity of %s was closed", id.label())
+		}
+		return nil, socksFailure, err
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := session.Dial("tcp", host)
+		results <- result{conn, err}
+	}()
+	select {
+	case r := <-results:
+		if r.err != nil {
+			return nil, socksHostUnreachable, fmt.Errorf("couldn't reach %s: %s", host, r.err)
+		}
+		return r.conn, socksSucceeded, nil
+	case <-ctx.Done():
+		go func() {
+			if r := <-results; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, socksTTLExpired, fmt.Errorf("couldn't reach %s: %s", host, ctx.Err())
+	}
+}
+
+func (id *socksIdentity) close() {
+	id.mutex.Lock()
+	session := id.session
+	id.session, id.closed = nil, true
+	id.mutex.Unlock()
+	if session != nil {
+		session.Close()
+	}
+}
+
+func (id *socksIdentity) status() SOCKSIdentityStatus {
+	id.mutex.Lock()
+	defer id.mutex.Unlock()
+	status := SOCKSIdentityStatus{User: id.user, LastUsed: id.used, socksCounts: id.counters.counts()}
+	if id.session != nil {
+		status.Base32 = id.session.Addr().Base32()
+	}
+	if id.err != nil {
+		status.Error = id.err.Error()
+	}
+	return status
+}
@@ -0,0 +1,408 @@
+package tbproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// i2pBase64 is the base64 alphabet of I2P destinations.
+var i2pBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+
+// fakeSAM is a SAM bridge which answers HELLO, DEST GENERATE, SESSION CREATE,
+// NAMING LOOKUP and STREAM CONNECT. Connected streams echo what they are sent.
+type fakeSAM struct {
+	ln net.Listener
+	// names are the destinations NAMING LOOKUP resolves.
+	names map[string]string
+
+	mutex sync.Mutex
+	// sessions are the IDs of the sessions which were created.
+	sessions []string
+	// streams are the sessions the streams were connected from, by the
+	// destination they were connected to.
+	streams map[string][]string
+	lookups []string
+}
+
+func newFakeSAM(t *testing.T) *fakeSAM {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sam := &fakeSAM{ln: ln, names: make(map[string]string), streams: make(map[string][]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go sam.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return sam
+}
+
+// destination returns a random destination.
+func destination() string {
+	b := make([]byte, 387)
+	rand.Read(b)
+	return i2pBase64.EncodeToString(b)
+}
+
+// fields returns the KEY=VALUE pairs of a SAM command.
+func fields(line string) map[string]string {
+	values := make(map[string]string)
+	for _, field := range strings.Fields(line) {
+		if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+			values[kv[0]] = kv[1]
+		}
+	}
+	return values
+}
+
+func (sam *fakeSAM) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		values := fields(line)
+		switch {
+		case strings.HasPrefix(line, "HELLO VERSION"):
+			io.WriteString(conn, "HELLO REPLY RESULT=OK VERSION=3.1\n")
+		case strings.HasPrefix(line, "DEST GENERATE"):
+			pub := destination()
+			io.WriteString(conn, "DEST REPLY PUB="+pub+" PRIV="+pub+destination()+"\n")
+		case strings.HasPrefix(line, "SESSION CREATE"):
+			sam.mutex.Lock()
+			sam.sessions = append(sam.sessions, values["ID"])
+			sam.mutex.Unlock()
+			io.WriteString(conn, "SESSION STATUS RESULT=OK DESTINATION="+values["DESTINATION"]+"\n")
+		case strings.HasPrefix(line, "NAMING LOOKUP"):
+			name := values["NAME"]
+			sam.mutex.Lock()
+			sam.lookups = append(sam.lookups, name)
+			dest, ok := sam.names[name]
+			sam.mutex.Unlock()
+			if !ok {
+				io.WriteString(conn, "NAMING REPLY RESULT=KEY_NOT_FOUND NAME="+name+"\n")
+				continue
+			}
+			io.WriteString(conn, "NAMING REPLY RESULT=OK NAME="+name+" VALUE="+dest+"\n")
+		case strings.HasPrefix(line, "STREAM CONNECT"):
+			sam.mutex.Lock()
+			sam.streams[values["DESTINATION"]] = append(sam.streams[values["DESTINATION"]], values["ID"])
+			sam.mutex.Unlock()
+			io.WriteString(conn, "STREAM STATUS RESULT=OK\n")
+			io.Copy(conn, r)
+			return
+		default:
+			return
+		}
+	}
+}
+
+// sessionsOf returns the sessions which connected streams to the destination.
+func (sam *fakeSAM) sessionsOf(dest string) []string {
+	sam.mutex.Lock()
+	defer sam.mutex.Unlock()
+	return append([]string{}, sam.streams[dest]...)
+}
+
+func (sam *fakeSAM) sessionCount() int {
+	sam.mutex.Lock()
+	defer sam.mutex.Unlock()
+	return len(sam.sessions)
+}
+
+// newTestSOCKS returns a SOCKS proxy on loopback using the bridge, with the
+// settings changed by change.
+func newTestSOCKS(t *testing.T, sam *fakeSAM, change func(s *Settings)) *SOCKS {
+	t.Helper()
+	settings := DefaultSettings()
+	if change != nil {
+		change(&settings)
+	}
+	s := NewSOCKS(func() Settings { return settings }, func() string { return sam.ln.Addr().String() })
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// socksClient greets the proxy, with the credentials if user isn't empty, and
+// returns the connection and the method the proxy picked.
+func socksClient(t *testing.T, s *SOCKS, user, pass string) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	greeting := []byte{5, 1, 0}
+	if user != "" {
+		greeting = []byte{5, 1, 2}
+	}
+	conn.Write(greeting)
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] == 2 {
+		request := append([]byte{1, byte(len(user))}, user...)
+		request = append(append(request, byte(len(pass))), pass...)
+		conn.Write(request)
+		status := make([]byte, 2)
+		if _, err := io.ReadFull(conn, status); err != nil {
+			t.Fatal(err)
+		}
+		if status[1] != 0 {
+			t.Fatalf("credentials refused with %d", status[1])
+		}
+	}
+	return conn, reply[1]
+}
+
+// connect sends a CONNECT request of the address type with the address and
+// returns the proxy's reply code.
+func connect(t *testing.T, conn net.Conn, command, atyp byte, addr []byte, port uint16) byte {
+	t.Helper()
+	request := []byte{5, command, 0, atyp}
+	if atyp == 0x03 {
+		request = append(request, byte(len(addr)))
+	}
+	request = append(request, addr...)
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], port)
+	conn.Write(request)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+// echo checks that what is sent through the stream comes back.
+func echo(t *testing.T, conn net.Conn, message string) {
+	t.Helper()
+	conn.Write([]byte(message))
+	back := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, back); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(back, []byte(message)) {
+		t.Errorf("echoed %q, want %q", back, message)
+	}
+}
+
+func TestSOCKSHandshake(t *testing.T) {
+	sam := newFakeSAM(t)
+	site := destination()
+	sam.names["site.i2p"] = site
+	s := newTestSOCKS(t, sam, nil)
+
+	conn, method := socksClient(t, s, "", "")
+	if method != 0 {
+		t.Fatalf("method %d, want no authentication", method)
+	}
+	if code := connect(t, conn, 1, 0x03, []byte("Site.I2P"), 80); code != socksSucceeded {
+		t.Fatalf("CONNECT answered %d", code)
+	}
+	echo(t, conn, "GET / HTTP/1.0\r\n\r\n")
+	if sessions := sam.sessionsOf(site); len(sessions) != 1 {
+		t.Errorf("%d streams to site.i2p, want 1", len(sessions))
+	}
+	sam.mutex.Lock()
+	lookups := strings.Join(sam.lookups, ",")
+	sam.mutex.Unlock()
+	if lookups != "site.i2p" {
+		t.Errorf("looked up %q, want the lowercased site.i2p", lookups)
+	}
+
+	conn, _ = socksClient(t, s, "", "")
+	if code := connect(t, conn, 1, 0x03, []byte("missing.i2p"), 80); code != socksHostUnreachable {
+		t.Errorf("CONNECT to an unknown name answered %d, want %d", code, socksHostUnreachable)
+	}
+}
+
+func TestSOCKSRequireAuth(t *testing.T) {
+	sam := newFakeSAM(t)
+	s := newTestSOCKS(t, sam, func(s *Settings) { s.SOCKSRequireAuth = true })
+	if _, method := socksClient(t, s, "", ""); method != 0xff {
+		t.Errorf("method %d for a client without credentials, want 0xff", method)
+	}
+	if _, method := socksClient(t, s, "user", "pass"); method != 2 {
+		t.Errorf("method %d for a client with credentials, want 2", method)
+	}
+}
+
+func TestSOCKSIsolation(t *testing.T) {
+	sam := newFakeSAM(t)
+	site := destination()
+	sam.names["site.i2p"] = site
+	s := newTestSOCKS(t, sam, nil)
+
+	for _, c := range []struct{ user, pass string }{
+		{"alice", "one"},
+		{"bob", "one"},
+		{"alice", "one"},
+		{"alice", "two"},
+	} {
+		conn, _ := socksClient(t, s, c.user, c.pass)
+		if code := connect(t, conn, 1, 0x03, []byte("site.i2p"), 80); code != socksSucceeded {
+			t.Fatalf("CONNECT as %s:%s answered %d", c.user, c.pass, code)
+		}
+		echo(t, conn, c.user)
+	}
+	sessions := sam.sessionsOf(site)
+	if len(sessions) != 4 {
+		t.Fatalf("%d streams, want 4", len(sessions))
+	}
+	if sessions[0] != sessions[2] {
+		t.Errorf("the same credentials used sessions %s and %s", sessions[0], sessions[2])
+	}
+	for _, i := range []int{1, 3} {
+		if sessions[i] == sessions[0] {
+			t.Errorf("stream %d shared session %s with other credentials", i, sessions[i])
+		}
+	}
+	if sessions[1] == sessions[3] {
+		t.Errorf("other credentials shared session %s", sessions[1])
+	}
+	if n := sam.sessionCount(); n != 3 {
+		t.Errorf("%d sessions created, want 3", n)
+	}
+}
+
+func TestSOCKSRefusals(t *testing.T) {
+	sam := newFakeSAM(t)
+	s := newTestSOCKS(t, sam, nil)
+	for _, c := range []struct {
+		name    string
+		command byte
+		atyp    byte
+		addr    []byte
+		code    byte
+	}{
+		{"IPv4", 1, 0x01, net.ParseIP("192.0.2.1").To4(), socksAddressUnsupported},
+		{"IPv6", 1, 0x04, net.ParseIP("2001:db8::1"), socksAddressUnsupported},
+		{"clearnet name", 1, 0x03, []byte("example.com"), socksNotAllowed},
+		{"onion", 1, 0x03, []byte("example.onion"), socksNotAllowed},
+		{"BIND", 2, 0x03, []byte("site.i2p"), socksCommandUnsupported},
+	} {
+		conn, _ := socksClient(t, s, "", "")
+		if code := connect(t, conn, c.command, c.atyp, c.addr, 80); code != c.code {
+			t.Errorf("%s answered %d, want %d", c.name, code, c.code)
+		}
+	}
+	if n := sam.sessionCount(); n != 0 {
+		t.Errorf("refused requests created %d sessions", n)
+	}
+	if failed := s.Status().Failed; failed != 5 {
+		t.Errorf("%d failed requests counted, want 5", failed)
+	}
+}
+
+func TestSOCKSStats(t *testing.T) {
+	sam := newFakeSAM(t)
+	sam.names["site.i2p"] = destination()
+	s := newTestSOCKS(t, sam, nil)
+
+	conn, _ := socksClient(t, s, "alice", "pass")
+	if code := connect(t, conn, 1, 0x03, []byte("site.i2p"), 80); code != socksSucceeded {
+		t.Fatalf("CONNECT answered %d", code)
+	}
+	echo(t, conn, "hello")
+	status := s.Status()
+	if status.Active != 1 || status.Total != 1 {
+		t.Errorf("%d active and %d total streams while open, want 1 and 1", status.Active, status.Total)
+	}
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Status().Active != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status = s.Status()
+	if status.Active != 0 || status.Total != 1 || status.Failed != 0 {
+		t.Errorf("counts %+v after closing, want 0 active, 1 total and 0 failed", status.socksCounts)
+	}
+	if status.BytesIn != 5 || status.BytesOut != 5 {
+		t.Errorf("%d bytes in and %d out, want 5 and 5", status.BytesIn, status.BytesOut)
+	}
+	if len(status.Identities) != 1 || status.Identities[0].User != "alice" || status.Identities[0].Total != 1 {
+		t.Errorf("identities %+v, want alice with 1 stream", status.Identities)
+	}
+	if status.Identities[0].Base32 == "" {
+		t.Error("alice's identity has no address")
+	}
+}
+
+func TestSOCKSIdentityLimit(t *testing.T) {
+	max := SOCKS_MAX_IDENTITIES
+	SOCKS_MAX_IDENTITIES = 1
+	defer func() { SOCKS_MAX_IDENTITIES = max }()
+	sam := newFakeSAM(t)
+	sam.names["site.i2p"] = destination()
+	s := newTestSOCKS(t, sam, nil)
+
+	// An identity which is still being created is in use, and isn't closed to
+	// make room for another.
+	alice, err := s.identity("alice", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.identity("bob", "pass"); err == nil {
+		t.Fatal("closed an identity in use to make room for another")
+	}
+	alice.release()
+	bob, err := s.identity("bob", "pass")
+	if err != nil {
+		t.Fatalf("an idle identity wasn't closed to make room: %s", err)
+	}
+	bob.release()
+
+	conn, _ := socksClient(t, s, "bob", "pass")
+	if code := connect(t, conn, 1, 0x03, []byte("site.i2p"), 80); code != socksSucceeded {
+		t.Fatalf("CONNECT answered %d", code)
+	}
+	echo(t, conn, "bob")
+	other, _ := socksClient(t, s, "carol", "pass")
+	if code := connect(t, other, 1, 0x03, []byte("site.i2p"), 80); code != socksFailure {
+		t.Errorf("CONNECT while every identity is in use answered %d, want %d", code, socksFailure)
+	}
+}
+
+func TestValidateSOCKSAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"":               true,
+		"127.0.0.1:4446": true,
+		"[::1]:4446":     true,
+		"localhost:4446": true,
+		":4446":          false,
+		"0.0.0.0:4446":   false,
+		"192.0.2.1:4446": false,
+		"127.0.0.1":      false,
+	} {
+		s := DefaultSettings()
+		s.SOCKSAddr = addr
+		if err := s.Validate(); (err == nil) != ok {
+			t.Errorf("Validate with SOCKSAddr %q: %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Package tbready checks whether the services tor-manager depends on are up,
+// by speaking their protocols rather than by checking whether their ports can
+// be bound. Probes take a context, and Wait retries them with backoff until
+// they succeed or the context is done.
+package tbready
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MinBackoff and MaxBackoff bound the time Wait waits between attempts. It
+// starts at MinBackoff and doubles up to MaxBackoff.
+var (
+	MinBackoff = 250 * time.Millisecond
+	MaxBackoff = 5 * time.Second
+)
+
+// Probe checks whether a service is ready, returning nil if it is.
+type Probe func(ctx context.Context) error
+
+// Wait runs the probe until it succeeds, backing off between attempts, and
+// returns nil. If the context is done first, it returns the probe's last error.
+func Wait(ctx context.Context, probe Probe) error {
+	backoff := MinBackoff
+	for {
+		err := probe(ctx)
+		if err == nil {
+			return nil
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("Wait: %s: %s", ctx.Err(), err)
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > MaxBackoff {
+			backoff = MaxBackoff
+		}
+	}
+}
+
+// WaitTimeout runs Wait with a context which is done after the timeout.
+func WaitTimeout(timeout time.Duration, probe Probe) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return Wait(ctx, probe)
+}
+
+// Check runs the probe once, giving up after the timeout.
+func Check(timeout time.Duration, probe Probe) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return probe(ctx)
+}
+
+// dial connects to addr, with the connection's deadline set from the context.
+func dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// Listening returns a probe which succeeds if something accepts connections
+// at addr. It is for services without a protocol of their own to check.
+func Listening(addr string) Probe {
+	return func(ctx context.Context) error {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return fmt.Errorf("Listening: %s", err)
+		}
+		return conn.Close()
+	}
+}
+
+// HTTPProxy returns a probe which asks the I2P HTTP proxy at addr for
+// http://proxy.i2p/, which the proxy answers itself once it is running. The
+// attempts share one transport, which keeps no idle connections.
+func HTTPProxy(addr string) Probe {
+	proxyURL, perr := url.Parse("http://" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+	return func(ctx context.Context) error {
+		if perr != nil {
+			return fmt.Errorf("HTTPProxy: %s", perr)
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://proxy.i2p/", nil)
+		if err != nil {
+			return fmt.Errorf("HTTPProxy: %s", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("HTTPProxy: %s", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return fmt.Errorf("HTTPProxy: %s", err)
+		}
+		if !strings.Contains(string(body), "I2P HTTP proxy OK") {
+			return fmt.Errorf("HTTPProxy: %s is not an I2P HTTP proxy, or isn't ready", addr)
+		}
+		return nil
+	}
+}
+
+// SOCKS returns a probe which greets the SOCKS5 proxy at addr and checks it
+// accepts connections without authentication.
+func SOCKS(addr string) Probe {
+	return func(ctx context.Context) error {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return fmt.Errorf("SOCKS: %s", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+			return fmt.Errorf("SOCKS: %s", err)
+		}
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("SOCKS: %s", err)
+		}
+		if reply[0] != 5 || reply[1] != 0 {
+			return fmt.Errorf("SOCKS: %s refused the greeting with %x", addr, reply)
+		}
+		return nil
+	}
+}
+
+// SAM returns a probe which says HELLO to the SAM bridge at addr.
+func SAM(addr string) Probe {
+	return func(ctx context.Context) error {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return fmt.Errorf("SAM: %s", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("HELLO VERSION MIN=3.0 MAX=3.3\n")); err != nil {
+			return fmt.Errorf("SAM: %s", err)
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("SAM: %s", err)
+		}
+		if !strings.HasPrefix(line, "HELLO REPLY") || !strings.Contains(line, "RESULT=OK") {
+			return fmt.Errorf("SAM: %s answered %s", addr, strings.TrimSpace(line))
+		}
+		return nil
+	}
+}
+
+// I2PControl returns a probe which sends a JSON-RPC request to the i2pcontrol
+// API at the URL. Any JSON-RPC response means the API is up, even one asking
+// for authentication. The I2PControl plugin's certificate is self-signed, so
+// it isn't checked. The attempts share one transport, which keeps no idle
+// connections.
+func I2PControl(apiURL string) Probe {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}}
+	return func(ctx context.Context) error {
+		body := []byte(`{"id":1,"jsonrpc":"2.0","method":"Echo","params":{"Echo":"ready"}}`)
+		req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("I2PControl: %s", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("I2PControl: %s", err)
+		}
+		defer resp.Body.Close()
+		var reply struct {
+			JSONRPC string `json:"jsonrpc"`
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&reply); err != nil || reply.JSONRPC == "" {
+			return fmt.Errorf("I2PControl: %s is not a JSON-RPC API, or isn't ready (%s)", apiURL, resp.Status)
+		}
+		return nil
+	}
+}
+
+// TorControl returns a probe which asks the Tor control port at addr for
+// PROTOCOLINFO, which Tor answers before authentication.
+func TorControl(addr string) Probe {
+	return func(ctx context.Context) error {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return fmt.Errorf("TorControl: %s", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("PROTOCOLINFO 1\r\n")); err != nil {
+			return fmt.Errorf("TorControl: %s", err)
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("TorControl: %s", err)
+		}
+		if !strings.HasPrefix(line, "250") {
+			return fmt.Errorf("TorControl: %s answered %s", addr, strings.TrimSpace(line))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,434 @@
+package tbrouter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
+	tbready "i2pgit.org/idk/i2p.plugins.tor-manager/ready"
+)
+
+// Daemon is a router which can be started and stopped, like the jpackage
+// router embedded in tor-manager.
+type Daemon interface {
+	Start() error
+	Stop() error
+}
+
+// The states of the embedded router.
+const (
+	StateStopped    = "stopped"
+	StateStarting   = "starting"
+	StateRunning    = "running"
+	StateUnhealthy  = "unhealthy"
+	StateRestarting = "restarting"
+)
+
+// Embedded runs the embedded router as a supervised service. It checks the
+// router's HTTP proxy and SAM bridge, and restarts it with backoff when they
+// stop answering or it fails to start.
+type Embedded struct {
+	// Dir is the router's own directory, which it is unpacked into and keeps
+	// its configuration in.
+	Dir string
+	// LogPath is the log of the router's starts, health checks and restarts,
+	// and of what the router logs itself.
+	LogPath string
+	// NewDaemon creates the router in dir.
+	NewDaemon func(dir string) (Daemon, error)
+	// StartTimeout is how long a started router has to become healthy.
+	StartTimeout time.Duration
+	// CheckInterval is how often a healthy router is checked.
+	CheckInterval time.Duration
+	// MaxFailures is how many checks in a row may fail before the router is
+	// restarted.
+	MaxFailures int
+	// MinBackoff and MaxBackoff bound the wait before a restart. It doubles
+	// every time the router fails without having been healthy for MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mutex sync.Mutex
+	// lifecycle serializes Start and Stop, so a router isn't started while
+	// the previous one is being stopped.
+	lifecycle sync.Mutex
+	status    EmbeddedStatus
+	healthy   chan struct{}
+	cancel    context.CancelFunc
+	done      chan struct{}
+	logger    *log.Logger
+	logFile   *os.File
+	logMutex  sync.Mutex
+}
+
+// EmbeddedStatus is the state of the embedded router.
+type EmbeddedStatus struct {
+	State string `json:"state"`
+	// Since is when the router entered the state.
+	Since    time.Time `json:"since"`
+	Restarts int       `json:"restarts"`
+	// Error is why the router was last restarted.
+	Error string `json:"error,omitempty"`
+	Dir   string `json:"dir"`
+	Log   string `json:"log"`
+}
+
+// NewEmbedded returns a stopped Embedded router in dir, which logs to logPath
+// and creates the router with newDaemon.
+func NewEmbedded(dir, logPath string, newDaemon func(dir string) (Daemon, error)) *Embedded {
+	return &Embedded{
+		Dir:           dir,
+		LogPath:       logPath,
+		NewDaemon:     newDaemon,
+		StartTimeout:  3 * time.Minute,
+		CheckInterval: 30 * time.Second,
+		MaxFailures:   3,
+		MinBackoff:    5 * time.Second,
+		MaxBackoff:    5 * time.Minute,
+		status:        EmbeddedStatus{State: StateStopped},
+	}
+}
+
+// Router returns the endpoints the embedded router is configured with.
+func (e *Embedded) Router() *tbdiscover.Router {
+	return tbdiscover.Read(e.Dir)
+}
+
+// Status returns the state of the embedded router.
+func (e *Embedded) Status() EmbeddedStatus {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	status := e.status
+	status.Dir, status.Log = e.Dir, e.LogPath
+	return status
+}
+
+// Running returns true if the embedded router is supervised, whatever its
+// state.
+func (e *Embedded) Running() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.cancel != nil
+}
+
+// Start starts supervising the embedded router, unless it is already.
+func (e *Embedded) Start() error {
+	e.lifecycle.Lock()
+	defer e.lifecycle.Unlock()
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.cancel != nil {
+		return nil
+	}
+	if err := os.MkdirAll(e.Dir, 0755); err != nil {
+		return fmt.Errorf("Start: %s", err)
+	}
+	if err := e.openLog(); err != nil {
+		return fmt.Errorf("Start: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	e.done = make(chan struct{})
+	e.healthy = make(chan struct{})
+	go e.supervise(ctx, e.done)
+	return nil
+}
+
+// Stop stops the embedded router and waits until it has.
+func (e *Embedded) Stop() error {
+	e.lifecycle.Lock()
+	defer e.lifecycle.Unlock()
+	e.mutex.Lock()
+	cancel, done := e.cancel, e.done
+	e.mutex.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	<-done
+	e.mutex.Lock()
+	stopped := e.done == done
+	if stopped {
+		e.cancel = nil
+	}
+	e.mutex.Unlock()
+	if stopped {
+		e.closeLog()
+	}
+	return nil
+}
+
+// WaitHealthy waits until the router's HTTP proxy and SAM bridge answer for
+// the first time since Start, or the context is done.
+func (e *Embedded) WaitHealthy(ctx context.Context) error {
+	e.mutex.Lock()
+	healthy := e.healthy
+	e.mutex.Unlock()
+	if healthy == nil {
+		return fmt.Errorf("WaitHealthy: the embedded router isn't running")
+	}
+	select {
+	case <-healthy:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("WaitHealthy: %s", ctx.Err())
+	}
+}
+
+// openLog opens the log, keeping the previous one as LogPath.1.
+func (e *Embedded) openLog() error {
+	e.logMutex.Lock()
+	defer e.logMutex.Unlock()
+	if e.LogPath == "" {
+		e.logger = log.New(io.Discard, "", 0)
+		return nil
+	}
+	if _, err := os.Stat(e.LogPath); err == nil {
+		os.Rename(e.LogPath, e.LogPath+".1")
+	}
+	if err := os.MkdirAll(filepath.Dir(e.LogPath), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(e.LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	e.logFile = file
+	e.logger = log.New(io.MultiWriter(file, log.Writer()), "i2p router: ", log.LstdFlags)
+	return nil
+}
+
+func (e *Embedded) closeLog() {
+	e.logMutex.Lock()
+	defer e.logMutex.Unlock()
+	if e.logFile != nil {
+		e.logFile.Close()
+		e.logFile = nil
+	}
+}
+
+// logOutput writes what the router logged itself to the log file only, it
+// would drown out tor-manager's own output.
+func (e *Embedded) logOutput(line string) {
+	e.logMutex.Lock()
+	defer e.logMutex.Unlock()
+	if e.logFile != nil {
+		fmt.Fprintf(e.logFile, "i2p router output: %s %s\n", time.Now().Format("2006/01/02 15:04:05"), line)
+	}
+}
+
+func (e *Embedded) logf(format string, args ...interface{}) {
+	e.logMutex.Lock()
+	defer e.logMutex.Unlock()
+	if e.logger != nil {
+		e.logger.Printf(format, args...)
+	}
+}
+
+func (e *Embedded) setState(state string, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.status.State != state {
+		e.status.State = state
+		e.status.Since = time.Now()
+	}
+	if state == StateRestarting {
+		e.status.Restarts++
+	}
+	if err != nil {
+		e.status.Error = err.Error()
+	}
+}
+
+// check returns nil if the router's HTTP proxy and, if it is enabled, its SAM
+// bridge answer.
+func (e *Embedded) check(ctx context.Context) error {
+	router := e.Router()
+	if err := tbready.HTTPProxy(router.HTTPProxy.Addr())(ctx); err != nil {
+		return err
+	}
+	if router.SAM.Enabled {
+		return tbready.SAM(router.SAM.Addr())(ctx)
+	}
+	return nil
+}
+
+// supervise runs the router until the context is done, restarting it with
+// backoff whenever it fails.
+func (e *Embedded) supervise(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	backoff := e.MinBackoff
+	for {
+		healthyFor, err := e.run(ctx)
+		if ctx.Err() != nil {
+			e.setState(StateStopped, nil)
+			e.logf("stopped")
+			return
+		}
+		if healthyFor >= e.MaxBackoff {
+			backoff = e.MinBackoff
+		}
+		e.setState(StateRestarting, err)
+		e.logf("%s, restarting in %s", err, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			e.setState(StateStopped, nil)
+			e.logf("stopped")
+			return
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > e.MaxBackoff {
+			backoff = e.MaxBackoff
+		}
+	}
+}
+
+// run starts the router and checks it until it fails or the context is
+// done, then stops it. It returns how long the router was healthy and why it
+// failed.
+func (e *Embedded) run(ctx context.Context) (time.Duration, error) {
+	e.setState(StateStarting, nil)
+	e.logf("starting in %s", e.Dir)
+	daemon, err := e.NewDaemon(e.Dir)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't create the router: %s", err)
+	}
+	if err := daemon.Start(); err != nil {
+		return 0, fmt.Errorf("couldn't start the router: %s", err)
+	}
+	followCtx, stopFollowing := context.WithCancel(ctx)
+	following := make(chan struct{})
+	go e.follow(followCtx, following)
+	defer func() {
+		if err := daemon.Stop(); err != nil {
+			e.logf("couldn't stop the router: %s", err)
+		}
+		stopFollowing()
+		<-following
+	}()
+	startCtx, cancel := context.WithTimeout(ctx, e.StartTimeout)
+	err = tbready.Wait(startCtx, e.check)
+	cancel()
+	if err != nil {
+		return 0, fmt.Errorf("the router didn't become healthy: %s", err)
+	}
+	started := time.Now()
+	e.setState(StateRunning, nil)
+	e.logf("healthy, HTTP proxy on %s, SAM on %s", e.Router().HTTPProxy.Addr(), e.Router().SAM.Addr())
+	e.mutex.Lock()
+	select {
+	case <-e.healthy:
+	default:
+		close(e.healthy)
+	}
+	e.mutex.Unlock()
+	ticker := time.NewTicker(e.CheckInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return time.Since(started), ctx.Err()
+		case <-ticker.C:
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, e.CheckInterval)
+		err := e.check(checkCtx)
+		cancel()
+		if err == nil {
+			if failures > 0 {
+				e.logf("healthy again")
+				e.setState(StateRunning, nil)
+			}
+			failures = 0
+			continue
+		}
+		failures++
+		e.setState(StateUnhealthy, err)
+		e.logf("health check %d of %d failed: %s", failures, e.MaxFailures, err)
+		if failures >= e.MaxFailures {
+			return time.Since(started), fmt.Errorf("the router failed %d health checks: %s", failures, err)
+		}
+	}
+}
+
+// ROUTER_LOGS are the logs the router writes in its directory, which are
+// followed into the router's log.
+var ROUTER_LOGS = []string{"wrapper.log", filepath.Join("logs", "log-router-*.txt")}
+
+// follow copies what the router appends to ROUTER_LOGS to the log, until the
+// context is done, then closes followed. Only what is written after it starts
+// is copied, and logs which are rotated are followed from their start.
+func (e *Embedded) follow(ctx context.Context, followed chan struct{}) {
+	defer close(followed)
+	offsets := make(map[string]int64)
+	read := func(initial bool) {
+		for _, pattern := range ROUTER_LOGS {
+			paths, _ := filepath.Glob(filepath.Join(e.Dir, pattern))
+			for _, path := range paths {
+				info, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+				if initial {
+					offsets[path] = info.Size()
+					continue
+				}
+				offset := offsets[path]
+				if info.Size() < offset {
+					// The log was rotated.
+					offset = 0
+				}
+				offsets[path] = e.copyOutput(path, offset)
+			}
+		}
+	}
+	read(true)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			read(false)
+			return
+		case <-ticker.C:
+			read(false)
+		}
+	}
+}
+
+// copyOutput writes the complete lines of the file after offset to the log,
+// and returns the offset after the last of them.
+func (e *Embedded) copyOutput(path string, offset int64) int64 {
+	file, err := os.Open(path)
+	if err != nil {
+		return offset
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return offset
+	}
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		return offset
+	}
+	for _, line := range strings.Split(string(data[:end]), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			e.logOutput(line)
+		}
+	}
+	return offset + int64(end) + 1
+}
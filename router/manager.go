@@ -0,0 +1,243 @@
+// Package tbrouter decides which I2P router tor-manager uses: a router
+// installed on the system, the router embedded in tor-manager, or none, and
+// supervises the embedded router when it is used.
+package tbrouter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
+	tbready "i2pgit.org/idk/i2p.plugins.tor-manager/ready"
+)
+
+// The router modes. In auto mode, a running router is used, then an installed
+// one is started, and the embedded router is started if there is none.
+const (
+	ModeAuto     = "auto"
+	ModeExternal = "external"
+	ModeEmbedded = "embedded"
+	ModeNever    = "never"
+)
+
+// Modes are the router modes, in the order the panel offers them.
+var Modes = []string{ModeAuto, ModeExternal, ModeEmbedded, ModeNever}
+
+// ValidMode returns an error if mode isn't one of Modes.
+func ValidMode(mode string) error {
+	for _, m := range Modes {
+		if m == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("ValidMode: %s is not a router mode, use one of %v", mode, Modes)
+}
+
+// Manager starts the router the mode asks for.
+type Manager struct {
+	// Embedded is the embedded router.
+	Embedded *Embedded
+	// Launch starts the router installed on the system unless it is running,
+	// and returns false if there is none.
+	Launch func() (bool, error)
+	path   string
+	mutex  sync.Mutex
+	mode   string
+	active string
+	// switching serializes changes of the mode and of the router in use.
+	switching sync.Mutex
+}
+
+// Status is the router mode, which router is in use, and the state of the
+// embedded router.
+type Status struct {
+	Mode string `json:"mode"`
+	// Active is ModeExternal or ModeEmbedded, whichever router is in use, or
+	// ModeNever if there is none.
+	Active   string         `json:"active"`
+	Embedded EmbeddedStatus `json:"embedded"`
+}
+
+// settings are what the Manager saves.
+type settings struct {
+	Mode string `json:"mode"`
+}
+
+// NewManager returns a Manager which keeps the embedded router and the saved
+// mode in workdir. A mode which isn't empty is used instead of the saved one,
+// without being saved. The embedded router is created with newDaemon, and the
+// system's router is started with launch.
+func NewManager(workdir, mode string, newDaemon func(dir string) (Daemon, error), launch func() (bool, error)) (*Manager, error) {
+	m := &Manager{
+		Embedded: NewEmbedded(filepath.Join(workdir, "i2p-router"), filepath.Join(workdir, "i2p-router.log"), newDaemon),
+		Launch:   launch,
+		path:     filepath.Join(workdir, "router.json"),
+		mode:     ModeAuto,
+		active:   ModeNever,
+	}
+	if data, err := ioutil.ReadFile(m.path); err == nil {
+		var s settings
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("NewManager: %s", err)
+		}
+		if ValidMode(s.Mode) == nil {
+			m.mode = s.Mode
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("NewManager: %s", err)
+	}
+	if mode != "" {
+		if err := ValidMode(mode); err != nil {
+			return nil, fmt.Errorf("NewManager: %s", err)
+		}
+		m.mode = mode
+	}
+	return m, nil
+}
+
+// Mode returns the router mode.
+func (m *Manager) Mode() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.mode
+}
+
+// Active returns ModeExternal or ModeEmbedded, whichever router is in use, or
+// ModeNever if there is none.
+func (m *Manager) Active() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.active
+}
+
+// Status returns the mode and the state of the routers.
+func (m *Manager) Status() Status {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return Status{Mode: m.mode, Active: m.active, Embedded: m.Embedded.Status()}
+}
+
+// SetMode saves the mode and switches to the router it asks for, waiting for
+// it until the context is done.
+func (m *Manager) SetMode(ctx context.Context, mode string) error {
+	if err := ValidMode(mode); err != nil {
+		return fmt.Errorf("SetMode: %s", err)
+	}
+	data, err := json.MarshalIndent(settings{Mode: mode}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("SetMode: %s", err)
+	}
+	m.switching.Lock()
+	if err := ioutil.WriteFile(m.path, data, 0644); err != nil {
+		m.switching.Unlock()
+		return fmt.Errorf("SetMode: %s", err)
+	}
+	m.mutex.Lock()
+	m.mode = mode
+	m.mutex.Unlock()
+	wait, err := m.start()
+	m.switching.Unlock()
+	if err != nil {
+		return err
+	}
+	return wait(ctx)
+}
+
+// Start starts the router the mode asks for and waits until its HTTP proxy
+// answers or the context is done. The embedded router is stopped unless it is
+// used. In never mode, only a router which is already running is used.
+func (m *Manager) Start(ctx context.Context) error {
+	m.switching.Lock()
+	wait, err := m.start()
+	m.switching.Unlock()
+	if err != nil {
+		return err
+	}
+	return wait(ctx)
+}
+
+// start switches to the router the mode asks for, and returns the function
+// which waits for it. It is called with the switching lock held, which the
+// wait doesn't need.
+func (m *Manager) start() (func(context.Context) error, error) {
+	mode := m.Mode()
+	log.Println("Starting the I2P router in", mode, "mode")
+	if mode == ModeEmbedded || (mode == ModeAuto && m.Embedded.Running()) {
+		return m.startEmbedded()
+	}
+	m.useExternal()
+	if proxyReady() {
+		return func(context.Context) error { return nil }, nil
+	}
+	if mode == ModeNever {
+		m.setActive(ModeNever)
+		return nil, fmt.Errorf("Start: no I2P router is running, and the router mode is %s", mode)
+	}
+	launched, err := m.Launch()
+	if launched {
+		tbdiscover.Refresh()
+		return func(ctx context.Context) error {
+			if err := tbready.Wait(ctx, tbready.HTTPProxy(tbdiscover.Default().HTTPProxy.Addr())); err != nil {
+				return fmt.Errorf("Start: the I2P router was started, but its HTTP proxy isn't answering: %s", err)
+			}
+			return nil
+		}, nil
+	}
+	if mode == ModeExternal {
+		m.setActive(ModeNever)
+		return nil, fmt.Errorf("Start: no I2P router could be started: %s", err)
+	}
+	log.Println("No I2P router is installed, starting the embedded router", err)
+	return m.startEmbedded()
+}
+
+// startEmbedded starts the embedded router, and returns the function which
+// waits until it is healthy or the context is done.
+func (m *Manager) startEmbedded() (func(context.Context) error, error) {
+	if err := m.Embedded.Start(); err != nil {
+		return nil, fmt.Errorf("Start: %s", err)
+	}
+	tbdiscover.UseConfigDir(m.Embedded.Dir)
+	m.setActive(ModeEmbedded)
+	return func(ctx context.Context) error {
+		if err := m.Embedded.WaitHealthy(ctx); err != nil {
+			return fmt.Errorf("Start: the embedded router isn't healthy yet: %s", err)
+		}
+		return nil
+	}, nil
+}
+
+// useExternal stops the embedded router and goes back to discovering the
+// system's router.
+func (m *Manager) useExternal() {
+	if err := m.Embedded.Stop(); err != nil {
+		log.Println(err)
+	}
+	tbdiscover.UseConfigDir("")
+	m.setActive(ModeExternal)
+}
+
+func (m *Manager) setActive(active string) {
+	m.mutex.Lock()
+	m.active = active
+	m.mutex.Unlock()
+}
+
+// Stop stops the embedded router if it is running.
+func (m *Manager) Stop() error {
+	m.switching.Lock()
+	defer m.switching.Unlock()
+	return m.Embedded.Stop()
+}
+
+// proxyReady returns true if the HTTP proxy of the system's router answers.
+func proxyReady() bool {
+	return tbready.Check(10*time.Second, tbready.HTTPProxy(tbdiscover.Default().HTTPProxy.Addr())) == nil
+}
@@ -6,12 +6,10 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"strings"
-
-	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
 )
 
 func (m *Client) generateMirrorJSON() (map[string]interface{}, error) {
-	path := filepath.Join(tbget.DOWNLOAD_PATH(), "downloads.json")
+	path := filepath.Join(m.TBD.DownloadPath, m.TBD.FeedFile())
 	preBytes, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("GenerateMirrorJSON: %s", err)
@@ -45,7 +43,7 @@ func (m *Client) GenerateMirrorJSON() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	path := filepath.Join(tbget.DOWNLOAD_PATH(), "downloads.json")
+	path := filepath.Join(m.TBD.DownloadPath, m.TBD.FeedFile())
 	preBytes, err := ioutil.ReadFile(path)
 	if err != nil {
 		return "", fmt.Errorf("GenerateMirrorJSONBytes: %s", err)
@@ -0,0 +1,34 @@
+package tbserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// serveLogs handles /logs.json, /crashes.json, and /logs/ followed by the name
+// of a browser launch log, which is downloaded if download=true is set.
+func (m *Client) serveLogs(rw http.ResponseWriter, rq *http.Request) {
+	switch rq.URL.Path {
+	case "/logs.json":
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(m.TBS.BrowserLogs())
+		return
+	case "/crashes.json":
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(m.TBS.Crashes())
+		return
+	}
+	name := strings.TrimPrefix(rq.URL.Path, "/logs/")
+	path, err := m.TBS.BrowserLogPath(name)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if rq.URL.Query().Get("download") == "true" {
+		rw.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(path)+"\"")
+	}
+	http.ServeFile(rw, rq, path)
+}
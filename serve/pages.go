@@ -7,8 +7,9 @@ import (
 	"strings"
 )
 
-// Page generates the HTML for the panel.
-func (m *Client) Page() (string, error) {
+// Page generates the HTML for the panel. The CSRF token is put in the forms
+// which are POSTed.
+func (m *Client) Page(csrfToken string) (string, error) {
 
 	htmlbytes := htmlhead
 
@@ -32,14 +33,27 @@ func (m *Client) Page() (string, error) {
 	</script>
 	`)...)
 
-	mdbytes := m.PageHTML()
-	htmlbytes = append(htmlbytes, mdbytes...)
+	m.reading(func() {
+		mdbytes := m.PageHTML()
+		htmlbytes = append(htmlbytes, mdbytes...)
 
-	if alive, ours := m.TBS.TorIsAlive(); alive {
-		htmlbytes = append(htmlbytes, m.TorOnStatusHTML(ours)...)
-	} else {
-		htmlbytes = append(htmlbytes, m.TorOffStatusHTML(ours)...)
-	}
+		if alive, ours := m.TBS.TorIsAlive(); alive {
+			htmlbytes = append(htmlbytes, m.TorOnStatusHTML(ours)...)
+		} else {
+			htmlbytes = append(htmlbytes, m.TorOffStatusHTML(ours)...)
+		}
+	})
+	// The router and the proxies are asked for their state over the
+	// network, so they are left out of the channel lock.
+	htmlbytes = append(htmlbytes, m.RouterHTML(csrfToken)...)
+	htmlbytes = append(htmlbytes, m.ProxiesHTML(csrfToken)...)
+	m.reading(func() {
+		htmlbytes = append(htmlbytes, m.ProfilesHTML(csrfToken)...)
+		htmlbytes = append(htmlbytes, m.OfflineHTML()...)
+		htmlbytes = append(htmlbytes, m.LogsHTML()...)
+		htmlbytes = append(htmlbytes, m.UpdatesHTML(csrfToken)...)
+		htmlbytes = append(htmlbytes, m.ChannelHTML(csrfToken)...)
+	})
 	htmlbytes = append(htmlbytes, []byte(`</body>
 	</html>`)...)
 	return string(htmlbytes), nil
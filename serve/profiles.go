@@ -0,0 +1,85 @@
+package tbserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/justinas/nosurf"
+	TBSupervise "i2pgit.org/idk/i2p.plugins.tor-manager/supervise"
+)
+
+// profileResponse is what the profile API answers with.
+type profileResponse struct {
+	Profile  *TBSupervise.Profile   `json:"profile,omitempty"`
+	Profiles []*TBSupervise.Profile `json:"profiles,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	// CSRFToken has to be sent back with the actions, which are POSTed, as the
+	// csrf_token form field or the X-CSRF-Token header.
+	CSRFToken string `json:"csrf_token"`
+}
+
+// serveProfiles handles /profiles.json and the /profile/ actions. Actions must
+// be POSTed, and redirect back to the panel unless the client asked for JSON.
+func (m *Client) serveProfiles(rw http.ResponseWriter, rq *http.Request) {
+	resp := profileResponse{CSRFToken: nosurf.Token(rq)}
+	if rq.URL.Path != "/profiles.json" && rq.Method != "POST" {
+		resp.Error = "profile actions must be POSTed"
+		m.writeProfiles(rw, rq, resp, http.StatusMethodNotAllowed)
+		return
+	}
+	name := rq.FormValue("name")
+	var err error
+	switch rq.URL.Path {
+	case "/profiles.json":
+		resp.Profiles, err = m.TBS.Profiles()
+	case "/profile/launch":
+		log.Println("Launching profile", name)
+		ephemeral := rq.FormValue("ephemeral") == "true"
+		m.launch(func() error {
+			if ephemeral {
+				return m.TBS.RunEphemeralProfile(name)
+			}
+			return m.TBS.RunProfile(name)
+		})
+	case "/profile/create":
+		log.Println("Creating profile", name)
+		resp.Profile, err = m.TBS.CreateProfile(name, rq.FormValue("mode"), rq.FormValue("template"))
+	case "/profile/clone":
+		log.Println("Cloning profile", rq.FormValue("from"), "to", name)
+		resp.Profile, err = m.TBS.CloneProfile(rq.FormValue("from"), name)
+	case "/profile/reset":
+		log.Println("Resetting profile", name)
+		err = m.TBS.ResetProfile(name)
+	case "/profile/delete":
+		log.Println("Deleting profile", name)
+		err = m.TBS.DeleteProfile(name)
+	case "/profile/sandbox":
+		log.Println("Setting the sandbox of profile", name, "to", rq.FormValue("setting"))
+		err = m.TBS.SetProfileSandbox(name, rq.FormValue("setting"))
+	default:
+		err = fmt.Errorf("unknown profile action %s", rq.URL.Path)
+	}
+	status := http.StatusOK
+	if err != nil {
+		log.Println(err)
+		resp.Error = err.Error()
+		status = http.StatusBadRequest
+	}
+	if rq.URL.Path != "/profiles.json" {
+		m.setError(&m.profileError, resp.Error)
+	}
+	m.writeProfiles(rw, rq, resp, status)
+}
+
+func (m *Client) writeProfiles(rw http.ResponseWriter, rq *http.Request, resp profileResponse, status int) {
+	if rq.URL.Path == "/profiles.json" || strings.Contains(rq.Header.Get("Accept"), "application/json") {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(resp)
+		return
+	}
+	http.Redirect(rw, rq, "/", http.StatusFound)
+}
@@ -0,0 +1,127 @@
+package tbserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/justinas/nosurf"
+	tbproxy "i2pgit.org/idk/i2p.plugins.tor-manager/proxy"
+)
+
+// proxyResponse is what the proxies API answers with.
+type proxyResponse struct {
+	Settings  *tbproxy.Settings `json:"settings,omitempty"`
+	Listeners []tbproxy.Status  `json:"listeners"`
+	// SOCKS are the statistics of the SOCKS proxy, if it is running.
+	SOCKS *tbproxy.SOCKSStatus `json:"socks,omitempty"`
+	Error string               `json:"error,omitempty"`
+	// CSRFToken has to be sent back with the actions, which are POSTed, as the
+	// csrf_token form field or the X-CSRF-Token header.
+	CSRFToken string `json:"csrf_token"`
+}
+
+// serveProxies handles /proxies.json and the /proxy/ actions, which change the
+// proxies' settings or give a profile's proxy a new identity. Actions must be
+// POSTed, and redirect back to the panel unless the client asked for JSON.
+func (m *Client) serveProxies(rw http.ResponseWriter, rq *http.Request) {
+	resp := proxyResponse{CSRFToken: nosurf.Token(rq)}
+	if m.Proxies == nil {
+		resp.Error = "tor-manager isn't running its own I2P proxies"
+		m.writeProxies(rw, rq, resp, http.StatusNotFound)
+		return
+	}
+	if rq.URL.Path != "/proxies.json" && rq.Method != "POST" {
+		resp.Error = "proxy actions must be POSTed"
+		m.writeProxies(rw, rq, resp, http.StatusMethodNotAllowed)
+		return
+	}
+	var err error
+	switch rq.URL.Path {
+	case "/proxies.json":
+	case "/proxy/settings":
+		log.Println("Changing the I2P proxy settings")
+		var settings tbproxy.Settings
+		if settings, err = proxySettingsForm(rq, m.Proxies.SavedSettings()); err == nil {
+			err = m.Proxies.Configure(settings)
+		}
+	case "/proxy/new-identity":
+		err = m.Proxies.NewIdentity(rq.FormValue("profile"))
+	default:
+		err = fmt.Errorf("unknown proxy action %s", rq.URL.Path)
+	}
+	status := http.StatusOK
+	if err != nil {
+		log.Println(err)
+		resp.Error = err.Error()
+		status = http.StatusBadRequest
+	}
+	if rq.URL.Path != "/proxies.json" {
+		m.setError(&m.proxyError, resp.Error)
+	}
+	settings := m.Proxies.Settings()
+	resp.Settings = &settings
+	resp.Listeners = m.Proxies.Status()
+	resp.SOCKS = m.Proxies.SOCKSStatus()
+	m.writeProxies(rw, rq, resp, status)
+}
+
+// proxySettingsForm returns the settings with the values of the settings form
+// in place of them. Checkboxes which aren't sent are off.
+func proxySettingsForm(rq *http.Request, s tbproxy.Settings) (tbproxy.Settings, error) {
+	if err := rq.ParseForm(); err != nil {
+		return s, err
+	}
+	for name, value := range map[string]*int{
+		"in_length":            &s.InLength,
+		"out_length":           &s.OutLength,
+		"in_quantity":          &s.InQuantity,
+		"out_quantity":         &s.OutQuantity,
+		"in_backups":           &s.InBackups,
+		"out_backups":          &s.OutBackups,
+		"in_variance":          &s.InVariance,
+		"out_variance":         &s.OutVariance,
+		"reduce_idle_time":     &s.ReduceIdleTime,
+		"reduce_idle_quantity": &s.ReduceIdleQuantity,
+		"port":                 &s.Port,
+	} {
+		field := strings.TrimSpace(rq.PostForm.Get(name))
+		if field == "" {
+			continue
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return s, fmt.Errorf("%s is not a number: %s", name, field)
+		}
+		*value = n
+	}
+	if addr, ok := rq.PostForm["socks_addr"]; ok {
+		s.SOCKSAddr = strings.TrimSpace(addr[0])
+	}
+	for name, value := range map[string]*bool{
+		"unpublished":          &s.Unpublished,
+		"reduce_idle":          &s.ReduceIdle,
+		"compression":          &s.Compression,
+		"aggressive_isolation": &s.AggressiveIsolation,
+		"persist_keys":         &s.PersistKeys,
+		"isolate":              &s.Isolate,
+		"debug":                &s.Debug,
+		"socks_require_auth":   &s.SOCKSRequireAuth,
+	} {
+		*value = rq.PostForm.Get(name) == "on"
+	}
+	return s, nil
+}
+
+func (m *Client) writeProxies(rw http.ResponseWriter, rq *http.Request, resp proxyResponse, status int) {
+	if rq.URL.Path == "/proxies.json" || strings.Contains(rq.Header.Get("Accept"), "application/json") {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(resp)
+		return
+	}
+	http.Redirect(rw, rq, "/", http.StatusFound)
+}
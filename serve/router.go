@@ -0,0 +1,159 @@
+package tbserve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/justinas/nosurf"
+	tbcontrol "i2pgit.org/idk/i2p.plugins.tor-manager/control"
+	tbrouter "i2pgit.org/idk/i2p.plugins.tor-manager/router"
+)
+
+// ROUTER_TIMEOUT is how long the panel waits for the router to answer over
+// i2pcontrol.
+var ROUTER_TIMEOUT = 5 * time.Second
+
+// ROUTER_SWITCH_TIMEOUT is how long switching the router mode from the panel
+// waits for the new router.
+var ROUTER_SWITCH_TIMEOUT = 2 * time.Minute
+
+// routerResponse is what the router API answers with. The password is never
+// sent back.
+type routerResponse struct {
+	URL     string            `json:"url,omitempty"`
+	Status  *tbcontrol.Status `json:"status,omitempty"`
+	Manager *tbrouter.Status  `json:"manager,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	// CSRFToken has to be sent back with the actions, which are POSTed, as the
+	// csrf_token form field or the X-CSRF-Token header.
+	CSRFToken string `json:"csrf_token"`
+}
+
+// serveRouter handles /router.json, /router/log, and the /router/ actions,
+// which switch the router mode, restart the router, shut it down gracefully,
+// cancel the shutdown, or change the i2pcontrol URL and password. Actions must
+// be POSTed, and redirect back to the panel unless the client asked for JSON.
+func (m *Client) serveRouter(rw http.ResponseWriter, rq *http.Request) {
+	if rq.URL.Path == "/router/log" {
+		m.serveRouterLog(rw, rq)
+		return
+	}
+	resp := routerResponse{CSRFToken: nosurf.Token(rq)}
+	if m.Routers != nil {
+		status := m.Routers.Status()
+		resp.Manager = &status
+	}
+	if m.Router != nil {
+		resp.URL = m.Router.URL()
+	}
+	if rq.URL.Path != "/router.json" && rq.Method != "POST" {
+		resp.Error = "router actions must be POSTed"
+		m.writeRouter(rw, rq, resp, http.StatusMethodNotAllowed)
+		return
+	}
+	if rq.URL.Path == "/router/mode" {
+		status := http.StatusOK
+		if err := m.switchRouter(rq.FormValue("mode")); err != nil {
+			log.Println(err)
+			resp.Error = err.Error()
+			status = http.StatusBadRequest
+		}
+		m.setError(&m.routerError, resp.Error)
+		m.writeRouter(rw, rq, resp, status)
+		return
+	}
+	if m.Router == nil {
+		if rq.URL.Path != "/router.json" {
+			resp.Error = "no i2pcontrol API is configured"
+		}
+		m.writeRouter(rw, rq, resp, http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(rq.Context(), ROUTER_TIMEOUT)
+	defer cancel()
+	var err error
+	switch rq.URL.Path {
+	case "/router.json":
+		resp.Status, err = m.Router.Status(ctx)
+	case "/router/restart":
+		log.Println("Restarting the I2P router")
+		err = m.Router.Restart(ctx)
+	case "/router/shutdown":
+		log.Println("Shutting the I2P router down")
+		err = m.Router.ShutdownGraceful(ctx)
+	case "/router/cancel-shutdown":
+		log.Println("Cancelling the I2P router's shutdown")
+		err = m.Router.CancelShutdown(ctx)
+	case "/router/settings":
+		log.Println("Changing the i2pcontrol settings")
+		err = m.Router.Configure(strings.TrimSpace(rq.FormValue("url")), rq.FormValue("password"))
+		resp.URL = m.Router.URL()
+	default:
+		err = fmt.Errorf("unknown router action %s", rq.URL.Path)
+	}
+	status := http.StatusOK
+	if err != nil {
+		log.Println(err)
+		resp.Error = err.Error()
+		status = http.StatusBadGateway
+	}
+	if rq.URL.Path != "/router.json" {
+		m.setError(&m.routerError, resp.Error)
+	}
+	m.writeRouter(rw, rq, resp, status)
+}
+
+// switchRouter saves the router mode and switches to its router in the
+// background, as starting a router takes a while.
+func (m *Client) switchRouter(mode string) error {
+	if m.Routers == nil {
+		return fmt.Errorf("the router mode can't be changed, tor-manager isn't managing the router")
+	}
+	if err := tbrouter.ValidMode(mode); err != nil {
+		return err
+	}
+	log.Println("Switching the I2P router mode to", mode)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ROUTER_SWITCH_TIMEOUT)
+		defer cancel()
+		if err := m.Routers.SetMode(ctx, mode); err != nil {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
+// serveRouterLog serves the log of the embedded router and its supervisor, or
+// the previous one if previous=true is set.
+func (m *Client) serveRouterLog(rw http.ResponseWriter, rq *http.Request) {
+	if m.Routers == nil {
+		http.Error(rw, "tor-manager isn't managing the router", http.StatusNotFound)
+		return
+	}
+	path := m.Routers.Embedded.LogPath
+	if rq.URL.Query().Get("previous") == "true" {
+		path += ".1"
+	}
+	if _, err := os.Stat(path); err != nil {
+		http.Error(rw, "the embedded router hasn't written this log", http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeFile(rw, rq, path)
+}
+
+func (m *Client) writeRouter(rw http.ResponseWriter, rq *http.Request, resp routerResponse, status int) {
+	if rq.URL.Path == "/router.json" || strings.Contains(rq.Header.Get("Accept"), "application/json") {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(resp)
+		return
+	}
+	http.Redirect(rw, rq, "/", http.StatusFound)
+}
@@ -16,11 +16,16 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/justinas/nosurf"
 	cp "github.com/otiai10/copy"
+	tbcontrol "i2pgit.org/idk/i2p.plugins.tor-manager/control"
 	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
 	i2pdotonion "i2pgit.org/idk/i2p.plugins.tor-manager/onion"
+	tbproxy "i2pgit.org/idk/i2p.plugins.tor-manager/proxy"
+	tbrouter "i2pgit.org/idk/i2p.plugins.tor-manager/router"
 	TBSupervise "i2pgit.org/idk/i2p.plugins.tor-manager/supervise"
 )
 
@@ -34,34 +39,176 @@ type Client struct {
 	DarkMode bool
 	Host     string
 	Port     int
-	server   http.Server
+	// UpdateInterval is how often Serve checks for updates. Zero disables the checks.
+	UpdateInterval time.Duration
+	server         http.Server
+	updateMutex    sync.Mutex
+	updateStatus   UpdateStatus
+	updatesDone    chan struct{}
+	// switchMutex lets one channel switch run at a time, channelMutex keeps
+	// the panel from reading the downloader and the supervisor while the
+	// switch changes them. SwitchChannel replaces TBD rather than changing
+	// it, so a downloader taken with downloader stays usable unlocked.
+	switchMutex  sync.Mutex
+	channelMutex sync.RWMutex
+	channelError string
+	// errorMutex guards the errors shown in the profiles, router and proxies
+	// sections, which launches in the background and concurrent requests set.
+	errorMutex   sync.Mutex
+	profileError string
+	// Router shows the I2P router's status in the panel and controls it. The
+	// panel leaves the router out if it is nil.
+	Router *tbcontrol.Client
+	// Routers lets the panel switch the router mode and shows the embedded
+	// router's state.
+	Routers     *tbrouter.Manager
+	routerError string
+	// Proxies are tor-manager's own I2P proxies, which the panel configures
+	// and gives new identities.
+	Proxies    *tbproxy.Manager
+	proxyError string
+}
+
+// setError sets one of the errors the panel shows, guarded by errorMutex.
+func (m *Client) setError(field *string, err string) {
+	m.errorMutex.Lock()
+	defer m.errorMutex.Unlock()
+	*field = err
+}
+
+// shownError returns one of the errors the panel shows, guarded by errorMutex.
+func (m *Client) shownError(field *string) string {
+	m.errorMutex.Lock()
+	defer m.errorMutex.Unlock()
+	return *field
 }
 
 // NewClient creates a new Client.
 func NewClient(verbose bool, lang, OS, arch, mirror string, content *embed.FS, nounpack bool) (*Client, error) {
+	return NewProductClient(verbose, tbget.TorBrowser.Name, lang, OS, arch, mirror, content, nounpack)
+}
+
+// NewProductClient creates a new Client which downloads and supervises the named product.
+func NewProductClient(verbose bool, product, lang, OS, arch, mirror string, content *embed.FS, nounpack bool) (*Client, error) {
+	p, err := tbget.GetProduct(product)
+	if err != nil {
+		return nil, err
+	}
 	m := &Client{
-		TBD: tbget.NewTBDownloader(lang, OS, arch, content),
+		TBD: tbget.NewProductDownloader(p, lang, OS, arch, content),
 	}
 	m.TBD.Mirror = mirror
 	m.TBD.Verbose = verbose
 	m.TBD.NoUnpack = nounpack
 	m.TBD.MakeTBDirectory()
-	var err error
 	m.Onion, err = i2pdotonion.NewOnionService(m.TBD.DownloadPath)
 	if err != nil {
 		return nil, err
 	}
-	tgz, sig, sums, err := m.TBD.DownloadUpdaterForLang(lang)
+	home, err := m.install(m.TBD)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	m.TBS = TBSupervise.NewSupervisor(home, lang)
+	m.TBS.Product = p.Name
+	m.TBS.AnchorManifest = m.anchorManifest
+	if _, err := m.ApplyUpdateIfIdle(); err != nil {
+		log.Println(err)
+	}
+	//go m.TBS.RunTorWithLang()
+	return m, nil
+}
+
+// DownloadProduct downloads, verifies and unpacks another product alongside the
+// one the Client was created for, using the same language, platform and mirror.
+func (m *Client) DownloadProduct(product string) (string, error) {
+	p, err := tbget.GetProduct(product)
+	if err != nil {
+		return "", err
+	}
+	if p == m.TBD.GetProduct() {
+		return m.TBD.BrowserDir(), nil
 	}
-	sum := ""
+	tbd := tbget.NewProductDownloader(p, m.TBD.Lang, m.TBD.OS, m.TBD.ARCH, m.TBD.Profile)
+	tbd.Mirror = m.TBD.Mirror
+	tbd.Verbose = m.TBD.Verbose
+	tbd.NoUnpack = m.TBD.NoUnpack
+	tbd.MakeTBDirectory()
+	return m.install(tbd)
+}
+
+// anchorManifest checks the manifest of an installed tree against the archive
+// it was unpacked from, using a downloader for the product installed there.
+func (m *Client) anchorManifest(install string) error {
+	current := m.downloader()
+	tbd := current
+	for _, name := range tbget.ProductNames() {
+		p := tbget.Products[name]
+		if p != current.GetProduct() && filepath.Base(install) == p.InstallDir(current.Lang) {
+			tbd = tbget.NewProductDownloader(p, current.Lang, current.OS, current.ARCH, current.Profile)
+			break
+		}
+	}
+	return tbd.AnchorManifest(install)
+}
+
+// SwitchChannel moves the Client to another release channel. The channel's
+// release is downloaded, verified and unpacked into the channel's own
+// directories, then the Client and the Supervisor are pointed at it. If that
+// fails, the Client stays on the channel it was using.
+func (m *Client) SwitchChannel(channel string) error {
+	m.switchMutex.Lock()
+	defer m.switchMutex.Unlock()
+	tbd := *m.TBD
+	if err := tbd.SetChannel(channel); err != nil {
+		return err
+	}
+	tbd.MakeTBDirectory()
+	home, err := m.install(&tbd)
+	m.channelMutex.Lock()
+	defer m.channelMutex.Unlock()
+	if err != nil {
+		m.channelError = fmt.Sprintf("Couldn't switch to the %s channel: %s", tbd.GetChannel(), err)
+		return fmt.Errorf("SwitchChannel: %s", err)
+	}
+	m.channelError = ""
+	m.TBD = &tbd
+	tbget.CHANNEL = m.TBD.GetChannel()
+	m.TBS.UnpackPath = home
+	return nil
+}
+
+// downloader returns the downloader of the channel the Client is on.
+func (m *Client) downloader() *tbget.TBDownloader {
+	m.channelMutex.RLock()
+	defer m.channelMutex.RUnlock()
+	return m.TBD
+}
+
+// reading runs f while no channel switch can change the downloader or the
+// supervisor. f must not wait on a browser or the network.
+func (m *Client) reading(f func()) {
+	m.channelMutex.RLock()
+	defer m.channelMutex.RUnlock()
+	f()
+}
+
+// install downloads, verifies and unpacks the product managed by tbd. It returns the
+// path the product was unpacked to.
+func (m *Client) install(tbd *tbget.TBDownloader) (string, error) {
+	lang := tbd.Lang
+	tgz, sig, sums, err := tbd.DownloadUpdaterForLang(lang)
+	if err != nil {
+		return "", fmt.Errorf("downloading updater: %v", err)
+	}
+	signed := tgz
 	if sums != "" && runtime.GOOS == "linux" && runtime.GOARCH == "arm64" {
 		b, err := ioutil.ReadFile(sums)
 		if err != nil {
-			log.Fatal(err)
+			return "", err
 		}
 		// find the line containing the checksum of our tgz file
+		sum := ""
 		for _, line := range strings.Split(string(b), "\n") {
 			if strings.Contains(line, lang+".tar.xz") {
 				sum = strings.Split(line, " ")[0]
@@ -72,43 +219,58 @@ func NewClient(verbose bool, lang, OS, arch, mirror string, content *embed.FS, n
 		// compute the sha256sum of the downloaded tar.xz file
 		f, err := os.Open(tgz)
 		if err != nil {
-			log.Fatal(err)
+			return "", err
 		}
 		h := sha256.New()
-		if _, err := io.Copy(h, f); err != nil {
-			log.Fatal(err)
-		}
+		_, err = io.Copy(h, f)
 		f.Close()
+		if err != nil {
+			return "", err
+		}
 		if sum != hex.EncodeToString(h.Sum(nil)) {
-			log.Fatal("Checksum mismatch")
+			return "", fmt.Errorf("checksum mismatch for %s", tgz)
 		}
-		var home string
-		if home, err = m.TBD.CheckSignature(sums, sig); err != nil {
-			log.Fatal(err)
-		} else {
-			_, err = m.TBD.UnpackUpdater(tgz)
-			if err != nil {
-				return nil, fmt.Errorf("unpacking updater: %v", err)
-			}
-			log.Printf("Signature check passed: %s %s", tgz, sig)
+		signed = sums
+	}
+	fresh := !tbget.FileExists(tbd.BrowserDir())
+	home, err := tbd.CheckSignature(signed, sig)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tbd.UnpackUpdater(tgz); err != nil {
+		return "", fmt.Errorf("unpacking updater: %v", err)
+	}
+	log.Printf("Signature check passed: %s %s", tgz, sig)
+	recordVersion(tbd, fresh, tgz, sig)
+	return home, nil
+}
+
+// recordVersion records the version of a freshly unpacked install. If an older
+// install was already unpacked, the download is staged to be swapped in once
+// no browser is running from it.
+func recordVersion(tbd *tbget.TBDownloader, fresh bool, tgz, sig string) {
+	if tbd.NoUnpack {
+		return
+	}
+	// The version is taken from the name of the verified download, so the
+	// feed isn't fetched again.
+	version := tbd.VersionFromName(tgz)
+	if version == "" {
+		log.Println("recordVersion: unknown version of", tgz)
+		return
+	}
+	installed := tbd.InstalledVersion()
+	if fresh || installed == "" {
+		if err := tbd.SetInstalledVersion(version); err != nil {
+			log.Println("recordVersion:", err)
 		}
-		m.TBS = TBSupervise.NewSupervisor(home, lang)
-		//go m.TBS.RunTorWithLang()
-		return m, nil
+		return
 	}
-	var home string
-	if home, err = m.TBD.CheckSignature(tgz, sig); err != nil {
-		log.Fatal(err)
-	} else {
-		_, err = m.TBD.UnpackUpdater(tgz)
-		if err != nil {
-			return nil, fmt.Errorf("unpacking updater: %v", err)
+	if installed != version {
+		if _, err := tbd.Stage(version, tgz, sig); err != nil {
+			log.Println("recordVersion:", err)
 		}
-		log.Printf("Signature check passed: %s %s", tgz, sig)
 	}
-	m.TBS = TBSupervise.NewSupervisor(home, lang)
-	//go m.TBS.RunTorWithLang()
-	return m, nil
 }
 
 // NewFirefoxClient creates a new Client.
@@ -159,43 +321,63 @@ func (m *Client) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 	path := path.Clean(rq.URL.Path)
 	rq.URL.Path = path
 	log.Printf("ServeHTTP: '%s'", path)
+	if path == "/profiles.json" || strings.HasPrefix(path, "/profile/") {
+		m.reading(func() { m.serveProfiles(rw, rq) })
+		return
+	}
+	if path == "/logs.json" || path == "/crashes.json" || strings.HasPrefix(path, "/logs/") {
+		m.reading(func() { m.serveLogs(rw, rq) })
+		return
+	}
+	if path == "/router.json" || strings.HasPrefix(path, "/router/") {
+		m.serveRouter(rw, rq)
+		return
+	}
+	if path == "/proxies.json" || strings.HasPrefix(path, "/proxy/") {
+		m.serveProxies(rw, rq)
+		return
+	}
 	fileextension := filepath.Ext(path)
 	switch fileextension {
 	case ".json":
-		m.serveJSON(rw, rq)
+		m.reading(func() { m.serveJSON(rw, rq) })
 		return
 	case ".css":
-		m.serveCSS(rw, rq)
+		m.reading(func() { m.serveCSS(rw, rq) })
 		return
 	case ".js":
-		m.serveJS(rw, rq)
+		m.reading(func() { m.serveJS(rw, rq) })
 		return
 	case ".png":
-		m.servePNG(rw, rq)
+		m.reading(func() { m.servePNG(rw, rq) })
 		return
 	case ".ico":
-		m.serveICO(rw, rq)
+		m.reading(func() { m.serveICO(rw, rq) })
 		return
 	case ".svg":
-		m.serveSVG(rw, rq)
+		m.reading(func() { m.serveSVG(rw, rq) })
 		return
 	default:
 		switch path {
 		case "/launch-tor-browser":
 			log.Println("Starting Tor Browser")
-			go m.TBS.RunTBWithLang()
+			m.launch(m.TBS.RunTBWithLang)
 			http.Redirect(rw, rq, "/", http.StatusFound)
 		case "/launch-i2p-browser":
 			log.Println("Starting I2P Browser")
-			go m.TBS.RunI2PBWithLang()
+			m.launch(m.TBS.RunI2PBWithLang)
 			http.Redirect(rw, rq, "/", http.StatusFound)
 		case "/launch-firefox-browser":
 			log.Println("Starting Hardened Firefox Browser")
-			go m.TBS.RunTBBWithOfflineClearnetProfile("profile.firefox", false, true)
+			m.launch(func() error {
+				return m.TBS.RunProfile("clearnet")
+			})
 			http.Redirect(rw, rq, "/", http.StatusFound)
 		case "/launch-offline-browser":
 			log.Println("Starting Hardened Firefox Browser in offline mode")
-			go m.TBS.RunTBBWithOfflineClearnetProfile("profile.firefox.offline", true, true)
+			m.launch(func() error {
+				return m.TBS.RunProfile("offline")
+			})
 			http.Redirect(rw, rq, "/", http.StatusFound)
 		case "/start-tor":
 			log.Println("Starting Tor")
@@ -205,16 +387,52 @@ func (m *Client) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 			log.Println("Stopping Tor")
 			go m.TBS.StopTor()
 			http.Redirect(rw, rq, "/", http.StatusFound)
+		case "/switch-channel":
+			if !posted(rw, rq) {
+				return
+			}
+			channel := rq.FormValue("channel")
+			log.Println("Switching release channel to", channel)
+			go func() {
+				if err := m.SwitchChannel(channel); err != nil {
+					log.Println("Couldn't switch release channel", err)
+				}
+			}()
+			http.Redirect(rw, rq, "/", http.StatusFound)
+		case "/check-updates":
+			if !posted(rw, rq) {
+				return
+			}
+			log.Println("Checking for updates")
+			go func() {
+				if err := m.CheckForUpdates(); err != nil {
+					log.Println(err)
+				}
+			}()
+			http.Redirect(rw, rq, "/", http.StatusFound)
+		case "/update-extensions":
+			if !posted(rw, rq) {
+				return
+			}
+			log.Println("Updating extensions")
+			go func() {
+				if err := m.TBS.UpdateExtensions(); err != nil {
+					log.Println(err)
+				}
+			}()
+			http.Redirect(rw, rq, "/", http.StatusFound)
 		case "/switch-theme":
 			log.Println("Switching theme")
 			m.DarkMode = !m.DarkMode
 			http.Redirect(rw, rq, "/", http.StatusFound)
 		case "/launch-site-editor":
 			log.Println("Starting Site Editor")
-			m.TBS.RunI2PSiteEditorWithOfflineClearnetProfile(filepath.Join(m.TBD.UnpackPath, "i2p.firefox.editor"))
+			m.launch(func() error {
+				return m.TBS.RunI2PSiteEditorWithProfile("i2p-editor")
+			})
 			http.Redirect(rw, rq, "/", http.StatusFound)
 		default:
-			b, _ := m.Page()
+			b, _ := m.Page(nosurf.Token(rq))
 			rw.Header().Set("Content-Type", "text/html")
 			rw.Write([]byte(b))
 		}
@@ -222,6 +440,16 @@ func (m *Client) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 
 }
 
+// posted refuses an action which wasn't POSTed, as nosurf only checks the CSRF
+// token of POSTs. It returns true if the action may go ahead.
+func posted(rw http.ResponseWriter, rq *http.Request) bool {
+	if rq.Method == "POST" {
+		return true
+	}
+	http.Error(rw, "this action must be POSTed", http.StatusMethodNotAllowed)
+	return false
+}
+
 // Serve serve the control panel locally
 func (m *Client) Serve() error {
 	//http.Handle("/", m)
@@ -235,10 +463,18 @@ func (m *Client) Serve() error {
 	}
 	ioutil.WriteFile(filepath.Join(m.TBD.DownloadPath, "mirror.json"), []byte(mirrorjson), 0644)
 	cp.Copy(m.TBS.I2PProfilePath(), filepath.Join(m.TBD.DownloadPath, "i2p.firefox"))
+	if m.UpdateInterval > 0 {
+		m.updatesDone = make(chan struct{})
+		go m.scheduleUpdates(m.updatesDone)
+	}
 	return m.server.ListenAndServe() //http.ListenAndServe(m.GetAddress(), nosurf.New(m))
 }
 
 func (m *Client) Shutdown(ctx context.Context) error {
 	m.TBS.StopTor()
+	if m.updatesDone != nil {
+		close(m.updatesDone)
+		m.updatesDone = nil
+	}
 	return m.server.Shutdown(ctx)
 }
@@ -1,10 +1,21 @@
 package tbserve
 
 import (
+	"context"
+	"fmt"
+	"html"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/russross/blackfriday"
+	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+	tbproxy "i2pgit.org/idk/i2p.plugins.tor-manager/proxy"
+	tbrouter "i2pgit.org/idk/i2p.plugins.tor-manager/router"
+	TBSupervise "i2pgit.org/idk/i2p.plugins.tor-manager/supervise"
 )
 
 var dmd string = `
@@ -121,3 +132,457 @@ func (m *Client) TorOffStatusHTML(ours bool) []byte {
 	htmlbytes := blackfriday.Run(toroff)
 	return htmlbytes
 }
+
+// ChannelHTML returns the HTML for the "Release Channel" section of the page,
+// with forms to switch channels which carry the CSRF token
+func (m *Client) ChannelHTML(csrfToken string) []byte {
+	out := "\n<h2>Release Channel</h2>\n"
+	if m.channelError != "" {
+		out += fmt.Sprintf("<p><strong>%s</strong></p>\n", html.EscapeString(m.channelError))
+	}
+	out += "<ul>\n"
+	for _, channel := range tbget.Channels {
+		if channel == m.TBD.GetChannel() {
+			out += fmt.Sprintf("<li><strong>%s</strong> (in use)</li>\n", channel)
+			continue
+		}
+		out += fmt.Sprintf(`<li><form action="/switch-channel" method="post">
+	<input type="hidden" name="csrf_token" value="%s">
+	<input type="hidden" name="channel" value="%s">
+	<input type="submit" value="Switch to %s">
+</form></li>
+`, html.EscapeString(csrfToken), channel, channel)
+	}
+	return []byte(out + "</ul>\n")
+}
+
+// UpdatesHTML returns the HTML for the "Updates" section of the page, with a
+// form to check for updates which carries the CSRF token
+func (m *Client) UpdatesHTML(csrfToken string) []byte {
+	status := m.statusOf(m.TBD)
+	mdbytes := []byte("\n## Updates\n\n")
+	if status.Installed != "" {
+		mdbytes = append(mdbytes, []byte(fmt.Sprintf(" - Installed version: %s\n", status.Installed))...)
+	}
+	if status.Ready != "" {
+		mdbytes = append(mdbytes, []byte(fmt.Sprintf(" - **Update ready:** %s will be installed the next time no browser is running from this install\n", status.Ready))...)
+	}
+	if highest := m.TBD.GetVersionState().Highest; highest != "" {
+		mdbytes = append(mdbytes, []byte(fmt.Sprintf(" - Newest verified version: %s\n", highest))...)
+	}
+	if m.TBD.FeedWarning != "" {
+		mdbytes = append(mdbytes, []byte(fmt.Sprintf(" - **Warning:** %s\n", m.TBD.FeedWarning))...)
+	}
+	if record, err := m.TBD.GetConsensusRecord(); err == nil {
+		result := "passed"
+		if !record.Passed {
+			result = "failed"
+		}
+		mdbytes = append(mdbytes, []byte(fmt.Sprintf(" - Mirror consensus for %s: %s, %d of %d mirrors agreed\n", record.File, result, record.Agreed, record.Required))...)
+	}
+	if !status.LastCheck.IsZero() {
+		mdbytes = append(mdbytes, []byte(fmt.Sprintf(" - Last checked: %s\n", status.LastCheck.Format("2006-01-02 15:04")))...)
+	}
+	if status.Err != nil {
+		mdbytes = append(mdbytes, []byte(fmt.Sprintf(" - Last check failed: %s\n", status.Err))...)
+	}
+	return append(blackfriday.Run(mdbytes), []byte(fmt.Sprintf(`<form action="/check-updates" method="post">
+	<input type="hidden" name="csrf_token" value="%s">
+	<input type="submit" value="Check for updates now">
+</form>
+`, html.EscapeString(csrfToken)))...)
+}
+
+// OfflineHTML returns the HTML for the "Offline Mode" section of the page,
+// which lists what the offline proxy blocked
+func (m *Client) OfflineHTML() []byte {
+	blocked := TBSupervise.OfflineBlocked()
+	if len(blocked) == 0 {
+		return nil
+	}
+	htmlbytes := []byte("\n<h2>Offline Mode</h2>\n")
+	htmlbytes = append(htmlbytes, []byte(fmt.Sprintf("<p>Offline profiles can only reach %s. Recently blocked:</p>\n<ul>\n", html.EscapeString(strings.Join(TBSupervise.OFFLINE_ALLOWLIST, ", "))))...)
+	for i, b := range blocked {
+		if i == 20 {
+			break
+		}
+		htmlbytes = append(htmlbytes, []byte(fmt.Sprintf("<li>%s %s <code>%s</code></li>\n", b.Time.Format("15:04:05"), html.EscapeString(b.Method), html.EscapeString(b.URL)))...)
+	}
+	htmlbytes = append(htmlbytes, []byte("</ul>\n")...)
+	return htmlbytes
+}
+
+// LogsHTML returns the HTML for the "Browser Logs" section of the page, which
+// shows recent crashes and links to the launch logs
+func (m *Client) LogsHTML() []byte {
+	logs := m.TBS.BrowserLogs()
+	if len(logs) == 0 {
+		return nil
+	}
+	htmlbytes := []byte("\n<h2>Browser Logs</h2>\n")
+	for i, crash := range m.TBS.Crashes() {
+		if i == 5 {
+			break
+		}
+		htmlbytes = append(htmlbytes, []byte(fmt.Sprintf("<details><summary>%s: the %s browser with profile %s %s crashed (%s) - <a href=\"/logs/%s\">log</a></summary>\n<pre>%s</pre>\n</details>\n",
+			crash.Time.Format("2006-01-02 15:04:05"), html.EscapeString(crash.Mode), html.EscapeString(crash.Profile), html.EscapeString(crash.Version),
+			html.EscapeString(crash.Exit), url.PathEscape(crash.Log), html.EscapeString(strings.Join(crash.Tail, "\n"))))...)
+	}
+	htmlbytes = append(htmlbytes, []byte("<ul>\n")...)
+	for i, l := range logs {
+		if i == 10 {
+			break
+		}
+		htmlbytes = append(htmlbytes, []byte(fmt.Sprintf("<li>%s (%d KB) - <a href=\"/logs/%s\">View</a> - <a href=\"/logs/%s?download=true\">Download</a></li>\n",
+			html.EscapeString(l.Name), (l.Size+1023)/1024, url.PathEscape(l.Name), url.PathEscape(l.Name)))...)
+	}
+	htmlbytes = append(htmlbytes, []byte("</ul>\n<p><a href=\"/crashes.json\">All crash reports</a> - <a href=\"/logs.json\">All logs</a></p>\n")...)
+	return htmlbytes
+}
+
+// profileAction returns a button which POSTs a profile action with the CSRF
+// token.
+func profileAction(token, action, name, label string, fields ...string) string {
+	form := fmt.Sprintf(`<form action="/profile/%s" method="post" style="display: inline">
+	<input type="hidden" name="csrf_token" value="%s">
+	<input type="hidden" name="name" value="%s">
+`, action, token, html.EscapeString(name))
+	for i := 0; i+1 < len(fields); i += 2 {
+		form += fmt.Sprintf(`	<input type="hidden" name="%s" value="%s">
+`, fields[i], html.EscapeString(fields[i+1]))
+	}
+	return form + fmt.Sprintf(`	<input type="submit" value="%s">
+</form>
+`, label)
+}
+
+// sandboxHTML describes whether the profile runs in the sandbox, with buttons
+// to change it.
+func sandboxHTML(token string, p *TBSupervise.Profile) string {
+	state, other := "default", "on"
+	if TBSupervise.SANDBOX {
+		state, other = "default, on", "off"
+	}
+	if p.Sandbox != nil && *p.Sandbox {
+		state, other = "on", "off"
+	} else if p.Sandbox != nil {
+		state, other = "off", "on"
+	}
+	out := fmt.Sprintf("<li>Sandbox: %s %s", state, profileAction(token, "sandbox", p.Name, "Turn "+other, "setting", other))
+	if p.Sandbox != nil {
+		out += profileAction(token, "sandbox", p.Name, "Use the default", "setting", "default")
+	}
+	return out + "</li>\n"
+}
+
+// prefChangesHTML lists the changes the last launch of a profile made to its
+// managed preferences.
+func prefChangesHTML(changes []TBSupervise.PrefChange) string {
+	out := "<li>Managed preferences changed on the last launch:\n<ul>\n"
+	for _, change := range changes {
+		out += fmt.Sprintf("<li><code>%s</code></li>\n", html.EscapeString(change.String()))
+	}
+	return out + "</ul>\n</li>\n"
+}
+
+// ProfilesHTML returns the HTML for the "Profiles" section of the page, with
+// forms for the profile actions, which carry the CSRF token
+func (m *Client) ProfilesHTML(csrfToken string) []byte {
+	token := html.EscapeString(csrfToken)
+	out := "\n<h2>Profiles</h2>\n"
+	if msg := m.shownError(&m.profileError); msg != "" {
+		out += fmt.Sprintf("<p><strong>%s</strong></p>\n", html.EscapeString(msg))
+	}
+	profiles, err := m.TBS.Profiles()
+	if err != nil {
+		out += fmt.Sprintf("<p><strong>%s</strong></p>\n", html.EscapeString(err.Error()))
+	}
+	changes := m.TBS.PrefChanges()
+	out += "<ul>\n"
+	for _, p := range profiles {
+		out += fmt.Sprintf("<li><strong>%s</strong> (%s, created %s): %s%s%s",
+			html.EscapeString(p.Name), html.EscapeString(p.Mode), p.Created.Format("2006-01-02"),
+			profileAction(token, "launch", p.Name, "Launch"),
+			profileAction(token, "launch", p.Name, "Launch ephemeral", "ephemeral", "true"),
+			profileAction(token, "reset", p.Name, "Reset"))
+		if !m.TBS.BuiltinProfile(p.Name) {
+			out += profileAction(token, "delete", p.Name, "Delete")
+		}
+		details := ""
+		if TBSupervise.OS() == "linux" {
+			details += sandboxHTML(token, p)
+		}
+		if dir := m.TBS.ProfileDir(p); dir != "" {
+			if adir, err := filepath.Abs(dir); err == nil && changes[adir] != nil {
+				details += prefChangesHTML(changes[adir])
+				delete(changes, adir)
+			}
+			for _, ext := range TBSupervise.ProfileExtensions(dir) {
+				managed := ""
+				if ext.Managed {
+					managed = ", managed"
+				}
+				details += fmt.Sprintf("<li>%s %s (%s%s)</li>\n", html.EscapeString(ext.Name), html.EscapeString(ext.Version), html.EscapeString(ext.ID), managed)
+			}
+		}
+		if details != "" {
+			out += "<ul>\n" + details + "</ul>\n"
+		}
+		out += "</li>\n"
+	}
+	out += "</ul>\n"
+	if len(changes) > 0 {
+		out += "<p>Other profile directories:</p>\n<ul>\n"
+		for dir, c := range changes {
+			out += fmt.Sprintf("<li>%s\n<ul>\n%s</ul>\n</li>\n", html.EscapeString(dir), prefChangesHTML(c))
+		}
+		out += "</ul>\n"
+	}
+	if TBSupervise.EXTENSION_SOURCE != "" {
+		out += fmt.Sprintf(`<form action="/update-extensions" method="post">
+	<input type="hidden" name="csrf_token" value="%s">
+	Extensions are upgraded from %s.
+	<input type="submit" value="Check for new extensions">
+</form>
+`, token, html.EscapeString(TBSupervise.EXTENSION_SOURCE))
+	}
+	out += fmt.Sprintf(`<form action="/profile/create" method="post">
+	<input type="hidden" name="csrf_token" value="%s">
+	<input type="text" name="name" placeholder="New profile name">
+	<select name="mode">`, token)
+	for _, mode := range TBSupervise.Modes {
+		out += fmt.Sprintf(`<option value="%s">%s</option>`, mode, mode)
+	}
+	out += `</select>
+	<select name="template">`
+	for _, template := range m.TBS.ProfileTemplates() {
+		label := template
+		if label == "" {
+			label = "mode default"
+		}
+		out += fmt.Sprintf(`<option value="%s">%s</option>`, html.EscapeString(template), html.EscapeString(label))
+	}
+	out += fmt.Sprintf(`</select>
+	<input type="submit" value="Create profile">
+</form>
+<form action="/profile/clone" method="post">
+	<input type="hidden" name="csrf_token" value="%s">
+	<select name="from">`, token)
+	for _, p := range profiles {
+		out += fmt.Sprintf(`<option value="%s">%s</option>`, html.EscapeString(p.Name), html.EscapeString(p.Name))
+	}
+	out += `</select>
+	<input type="text" name="name" placeholder="Clone name">
+	<input type="submit" value="Clone profile">
+</form>
+`
+	return []byte(out)
+}
+
+// RouterHTML returns the HTML for the "I2P Router" section of the page, with
+// the router mode, the router's status and forms to control it, which carry
+// the CSRF token
+func (m *Client) RouterHTML(csrfToken string) []byte {
+	if m.Router == nil && m.Routers == nil {
+		return nil
+	}
+	out := "\n<h2>I2P Router</h2>\n"
+	if msg := m.shownError(&m.routerError); msg != "" {
+		out += fmt.Sprintf("<p><strong><code>%s</code></strong></p>\n", html.EscapeString(msg))
+	}
+	out += "<ul>\n"
+	if m.Routers != nil {
+		status := m.Routers.Status()
+		using := map[string]string{
+			tbrouter.ModeExternal: "the installed router",
+			tbrouter.ModeEmbedded: "the embedded router",
+			tbrouter.ModeNever:    "no router",
+		}[status.Active]
+		out += fmt.Sprintf("<li>Mode: %s, using %s</li>\n", html.EscapeString(status.Mode), using)
+		if embedded := status.Embedded; embedded.State != tbrouter.StateStopped || embedded.Restarts > 0 {
+			out += fmt.Sprintf("<li>Embedded router: %s since %s, restarted %d times - <a href=\"/router/log\">Log</a> - <a href=\"/router/log?previous=true\">Previous log</a></li>\n",
+				html.EscapeString(embedded.State), embedded.Since.Format("2006-01-02 15:04:05"), embedded.Restarts)
+			if embedded.Error != "" {
+				out += fmt.Sprintf("<li>Last failure: <code>%s</code></li>\n", html.EscapeString(embedded.Error))
+			}
+		}
+	}
+	if m.Router != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), ROUTER_TIMEOUT)
+		defer cancel()
+		status, err := m.Router.Status(ctx)
+		if err != nil {
+			out += fmt.Sprintf("<li>The router isn't answering on <code>%s</code>: <code>%s</code></li>\n", html.EscapeString(m.Router.URL()), html.EscapeString(err.Error()))
+		} else {
+			out += fmt.Sprintf("<li>Version: %s</li>\n", html.EscapeString(status.Version))
+			if status.Status != "" {
+				out += fmt.Sprintf("<li>Status: %s</li>\n", html.EscapeString(status.Status))
+			}
+			out += fmt.Sprintf("<li>Network: %s</li>\n", html.EscapeString(status.NetStatusName))
+			out += fmt.Sprintf("<li>Uptime: %s</li>\n", status.Uptime())
+			out += fmt.Sprintf("<li>Bandwidth: %.1f KB/s in, %.1f KB/s out</li>\n", status.BandwidthIn/1024, status.BandwidthOut/1024)
+			out += fmt.Sprintf("<li>Peers: %d active, %d known</li>\n", status.ActivePeers, status.KnownPeers)
+			out += fmt.Sprintf("<li>Participating tunnels: %d</li>\n", status.ParticipatingTunnels)
+		}
+	}
+	out += "</ul>\n"
+	htmlbytes := []byte(out)
+	token := html.EscapeString(csrfToken)
+	form := ""
+	if m.Routers != nil {
+		form += fmt.Sprintf(`<form action="/router/mode" method="post">
+	<input type="hidden" name="csrf_token" value="%s">
+	<select name="mode">`, token)
+		labels := map[string]string{
+			tbrouter.ModeAuto:     "Use an installed router, or the embedded one",
+			tbrouter.ModeExternal: "Use the installed router",
+			tbrouter.ModeEmbedded: "Use the embedded router",
+			tbrouter.ModeNever:    "Never start a router",
+		}
+		for _, mode := range tbrouter.Modes {
+			selected := ""
+			if mode == m.Routers.Mode() {
+				selected = " selected"
+			}
+			form += fmt.Sprintf(`<option value="%s"%s>%s</option>`, mode, selected, labels[mode])
+		}
+		form += `</select>
+	<input type="submit" value="Switch router">
+</form>
+`
+	}
+	if m.Router == nil {
+		return append(htmlbytes, []byte(form)...)
+	}
+	for _, action := range []struct{ path, label string }{
+		{"/router/restart", "Restart"},
+		{"/router/shutdown", "Shut down gracefully"},
+		{"/router/cancel-shutdown", "Cancel shutdown"},
+	} {
+		form += fmt.Sprintf(`<form action="%s" method="post" style="display: inline">
+	<input type="hidden" name="csrf_token" value="%s">
+	<input type="submit" value="%s">
+</form>
+`, action.path, token, action.label)
+	}
+	form += fmt.Sprintf(`<form action="/router/settings" method="post">
+	<input type="hidden" name="csrf_token" value="%s">
+	<input type="text" name="url" value="%s" placeholder="i2pcontrol URL">
+	<input type="password" name="password" placeholder="Password, needed again to change the URL" autocomplete="off">
+	<input type="submit" value="Save i2pcontrol settings">
+</form>
+`, token, html.EscapeString(m.Router.URL()))
+	return append(htmlbytes, []byte(form)...)
+}
+
+// ProxiesHTML returns the panel's section on tor-manager's own I2P proxies:
+// every profile's listener and identity, with a button to replace the identity,
+// and the form for the proxies' settings.
+func (m *Client) ProxiesHTML(csrfToken string) []byte {
+	if m.Proxies == nil {
+		return nil
+	}
+	token := html.EscapeString(csrfToken)
+	out := "\n<h2>I2P Proxies</h2>\n"
+	if msg := m.shownError(&m.proxyError); msg != "" {
+		out += fmt.Sprintf("<p><strong><code>%s</code></strong></p>\n", html.EscapeString(msg))
+	}
+	listeners := m.Proxies.Status()
+	if len(listeners) == 0 {
+		out += "<p>No I2P or app profile has been launched with its own proxy yet.</p>\n"
+	} else {
+		out += "<table>\n<tr><th>Profile</th><th>Proxy</th><th>Identity</th><th>Age</th><th></th></tr>\n"
+		for _, l := range listeners {
+			profile := l.Profile
+			if profile == tbproxy.SHARED {
+				profile = "(router's HTTP proxy port)"
+			}
+			identity, age := l.Error, ""
+			if l.Base32 != "" {
+				identity = l.Base32
+				age = time.Since(l.Since).Truncate(time.Minute).String()
+			}
+			out += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td><code>%s</code></td><td>%s</td><td><form action="/proxy/new-identity" method="post">
+	<input type="hidden" name="csrf_token" value="%s">
+	<input type="hidden" name="profile" value="%s">
+	<input type="submit" value="New identity">
+</form></td></tr>
+`, html.EscapeString(profile), html.EscapeString(l.Addr), html.EscapeString(identity), age, token, html.EscapeString(l.Profile))
+		}
+		out += "</table>\n"
+	}
+	if socks := m.Proxies.SOCKSStatus(); socks != nil {
+		out += fmt.Sprintf("<h3>SOCKS Proxy</h3>\n<p>On <code>%s</code> since %s: %d streams open, %d opened, %d failed, %d KB in, %d KB out</p>\n",
+			html.EscapeString(socks.Addr), socks.Since.Format("2006-01-02 15:04:05"), socks.Active, socks.Total, socks.Failed, (socks.BytesIn+1023)/1024, (socks.BytesOut+1023)/1024)
+		if len(socks.Identities) > 0 {
+			out += "<table>\n<tr><th>User</th><th>Identity</th><th>Open</th><th>Opened</th><th>Failed</th><th>In</th><th>Out</th><th>Last used</th></tr>\n"
+			for _, id := range socks.Identities {
+				user := id.User
+				if user == "" {
+					user = "(no authentication)"
+				}
+				identity := id.Base32
+				if identity == "" {
+					identity = id.Error
+				}
+				out += fmt.Sprintf("<tr><td>%s</td><td><code>%s</code></td><td>%d</td><td>%d</td><td>%d</td><td>%d KB</td><td>%d KB</td><td>%s</td></tr>\n",
+					html.EscapeString(user), html.EscapeString(identity), id.Active, id.Total, id.Failed, (id.BytesIn+1023)/1024, (id.BytesOut+1023)/1024, id.LastUsed.Format("2006-01-02 15:04:05"))
+			}
+			out += "</table>\n"
+		}
+	}
+	// The form edits the saved settings, so the command line overrides aren't
+	// saved with them.
+	s := m.Proxies.SavedSettings()
+	if !reflect.DeepEqual(s, m.Proxies.Settings()) {
+		out += "<p>Some of these settings are overridden on the command line. The form shows the saved settings, the overrides are in use until tor-manager is restarted without them.</p>\n"
+	}
+	out += fmt.Sprintf(`<form action="/proxy/settings" method="post">
+	<input type="hidden" name="csrf_token" value="%s">
+`, token)
+	for _, field := range []struct {
+		name, label string
+		value       int
+	}{
+		{"in_length", "Inbound hops", s.InLength},
+		{"out_length", "Outbound hops", s.OutLength},
+		{"in_variance", "Inbound hop variance", s.InVariance},
+		{"out_variance", "Outbound hop variance", s.OutVariance},
+		{"in_quantity", "Inbound tunnels", s.InQuantity},
+		{"out_quantity", "Outbound tunnels", s.OutQuantity},
+		{"in_backups", "Inbound backup tunnels", s.InBackups},
+		{"out_backups", "Outbound backup tunnels", s.OutBackups},
+		{"reduce_idle_time", "Idle time before reducing tunnels (ms)", s.ReduceIdleTime},
+		{"reduce_idle_quantity", "Tunnels when idle", s.ReduceIdleQuantity},
+		{"port", "First port of new profile proxies", s.Port},
+	} {
+		out += fmt.Sprintf(`	<label>%s <input type="number" name="%s" value="%d"></label><br>
+`, field.label, field.name, field.value)
+	}
+	for _, field := range []struct {
+		name, label string
+		value       bool
+	}{
+		{"isolate", "Give every I2P and app profile its own proxy and identity", s.Isolate},
+		{"aggressive_isolation", "Give every site its own identity", s.AggressiveIsolation},
+		{"persist_keys", "Keep identities across restarts", s.PersistKeys},
+		{"unpublished", "Don't publish leasesets", s.Unpublished},
+		{"reduce_idle", "Reduce tunnels when idle", s.ReduceIdle},
+		{"compression", "Compress traffic", s.Compression},
+		{"debug", "Log connections", s.Debug},
+		{"socks_require_auth", "Refuse SOCKS clients which don't authenticate", s.SOCKSRequireAuth},
+	} {
+		checked := ""
+		if field.value {
+			checked = " checked"
+		}
+		out += fmt.Sprintf(`	<label><input type="checkbox" name="%s"%s> %s</label><br>
+`, field.name, checked, field.label)
+	}
+	out += fmt.Sprintf(`	<label>SOCKS proxy <input type="text" name="socks_addr" value="%s" placeholder="Off, or an address like 127.0.0.1:4446"></label><br>
+`, html.EscapeString(s.SOCKSAddr))
+	out += `	<input type="submit" value="Save proxy settings">
+</form>
+`
+	return []byte(out)
+}
@@ -0,0 +1,137 @@
+package tbserve
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+	TBSupervise "i2pgit.org/idk/i2p.plugins.tor-manager/supervise"
+)
+
+// UpdateStatus describes the state of the background update scheduler.
+type UpdateStatus struct {
+	// Installed is the version of the installed product.
+	Installed string
+	// Ready is the version of a downloaded and verified update which is
+	// waiting for the browsers running from the install to close.
+	Ready string
+	// LastCheck is the time the feed was last checked.
+	LastCheck time.Time
+	// Err is the error from the last check, if there was one.
+	Err error
+}
+
+// UpdateStatus returns the state of the background update scheduler.
+func (m *Client) UpdateStatus() UpdateStatus {
+	return m.statusOf(m.downloader())
+}
+
+// statusOf returns the state of the background update scheduler for the
+// install managed by tbd.
+func (m *Client) statusOf(tbd *tbget.TBDownloader) UpdateStatus {
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	status := m.updateStatus
+	status.Installed = tbd.InstalledVersion()
+	status.Ready = ""
+	if staged, err := tbd.GetStagedUpdate(); err == nil {
+		status.Ready = staged.Version
+	}
+	return status
+}
+
+// UpdateReady returns the version of an update which has been downloaded and
+// verified, or an empty string if there isn't one.
+func (m *Client) UpdateReady() string {
+	return m.UpdateStatus().Ready
+}
+
+// CheckForUpdates checks the update feed using the mirror's network policy,
+// and downloads and verifies a new release in the background if there is one.
+// The release is swapped in as soon as no browser is running from the install.
+// The extension store is upgraded from its source at the same time.
+func (m *Client) CheckForUpdates() error {
+	if err := m.TBS.UpdateExtensions(); err != nil {
+		log.Println(err)
+	}
+	tbd := m.downloader()
+	_, err := tbd.StageUpdate()
+	m.updateMutex.Lock()
+	m.updateStatus.LastCheck = time.Now()
+	m.updateStatus.Err = err
+	m.updateMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("CheckForUpdates: %s", err)
+	}
+	_, err = applyUpdateIfIdle(tbd)
+	return err
+}
+
+// ApplyUpdateIfIdle swaps a staged update into place if no browser is running
+// from the install. It returns true if an update was applied.
+func (m *Client) ApplyUpdateIfIdle() (bool, error) {
+	return applyUpdateIfIdle(m.downloader())
+}
+
+func applyUpdateIfIdle(tbd *tbget.TBDownloader) (bool, error) {
+	if _, err := tbd.GetStagedUpdate(); err != nil {
+		return false, nil
+	}
+	unlock, err := TBSupervise.LockInstall(tbd.BrowserDir())
+	if err != nil {
+		log.Println("ApplyUpdateIfIdle: waiting for the browser to close,", err)
+		return false, nil
+	}
+	defer unlock()
+	if tbd.GetProduct().I2P {
+		unlockI2P, err := TBSupervise.LockInstall(tbd.I2PBrowserDir())
+		if err != nil {
+			log.Println("ApplyUpdateIfIdle: waiting for the browser to close,", err)
+			return false, nil
+		}
+		defer unlockI2P()
+	}
+	if err := tbd.ApplyStagedUpdate(); err != nil {
+		return false, fmt.Errorf("ApplyUpdateIfIdle: %s", err)
+	}
+	return true, nil
+}
+
+// launch applies a staged update if the install is idle, then runs a browser.
+// If the browser can't be launched, the error is shown in the profiles section.
+func (m *Client) launch(run func() error) {
+	go func() {
+		if _, err := m.ApplyUpdateIfIdle(); err != nil {
+			log.Println(err)
+		}
+		if err := run(); err != nil {
+			log.Println(err)
+			m.setError(&m.profileError, err.Error())
+		}
+	}()
+}
+
+// scheduleUpdates checks for updates every UpdateInterval, plus up to a quarter
+// of the interval of random jitter so that clients don't hit the mirrors in
+// lockstep. While an update is waiting, it retries swapping it in every minute.
+func (m *Client) scheduleUpdates(done chan struct{}) {
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano()))
+	next := time.Now()
+	for {
+		if !time.Now().Before(next) {
+			if err := m.CheckForUpdates(); err != nil {
+				log.Println(err)
+			}
+			next = time.Now().Add(m.UpdateInterval + time.Duration(jitter.Int63n(int64(m.UpdateInterval/4)+1)))
+		} else if _, err := m.ApplyUpdateIfIdle(); err != nil {
+			log.Println(err)
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
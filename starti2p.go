@@ -1,52 +1,70 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"time"
 
 	i2cpcheck "github.com/eyedeekay/checki2cp"
 	"github.com/eyedeekay/go-I2P-jpackage"
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
 	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+	tbrouter "i2pgit.org/idk/i2p.plugins.tor-manager/router"
 )
 
-func StartI2P(directory string) (*I2P.Daemon, error) {
-	if tbget.TestHTTPDefaultProxy() {
-		log.Println("I2P HTTP proxy OK")
-	} else {
-		log.Println("I2P HTTP proxy not OK")
-		run, err := i2cpcheck.ConditionallyLaunchI2P()
+// I2P_TIMEOUT is how long StartI2P waits for the HTTP proxy of a router it
+// started.
+var I2P_TIMEOUT = 2 * time.Minute
+
+// routers starts the router the router mode asks for and supervises the
+// embedded router.
+var routers *tbrouter.Manager
+
+// StartI2P starts the router the router mode asks for. If an installed router
+// is started but its HTTP proxy doesn't answer, tor-manager serves its own on
+// the proxy's port. The embedded router keeps being restarted if it isn't
+// healthy in time.
+func StartI2P(directory string) error {
+	var err error
+	routers, err = tbrouter.NewManager(directory, *routerMode, newDaemon, i2cpcheck.ConditionallyLaunchI2P)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), I2P_TIMEOUT)
+	defer cancel()
+	err = routers.Start(ctx)
+	switch routers.Active() {
+	case tbrouter.ModeEmbedded:
+		go runSysTray(false)
 		if err != nil {
-			log.Println("Couldn't launch I2P", err)
+			log.Println(err)
+			log.Println("The embedded I2P router is still starting, its log is", routers.Embedded.LogPath)
+		}
+		return nil
+	case tbrouter.ModeExternal:
+		if err == nil {
+			log.Println("I2P HTTP proxy OK")
+			return nil
 		}
-		if run {
-			if tbget.TestHTTPDefaultProxy() {
-				log.Println("I2P HTTP proxy OK after launching I2P")
-			} else {
-				go proxy()
-				if !tbget.TestHTTPBackupProxy() {
-					log.Println("Please set the I2P HTTP proxy on localhost:4444", err)
-					return nil, err
-				}
-			}
-		} else {
-			I2Pdaemon, err := I2P.NewDaemon(directory, false)
-			if err != nil {
-				log.Println(err)
-				return nil, err
-			}
-			if err = I2Pdaemon.Start(); err != nil {
-				log.Println(err)
-				return nil, err
-			}
-			shutdown = true
-			go runSysTray(true)
-			if tbget.TestHTTPDefaultProxy() {
-				log.Println("I2P HTTP proxy OK")
-			} else {
-				log.Println(err)
-				return nil, err
-			}
-			return I2Pdaemon, nil
+		log.Println(err)
+		if err := proxy(); err != nil {
+			return fmt.Errorf("StartI2P: %s", err)
 		}
+		if !tbget.TestHTTPBackupProxy() {
+			log.Println("Please set the I2P HTTP proxy on", tbdiscover.Default().HTTPProxy.Addr())
+			return fmt.Errorf("StartI2P: no HTTP proxy on %s", tbdiscover.Default().HTTPProxy.Addr())
+		}
+		return nil
+	}
+	if routers.Mode() == tbrouter.ModeNever {
+		log.Println(err)
+		return nil
 	}
-	return nil, nil
+	return err
+}
+
+// newDaemon creates the embedded router in dir.
+func newDaemon(dir string) (tbrouter.Daemon, error) {
+	return I2P.NewDaemon(dir, false)
 }
@@ -0,0 +1,128 @@
+package tbsupervise
+
+import (
+	"fmt"
+	"strings"
+)
+
+// browserFlag is a Firefox command line flag which may be passed through to
+// the browser.
+type browserFlag struct {
+	// value is set if the flag takes a value.
+	value bool
+	// optional is set if the value may be left out.
+	optional bool
+	// modes are the modes the flag is allowed in. If it is empty, the flag is
+	// allowed in every mode.
+	modes []string
+}
+
+// allowedBrowserFlags are the flags which may be passed through to browsers,
+// by lower-case name. Firefox doesn't care about case or the number of dashes.
+var allowedBrowserFlags = map[string]browserFlag{
+	"new-window":     {value: true},
+	"new-tab":        {value: true},
+	"private-window": {value: true, optional: true},
+	"url":            {value: true},
+	"browser":        {},
+	"preferences":    {},
+	"safe-mode":      {},
+	"kiosk":          {},
+	"disable-pinch":  {},
+	"jsconsole":      {},
+	"devtools":       {},
+	// Searching sends the term to a search engine, which offline and app
+	// browsers can't reach.
+	"search": {value: true, modes: []string{ModeTor, ModeI2P, ModeClearnet}},
+	// These are options of the start-tor-browser script, which is only used
+	// by Tor Browsers.
+	"verbose": {modes: []string{ModeTor}},
+	"log":     {value: true, optional: true, modes: []string{ModeTor}},
+}
+
+// deniedBrowserFlags are the flags which would undo what tor-manager sets up
+// for the mode, by lower-case name, with the reason they are refused.
+var deniedBrowserFlags = map[string]string{
+	"p":                     "selects another profile",
+	"profile":               "selects another profile",
+	"profilemanager":        "selects another profile",
+	"createprofile":         "creates another profile",
+	"migration":             "imports another browser's profile",
+	"proxy-server":          "overrides the proxy",
+	"proxy-pac-url":         "overrides the proxy",
+	"proxy-bypass-list":     "overrides the proxy",
+	"no-proxy-server":       "overrides the proxy",
+	"headless":              "runs the browser headless",
+	"screenshot":            "runs the browser headless",
+	"window-size":           "runs the browser headless",
+	"remote-debugging-port": "lets other programs control the browser",
+	"remote-allow-hosts":    "lets other programs control the browser",
+	"remote-allow-origins":  "lets other programs control the browser",
+	"start-debugger-server": "lets other programs control the browser",
+	"marionette":            "lets other programs control the browser",
+	"allow-remote":          "lets other programs control the browser",
+	"jsdebugger":            "lets other programs control the browser",
+	"wait-for-jsdebugger":   "lets other programs control the browser",
+	"detach":                "detaches the browser from tor-manager",
+}
+
+// ValidateBrowserArgs checks the arguments passed through to a browser in the
+// mode. Flags must be allowed in the mode, and flags which override the
+// profile, proxy, headless or remote debugging settings are always refused.
+// Arguments which aren't flags are URLs to open. On Windows, arguments which
+// start with a slash are flags too.
+func ValidateBrowserArgs(mode string, args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !isBrowserFlag(arg) {
+			continue
+		}
+		name := strings.ToLower(strings.TrimLeft(arg, flagPrefixes()))
+		inline := strings.Contains(name, "=")
+		name = strings.SplitN(name, "=", 2)[0]
+		if name == "" {
+			return fmt.Errorf("ValidateBrowserArgs: %s is not a browser flag", arg)
+		}
+		if reason, ok := deniedBrowserFlags[name]; ok {
+			return fmt.Errorf("ValidateBrowserArgs: %s is not allowed, it %s", arg, reason)
+		}
+		f, ok := allowedBrowserFlags[name]
+		if !ok {
+			return fmt.Errorf("ValidateBrowserArgs: %s is not a browser flag tor-manager passes through", arg)
+		}
+		if len(f.modes) > 0 && !containsMode(f.modes, mode) {
+			return fmt.Errorf("ValidateBrowserArgs: %s is not allowed in %s mode", arg, mode)
+		}
+		if !f.value || inline {
+			continue
+		}
+		if i+1 < len(args) && !isBrowserFlag(args[i+1]) {
+			i++
+		} else if !f.optional {
+			return fmt.Errorf("ValidateBrowserArgs: %s needs a value", arg)
+		}
+	}
+	return nil
+}
+
+// flagPrefixes are the characters browser flags start with. On Windows,
+// Firefox also takes flags which start with a slash, such as /profile.
+func flagPrefixes() string {
+	if OS() == "win" {
+		return "-/"
+	}
+	return "-"
+}
+
+func isBrowserFlag(arg string) bool {
+	return arg != "" && strings.ContainsRune(flagPrefixes(), rune(arg[0]))
+}
+
+func containsMode(modes []string, mode string) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,369 @@
+package tbsupervise
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LOG_KEEP is how many browser launch logs are kept. It can be set with
+// TOR_MANAGER_LOG_KEEP.
+var LOG_KEEP = DefaultLogKeep()
+
+// CRASH_LINES is how many of the last lines of a crashed browser's output its
+// crash report keeps. It can be set with TOR_MANAGER_CRASH_LINES.
+var CRASH_LINES = DefaultCrashLines()
+
+// LOG_MAX_SIZE is the size at which a launch log is rotated. The rotated part
+// is kept next to it with a .1 suffix.
+const LOG_MAX_SIZE = 10 << 20
+
+// maxCrashes is how many crash reports are kept.
+const maxCrashes = 50
+
+// DefaultLogKeep returns the number of logs to keep configured in the
+// environment, or 20.
+func DefaultLogKeep() int {
+	n, err := strconv.Atoi(os.Getenv("TOR_MANAGER_LOG_KEEP"))
+	if err != nil || n < 1 {
+		return 20
+	}
+	return n
+}
+
+// DefaultCrashLines returns the number of lines crash reports keep configured
+// in the environment, or 200.
+func DefaultCrashLines() int {
+	n, err := strconv.Atoi(os.Getenv("TOR_MANAGER_CRASH_LINES"))
+	if err != nil || n < 1 {
+		return 200
+	}
+	return n
+}
+
+// BrowserLog is the output of one browser launch.
+type BrowserLog struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// CrashReport records a browser which exited with an error or was killed by a
+// signal.
+type CrashReport struct {
+	Time    time.Time `json:"time"`
+	Mode    string    `json:"mode"`
+	Profile string    `json:"profile"`
+	Version string    `json:"version"`
+	// Exit is how the browser exited, like "exit status 1" or "signal: killed".
+	Exit string `json:"exit"`
+	// Log is the name of the launch log.
+	Log string `json:"log"`
+	// Tail is the last CRASH_LINES lines of the browser's output.
+	Tail []string `json:"tail"`
+}
+
+var crashesMutex sync.Mutex
+
+// LogDir returns the directory which holds the browser launch logs and crash
+// reports.
+func (s *Supervisor) LogDir() string {
+	return filepath.Join(filepath.Dir(s.TBUnpackPath()), "logs")
+}
+
+func (s *Supervisor) crashesPath() string {
+	return filepath.Join(s.LogDir(), "crashes.json")
+}
+
+// BrowserLogs returns the launch logs, newest first.
+func (s *Supervisor) BrowserLogs() []BrowserLog {
+	matches, _ := filepath.Glob(filepath.Join(s.LogDir(), "*.log"))
+	var logs []BrowserLog
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			continue
+		}
+		logs = append(logs, BrowserLog{Name: filepath.Base(match), Size: info.Size(), Modified: info.ModTime()})
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Name > logs[j].Name })
+	return logs
+}
+
+// BrowserLogPath returns the path of the named launch log, or of its rotated
+// part. It returns an error for any other name.
+func (s *Supervisor) BrowserLogPath(name string) (string, error) {
+	if name != filepath.Base(name) || !(strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".log.1")) {
+		return "", fmt.Errorf("BrowserLogPath: %s is not a browser log", name)
+	}
+	path := filepath.Join(s.LogDir(), name)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("BrowserLogPath: %s", err)
+	}
+	return path, nil
+}
+
+// Crashes returns the crash reports, newest first.
+func (s *Supervisor) Crashes() []CrashReport {
+	crashesMutex.Lock()
+	defer crashesMutex.Unlock()
+	return s.readCrashes()
+}
+
+func (s *Supervisor) readCrashes() []CrashReport {
+	var crashes []CrashReport
+	bytes, err := ioutil.ReadFile(s.crashesPath())
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(bytes, &crashes); err != nil {
+		log.Println("readCrashes:", err)
+		return nil
+	}
+	return crashes
+}
+
+func (s *Supervisor) recordCrash(crash CrashReport) error {
+	crashesMutex.Lock()
+	defer crashesMutex.Unlock()
+	crashes := append([]CrashReport{crash}, s.readCrashes()...)
+	if len(crashes) > maxCrashes {
+		crashes = crashes[:maxCrashes]
+	}
+	bytes, err := json.MarshalIndent(crashes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.crashesPath(), bytes, 0644)
+}
+
+// profileFor returns the managed profile which uses the profile directory, or
+// nil if it isn't a managed profile.
+func (s *Supervisor) profileFor(profiledata string) *Profile {
+	profiles, err := s.Profiles()
+	if err != nil {
+		return nil
+	}
+	want, _ := filepath.Abs(profiledata)
+	for _, p := range profiles {
+		dir := s.ProfileDir(p)
+		if dir != "" {
+			dir, _ = filepath.Abs(dir)
+		}
+		if (profiledata == "" && dir == "") || (profiledata != "" && dir == want) {
+			return p
+		}
+	}
+	return nil
+}
+
+// launchName returns the name a launch with the profile directory is logged
+// under.
+func (s *Supervisor) launchName(profiledata string) string {
+	if p := s.profileFor(profiledata); p != nil {
+		return p.Name
+	}
+	if isEphemeral(profiledata) {
+		return "ephemeral"
+	}
+	return filepath.Base(profiledata)
+}
+
+// installVersion returns the version of the browser unpacked in the install,
+// as recorded when it was unpacked.
+func installVersion(install string) string {
+	candidates := []string{install}
+	if resolved, err := filepath.EvalSymlinks(install); err == nil {
+		candidates = append(candidates, resolved)
+	}
+	// The I2P Browser install is a copy of the Tor Browser install.
+	candidates = append(candidates, strings.Replace(install, "i2p-browser", "tor-browser", -1))
+	for _, dir := range candidates {
+		if bytes, err := ioutil.ReadFile(dir + ".version"); err == nil {
+			return strings.TrimSpace(string(bytes))
+		}
+	}
+	return "unknown"
+}
+
+var logName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// launchLog writes a browser's output to its launch log, rotating it when it
+// grows past LOG_MAX_SIZE, and remembers its last CRASH_LINES lines.
+type launchLog struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+	size  int64
+	tail  []string
+}
+
+// openLaunchLog creates the log of a launch, and removes the oldest logs
+// beyond LOG_KEEP.
+func (s *Supervisor) openLaunchLog(mode, profile, version string, bcmd *exec.Cmd) (*launchLog, error) {
+	if err := os.MkdirAll(s.LogDir(), 0755); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s-%s.log", now.Format("20060102-150405.000"), mode, logName.ReplaceAllString(profile, "_"))
+	l := &launchLog{path: filepath.Join(s.LogDir(), name)}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	n, _ := fmt.Fprintf(l.file, "# Started:  %s\n# Mode:     %s\n# Profile:  %s\n# Version:  %s\n# Command:  %s\n\n",
+		now.Format(time.RFC3339), mode, profile, version, strings.Join(bcmd.Args, " "))
+	l.size = int64(n)
+	s.pruneLogs()
+	return l, nil
+}
+
+func (s *Supervisor) pruneLogs() {
+	logs := s.BrowserLogs()
+	if len(logs) <= LOG_KEEP {
+		return
+	}
+	for _, old := range logs[LOG_KEEP:] {
+		path := filepath.Join(s.LogDir(), old.Name)
+		os.Remove(path)
+		os.Remove(path + ".1")
+	}
+}
+
+// Name returns the name of the launch log.
+func (l *launchLog) Name() string {
+	return filepath.Base(l.path)
+}
+
+func (l *launchLog) write(p []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return
+	}
+	if l.size+int64(len(p)) > LOG_MAX_SIZE {
+		l.file.Close()
+		os.Rename(l.path, l.path+".1")
+		file, err := os.OpenFile(l.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Println("launchLog:", err)
+			l.file = nil
+			return
+		}
+		l.file, l.size = file, 0
+		fmt.Fprintf(l.file, "# Continued from %s.1\n\n", filepath.Base(l.path))
+	}
+	n, _ := l.file.Write(p)
+	l.size += int64(n)
+}
+
+func (l *launchLog) addLine(line string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.tail = append(l.tail, line)
+	if len(l.tail) > CRASH_LINES {
+		l.tail = l.tail[len(l.tail)-CRASH_LINES:]
+	}
+}
+
+// Tail returns the last lines of output.
+func (l *launchLog) Tail() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string{}, l.tail...)
+}
+
+// Close closes the launch log.
+func (l *launchLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Stream returns a writer for one of the browser's output streams, which
+// writes to the log and to terminal. The terminal may be gone, as it is when
+// tor-manager runs from the systray, so errors writing to it are ignored.
+func (l *launchLog) Stream(terminal io.Writer) io.Writer {
+	return &logStream{log: l, terminal: terminal}
+}
+
+type logStream struct {
+	log      *launchLog
+	terminal io.Writer
+	partial  []byte
+}
+
+func (w *logStream) Write(p []byte) (int, error) {
+	w.log.write(p)
+	if w.terminal != nil {
+		w.terminal.Write(p)
+	}
+	w.partial = append(w.partial, p...)
+	for {
+		i := strings.IndexByte(string(w.partial), '\n')
+		if i < 0 {
+			break
+		}
+		w.log.addLine(strings.TrimRight(string(w.partial[:i]), "\r"))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// logBrowser sends the output of bcmd to a new launch log, as well as to
+// wherever it was going. The returned function records a crash report if the
+// browser exited with err, and closes the log.
+func (s *Supervisor) logBrowser(install, profiledata, mode string, bcmd *exec.Cmd) func(err error) {
+	profile := s.launchName(profiledata)
+	version := installVersion(install)
+	l, err := s.openLaunchLog(mode, profile, version, bcmd)
+	if err != nil {
+		log.Println("Warning: can't log the browser's output:", err)
+		return func(error) {}
+	}
+	stdout, stderr := l.Stream(bcmd.Stdout), l.Stream(bcmd.Stderr)
+	bcmd.Stdout, bcmd.Stderr = stdout, stderr
+	return func(err error) {
+		for _, stream := range []io.Writer{stdout, stderr} {
+			if partial := stream.(*logStream).partial; len(partial) > 0 {
+				l.addLine(string(partial))
+			}
+		}
+		defer l.Close()
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return
+		}
+		crash := CrashReport{
+			Time:    time.Now(),
+			Mode:    mode,
+			Profile: profile,
+			Version: version,
+			Exit:    exitErr.ProcessState.String(),
+			Log:     l.Name(),
+			Tail:    l.Tail(),
+		}
+		l.write([]byte(fmt.Sprintf("\n# Crashed:  %s %s\n", crash.Time.Format(time.RFC3339), crash.Exit)))
+		log.Printf("The %s browser with profile %s crashed (%s), its output is in %s", mode, profile, crash.Exit, l.path)
+		if err := s.recordCrash(crash); err != nil {
+			log.Println("Warning: can't record the crash:", err)
+		}
+	}
+}
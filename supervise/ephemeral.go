@@ -0,0 +1,245 @@
+package tbsupervise
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+)
+
+// EPHEMERAL launches profiles in a throwaway copy of their template, which is
+// wiped when the browser exits. It can be set with TOR_MANAGER_EPHEMERAL.
+var EPHEMERAL = os.Getenv("TOR_MANAGER_EPHEMERAL") == "true"
+
+// EPHEMERAL_HELPER is the argument which makes tor-manager run as the helper
+// which waits for a browser with an ephemeral profile to exit and wipes it.
+const EPHEMERAL_HELPER = "--ephemeral-helper"
+
+// ephemeralPrefix starts the name of every ephemeral profile directory.
+const ephemeralPrefix = "tor-manager-ephemeral-"
+
+// ephemeralOwner is the file in an ephemeral profile which holds the process
+// ID of the process responsible for wiping it.
+const ephemeralOwner = ".tor-manager-ephemeral"
+
+// ephemeral are the ephemeral profile directories in use by this process, and
+// whether a helper is watching them.
+var ephemeral = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+// EphemeralRoots returns the directories ephemeral profiles may be created in,
+// best first. On Linux, the runtime directory and /dev/shm are memory-backed,
+// so the profile never reaches the disk.
+func EphemeralRoots() []string {
+	var roots []string
+	if OS() == "linux" {
+		if runtime := os.Getenv("XDG_RUNTIME_DIR"); runtime != "" {
+			roots = append(roots, runtime)
+		}
+		roots = append(roots, "/dev/shm")
+	}
+	return append(roots, os.TempDir())
+}
+
+// newEphemeralProfile creates an ephemeral profile directory from the template.
+func (s *Supervisor) newEphemeralProfile(template string) (string, error) {
+	var dir string
+	var err error
+	for _, root := range EphemeralRoots() {
+		if dir, err = ioutil.TempDir(root, ephemeralPrefix); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("newEphemeralProfile: %s", err)
+	}
+	if err := writeEphemeralOwner(dir, os.Getpid()); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("newEphemeralProfile: %s", err)
+	}
+	if err := s.unpackTemplate(template, dir); err != nil {
+		WipeDirectory(dir)
+		return "", fmt.Errorf("newEphemeralProfile: %s", err)
+	}
+	ephemeral.Lock()
+	ephemeral.dirs[installKey(dir)] = false
+	ephemeral.Unlock()
+	log.Println("Created ephemeral profile", dir)
+	return dir, nil
+}
+
+// releaseEphemeralProfile wipes the ephemeral profile, unless a helper is
+// watching it and will.
+func releaseEphemeralProfile(dir string) {
+	ephemeral.Lock()
+	watched := ephemeral.dirs[installKey(dir)]
+	delete(ephemeral.dirs, installKey(dir))
+	ephemeral.Unlock()
+	if !watched && tbget.FileExists(dir) {
+		if err := WipeDirectory(dir); err != nil {
+			log.Println("releaseEphemeralProfile:", err)
+		}
+	}
+}
+
+func isEphemeral(profiledata string) bool {
+	if profiledata == "" {
+		return false
+	}
+	ephemeral.Lock()
+	defer ephemeral.Unlock()
+	_, ok := ephemeral.dirs[installKey(profiledata)]
+	return ok
+}
+
+func writeEphemeralOwner(dir string, pid int) error {
+	return ioutil.WriteFile(filepath.Join(dir, ephemeralOwner), []byte(strconv.Itoa(pid)), 0600)
+}
+
+// RunEphemeralProfile launches the browser in the named profile's mode with a
+// new profile created from the profile's template. The profile is wiped when
+// the browser exits, by a helper process which outlives tor-manager if it has
+// to. The named profile itself isn't touched.
+func (s *Supervisor) RunEphemeralProfile(name string) error {
+	p, err := s.GetProfile(name)
+	if err != nil {
+		return err
+	}
+	dir, err := s.newEphemeralProfile(p.Template)
+	if err != nil {
+		return err
+	}
+	defer releaseEphemeralProfile(dir)
+	return s.runProfileIn(p, dir)
+}
+
+// watchEphemeral starts the ephemeral helper, which wipes the profile once the
+// browser with the process ID exits. The helper runs on its own, so that it
+// still wipes the profile if tor-manager crashes or is killed first.
+func watchEphemeral(profiledata string, pid int) {
+	self, err := os.Executable()
+	if err == nil {
+		hcmd := exec.Command(self, EPHEMERAL_HELPER, profiledata, strconv.Itoa(pid))
+		hcmd.SysProcAttr = detachedProcAttr()
+		if err = hcmd.Start(); err == nil {
+			go hcmd.Wait()
+			ephemeral.Lock()
+			ephemeral.dirs[installKey(profiledata)] = true
+			ephemeral.Unlock()
+			return
+		}
+	}
+	log.Println("Warning: the ephemeral profile will only be wiped if tor-manager is still running when the browser exits:", err)
+}
+
+// RunEphemeralHelper is run by tor-manager with EPHEMERAL_HELPER as its first
+// argument. It waits for the browser to exit and wipes the ephemeral profile,
+// whether or not tor-manager is still running. args are the profile directory
+// and the browser's process ID.
+func RunEphemeralHelper(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("RunEphemeralHelper: usage: %s profile pid", EPHEMERAL_HELPER)
+	}
+	dir := args[0]
+	if !strings.HasPrefix(filepath.Base(dir), ephemeralPrefix) {
+		return fmt.Errorf("RunEphemeralHelper: %s is not an ephemeral profile", dir)
+	}
+	pid, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("RunEphemeralHelper: %s", err)
+	}
+	signal.Ignore(ephemeralSignals...)
+	if err := writeEphemeralOwner(dir, os.Getpid()); err != nil {
+		return fmt.Errorf("RunEphemeralHelper: %s", err)
+	}
+	for processAlive(pid) && tbget.FileExists(dir) {
+		time.Sleep(time.Second)
+	}
+	return WipeDirectory(dir)
+}
+
+// ReapEphemeralProfiles wipes the ephemeral profiles left behind by browsers
+// whose helper is gone, after a crash or power loss.
+func ReapEphemeralProfiles() {
+	for _, root := range EphemeralRoots() {
+		matches, _ := filepath.Glob(filepath.Join(root, ephemeralPrefix+"*"))
+		for _, dir := range matches {
+			if ephemeralInUse(dir) {
+				continue
+			}
+			log.Println("Wiping orphaned ephemeral profile", dir)
+			if err := WipeDirectory(dir); err != nil {
+				log.Println("ReapEphemeralProfiles:", err)
+			}
+		}
+	}
+}
+
+func ephemeralInUse(dir string) bool {
+	if isEphemeral(dir) {
+		return true
+	}
+	owner, err := ioutil.ReadFile(filepath.Join(dir, ephemeralOwner))
+	if err != nil {
+		// It may have been created a moment ago, and not have an owner yet.
+		info, err := os.Stat(dir)
+		return err == nil && time.Since(info.ModTime()) < time.Minute
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(owner)))
+	return err == nil && processAlive(pid)
+}
+
+// WipeDirectory overwrites every file in the directory with zeros, flushes
+// them to disk, and removes the directory.
+func WipeDirectory(dir string) error {
+	var werr error
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := overwriteFile(path, info.Size()); err != nil && werr == nil {
+			werr = err
+		}
+		return nil
+	})
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("WipeDirectory: %s", err)
+	}
+	if werr != nil {
+		return fmt.Errorf("WipeDirectory: %s", werr)
+	}
+	return nil
+}
+
+func overwriteFile(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	zeros := make([]byte, 64*1024)
+	for written := int64(0); written < size; {
+		n := int64(len(zeros))
+		if size-written < n {
+			n = size - written
+		}
+		if _, err := file.Write(zeros[:n]); err != nil {
+			return err
+		}
+		written += n
+	}
+	return file.Sync()
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package tbsupervise
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+var ephemeralSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// processAlive returns true if a process with the ID is running. Zombies, which
+// have exited but not been reaped by their parent, aren't running.
+func processAlive(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	if stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+		if i := strings.LastIndex(string(stat), ")"); i >= 0 && strings.HasPrefix(string(stat[i+1:]), " Z") {
+			return false
+		}
+	}
+	return true
+}
+
+// detachedProcAttr starts a process in its own session, so it isn't
+// interrupted along with tor-manager.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
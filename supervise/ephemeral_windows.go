@@ -0,0 +1,31 @@
+package tbsupervise
+
+import (
+	"os"
+	"syscall"
+)
+
+var ephemeralSignals = []os.Signal{os.Interrupt}
+
+// processAlive returns true if a process with the ID is running.
+func processAlive(pid int) bool {
+	// PROCESS_QUERY_LIMITED_INFORMATION
+	handle, err := syscall.OpenProcess(0x1000, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(handle)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(handle, &code); err != nil {
+		return false
+	}
+	// STILL_ACTIVE
+	return code == 259
+}
+
+// detachedProcAttr starts a process in its own process group, so it isn't
+// interrupted along with tor-manager.
+func detachedProcAttr() *syscall.SysProcAttr {
+	// CREATE_NEW_PROCESS_GROUP
+	return &syscall.SysProcAttr{CreationFlags: 0x00000200}
+}
@@ -0,0 +1,549 @@
+package tbsupervise
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+)
+
+// EXTENSION_SOURCE is the URL of an extension index which the extension store
+// is upgraded from. Sources on .i2p and .onion hosts are fetched over I2P and
+// Tor. It is empty by default, which means only the embedded extensions are
+// used. It can be set with TOR_MANAGER_EXTENSION_SOURCE. The index is trusted
+// for the hashes of the xpis, so clearnet sources must use https.
+var EXTENSION_SOURCE = os.Getenv("TOR_MANAGER_EXTENSION_SOURCE")
+
+// ExtensionSpec is an extension the supervisor installs into profiles.
+type ExtensionSpec struct {
+	// ID is the extension's gecko ID, which is also its file name in a profile.
+	ID string
+	// Embedded is the path of the xpi in the embedded content, if it is shipped
+	// with tor-manager. Extensions which aren't are only installed once they
+	// have been fetched from EXTENSION_SOURCE.
+	Embedded string
+}
+
+// ExtensionSpecs are the extensions the supervisor manages.
+var ExtensionSpecs = []ExtensionSpec{
+	{ID: "uBlock0@raymondhill.net", Embedded: path.Join(TEMPLATE_ROOT, "i2p.firefox", "extensions", "uBlock0@raymondhill.net.xpi")},
+	{ID: "awo@eyedeekay.github.io", Embedded: path.Join(TEMPLATE_ROOT, "awo@eyedeekay.github.io.xpi")},
+	{ID: "i2ppb@eyedeekay.github.io"},
+}
+
+// RequiredExtensions returns the IDs of the extensions profiles of the mode need.
+func RequiredExtensions(mode string) []string {
+	switch mode {
+	case ModeClearnet:
+		return []string{"uBlock0@raymondhill.net"}
+	case ModeOffline:
+		return []string{"uBlock0@raymondhill.net", "awo@eyedeekay.github.io"}
+	case ModeI2P:
+		return []string{"uBlock0@raymondhill.net", "i2ppb@eyedeekay.github.io"}
+	case ModeApp:
+		return []string{"awo@eyedeekay.github.io", "i2ppb@eyedeekay.github.io"}
+	}
+	return nil
+}
+
+func extensionSpec(id string) (ExtensionSpec, bool) {
+	for _, spec := range ExtensionSpecs {
+		if spec.ID == id {
+			return spec, true
+		}
+	}
+	return ExtensionSpec{}, false
+}
+
+// StoredExtension is a verified xpi in the extension store.
+type StoredExtension struct {
+	ID      string    `json:"id"`
+	Version string    `json:"version"`
+	SHA256  string    `json:"sha256"`
+	File    string    `json:"file"`
+	Source  string    `json:"source"`
+	Updated time.Time `json:"updated"`
+}
+
+// extensionsMutex serializes changes to the extension store.
+var extensionsMutex sync.Mutex
+
+// ExtensionStore returns the directory which holds the verified xpis the
+// supervisor installs into profiles.
+func (s *Supervisor) ExtensionStore() string {
+	return filepath.Join(filepath.Dir(s.TBUnpackPath()), "extensions")
+}
+
+func (s *Supervisor) extensionIndexPath() string {
+	return filepath.Join(s.ExtensionStore(), "extensions.json")
+}
+
+func (s *Supervisor) readExtensionIndex() map[string]*StoredExtension {
+	index := make(map[string]*StoredExtension)
+	bytes, err := ioutil.ReadFile(s.extensionIndexPath())
+	if err != nil {
+		return index
+	}
+	if err := json.Unmarshal(bytes, &index); err != nil {
+		log.Println("readExtensionIndex:", err)
+	}
+	return index
+}
+
+func (s *Supervisor) writeExtensionIndex(index map[string]*StoredExtension) error {
+	bytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("writeExtensionIndex: %s", err)
+	}
+	return ioutil.WriteFile(s.extensionIndexPath(), bytes, 0644)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// XPIInfo is what an xpi's manifest.json says about it.
+type XPIInfo struct {
+	ID      string
+	Name    string
+	Version string
+}
+
+// ReadXPI reads the ID, name and version from an xpi's manifest.json.
+func ReadXPI(xpi string) (*XPIInfo, error) {
+	r, err := zip.OpenReader(xpi)
+	if err != nil {
+		return nil, fmt.Errorf("ReadXPI: %s", err)
+	}
+	defer r.Close()
+	readJSON := func(name string, v interface{}) error {
+		f, err := r.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return json.NewDecoder(f).Decode(v)
+	}
+	type gecko struct {
+		Gecko struct {
+			ID string `json:"id"`
+		} `json:"gecko"`
+	}
+	var manifest struct {
+		Name                   string `json:"name"`
+		Version                string `json:"version"`
+		DefaultLocale          string `json:"default_locale"`
+		Applications           gecko  `json:"applications"`
+		BrowserSpecificSetting gecko  `json:"browser_specific_settings"`
+	}
+	if err := readJSON("manifest.json", &manifest); err != nil {
+		return nil, fmt.Errorf("ReadXPI: %s: %s", xpi, err)
+	}
+	info := &XPIInfo{
+		ID:      manifest.BrowserSpecificSetting.Gecko.ID,
+		Name:    manifest.Name,
+		Version: manifest.Version,
+	}
+	if info.ID == "" {
+		info.ID = manifest.Applications.Gecko.ID
+	}
+	if strings.HasPrefix(info.Name, "__MSG_") && manifest.DefaultLocale != "" {
+		var messages map[string]struct {
+			Message string `json:"message"`
+		}
+		key := strings.TrimSuffix(strings.TrimPrefix(info.Name, "__MSG_"), "__")
+		if err := readJSON(path.Join("_locales", manifest.DefaultLocale, "messages.json"), &messages); err == nil {
+			if msg, ok := messages[key]; ok {
+				info.Name = msg.Message
+			}
+		}
+	}
+	return info, nil
+}
+
+// storeXPI checks that the xpi is the extension id, at the version if one is
+// given, and adds it to the store as the extension's current version, removing
+// the versions it replaces.
+func (s *Supervisor) storeXPI(index map[string]*StoredExtension, id, version string, data []byte, source string) (*StoredExtension, error) {
+	if err := os.MkdirAll(s.ExtensionStore(), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(s.ExtensionStore(), id+"-*.part")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	tmp.Close()
+	info, err := ReadXPI(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	if info.ID != "" && info.ID != id {
+		return nil, fmt.Errorf("%s from %s is the extension %s", id, source, info.ID)
+	}
+	if version != "" && info.Version != version {
+		return nil, fmt.Errorf("%s from %s is version %s, expected %s", id, source, info.Version, version)
+	}
+	stored := &StoredExtension{
+		ID:      id,
+		Version: info.Version,
+		SHA256:  sha256Hex(data),
+		File:    id + "-" + info.Version + ".xpi",
+		Source:  source,
+		Updated: time.Now(),
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.ExtensionStore(), stored.File)); err != nil {
+		return nil, err
+	}
+	index[id] = stored
+	if err := s.writeExtensionIndex(index); err != nil {
+		return nil, err
+	}
+	s.pruneExtension(stored)
+	log.Printf("stored %s %s from %s", id, stored.Version, source)
+	return stored, nil
+}
+
+// pruneExtension removes the versions of an extension the store no longer uses.
+func (s *Supervisor) pruneExtension(current *StoredExtension) {
+	old, err := filepath.Glob(filepath.Join(s.ExtensionStore(), current.ID+"-*.xpi"))
+	if err != nil {
+		return
+	}
+	for _, file := range old {
+		if filepath.Base(file) != current.File {
+			log.Println("removing obsolete extension", file)
+			os.Remove(file)
+		}
+	}
+}
+
+// StoredExtension returns the verified xpi of the extension in the store. The
+// store is seeded from the embedded content, which also replaces stored xpis
+// which don't match their recorded hash, or which are older than the embedded
+// one. It returns nil if the extension isn't available.
+func (s *Supervisor) StoredExtension(id string) (*StoredExtension, string, error) {
+	spec, ok := extensionSpec(id)
+	if !ok {
+		return nil, "", fmt.Errorf("StoredExtension: unknown extension %s", id)
+	}
+	extensionsMutex.Lock()
+	defer extensionsMutex.Unlock()
+	index := s.readExtensionIndex()
+	stored := index[id]
+	if stored != nil {
+		sum, err := fileSHA256(filepath.Join(s.ExtensionStore(), stored.File))
+		if err != nil || sum != stored.SHA256 {
+			log.Printf("StoredExtension: %s %s does not match its recorded hash, discarding it", id, stored.Version)
+			os.Remove(filepath.Join(s.ExtensionStore(), stored.File))
+			stored = nil
+		}
+	}
+	if spec.Embedded != "" && s.Profile != nil {
+		data, err := s.Profile.ReadFile(spec.Embedded)
+		if err == nil && (stored == nil || (stored.SHA256 != sha256Hex(data) && s.embeddedIsNewer(data, stored))) {
+			if stored, err = s.storeXPI(index, id, "", data, "embedded"); err != nil {
+				return nil, "", fmt.Errorf("StoredExtension: %s", err)
+			}
+		}
+	}
+	if stored == nil {
+		return nil, "", nil
+	}
+	return stored, filepath.Join(s.ExtensionStore(), stored.File), nil
+}
+
+func (s *Supervisor) embeddedIsNewer(data []byte, stored *StoredExtension) bool {
+	tmp, err := ioutil.TempFile("", "embedded-*.xpi")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Write(data)
+	tmp.Close()
+	info, err := ReadXPI(tmp.Name())
+	if err != nil {
+		return false
+	}
+	return tbget.CompareVersions(info.Version, stored.Version) > 0
+}
+
+// ExtensionFile returns the path of the extension's xpi in the store, or an
+// empty string if it isn't available.
+func (s *Supervisor) ExtensionFile(id string) string {
+	_, file, err := s.StoredExtension(id)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return file
+}
+
+// ExtensionIndexEntry is an extension offered by an EXTENSION_SOURCE index.
+type ExtensionIndexEntry struct {
+	Version string `json:"version"`
+	// URL of the xpi, relative to the index.
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// sourceRoute picks the network to reach a source on from its host.
+func sourceRoute(u *url.URL) string {
+	switch {
+	case strings.HasSuffix(u.Hostname(), ".i2p"):
+		return "i2p"
+	case strings.HasSuffix(u.Hostname(), ".onion"):
+		return "tor"
+	}
+	return "clearnet"
+}
+
+// checkExtensionSource refuses sources whose index could be replaced on the
+// way: only https URLs, and .i2p and .onion hosts, whose addresses
+// authenticate them, are allowed.
+func checkExtensionSource(u *url.URL) error {
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("extension source %s is not an http or https URL", u)
+	case u.Scheme == "https", sourceRoute(u) != "clearnet":
+		return nil
+	}
+	return fmt.Errorf("extension source %s must use https, or be on an .i2p or .onion host", u)
+}
+
+// UpdateExtensions upgrades the extension store from EXTENSION_SOURCE. The
+// source is a JSON object mapping extension IDs to ExtensionIndexEntries. It
+// must pass checkExtensionSource, and every xpi must match the hash given in
+// the index. Profiles get the new versions
+// the next time they are launched.
+func (s *Supervisor) UpdateExtensions() error {
+	if EXTENSION_SOURCE == "" {
+		return nil
+	}
+	source, err := url.Parse(EXTENSION_SOURCE)
+	if err != nil {
+		return fmt.Errorf("UpdateExtensions: %s", err)
+	}
+	if err := checkExtensionSource(source); err != nil {
+		return fmt.Errorf("UpdateExtensions: %s", err)
+	}
+	client, err := tbget.RouteClient(sourceRoute(source))
+	if err != nil {
+		return fmt.Errorf("UpdateExtensions: %s", err)
+	}
+	fetch := func(u string) ([]byte, error) {
+		resp, err := client.Get(u)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("%s: %s", u, resp.Status)
+		}
+		return ioutil.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	}
+	data, err := fetch(source.String())
+	if err != nil {
+		return fmt.Errorf("UpdateExtensions: %s", err)
+	}
+	var entries map[string]ExtensionIndexEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("UpdateExtensions: %s", err)
+	}
+	var errs []string
+	for _, spec := range ExtensionSpecs {
+		entry, ok := entries[spec.ID]
+		if !ok {
+			continue
+		}
+		stored, _, err := s.StoredExtension(spec.ID)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if stored != nil && tbget.CompareVersions(entry.Version, stored.Version) <= 0 {
+			continue
+		}
+		xpiURL, err := source.Parse(entry.URL)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if err := checkExtensionSource(xpiURL); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		xpi, err := fetch(xpiURL.String())
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if sum := sha256Hex(xpi); !strings.EqualFold(sum, entry.SHA256) {
+			errs = append(errs, fmt.Sprintf("%s %s has hash %s, the index says %s", spec.ID, entry.Version, sum, entry.SHA256))
+			continue
+		}
+		extensionsMutex.Lock()
+		_, err = s.storeXPI(s.readExtensionIndex(), spec.ID, entry.Version, xpi, xpiURL.String())
+		extensionsMutex.Unlock()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("UpdateExtensions: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// managedExtensionsFile records which extensions of a profile were installed
+// by the supervisor, so they can be removed when the profile's mode no longer
+// needs them.
+func managedExtensionsFile(profiledata string) string {
+	return filepath.Join(profiledata, "extensions", "tor-manager.json")
+}
+
+func readManagedExtensions(profiledata string) map[string]string {
+	managed := make(map[string]string)
+	if bytes, err := ioutil.ReadFile(managedExtensionsFile(profiledata)); err == nil {
+		json.Unmarshal(bytes, &managed)
+	}
+	return managed
+}
+
+func writeManagedExtensions(profiledata string, managed map[string]string) error {
+	bytes, err := json.MarshalIndent(managed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(managedExtensionsFile(profiledata), bytes, 0644)
+}
+
+// InstallExtension installs the current stored version of the extension into
+// the profile, if the profile doesn't have it already.
+func (s *Supervisor) InstallExtension(profiledata, id string) error {
+	apath, err := filepath.Abs(profiledata)
+	if err != nil {
+		return fmt.Errorf("InstallExtension: %s", err)
+	}
+	stored, file, err := s.StoredExtension(id)
+	if err != nil {
+		return fmt.Errorf("InstallExtension: %s", err)
+	}
+	if stored == nil {
+		log.Printf("InstallExtension: %s is not available, set an extension source to install it", id)
+		return nil
+	}
+	odir := filepath.Join(apath, "extensions")
+	if err := os.MkdirAll(odir, 0755); err != nil {
+		return fmt.Errorf("InstallExtension: %s", err)
+	}
+	managed := readManagedExtensions(apath)
+	opath := filepath.Join(odir, id+".xpi")
+	if sum, err := fileSHA256(opath); err != nil || sum != stored.SHA256 {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("InstallExtension: %s", err)
+		}
+		if err := ioutil.WriteFile(opath+".part", data, 0644); err != nil {
+			return fmt.Errorf("InstallExtension: %s", err)
+		}
+		if err := os.Rename(opath+".part", opath); err != nil {
+			return fmt.Errorf("InstallExtension: %s", err)
+		}
+		log.Printf("InstallExtension: installed %s %s in %s", id, stored.Version, apath)
+	}
+	managed[id] = stored.SHA256
+	return writeManagedExtensions(apath, managed)
+}
+
+// SyncExtensions installs the extensions the mode requires into the profile
+// and removes the ones the supervisor installed for another mode.
+func (s *Supervisor) SyncExtensions(profiledata, mode string) error {
+	apath, err := filepath.Abs(profiledata)
+	if err != nil {
+		return fmt.Errorf("SyncExtensions: %s", err)
+	}
+	required := make(map[string]bool)
+	for _, id := range RequiredExtensions(mode) {
+		required[id] = true
+		if err := s.InstallExtension(apath, id); err != nil {
+			return err
+		}
+	}
+	managed := readManagedExtensions(apath)
+	changed := false
+	for id := range managed {
+		if required[id] {
+			continue
+		}
+		log.Printf("SyncExtensions: removing %s from %s, %s profiles don't use it", id, apath, mode)
+		if err := os.Remove(filepath.Join(apath, "extensions", id+".xpi")); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("SyncExtensions: %s", err)
+		}
+		delete(managed, id)
+		changed = true
+	}
+	if changed {
+		return writeManagedExtensions(apath, managed)
+	}
+	return nil
+}
+
+// InstalledExtension is an extension found in a profile.
+type InstalledExtension struct {
+	ID      string
+	Name    string
+	Version string
+	// Managed is true if the supervisor installed it.
+	Managed bool
+}
+
+// ProfileExtensions lists the extensions installed in the profile directory.
+func ProfileExtensions(profiledata string) []InstalledExtension {
+	var installed []InstalledExtension
+	managed := readManagedExtensions(profiledata)
+	files, _ := filepath.Glob(filepath.Join(profiledata, "extensions", "*.xpi"))
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".xpi")
+		ext := InstalledExtension{ID: id, Name: id}
+		if info, err := ReadXPI(file); err == nil {
+			ext.Name, ext.Version = info.Name, info.Version
+		}
+		_, ext.Managed = managed[id]
+		installed = append(installed, ext)
+	}
+	sort.Slice(installed, func(i, j int) bool { return installed[i].Name < installed[j].Name })
+	return installed
+}
@@ -0,0 +1,38 @@
+package tbsupervise
+
+import (
+	"fmt"
+	"log"
+
+	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+)
+
+// VerifyInstall checks the installed tree at install against the manifest
+// written when it was unpacked, using file sizes and modification times and
+// only hashing files which changed. The manifest itself is checked with
+// AnchorManifest first, if it is set, which also builds the manifest of a tree
+// unpacked before manifests were written. It returns an error describing every
+// difference if the tree has been tampered with, or if it has no manifest.
+func (s *Supervisor) VerifyInstall(install string) error {
+	if !tbget.FileExists(install) {
+		return nil
+	}
+	if s.AnchorManifest != nil {
+		if err := s.AnchorManifest(install); err != nil {
+			log.Println(err)
+			return fmt.Errorf("VerifyInstall: refusing to launch, the manifest of %s can't be trusted: %s\nrun with -verify -repair to restore it from the downloaded archive", install, err)
+		}
+	}
+	if !tbget.FileExists(tbget.ManifestFile(install)) {
+		return fmt.Errorf("VerifyInstall: refusing to launch, %s has no manifest so it can't be checked\nrun with -verify -repair to restore it from the downloaded archive", install)
+	}
+	report, err := tbget.VerifyManifest(install, false)
+	if err != nil {
+		return err
+	}
+	if !report.OK() {
+		log.Println(report)
+		return fmt.Errorf("VerifyInstall: refusing to launch, %s\nrun with -verify -repair to restore it from the downloaded archive", report)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package tbsupervise
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// installs keeps track of the browsers the supervisor has started from each
+// install directory and with each profile directory, of the install
+// directories which are being updated, and of the policies the browsers
+// launched from each install directory use.
+var installs = struct {
+	sync.Mutex
+	running  map[string]int
+	profiles map[string]int
+	updating map[string]bool
+	policies map[string]string
+	leases   map[string]int
+	// reading releases the policies lease of a launch once its browser has
+	// read them, by profile directory.
+	reading map[string]func()
+}{
+	running:  make(map[string]int),
+	profiles: make(map[string]int),
+	updating: make(map[string]bool),
+	policies: make(map[string]string),
+	leases:   make(map[string]int),
+	reading:  make(map[string]func()),
+}
+
+func installKey(install string) string {
+	if abs, err := filepath.Abs(install); err == nil {
+		return abs
+	}
+	return install
+}
+
+// runBrowser runs a browser in the mode from the install directory with the
+// profile directory, refusing to start it while the install is being updated
+// or if it fails VerifyInstall. Its output goes to a launch log, and a crash
+// report is recorded if it crashes. Ephemeral profiles are wiped by a helper
+// once the browser exits.
+func (s *Supervisor) runBrowser(install, profiledata, mode string, bcmd *exec.Cmd) error {
+	key, profile := installKey(install), installKey(profiledata)
+	installs.Lock()
+	if installs.updating[key] {
+		installs.Unlock()
+		return fmt.Errorf("runBrowser: %s is being updated, try again in a moment", install)
+	}
+	installs.running[key]++
+	installs.profiles[profile]++
+	installs.Unlock()
+	defer func() {
+		installs.Lock()
+		installs.running[key]--
+		if installs.running[key] <= 0 {
+			delete(installs.running, key)
+		}
+		installs.profiles[profile]--
+		if installs.profiles[profile] <= 0 {
+			delete(installs.profiles, profile)
+		}
+		installs.Unlock()
+	}()
+	if err := s.VerifyInstall(install); err != nil {
+		return err
+	}
+	exited := s.logBrowser(install, profiledata, mode, bcmd)
+	launched := time.Now()
+	err := s.launcher().Run(bcmd, func(pid int) {
+		if isEphemeral(profiledata) {
+			watchEphemeral(profiledata, pid)
+		}
+		go policiesRead(install, profiledata, launched)
+	})
+	exited(err)
+	return err
+}
+
+// POLICIES_READ is how long a launch holds the policies of its install at
+// most, waiting for its browser to read them.
+var POLICIES_READ = 30 * time.Second
+
+// leaseProfile returns the profile directory a browser launched from the
+// install with profiledata runs with.
+func leaseProfile(install, profiledata string) string {
+	if profiledata == "" {
+		profiledata = filepath.Join(install, "Browser", "TorBrowser", "Data", "Browser", "profile.default")
+	}
+	return installKey(profiledata)
+}
+
+// leasePolicies claims the policies.json of the install for a launch with the
+// profile directory and the policies of the mode. A browser only reads
+// policies.json when it starts, so while a launch holds it, launches in other
+// modes wait for it instead of rewriting it under the starting browser, and
+// are refused if it isn't released in time. Launches in the same mode share
+// it. The lease is released when the returned function is called, or once the
+// browser has read the policies, see policiesRead. When the last lease is
+// released the install's own policies are put back, so browsers started from
+// the install without tor-manager don't get the mode's policies.
+func (s *Supervisor) leasePolicies(install, profiledata, mode string) (func(), error) {
+	if OS() == "osx" {
+		return func() {}, nil
+	}
+	key := installKey(install)
+	installs.Lock()
+	defer installs.Unlock()
+	for deadline := time.Now().Add(POLICIES_READ + 5*time.Second); installs.leases[key] > 0 && installs.policies[key] != mode; {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("leasePolicies: a browser with other policies is still starting from %s, try launching the %s browser again in a moment", install, mode)
+		}
+		installs.Unlock()
+		time.Sleep(250 * time.Millisecond)
+		installs.Lock()
+	}
+	installs.policies[key] = mode
+	installs.leases[key]++
+	profile := leaseProfile(install, profiledata)
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			installs.Lock()
+			defer installs.Unlock()
+			delete(installs.reading, profile)
+			installs.leases[key]--
+			if installs.leases[key] > 0 {
+				return
+			}
+			delete(installs.leases, key)
+			delete(installs.policies, key)
+			if err := s.restorePolicies(install); err != nil {
+				log.Println("leasePolicies:", err)
+			}
+		})
+	}
+	installs.reading[profile] = release
+	return release, nil
+}
+
+// policiesRead waits for the browser launched from the install with
+// profiledata at launched to lock its profile, which it does before it reads
+// its policies, then releases the launch's policies lease. If the profile
+// isn't locked within POLICIES_READ, the lease is released anyway.
+func policiesRead(install, profiledata string, launched time.Time) {
+	profile := leaseProfile(install, profiledata)
+	for deadline := time.Now().Add(POLICIES_READ); time.Now().Before(deadline); time.Sleep(250 * time.Millisecond) {
+		if profileLocked(profile, launched) {
+			// The policies are read right after the profile is locked,
+			// give the browser a moment to get there.
+			time.Sleep(2 * time.Second)
+			break
+		}
+	}
+	installs.Lock()
+	release := installs.reading[profile]
+	installs.Unlock()
+	if release != nil {
+		release()
+	}
+}
+
+// profileLocked returns true if a browser locked the profile directory after
+// launched. Firefox locks it with a lock symlink on Linux and macOS, and with
+// parent.lock on Windows.
+func profileLocked(profile string, launched time.Time) bool {
+	for _, lock := range []string{"lock", "parent.lock"} {
+		if info, err := os.Lstat(filepath.Join(profile, lock)); err == nil && !info.ModTime().Before(launched.Add(-time.Second)) {
+			return true
+		}
+	}
+	return false
+}
+
+// InstallInUse returns true if a browser is running from the install
+// directory, whether it was started by this supervisor or not.
+func InstallInUse(install string) bool {
+	key := installKey(install)
+	installs.Lock()
+	running := installs.running[key] > 0
+	installs.Unlock()
+	return running || processInInstall(key)
+}
+
+// ProfileInUse returns true if a browser the supervisor started is running
+// with the profile directory.
+func ProfileInUse(profiledata string) bool {
+	installs.Lock()
+	defer installs.Unlock()
+	return installs.profiles[installKey(profiledata)] > 0
+}
+
+// LockInstall marks the install directory as being updated so no browser can
+// be launched from it until the returned function is called. It fails if a
+// browser is running from the install.
+func LockInstall(install string) (func(), error) {
+	key := installKey(install)
+	installs.Lock()
+	defer installs.Unlock()
+	if installs.running[key] > 0 || processInInstall(key) {
+		return nil, fmt.Errorf("LockInstall: a browser is running from %s", install)
+	}
+	if installs.updating[key] {
+		return nil, fmt.Errorf("LockInstall: %s is already being updated", install)
+	}
+	installs.updating[key] = true
+	return func() {
+		installs.Lock()
+		delete(installs.updating, key)
+		installs.Unlock()
+	}, nil
+}
+
+// processInInstall looks for a process whose executable lives under the
+// install directory. It only finds anything on systems with a /proc filesystem.
+func processInInstall(install string) bool {
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return false
+	}
+	prefix := install + string(os.PathSeparator)
+	for _, proc := range procs {
+		exe, err := os.Readlink(filepath.Join("/proc", proc.Name(), "exe"))
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(exe, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package tbsupervise
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+)
+
+// Launch describes how to start a browser or tor: the executable, its
+// arguments, the directory it runs in and the variables added to its
+// environment.
+type Launch struct {
+	Path string
+	Args []string
+	Dir  string
+	Env  []string
+}
+
+// Command returns the command which starts the launch, with its output going
+// to the terminal.
+func (l *Launch) Command() *exec.Cmd {
+	cmd := exec.Command(l.Path, l.Args...)
+	cmd.Dir = l.Dir
+	if len(l.Env) > 0 {
+		cmd.Env = append(os.Environ(), l.Env...)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// Launcher resolves how browsers and tor are started on a platform, and starts
+// them. The launch modes of the Supervisor are built on top of it.
+type Launcher interface {
+	// OS returns the platform, named like tbget names it.
+	OS() string
+	// TorBrowser returns the launch of the browser unpacked in install through
+	// the bundle's own launcher, which starts the bundle's tor. If profiledata
+	// is empty the install's own profile is used. args follow the profile.
+	TorBrowser(install, profiledata string, args []string) *Launch
+	// Browser returns the launch of the bare browser executable unpacked in
+	// install, with the profile directory profiledata. args follow the profile.
+	Browser(install, profiledata string, args []string) *Launch
+	// Tor returns the launch of the tor unpacked in install. expert is set if
+	// the install is a Tor Expert Bundle rather than a Tor Browser.
+	Tor(install string, expert bool) *Launch
+	// Run starts the command and waits for it to exit. If started isn't nil,
+	// it is called with the process ID once the command has started.
+	Run(cmd *exec.Cmd, started func(pid int)) error
+}
+
+// PlatformLauncher returns the Launcher for the platform, which is named like
+// tbget names it.
+func PlatformLauncher(os string) Launcher {
+	switch os {
+	case "osx":
+		return darwinLauncher{}
+	case "win":
+		return windowsLauncher{}
+	default:
+		return unixLauncher{os: os}
+	}
+}
+
+// launcher returns the Supervisor's Launcher, or the one for the current
+// platform if it doesn't have one.
+func (s *Supervisor) launcher() Launcher {
+	if s.Launcher != nil {
+		return s.Launcher
+	}
+	return PlatformLauncher(OS())
+}
+
+// browserProduct returns the product with a browser which is unpacked in
+// install, found by checking for its executable at the path returned by
+// binary. If there is none, Tor Browser is returned.
+func browserProduct(install string, binary func(p *tbget.Product) string) *tbget.Product {
+	for _, name := range tbget.ProductNames() {
+		product := tbget.Products[name]
+		if product.Browser == "" {
+			continue
+		}
+		if tbget.FileExists(filepath.Join(install, binary(product))) {
+			return product
+		}
+	}
+	return tbget.TorBrowser
+}
+
+// profileArgs returns the browser arguments which select the profile directory.
+func profileArgs(profiledata string) []string {
+	if profiledata == "" {
+		return []string{}
+	}
+	return []string{"--profile", profiledata}
+}
+
+// runCommand starts the command, reports its process ID to started and waits
+// for it. It is how every platform runs what it launches.
+func runCommand(cmd *exec.Cmd, started func(pid int)) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if started != nil {
+		started(cmd.Process.Pid)
+	}
+	return cmd.Wait()
+}
+
+// unixLauncher launches from the Linux bundles. The bundles' launcher is the
+// start- script, and the browser executable is the .real binary behind it.
+type unixLauncher struct {
+	os string
+}
+
+func (l unixLauncher) OS() string {
+	return l.os
+}
+
+func (l unixLauncher) binary(p *tbget.Product) string {
+	return filepath.Join("Browser", p.BrowserBinary(l.os))
+}
+
+func (l unixLauncher) TorBrowser(install, profiledata string, args []string) *Launch {
+	product := browserProduct(install, l.binary)
+	return &Launch{
+		Path: filepath.Join(install, "Browser", "start-"+product.Prefix),
+		Args: append(profileArgs(profiledata), args...),
+	}
+}
+
+func (l unixLauncher) Browser(install, profiledata string, args []string) *Launch {
+	return &Launch{
+		Path: filepath.Join(install, l.binary(browserProduct(install, l.binary))),
+		Args: append(profileArgs(profiledata), args...),
+	}
+}
+
+func (l unixLauncher) Tor(install string, expert bool) *Launch {
+	if expert {
+		return &Launch{Path: filepath.Join(install, "tor", "tor")}
+	}
+	return &Launch{Path: filepath.Join(install, "Browser", "TorBrowser", "Tor", "tor")}
+}
+
+func (l unixLauncher) Run(cmd *exec.Cmd, started func(pid int)) error {
+	return runCommand(cmd, started)
+}
+
+// darwinLauncher launches from the macOS app bundles, which have no launcher
+// script of their own.
+type darwinLauncher struct{}
+
+func (darwinLauncher) OS() string {
+	return "osx"
+}
+
+func (darwinLauncher) binary(p *tbget.Product) string {
+	return filepath.Join(p.Title+".app", "Contents", "MacOS", p.BrowserBinary("osx"))
+}
+
+func (l darwinLauncher) TorBrowser(install, profiledata string, args []string) *Launch {
+	return &Launch{
+		Path: filepath.Join(install, l.binary(browserProduct(install, l.binary))),
+		Args: append(profileArgs(profiledata), args...),
+		Dir:  install,
+	}
+}
+
+func (l darwinLauncher) Browser(install, profiledata string, args []string) *Launch {
+	launch := l.TorBrowser(install, profiledata, args)
+	if profiledata != "" {
+		launch.Dir = profiledata
+	}
+	return launch
+}
+
+func (darwinLauncher) Tor(install string, expert bool) *Launch {
+	path := filepath.Join(install, "Tor Browser.app", "Contents", "Resources", "TorBrowser", "Tor", "tor")
+	if expert {
+		path = filepath.Join(install, "tor", "tor")
+	}
+	return &Launch{Path: path, Dir: filepath.Dir(path)}
+}
+
+func (darwinLauncher) Run(cmd *exec.Cmd, started func(pid int)) error {
+	return runCommand(cmd, started)
+}
+
+// windowsLauncher launches from the Windows bundles, which have no launcher
+// script of their own and run from the Browser directory.
+type windowsLauncher struct{}
+
+func (windowsLauncher) OS() string {
+	return "win"
+}
+
+func (windowsLauncher) binary(p *tbget.Product) string {
+	return filepath.Join("Browser", p.BrowserBinary("win"))
+}
+
+func (l windowsLauncher) TorBrowser(install, profiledata string, args []string) *Launch {
+	return &Launch{
+		Path: filepath.Join(install, l.binary(browserProduct(install, l.binary))),
+		Args: append(profileArgs(profiledata), args...),
+		Dir:  filepath.Join(install, "Browser"),
+	}
+}
+
+func (l windowsLauncher) Browser(install, profiledata string, args []string) *Launch {
+	launch := l.TorBrowser(install, profiledata, args)
+	if profiledata != "" {
+		launch.Dir = profiledata
+	}
+	return launch
+}
+
+func (windowsLauncher) Tor(install string, expert bool) *Launch {
+	path := filepath.Join(install, "Browser", "TorBrowser", "Tor", "tor.exe")
+	if expert {
+		path = filepath.Join(install, "tor", "tor.exe")
+	}
+	return &Launch{Path: path, Dir: filepath.Dir(path)}
+}
+
+func (windowsLauncher) Run(cmd *exec.Cmd, started func(pid int)) error {
+	return runCommand(cmd, started)
+}
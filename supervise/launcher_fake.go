@@ -0,0 +1,40 @@
+package tbsupervise
+
+import (
+	"os/exec"
+	"sync"
+)
+
+// FakeLauncher resolves launches like the platform it pretends to be, but
+// records the commands it is asked to run instead of running them. Setting it
+// as a Supervisor's Launcher lets every launch mode be checked for every
+// platform without starting a browser.
+type FakeLauncher struct {
+	Launcher
+	mutex    sync.Mutex
+	commands []*exec.Cmd
+	// Err is returned by Run, to pretend the browser or tor failed or crashed.
+	Err error
+}
+
+// NewFakeLauncher returns a FakeLauncher pretending to be the platform, which
+// is named like tbget names it.
+func NewFakeLauncher(os string) *FakeLauncher {
+	return &FakeLauncher{Launcher: PlatformLauncher(os)}
+}
+
+// Run records the command and returns f.Err. The command isn't started, so
+// started is never called.
+func (f *FakeLauncher) Run(cmd *exec.Cmd, started func(pid int)) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.commands = append(f.commands, cmd)
+	return f.Err
+}
+
+// Commands returns the commands Run was called with, oldest first.
+func (f *FakeLauncher) Commands() []*exec.Cmd {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]*exec.Cmd{}, f.commands...)
+}
@@ -0,0 +1,360 @@
+package tbsupervise
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+)
+
+// fakeInstall unpacks an empty tree at dir with a manifest, so VerifyInstall
+// accepts it.
+func fakeInstall(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, "Browser"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Browser", "application.ini"), []byte("[App]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbget.WriteManifest(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// envOf returns the variables a command adds to the environment it inherits.
+func envOf(env []string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	return env[len(os.Environ()):]
+}
+
+func TestLaunchModes(t *testing.T) {
+	sandbox, proxy, netns := SANDBOX, OFFLINE_PROXY, OFFLINE_NETNS
+	SANDBOX, OFFLINE_PROXY, OFFLINE_NETNS = false, "127.0.0.1:0", false
+	defer func() { SANDBOX, OFFLINE_PROXY, OFFLINE_NETNS = sandbox, proxy, netns }()
+
+	type expect struct {
+		path string
+		args []string
+		dir  string
+	}
+	cases := []struct {
+		mode string
+		// run launches the mode with the profile.
+		run func(s *Supervisor, profile string) error
+		// install is the tree the mode runs from.
+		install func(s *Supervisor) string
+		// page is the page the mode opens, if it opens one.
+		page func(profile string) string
+		env  []string
+	}{
+		{
+			mode: ModeTor,
+			run: func(s *Supervisor, profile string) error {
+				return s.RunTBWithLangAndProfile(profile)
+			},
+			install: (*Supervisor).TBUnpackPath,
+			page:    func(string) string { return "" },
+		},
+		{
+			mode: ModeClearnet,
+			run: func(s *Supervisor, profile string) error {
+				return s.RunSpecificTBBWithOfflineClearnetProfile(profile, s.TBUnpackPath(), false, true, false)
+			},
+			install: (*Supervisor).TBUnpackPath,
+			page:    func(profile string) string { return profile + "/index.html" },
+			env:     ModeEnv(ModeClearnet),
+		},
+		{
+			mode: ModeI2P,
+			run: func(s *Supervisor, profile string) error {
+				return s.RunSpecificTBBWithOfflineClearnetProfile(profile, s.IBBUnpackPath(), false, false, false)
+			},
+			install: (*Supervisor).IBBUnpackPath,
+			page:    func(string) string { return "about:blank" },
+			env:     ModeEnv(ModeI2P),
+		},
+		{
+			mode: ModeApp,
+			run: func(s *Supervisor, profile string) error {
+				return s.RunSpecificTBBWithOfflineClearnetProfile(profile, s.IBBUnpackPath(), true, false, false)
+			},
+			install: (*Supervisor).IBBUnpackPath,
+			page:    func(profile string) string { return profile + "/index.html" },
+			env:     ModeEnv(ModeApp),
+		},
+		{
+			mode: ModeOffline,
+			run: func(s *Supervisor, profile string) error {
+				return s.RunSpecificTBBWithOfflineClearnetProfile(profile, s.TBUnpackPath(), true, true, false)
+			},
+			install: (*Supervisor).TBUnpackPath,
+			page:    func(profile string) string { return profile + "/index.html" },
+			env:     ModeEnv(ModeOffline),
+		},
+	}
+	platforms := []struct {
+		os string
+		// browser is where the bundle keeps the browser executable, and
+		// launcher the bundle's own launcher, relative to the tree.
+		browser, launcher string
+		// dir returns the directory the browser runs in.
+		dir func(install, profile string, tor bool) string
+	}{
+		{
+			os:       "linux",
+			browser:  filepath.Join("Browser", "firefox.real"),
+			launcher: filepath.Join("Browser", "start-tor-browser"),
+			dir:      func(install, profile string, tor bool) string { return "" },
+		},
+		{
+			os:       "osx",
+			browser:  filepath.Join("Tor Browser.app", "Contents", "MacOS", "firefox"),
+			launcher: filepath.Join("Tor Browser.app", "Contents", "MacOS", "firefox"),
+			dir: func(install, profile string, tor bool) string {
+				if tor {
+					return install
+				}
+				return profile
+			},
+		},
+		{
+			os:       "win",
+			browser:  filepath.Join("Browser", "firefox.exe"),
+			launcher: filepath.Join("Browser", "firefox.exe"),
+			dir: func(install, profile string, tor bool) string {
+				if tor {
+					return filepath.Join(install, "Browser")
+				}
+				return profile
+			},
+		},
+	}
+	for _, platform := range platforms {
+		for _, c := range cases {
+			t.Run(platform.os+"/"+c.mode, func(t *testing.T) {
+				root := t.TempDir()
+				launcher := NewFakeLauncher(platform.os)
+				s := &Supervisor{
+					UnpackPath: filepath.Join(root, "tor-browser"),
+					Lang:       "en-US",
+					Launcher:   launcher,
+				}
+				fakeInstall(t, s.TBUnpackPath())
+				fakeInstall(t, s.IBBUnpackPath())
+				profile := filepath.Join(root, "profile."+c.mode)
+				if err := c.run(s, profile); err != nil {
+					t.Fatal(err)
+				}
+				commands := launcher.Commands()
+				if len(commands) != 1 {
+					t.Fatalf("launched %d commands, want 1", len(commands))
+				}
+				cmd := commands[0]
+				install := c.install(s)
+				tor := c.mode == ModeTor
+				want := expect{
+					path: filepath.Join(install, platform.browser),
+					args: []string{"--profile", profile},
+					dir:  platform.dir(install, profile, tor),
+				}
+				if tor {
+					want.path = filepath.Join(install, platform.launcher)
+				}
+				if page := c.page(profile); page != "" {
+					want.args = append(want.args, page)
+				}
+				if cmd.Path != want.path {
+					t.Errorf("path %s, want %s", cmd.Path, want.path)
+				}
+				if !reflect.DeepEqual(cmd.Args[1:], want.args) {
+					t.Errorf("args %q, want %q", cmd.Args[1:], want.args)
+				}
+				if cmd.Dir != want.dir {
+					t.Errorf("dir %s, want %s", cmd.Dir, want.dir)
+				}
+				if env := envOf(cmd.Env); !reflect.DeepEqual(env, c.env) {
+					t.Errorf("env %q, want %q", env, c.env)
+				}
+			})
+		}
+	}
+}
+
+func TestTorLaunch(t *testing.T) {
+	for _, c := range []struct {
+		os   string
+		path []string
+		dir  bool
+	}{
+		{os: "linux", path: []string{"Browser", "TorBrowser", "Tor", "tor"}},
+		{os: "osx", path: []string{"Tor Browser.app", "Contents", "Resources", "TorBrowser", "Tor", "tor"}, dir: true},
+		{os: "win", path: []string{"Browser", "TorBrowser", "Tor", "tor.exe"}, dir: true},
+	} {
+		t.Run(c.os, func(t *testing.T) {
+			install := filepath.Join(t.TempDir(), "tor-browser")
+			s := &Supervisor{UnpackPath: install, Launcher: NewFakeLauncher(c.os)}
+			want := filepath.Join(append([]string{install}, c.path...)...)
+			launch := s.torLaunch()
+			if launch.Path != want {
+				t.Errorf("path %s, want %s", launch.Path, want)
+			}
+			if len(launch.Args) != 0 {
+				t.Errorf("args %q, want none", launch.Args)
+			}
+			if dir := filepath.Dir(want); c.dir && launch.Dir != dir {
+				t.Errorf("dir %s, want %s", launch.Dir, dir)
+			} else if !c.dir && launch.Dir != "" {
+				t.Errorf("dir %s, want none", launch.Dir)
+			}
+			if s.TorPath() != want {
+				t.Errorf("TorPath %s, want %s", s.TorPath(), want)
+			}
+		})
+	}
+}
+
+func TestPoliciesRestored(t *testing.T) {
+	sandbox := SANDBOX
+	SANDBOX = false
+	defer func() { SANDBOX = sandbox }()
+
+	root := t.TempDir()
+	launcher := NewFakeLauncher("linux")
+	s := &Supervisor{UnpackPath: filepath.Join(root, "tor-browser"), Lang: "en-US", Launcher: launcher}
+	install := s.TBUnpackPath()
+	policies := filepath.Join(s.PolicyDir(install), "policies.json")
+	own := []byte(`{"policies": {"DisableTelemetry": true}}`)
+	if err := os.MkdirAll(filepath.Dir(policies), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(policies, own, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fakeInstall(t, install)
+	for _, run := range []func() error{
+		func() error {
+			return s.RunSpecificTBBWithOfflineClearnetProfile(filepath.Join(root, "profile.clearnet"), install, false, true, false)
+		},
+		func() error { return s.RunTBWithLangAndProfile(filepath.Join(root, "profile.tor")) },
+	} {
+		if err := run(); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(policies); err != nil || string(got) != string(own) {
+			t.Errorf("policies.json is %q after the launch, want the install's own %q", got, own)
+		}
+	}
+	if err := s.ApplyPolicies(install, ModeTor); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file struct {
+		Policies map[string]bool `json:"policies"`
+	}
+	if err := json.Unmarshal(got, &file); err != nil {
+		t.Fatal(err)
+	}
+	if !file.Policies["DisableAppUpdate"] || !file.Policies["DisableTelemetry"] {
+		t.Errorf("Tor policies %s, want the install's own with DisableAppUpdate", got)
+	}
+	if err := s.VerifyInstall(install); err != nil {
+		t.Errorf("the install doesn't verify with the Tor policies applied: %s", err)
+	}
+	if err := os.WriteFile(policies, []byte(`{"policies": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyInstall(install); err == nil {
+		t.Error("the install verifies with a changed policies.json")
+	}
+	if err := s.restorePolicies(install); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(policies); err != nil || string(got) != string(own) {
+		t.Errorf("policies.json is %q after restorePolicies, want %q", got, own)
+	}
+}
+
+func TestWindowsBrowserFlags(t *testing.T) {
+	defer func(system string) { tbget.OS = system }(tbget.OS)
+	for _, system := range []string{"linux", "win"} {
+		tbget.OS = system
+		for _, args := range [][]string{
+			{"-profile", "x"},
+			{"--remote-debugging-port=9222"},
+			{"-new-tab", "-headless"},
+		} {
+			if err := ValidateBrowserArgs(ModeTor, args); err == nil {
+				t.Errorf("%s: %q is allowed", system, args)
+			}
+		}
+		if err := ValidateBrowserArgs(ModeTor, []string{"-new-tab", "http://example.com"}); err != nil {
+			t.Errorf("%s: %s", system, err)
+		}
+	}
+	tbget.OS = "win"
+	for _, args := range [][]string{{"/profile", "x"}, {"/remote-debugging-port", "9222"}, {"/new-tab", "/headless"}} {
+		if err := ValidateBrowserArgs(ModeTor, args); err == nil {
+			t.Errorf("win: %q is allowed", args)
+		}
+	}
+	tbget.OS = "linux"
+	if err := ValidateBrowserArgs(ModeTor, []string{"/home/user/page.html"}); err != nil {
+		t.Errorf("linux: a path is refused: %s", err)
+	}
+}
+
+func TestI2PModesShareInstall(t *testing.T) {
+	read := POLICIES_READ
+	POLICIES_READ = 0
+	defer func() { POLICIES_READ = read }()
+
+	root := t.TempDir()
+	s := &Supervisor{UnpackPath: filepath.Join(root, "tor-browser"), Lang: "en-US", Launcher: NewFakeLauncher("linux")}
+	install := s.IBBUnpackPath()
+	release, err := s.leasePolicies(install, filepath.Join(root, "app"), ModeApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leased := make(chan error)
+	go func() {
+		release, err := s.leasePolicies(install, filepath.Join(root, "i2p"), ModeI2P)
+		if err == nil {
+			release()
+		}
+		leased <- err
+	}()
+	// The I2P launch waits for the app launch's browser to read its policies.
+	time.Sleep(500 * time.Millisecond)
+	release()
+	if err := <-leased; err != nil {
+		t.Errorf("an I2P launch is refused after the app launch released the policies: %s", err)
+	}
+
+	profile := filepath.Join(root, "i2p")
+	if _, err := s.ApplyPrefs(profile, ModeI2P, "127.0.0.1:4451"); err != nil {
+		t.Fatal(err)
+	}
+	prefs, err := os.ReadFile(filepath.Join(profile, "user.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pref := range []Pref{{Name: "network.proxy.http", Value: `"127.0.0.1"`}, {Name: "network.proxy.http_port", Value: "4451"}} {
+		if !strings.Contains(string(prefs), pref.String()) {
+			t.Errorf("the profile's user.js doesn't have %s", pref)
+		}
+	}
+	if p := s.ModePolicies(ModeI2P); p.Proxy != nil {
+		t.Errorf("the I2P policies set the proxy %+v, which would be shared by every profile", p.Proxy)
+	}
+}
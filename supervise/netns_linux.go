@@ -0,0 +1,258 @@
+package tbsupervise
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// NETNS_HELPER is the argument which makes tor-manager run as the helper
+// inside the offline browser's network namespace.
+const NETNS_HELPER = "--netns-helper"
+
+// capNetAdmin is CAP_NET_ADMIN, which the helper needs to bring up loopback.
+const capNetAdmin = 12
+
+// UserNamespacesAvailable returns an error if this system doesn't let
+// unprivileged users create user namespaces.
+func UserNamespacesAvailable() error {
+	for _, knob := range []string{"/proc/sys/kernel/unprivileged_userns_clone", "/proc/sys/user/max_user_namespaces"} {
+		if value, err := ioutil.ReadFile(knob); err == nil && strings.TrimSpace(string(value)) == "0" {
+			return fmt.Errorf("unprivileged user namespaces are disabled by %s", knob)
+		}
+	}
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return fmt.Errorf("this kernel doesn't support user namespaces")
+	}
+	return nil
+}
+
+// isolateNetwork returns a command which runs bcmd inside a new user and
+// network namespace, where only loopback exists. Inside it, the offline proxy's
+// address is forwarded over a unix socket to the real offline proxy, so the
+// browser can still reach the allowlisted services and nothing else. The
+// helper is dry run first, so an error is returned instead of a command which
+// would fail before the browser starts. The returned function stops the
+// forwarding once the browser has exited.
+func isolateNetwork(bcmd *exec.Cmd) (*exec.Cmd, func(), error) {
+	if err := UserNamespacesAvailable(); err != nil {
+		return nil, nil, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	socket, cleanup, err := forwardOfflineProxy()
+	if err != nil {
+		return nil, nil, err
+	}
+	helper := []string{NETNS_HELPER, socket, OFFLINE_PROXY}
+	flags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET)
+	caps := []uintptr{capNetAdmin}
+	if err := dryRun(helperCommand(self, bcmd, flags, caps, helper...)); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	icmd := helperCommand(self, bcmd, flags, caps, append(append(helper, bcmd.Path), bcmd.Args[1:]...)...)
+	return icmd, cleanup, nil
+}
+
+// helperCommand returns a command which runs tor-manager as a helper with args
+// in new namespaces from flags, with the capabilities caps, for the browser
+// command bcmd.
+func helperCommand(self string, bcmd *exec.Cmd, flags uintptr, caps []uintptr, args ...string) *exec.Cmd {
+	hcmd := exec.Command(self, args...)
+	hcmd.Dir = bcmd.Dir
+	hcmd.Env = bcmd.Env
+	hcmd.Stdin = bcmd.Stdin
+	hcmd.Stdout = bcmd.Stdout
+	hcmd.Stderr = bcmd.Stderr
+	hcmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  flags,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}},
+		AmbientCaps: caps,
+	}
+	return hcmd
+}
+
+// HELPER_DRY_RUN is passed to a helper in place of the browser's command line.
+// The helper then sets everything up as it would for the browser, and exits
+// instead of running it.
+const HELPER_DRY_RUN = "--dry-run"
+
+// helperAppArmorProfile is the AppArmor profile the helpers run in when
+// tor-manager is confined by its own profile, which doesn't allow the mounts
+// and capabilities they need.
+const helperAppArmorProfile = "tor-manager//helper"
+
+// enterHelperProfile runs the helper again in helperAppArmorProfile if
+// tor-manager is confined by its own AppArmor profile, and returns if it isn't.
+func enterHelperProfile() error {
+	current, err := ioutil.ReadFile("/proc/self/attr/apparmor/current")
+	if err != nil {
+		if current, err = ioutil.ReadFile("/proc/self/attr/current"); err != nil {
+			return nil
+		}
+	}
+	if label := strings.Fields(string(current)); len(label) == 0 || label[0] != "tor-manager" {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// The profile of the next exec is set for the calling thread only.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	task := fmt.Sprintf("/proc/self/task/%d/attr", syscall.Gettid())
+	change := []byte("exec " + helperAppArmorProfile)
+	if err := ioutil.WriteFile(filepath.Join(task, "apparmor", "exec"), change, 0); err != nil {
+		if err := ioutil.WriteFile(filepath.Join(task, "exec"), change, 0); err != nil {
+			return fmt.Errorf("can't change to the AppArmor profile %s, run -apparmor-install again: %s", helperAppArmorProfile, err)
+		}
+	}
+	return syscall.Exec(self, os.Args, os.Environ())
+}
+
+// dryRun runs the helper command hcmd with HELPER_DRY_RUN in place of the
+// browser. Namespaces can be refused at any step, by sysctls, seccomp or LSMs
+// such as apparmor_restrict_unprivileged_userns, so this is the only way to
+// know the helper will get to run the browser.
+func dryRun(hcmd *exec.Cmd) error {
+	hcmd.Args = append(hcmd.Args, HELPER_DRY_RUN)
+	hcmd.Stdin, hcmd.Stdout, hcmd.Stderr = nil, nil, nil
+	out, err := hcmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s failed: %s", hcmd.Args[1], msg)
+		}
+		return fmt.Errorf("%s failed: %s", hcmd.Args[1], err)
+	}
+	return nil
+}
+
+// forwardOfflineProxy forwards a new unix socket to the offline proxy. The
+// returned function stops forwarding and removes the socket.
+func forwardOfflineProxy() (string, func(), error) {
+	dir, err := ioutil.TempDir("", "tor-manager-netns")
+	if err != nil {
+		return "", nil, err
+	}
+	socket := filepath.Join(dir, "offline.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	go forwardConnections(listener, func() (net.Conn, error) {
+		return net.Dial("tcp", OFFLINE_PROXY)
+	})
+	return socket, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// forwardConnections copies every connection accepted by listener to a
+// connection made by dial, until the listener is closed.
+func forwardConnections(listener net.Listener, dial func() (net.Conn, error)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := dial()
+			if err != nil {
+				log.Println("forwardConnections:", err)
+				return
+			}
+			defer upstream.Close()
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+// RunNetnsHelper is run by tor-manager with NETNS_HELPER as its first argument
+// inside the namespace created by isolateNetwork. It moves into its own
+// AppArmor profile if tor-manager has one, brings up loopback, forwards the
+// offline proxy's address to the unix socket, drops its capabilities and runs
+// the browser. args are the socket, the proxy's address,
+// and the browser's command line or HELPER_DRY_RUN.
+func RunNetnsHelper(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("RunNetnsHelper: usage: %s socket address browser [args...]", NETNS_HELPER)
+	}
+	if err := enterHelperProfile(); err != nil {
+		return fmt.Errorf("RunNetnsHelper: %s", err)
+	}
+	socket, addr, browser := args[0], args[1], args[2:]
+	listener, err := connectNamespace(socket, addr)
+	if err != nil {
+		return fmt.Errorf("RunNetnsHelper: %s", err)
+	}
+	defer listener.Close()
+	// PR_CAP_AMBIENT, PR_CAP_AMBIENT_CLEAR_ALL: the browser gets no capabilities.
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, 47, 4, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("RunNetnsHelper: dropping capabilities: %s", errno)
+	}
+	if browser[0] == HELPER_DRY_RUN {
+		return nil
+	}
+	bcmd := exec.Command(browser[0], browser[1:]...)
+	bcmd.Stdin = os.Stdin
+	bcmd.Stdout = os.Stdout
+	bcmd.Stderr = os.Stderr
+	return bcmd.Run()
+}
+
+// connectNamespace brings up loopback in the current network namespace and
+// forwards addr on it to the unix socket.
+func connectNamespace(socket, addr string) (net.Listener, error) {
+	if err := loopbackUp(); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go forwardConnections(listener, func() (net.Conn, error) {
+		return net.Dial("unix", socket)
+	})
+	return listener, nil
+}
+
+// loopbackUp brings up the loopback interface of the current network namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifreq struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifreq.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifreq))); errno != 0 {
+		return errno
+	}
+	ifreq.flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifreq))); errno != 0 {
+		return errno
+	}
+	return nil
+}
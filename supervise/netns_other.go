@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package tbsupervise
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// NETNS_HELPER is the argument which makes tor-manager run as the helper
+// inside the offline browser's network namespace.
+const NETNS_HELPER = "--netns-helper"
+
+// UserNamespacesAvailable returns an error, network namespaces only exist on Linux.
+func UserNamespacesAvailable() error {
+	return fmt.Errorf("network namespaces are only available on Linux")
+}
+
+func isolateNetwork(bcmd *exec.Cmd) (*exec.Cmd, func(), error) {
+	return nil, nil, UserNamespacesAvailable()
+}
+
+// RunNetnsHelper returns an error, network namespaces only exist on Linux.
+func RunNetnsHelper(args []string) error {
+	return UserNamespacesAvailable()
+}
@@ -65,6 +65,9 @@ user_pref("network.IDN_show_punycode", true);
 user_pref("privacy.prioritizeonions.showNotification", false);
 `)
 
+// offlinebrowserjs is what older versions wrote to offline profiles, which
+// disabled the network with a proxy that doesn't exist. Offline profiles now use
+// the offline proxy instead, see offlineProxyPrefs.
 var offlinebrowserjs = append(secbrowserjs, []byte(`
 //set the proxy to 127.0.0.1:1, which will fail all requests
 user_pref("network.proxy.type", 1);
@@ -116,3 +119,18 @@ var offlinehtml = []byte(`
 </body>
 </html>
 `)
+
+var offlineblockedhtml = `<!DOCTYPE html>
+<html>
+<head>
+  <title>i2p.plugins.tor-manager - Blocked in Offline Mode</title>
+</head>
+<body>
+<h1 id="blocked-in-offline-mode">Blocked in Offline Mode</h1>
+<p>%s Offline mode only lets the browser reach these services on this device:</p>
+<ul>
+%s</ul>
+<p>This wrapper has been developed for use with the I2P project. To learn more about I2P, visit <a href="https://geti2p.net/">Get I2P</a></p>
+</body>
+</html>
+`
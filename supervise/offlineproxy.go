@@ -0,0 +1,312 @@
+package tbsupervise
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
+)
+
+// OFFLINE_PROXY is the address of the proxy offline profiles use. It can be set
+// with TOR_MANAGER_OFFLINE_PROXY.
+var OFFLINE_PROXY = DefaultOfflineProxy()
+
+// OFFLINE_ALLOWLIST are the host:port pairs offline profiles may reach: the I2P
+// router console, FProxy and the site editor. It can be set with
+// TOR_MANAGER_OFFLINE_ALLOWLIST as a comma-separated list.
+var OFFLINE_ALLOWLIST = DefaultOfflineAllowlist()
+
+// OFFLINE_NETNS runs offline browsers on Linux in their own network namespace,
+// which can only reach the offline proxy. It can be set with
+// TOR_MANAGER_OFFLINE_NETNS.
+var OFFLINE_NETNS = os.Getenv("TOR_MANAGER_OFFLINE_NETNS") == "true"
+
+// DefaultOfflineProxy returns the offline proxy address configured in the
+// environment, or 127.0.0.1:7698.
+func DefaultOfflineProxy() string {
+	if addr := os.Getenv("TOR_MANAGER_OFFLINE_PROXY"); addr != "" {
+		return addr
+	}
+	return "127.0.0.1:7698"
+}
+
+// DefaultOfflineAllowlist returns the allowlist configured in the environment,
+// or the local I2P services: the router console, Freenet's FProxy and the site
+// editor.
+func DefaultOfflineAllowlist() []string {
+	if list := os.Getenv("TOR_MANAGER_OFFLINE_ALLOWLIST"); list != "" {
+		return ParseOfflineAllowlist(list)
+	}
+	return []string{tbdiscover.Default().Console.Addr(), "127.0.0.1:8888", EDITOR_ADDR}
+}
+
+// ParseOfflineAllowlist parses a comma-separated list of host:port pairs.
+func ParseOfflineAllowlist(list string) []string {
+	var allow []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			allow = append(allow, entry)
+		}
+	}
+	return allow
+}
+
+// offlineProxyHeader marks the responses of the offline proxy, so that another
+// tor-manager can tell it's already running.
+const offlineProxyHeader = "X-Tor-Manager-Offline-Proxy"
+
+// BlockedRequest is a request the offline proxy refused.
+type BlockedRequest struct {
+	Time   time.Time
+	Method string
+	Host   string
+	URL    string
+}
+
+// OfflineProxy is an HTTP proxy which only forwards requests to an allowlist of
+// local services, and answers everything else with a page explaining that the
+// browser is in offline mode.
+type OfflineProxy struct {
+	Addr  string
+	Allow []string
+
+	mutex    sync.Mutex
+	listener net.Listener
+	blocked  []BlockedRequest
+}
+
+// maxBlocked is how many blocked requests the offline proxy remembers.
+const maxBlocked = 100
+
+var offlineProxy struct {
+	sync.Mutex
+	proxy *OfflineProxy
+}
+
+// StartOfflineProxy starts the offline proxy on OFFLINE_PROXY with the
+// OFFLINE_ALLOWLIST, unless it's already running. If another tor-manager is
+// already running one on the address, that one is used.
+func StartOfflineProxy() (*OfflineProxy, error) {
+	offlineProxy.Lock()
+	defer offlineProxy.Unlock()
+	if offlineProxy.proxy != nil {
+		return offlineProxy.proxy, nil
+	}
+	p := &OfflineProxy{Addr: OFFLINE_PROXY, Allow: OFFLINE_ALLOWLIST}
+	listener, err := net.Listen("tcp", p.Addr)
+	if err != nil {
+		if offlineProxyRunning(p.Addr) {
+			log.Println("StartOfflineProxy: using the offline proxy already running on", p.Addr)
+			return p, nil
+		}
+		return nil, fmt.Errorf("StartOfflineProxy: %s", err)
+	}
+	p.listener = listener
+	go func() {
+		if err := http.Serve(listener, p); err != nil {
+			log.Println("OfflineProxy:", err)
+		}
+	}()
+	log.Println("StartOfflineProxy: offline profiles can reach", strings.Join(p.Allow, ", "), "through", p.Addr)
+	offlineProxy.proxy = p
+	return p, nil
+}
+
+// OfflineBlocked returns the requests blocked by the offline proxy this
+// process runs, newest first.
+func OfflineBlocked() []BlockedRequest {
+	offlineProxy.Lock()
+	p := offlineProxy.proxy
+	offlineProxy.Unlock()
+	if p == nil {
+		return nil
+	}
+	return p.Blocked()
+}
+
+func offlineProxyRunning(addr string) bool {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get("http://" + addr + "/")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.Header.Get(offlineProxyHeader) != ""
+}
+
+// Blocked returns the requests the proxy refused, newest first.
+func (p *OfflineProxy) Blocked() []BlockedRequest {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	blocked := make([]BlockedRequest, len(p.blocked))
+	for i, b := range p.blocked {
+		blocked[len(p.blocked)-1-i] = b
+	}
+	return blocked
+}
+
+// Allowed returns true if the host:port is on the allowlist. localhost and
+// 127.0.0.1 are interchangeable.
+func (p *OfflineProxy) Allowed(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	for _, allow := range p.Allow {
+		ahost, aport, err := net.SplitHostPort(allow)
+		if err != nil {
+			continue
+		}
+		if ahost == "localhost" {
+			ahost = "127.0.0.1"
+		}
+		if ahost == host && aport == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *OfflineProxy) block(rq *http.Request, hostport string) {
+	u := rq.URL.String()
+	if rq.Method == http.MethodConnect {
+		u = hostport
+	}
+	log.Println("OfflineProxy: blocked", rq.Method, u)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.blocked = append(p.blocked, BlockedRequest{Time: time.Now(), Method: rq.Method, Host: hostport, URL: u})
+	if len(p.blocked) > maxBlocked {
+		p.blocked = p.blocked[len(p.blocked)-maxBlocked:]
+	}
+}
+
+func (p *OfflineProxy) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	rw.Header().Set(offlineProxyHeader, "1")
+	hostport := rq.URL.Host
+	if rq.Method == http.MethodConnect {
+		hostport = rq.Host
+	}
+	if hostport == "" {
+		// Not a proxy request, someone opened the proxy's address directly.
+		rw.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(rw, p.blockPage(""))
+		return
+	}
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, "80")
+		if rq.URL.Scheme == "https" {
+			hostport = net.JoinHostPort(rq.URL.Host, "443")
+		}
+	}
+	if !p.Allowed(hostport) {
+		p.block(rq, hostport)
+		if rq.Method == http.MethodConnect {
+			http.Error(rw, "blocked by offline mode", http.StatusForbidden)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/html")
+		rw.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(rw, p.blockPage(rq.URL.String()))
+		return
+	}
+	if rq.Method == http.MethodConnect {
+		p.tunnel(rw, hostport)
+		return
+	}
+	p.forward(rw, rq)
+}
+
+var offlineTransport = &http.Transport{Proxy: nil}
+
+// forward passes an allowed request on to the local service.
+func (p *OfflineProxy) forward(rw http.ResponseWriter, rq *http.Request) {
+	out := rq.Clone(rq.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+	resp, err := offlineTransport.RoundTrip(out)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(key, value)
+		}
+	}
+	rw.WriteHeader(resp.StatusCode)
+	io.Copy(rw, resp.Body)
+}
+
+// tunnel connects an allowed CONNECT request to the local service.
+func (p *OfflineProxy) tunnel(rw http.ResponseWriter, hostport string) {
+	conn, err := net.DialTimeout("tcp", hostport, 10*time.Second)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		conn.Close()
+		http.Error(rw, "can't tunnel", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		io.Copy(conn, client)
+		conn.Close()
+	}()
+	io.Copy(client, conn)
+	client.Close()
+}
+
+func (p *OfflineProxy) blockPage(blocked string) string {
+	links := ""
+	for _, allow := range p.Allow {
+		links += fmt.Sprintf("<li><a href=\"http://%s\">%s</a></li>\n", html.EscapeString(allow), html.EscapeString(allow))
+	}
+	message := "This browser is in offline mode."
+	if blocked != "" {
+		message = fmt.Sprintf("This browser is in offline mode, so <code>%s</code> was blocked.", html.EscapeString(blocked))
+	}
+	return fmt.Sprintf(offlineblockedhtml, message, links)
+}
+
+// offlineProxyPrefs point every protocol at the offline proxy. Local addresses
+// go through it too, so the allowlist applies to them.
+func offlineProxyPrefs(addr string) []Pref {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = "127.0.0.1", "1"
+	}
+	prefs := []Pref{{Name: "network.proxy.type", Value: "1"}}
+	for _, scheme := range []string{"http", "ssl", "ftp"} {
+		prefs = append(prefs,
+			Pref{Name: "network.proxy." + scheme, Value: fmt.Sprintf("%q", host)},
+			Pref{Name: "network.proxy." + scheme + "_port", Value: port})
+	}
+	return append(prefs,
+		Pref{Name: "network.proxy.socks", Value: `""`},
+		Pref{Name: "network.proxy.socks_port", Value: "0"},
+		Pref{Name: "network.proxy.share_proxy_settings", Value: "true"},
+		Pref{Name: "network.proxy.no_proxies_on", Value: `""`},
+		Pref{Name: "network.proxy.allow_hijacking_localhost", Value: "true"})
+}
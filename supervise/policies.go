@@ -0,0 +1,317 @@
+package tbsupervise
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
+	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+)
+
+// ExtensionSetting is an entry of the ExtensionSettings policy.
+type ExtensionSetting struct {
+	InstallationMode string `json:"installation_mode"`
+	InstallURL       string `json:"install_url,omitempty"`
+}
+
+// ProxyPolicy is the Proxy policy.
+type ProxyPolicy struct {
+	Mode                        string `json:"Mode"`
+	Locked                      bool   `json:"Locked"`
+	HTTPProxy                   string `json:"HTTPProxy,omitempty"`
+	UseHTTPProxyForAllProtocols bool   `json:"UseHTTPProxyForAllProtocols,omitempty"`
+	Passthrough                 string `json:"Passthrough,omitempty"`
+}
+
+// HomepagePolicy is the Homepage policy.
+type HomepagePolicy struct {
+	URL       string `json:"URL"`
+	Locked    bool   `json:"Locked"`
+	StartPage string `json:"StartPage"`
+}
+
+// SearchEngine is a search engine added by the SearchEngines policy.
+type SearchEngine struct {
+	Name        string `json:"Name"`
+	URLTemplate string `json:"URLTemplate"`
+	Method      string `json:"Method"`
+}
+
+// SearchEnginesPolicy is the SearchEngines policy.
+type SearchEnginesPolicy struct {
+	Add             []SearchEngine `json:"Add,omitempty"`
+	Default         string         `json:"Default,omitempty"`
+	PreventInstalls bool           `json:"PreventInstalls"`
+}
+
+// Policies is the subset of the Firefox enterprise policies tor-manager writes.
+type Policies struct {
+	DisableAppUpdate     bool                        `json:"DisableAppUpdate"`
+	SearchSuggestEnabled bool                        `json:"SearchSuggestEnabled"`
+	Proxy                *ProxyPolicy                `json:"Proxy,omitempty"`
+	ExtensionSettings    map[string]ExtensionSetting `json:"ExtensionSettings,omitempty"`
+	Homepage             *HomepagePolicy             `json:"Homepage,omitempty"`
+	SearchEngines        *SearchEnginesPolicy        `json:"SearchEngines,omitempty"`
+}
+
+// policiesFile is the file Firefox reads its policies from.
+type policiesFile struct {
+	Policies Policies `json:"policies"`
+}
+
+// builtinSearchEngines are the search engines Tor Browser ships.
+var builtinSearchEngines = []string{"DuckDuckGo", "DuckDuckGo Onion", "Startpage", "Wikipedia (en)", "Twitter", "YouTube"}
+
+// Validate checks the policies against the schema Firefox expects for them.
+func (p *Policies) Validate() error {
+	if p.Proxy != nil {
+		switch p.Proxy.Mode {
+		case "none", "system", "autoDetect":
+		case "manual":
+			if _, _, err := net.SplitHostPort(p.Proxy.HTTPProxy); err != nil {
+				return fmt.Errorf("Validate: Proxy.HTTPProxy %q is not host:port", p.Proxy.HTTPProxy)
+			}
+		default:
+			return fmt.Errorf("Validate: unknown Proxy.Mode %q", p.Proxy.Mode)
+		}
+	}
+	for id, ext := range p.ExtensionSettings {
+		switch ext.InstallationMode {
+		case "allowed", "blocked":
+		case "force_installed", "normal_installed":
+			u, err := url.Parse(ext.InstallURL)
+			if err != nil || (u.Scheme != "file" && u.Scheme != "https") {
+				return fmt.Errorf("Validate: extension %s has an invalid install_url %q", id, ext.InstallURL)
+			}
+		default:
+			return fmt.Errorf("Validate: extension %s has unknown installation_mode %q", id, ext.InstallationMode)
+		}
+	}
+	if p.Homepage != nil {
+		if u, err := url.Parse(p.Homepage.URL); err != nil || u.Scheme == "" {
+			return fmt.Errorf("Validate: Homepage.URL %q is not a URL", p.Homepage.URL)
+		}
+		switch p.Homepage.StartPage {
+		case "none", "homepage", "previous-session", "homepage-locked":
+		default:
+			return fmt.Errorf("Validate: unknown Homepage.StartPage %q", p.Homepage.StartPage)
+		}
+	}
+	if p.SearchEngines != nil {
+		names := append([]string{}, builtinSearchEngines...)
+		for _, engine := range p.SearchEngines.Add {
+			if engine.Name == "" || !strings.Contains(engine.URLTemplate, "{searchTerms}") {
+				return fmt.Errorf("Validate: search engine %q needs a name and a URLTemplate containing {searchTerms}", engine.Name)
+			}
+			if engine.Method != "GET" && engine.Method != "POST" {
+				return fmt.Errorf("Validate: search engine %s has unknown Method %q", engine.Name, engine.Method)
+			}
+			names = append(names, engine.Name)
+		}
+		if p.SearchEngines.Default != "" {
+			found := false
+			for _, name := range names {
+				found = found || name == p.SearchEngines.Default
+			}
+			if !found {
+				return fmt.Errorf("Validate: the default search engine %s is not available", p.SearchEngines.Default)
+			}
+		}
+	}
+	return nil
+}
+
+// PolicyDir returns the distribution directory of the install, where Firefox
+// looks for policies.json.
+func (s *Supervisor) PolicyDir(install string) string {
+	return filepath.Join(s.SpecificTBDirectory(install), "distribution")
+}
+
+// extensionSetting returns a force_installed setting for the xpi.
+func extensionSetting(xpi string) ExtensionSetting {
+	if abs, err := filepath.Abs(xpi); err == nil {
+		xpi = abs
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(xpi)}
+	return ExtensionSetting{InstallationMode: "force_installed", InstallURL: u.String()}
+}
+
+// ModePolicies returns the policies for launching a browser in the mode. Every
+// mode disables Firefox's own updates, as tor-manager updates the installs, and
+// ModeTor leaves the rest of Tor Browser's configuration alone. The mode's
+// RequiredExtensions are pinned when they are in the extension store. The
+// proxies of I2P and app browsers are set in their profiles' prefs instead, as
+// each profile has its own, see ApplyPrefs.
+func (s *Supervisor) ModePolicies(mode string) *Policies {
+	if mode == ModeTor {
+		return &Policies{DisableAppUpdate: true}
+	}
+	extensions := make(map[string]ExtensionSetting)
+	for _, id := range RequiredExtensions(mode) {
+		if xpi := s.ExtensionFile(id); xpi != "" {
+			extensions[id] = extensionSetting(xpi)
+		}
+	}
+	home := tbdiscover.Default().Console.URL() + "home"
+	p := &Policies{DisableAppUpdate: true}
+	switch mode {
+	case ModeClearnet:
+		p.Proxy = &ProxyPolicy{Mode: "none", Locked: true}
+		p.Homepage = &HomepagePolicy{URL: "https://duckduckgo.com", StartPage: "homepage"}
+		p.SearchEngines = &SearchEnginesPolicy{Default: "DuckDuckGo"}
+		p.SearchSuggestEnabled = true
+	case ModeOffline:
+		p.Proxy = &ProxyPolicy{Mode: "manual", Locked: true, HTTPProxy: OFFLINE_PROXY, UseHTTPProxyForAllProtocols: true}
+		p.Homepage = &HomepagePolicy{URL: home, StartPage: "homepage"}
+		p.SearchEngines = &SearchEnginesPolicy{PreventInstalls: true}
+	case ModeI2P:
+		p.Homepage = &HomepagePolicy{URL: home, StartPage: "homepage"}
+		p.SearchEngines = &SearchEnginesPolicy{
+			Add:             []SearchEngine{{Name: "Legwork", URLTemplate: "http://legwork.i2p/yacysearch.html?query={searchTerms}", Method: "GET"}},
+			Default:         "Legwork",
+			PreventInstalls: true,
+		}
+	case ModeApp:
+		p.Homepage = &HomepagePolicy{URL: home, Locked: true, StartPage: "homepage"}
+		p.SearchEngines = &SearchEnginesPolicy{PreventInstalls: true}
+	}
+	if len(extensions) > 0 {
+		p.ExtensionSettings = extensions
+	}
+	return p
+}
+
+// policiesFileMutex serializes the writes of policies.json files.
+var policiesFileMutex sync.Mutex
+
+// ApplyPolicies writes the policies.json for the mode into the install, so it
+// is in effect when the browser is launched from it. If the install already had
+// a policies.json which tor-manager didn't write, it is kept next to it and put
+// back by restorePolicies; ModeTor browsers get it with only Firefox's updates
+// turned off. On macOS the install is a read-only disk image, so nothing is
+// written. The launches hold a leasePolicies on the install from before they
+// apply its policies until their browser has read them. Next to the
+// policies.json, the hash of what was written is recorded for the integrity
+// checks, see tbget.PoliciesOwner.
+func (s *Supervisor) ApplyPolicies(install, mode string) error {
+	if OS() == "osx" {
+		return nil
+	}
+	policiesFileMutex.Lock()
+	defer policiesFileMutex.Unlock()
+	if install == "" {
+		install = UNPACK_URL()
+	}
+	dir := s.PolicyDir(install)
+	policies := filepath.Join(dir, "policies.json")
+	original := policies + ".orig"
+	owner := tbget.PoliciesOwner(policies)
+	ours := tbget.FileExists(owner)
+	p := s.ModePolicies(mode)
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("ApplyPolicies: %s", err)
+	}
+	data, err := json.MarshalIndent(policiesFile{Policies: *p}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ApplyPolicies: %s", err)
+	}
+	if mode == ModeTor {
+		own := policies
+		if ours {
+			own = original
+		}
+		if data, err = disableAppUpdate(own, data); err != nil {
+			return fmt.Errorf("ApplyPolicies: %s", err)
+		}
+	}
+	if current, err := ioutil.ReadFile(policies); err == nil && ours && bytes.Equal(current, data) {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("ApplyPolicies: %s", err)
+	}
+	if !ours && tbget.FileExists(policies) {
+		if err := os.Rename(policies, original); err != nil {
+			return fmt.Errorf("ApplyPolicies: %s", err)
+		}
+	}
+	// The owner file is written first, so that the integrity checks never
+	// see a policies.json of ours which isn't accounted for.
+	if err := ioutil.WriteFile(owner, []byte(fmt.Sprintf("%x\n", sha256.Sum256(data))), 0644); err != nil {
+		return fmt.Errorf("ApplyPolicies: %s", err)
+	}
+	// Write a new file and rename it over the old one, so a policies.json
+	// which is hardlinked into another install is never changed in place.
+	tmp := policies + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("ApplyPolicies: %s", err)
+	}
+	if err := os.Rename(tmp, policies); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("ApplyPolicies: %s", err)
+	}
+	log.Println("ApplyPolicies: wrote the", mode, "policies to", policies)
+	return nil
+}
+
+// disableAppUpdate returns the policies.json at own with Firefox's updates
+// turned off, or fallback if there is no policies.json there.
+func disableAppUpdate(own string, fallback []byte) ([]byte, error) {
+	current, err := ioutil.ReadFile(own)
+	if os.IsNotExist(err) {
+		return fallback, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]interface{}
+	if err := json.Unmarshal(current, &file); err != nil {
+		return nil, fmt.Errorf("%s: %s", own, err)
+	}
+	policies, ok := file["policies"].(map[string]interface{})
+	if !ok {
+		policies = make(map[string]interface{})
+		file["policies"] = policies
+	}
+	policies["DisableAppUpdate"] = true
+	return json.MarshalIndent(file, "", "  ")
+}
+
+// restorePolicies removes the policies.json ApplyPolicies wrote into the
+// install, and puts back the policies.json the install had before.
+func (s *Supervisor) restorePolicies(install string) error {
+	if OS() == "osx" {
+		return nil
+	}
+	policiesFileMutex.Lock()
+	defer policiesFileMutex.Unlock()
+	if install == "" {
+		install = UNPACK_URL()
+	}
+	policies := filepath.Join(s.PolicyDir(install), "policies.json")
+	original := policies + ".orig"
+	owner := tbget.PoliciesOwner(policies)
+	if !tbget.FileExists(owner) {
+		return nil
+	}
+	if err := os.Remove(policies); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("restorePolicies: %s", err)
+	}
+	if tbget.FileExists(original) {
+		if err := os.Rename(original, policies); err != nil {
+			return fmt.Errorf("restorePolicies: %s", err)
+		}
+	}
+	log.Println("restorePolicies: put back the policies of", install)
+	return os.Remove(owner)
+}
@@ -0,0 +1,371 @@
+package tbsupervise
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
+)
+
+// The managed section of a user.js is everything between these two lines. It is
+// regenerated on every launch, everything outside of it belongs to the user.
+const (
+	PREFS_BEGIN = "// BEGIN tor-manager managed preferences. Changes between these lines are overwritten on every launch,"
+	PREFS_HINT  = "// add your own user_pref lines after the END line instead, they override the managed ones."
+	PREFS_END   = "// END tor-manager managed preferences"
+)
+
+// basejs is the hardening every profile tor-manager manages gets, whatever its mode.
+var basejs = []byte(`
+// Show punycode in the URL bar to defeat homograph attacks.
+user_pref("network.IDN_show_punycode", true);
+// Never send telemetry or crash reports.
+user_pref("toolkit.telemetry.enabled", false);
+user_pref("datareporting.healthreport.uploadEnabled", false);
+user_pref("browser.crashReports.unsubmittedCheck.autoSubmit2", false);
+`)
+
+// Pref is a single user_pref line. Value is the raw javascript value.
+type Pref struct {
+	Name  string
+	Value string
+}
+
+func (p Pref) String() string {
+	return fmt.Sprintf("user_pref(%q, %s);", p.Name, p.Value)
+}
+
+// prefLine matches a user_pref line. Quoted strings in the value are matched
+// whole, so a value such as "a);b" isn't cut short at the ");" inside it.
+var prefLine = regexp.MustCompile(`^\s*user_pref\(\s*"((?:[^"\\]|\\.)*)"\s*,\s*((?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|[^"'])*?)\s*\)\s*;`)
+
+// ParsePref parses a user_pref line. It returns false if the line isn't one.
+func ParsePref(line string) (Pref, bool) {
+	match := prefLine.FindStringSubmatch(line)
+	if match == nil {
+		return Pref{}, false
+	}
+	return Pref{Name: match[1], Value: match[2]}, true
+}
+
+// ParsePrefs returns the user_pref lines of a user.js in order.
+func ParsePrefs(data []byte) []Pref {
+	var prefs []Pref
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if pref, ok := ParsePref(scanner.Text()); ok {
+			prefs = append(prefs, pref)
+		}
+	}
+	return prefs
+}
+
+// mergePrefs composes layers of prefs in order. A pref set by a later layer
+// replaces the value set by an earlier one, keeping its position.
+func mergePrefs(layers ...[]Pref) []Pref {
+	var merged []Pref
+	index := make(map[string]int)
+	for _, layer := range layers {
+		for _, pref := range layer {
+			if i, ok := index[pref.Name]; ok {
+				merged[i] = pref
+				continue
+			}
+			index[pref.Name] = len(merged)
+			merged = append(merged, pref)
+		}
+	}
+	return merged
+}
+
+// modePrefs returns the prefs of the mode's layer. I2P and app profiles use the
+// user.js shipped in their default template, so that prefs added to it by newer
+// versions reach existing profiles.
+func (s *Supervisor) modePrefs(mode string) []Pref {
+	switch mode {
+	case ModeClearnet:
+		return ParsePrefs(secbrowserjs)
+	case ModeOffline:
+		return mergePrefs(ParsePrefs(secbrowserjs), offlineProxyPrefs(OFFLINE_PROXY))
+	case ModeI2P, ModeApp:
+		return ParsePrefs(s.templateUserJS(DefaultTemplate(mode)))
+	}
+	return nil
+}
+
+func (s *Supervisor) templateUserJS(template string) []byte {
+	if s.Profile == nil || template == "" {
+		return nil
+	}
+	data, err := s.Profile.ReadFile(path.Join(TEMPLATE_ROOT, template, "user.js"))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// ManagedPrefs returns the prefs tor-manager manages for a profile of the mode:
+// the base hardening, then the mode's own prefs.
+func (s *Supervisor) ManagedPrefs(mode string) []Pref {
+	return mergePrefs(ParsePrefs(basejs), s.modePrefs(mode))
+}
+
+// splitUserJS separates a user.js into the prefs of its managed section and
+// the user's own lines. A user.js without a managed section was written by an
+// older version of tor-manager, which wrote one of the files it ships. Its lines
+// which match what tor-manager ships are dropped, everything else is the user's.
+func (s *Supervisor) splitUserJS(data []byte) ([]Pref, []string) {
+	var managed []Pref
+	var user []string
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	begin, end := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case PREFS_BEGIN:
+			begin = i
+		case PREFS_END:
+			if begin >= 0 && end < 0 {
+				end = i
+			}
+		}
+	}
+	if begin >= 0 && end > begin {
+		for _, line := range lines[begin+1 : end] {
+			if pref, ok := ParsePref(line); ok {
+				managed = append(managed, pref)
+			}
+		}
+		return managed, trimBlank(append(append([]string{}, lines[:begin]...), lines[end+1:]...))
+	}
+	shipped := [][]byte{basejs, secbrowserjs, offlinebrowserjs, []byte("#")}
+	known := make(map[Pref]bool)
+	for _, file := range shipped {
+		for _, pref := range ParsePrefs(file) {
+			known[pref] = true
+		}
+	}
+	for _, mode := range []string{ModeI2P, ModeApp} {
+		shipped = append(shipped, s.templateUserJS(DefaultTemplate(mode)))
+		for _, pref := range s.modePrefs(mode) {
+			known[pref] = true
+		}
+	}
+	for _, file := range shipped {
+		if file != nil && bytes.Equal(bytes.TrimSpace(file), bytes.TrimSpace(data)) {
+			return ParsePrefs(data), nil
+		}
+	}
+	for _, line := range lines {
+		if pref, ok := ParsePref(line); ok && known[pref] {
+			managed = append(managed, pref)
+			continue
+		}
+		if strings.TrimSpace(line) == "#" {
+			continue
+		}
+		user = append(user, line)
+	}
+	return managed, trimBlank(user)
+}
+
+func trimBlank(lines []string) []string {
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// PrefChange is a difference between two versions of the managed prefs. Old is
+// empty for added prefs and New is empty for removed ones.
+type PrefChange struct {
+	Name string
+	Old  string
+	New  string
+}
+
+func (c PrefChange) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("+ %s = %s", c.Name, c.New)
+	case c.New == "":
+		return fmt.Sprintf("- %s = %s", c.Name, c.Old)
+	}
+	return fmt.Sprintf("~ %s = %s (was %s)", c.Name, c.New, c.Old)
+}
+
+// DiffPrefs returns the changes from old to new.
+func DiffPrefs(old, new []Pref) []PrefChange {
+	var changes []PrefChange
+	before := make(map[string]string)
+	for _, pref := range old {
+		before[pref.Name] = pref.Value
+	}
+	after := make(map[string]bool)
+	for _, pref := range new {
+		after[pref.Name] = true
+		if value, ok := before[pref.Name]; !ok {
+			changes = append(changes, PrefChange{Name: pref.Name, New: pref.Value})
+		} else if value != pref.Value {
+			changes = append(changes, PrefChange{Name: pref.Name, Old: value, New: pref.Value})
+		}
+	}
+	for _, pref := range old {
+		if !after[pref.Name] {
+			changes = append(changes, PrefChange{Name: pref.Name, Old: pref.Value})
+		}
+	}
+	return changes
+}
+
+// prefChanges holds the changes the last ApplyPrefs made to the managed prefs
+// of each profile directory, so the panel can show them.
+var prefChanges = struct {
+	sync.Mutex
+	byDir map[string][]PrefChange
+}{byDir: make(map[string][]PrefChange)}
+
+// PrefChanges returns the changes the last launch of each profile made to its
+// managed prefs, by profile directory. Profiles whose managed prefs didn't
+// change on their last launch aren't in it.
+func (s *Supervisor) PrefChanges() map[string][]PrefChange {
+	prefChanges.Lock()
+	defer prefChanges.Unlock()
+	changes := make(map[string][]PrefChange, len(prefChanges.byDir))
+	for dir, c := range prefChanges.byDir {
+		changes[dir] = c
+	}
+	return changes
+}
+
+func recordPrefChanges(dir string, changes []PrefChange) {
+	prefChanges.Lock()
+	defer prefChanges.Unlock()
+	if len(changes) == 0 {
+		delete(prefChanges.byDir, dir)
+		return
+	}
+	prefChanges.byDir[dir] = changes
+}
+
+// proxyPrefs returns the prefs of I2P and app profiles which send everything
+// but the router console through the HTTP proxy at addr.
+func proxyPrefs(addr string) []Pref {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = "127.0.0.1", "4444"
+	}
+	prefs := []Pref{
+		{Name: "network.proxy.no_proxies_on", Value: fmt.Sprintf("%q", consolePassthrough())},
+		{Name: "network.proxy.type", Value: "1"},
+	}
+	for _, scheme := range []string{"http", "ssl", "ftp", "socks"} {
+		prefs = append(prefs,
+			Pref{Name: "network.proxy." + scheme, Value: fmt.Sprintf("%q", host)},
+			Pref{Name: "network.proxy." + scheme + "_port", Value: port})
+	}
+	return append(prefs, Pref{Name: "network.proxy.share_proxy_settings", Value: "true"})
+}
+
+// consolePassthrough returns the router console addresses the I2P modes reach
+// without the proxy: the console, and the ports 7662 and 7669 local I2P
+// applications use.
+func consolePassthrough() string {
+	var hosts []string
+	for _, port := range []string{tbdiscover.Default().Console.PortString(), "7662", "7669"} {
+		hosts = append(hosts, "127.0.0.1:"+port, "localhost:"+port)
+	}
+	return strings.Join(hosts, ",")
+}
+
+// ApplyPrefs regenerates the managed section of the user.js in the profile
+// directory for the mode, keeping the user's own lines after it so they
+// override the managed prefs. I2P and app profiles use httpProxy, or the
+// router's HTTP proxy if it is empty. It returns the changes made to the
+// managed prefs.
+func (s *Supervisor) ApplyPrefs(profiledata, mode, httpProxy string) ([]PrefChange, error) {
+	apath, err := filepath.Abs(profiledata)
+	if err != nil {
+		return nil, fmt.Errorf("ApplyPrefs: %s", err)
+	}
+	if err := os.MkdirAll(apath, 0755); err != nil {
+		return nil, fmt.Errorf("ApplyPrefs: %s", err)
+	}
+	userjs := filepath.Join(apath, "user.js")
+	data, err := ioutil.ReadFile(userjs)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("ApplyPrefs: %s", err)
+	}
+	old, user := s.splitUserJS(data)
+	managed := s.ManagedPrefs(mode)
+	if mode == ModeI2P || mode == ModeApp {
+		if httpProxy == "" {
+			httpProxy = tbdiscover.Default().HTTPProxy.Addr()
+		}
+		managed = mergePrefs(managed, proxyPrefs(httpProxy))
+	}
+	var out bytes.Buffer
+	fmt.Fprintln(&out, PREFS_BEGIN)
+	fmt.Fprintln(&out, PREFS_HINT)
+	for _, pref := range managed {
+		fmt.Fprintln(&out, pref)
+	}
+	fmt.Fprintln(&out, PREFS_END)
+	if len(user) > 0 {
+		fmt.Fprintln(&out)
+		fmt.Fprintln(&out, strings.Join(user, "\n"))
+	}
+	changes := DiffPrefs(old, managed)
+	if bytes.Equal(out.Bytes(), data) {
+		recordPrefChanges(apath, nil)
+		return nil, nil
+	}
+	if err := ioutil.WriteFile(userjs, out.Bytes(), 0644); err != nil {
+		return nil, fmt.Errorf("ApplyPrefs: %s", err)
+	}
+	if len(data) > 0 && len(changes) > 0 {
+		log.Printf("ApplyPrefs: managed preferences of %s changed:", userjs)
+		for _, change := range changes {
+			log.Println("\t" + change.String())
+		}
+		recordPrefChanges(apath, changes)
+	} else {
+		recordPrefChanges(apath, nil)
+	}
+	overridden := make(map[string]bool)
+	for _, pref := range managed {
+		overridden[pref.Name] = true
+	}
+	for _, line := range user {
+		if pref, ok := ParsePref(line); ok && overridden[pref.Name] {
+			log.Printf("ApplyPrefs: %s overrides the managed preference %s", userjs, pref.Name)
+		}
+	}
+	return changes, nil
+}
+
+// prefsMode returns the mode whose prefs a profile launched with these flags gets.
+func prefsMode(offline, clearnet, editor bool) string {
+	switch {
+	case editor, offline && clearnet:
+		return ModeOffline
+	case clearnet:
+		return ModeClearnet
+	case offline:
+		return ModeApp
+	}
+	return ModeI2P
+}
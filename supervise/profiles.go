@@ -0,0 +1,477 @@
+package tbsupervise
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	cp "github.com/otiai10/copy"
+	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+)
+
+// Profile modes decide which network a profile's browser uses and how it is launched.
+const (
+	// ModeTor profiles use Tor, through Tor Browser's own launcher.
+	ModeTor = "tor"
+	// ModeI2P profiles use I2P, through the I2P HTTP proxy.
+	ModeI2P = "i2p"
+	// ModeClearnet profiles use the network directly, with a hardened configuration.
+	ModeClearnet = "clearnet"
+	// ModeOffline profiles can only reach services on this device.
+	ModeOffline = "offline"
+	// ModeApp profiles are locked to the I2P router console and its applications.
+	ModeApp = "app"
+)
+
+// Modes is every profile mode.
+var Modes = []string{ModeTor, ModeI2P, ModeClearnet, ModeOffline, ModeApp}
+
+// TEMPLATE_ROOT is the directory of the embedded content which holds the profile templates.
+const TEMPLATE_ROOT = "tor-browser/unpack"
+
+// Profile is a named browser profile managed by the Supervisor.
+type Profile struct {
+	// Name is the name used to refer to the profile.
+	Name string `json:"name"`
+	// Mode is one of Modes.
+	Mode string `json:"mode"`
+	// Template is the directory of embedded content the profile was created
+	// from. Profiles with an empty template are generated on first launch.
+	Template string `json:"template"`
+	// Created is when the profile was created.
+	Created time.Time `json:"created"`
+	// Path is the profile directory, relative to the profile root unless it is
+	// absolute. Tor profiles with an empty path use Tor Browser's own profile.
+	Path string `json:"path"`
+	// Sandbox decides whether the profile's browser runs in the sandbox on
+	// Linux. If it isn't set, SANDBOX decides.
+	Sandbox *bool `json:"sandbox,omitempty"`
+}
+
+var profileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// profilesMutex serializes changes to the profile index.
+var profilesMutex sync.Mutex
+
+// ProfileRoot returns the directory which holds the profile index and new profiles.
+func (s *Supervisor) ProfileRoot() string {
+	return filepath.Dir(s.TBUnpackPath())
+}
+
+// ProfileIndexPath returns the path of the on-disk profile index.
+func (s *Supervisor) ProfileIndexPath() string {
+	return filepath.Join(s.ProfileRoot(), "profiles.json")
+}
+
+// ProfileDir returns the directory of the profile.
+func (s *Supervisor) ProfileDir(p *Profile) string {
+	if p.Path == "" || filepath.IsAbs(p.Path) {
+		return p.Path
+	}
+	return filepath.Join(s.ProfileRoot(), p.Path)
+}
+
+// DefaultTemplate returns the template profiles of the mode are created from.
+func DefaultTemplate(mode string) string {
+	switch mode {
+	case ModeI2P:
+		return "i2p.firefox"
+	case ModeApp:
+		return "i2p.firefox.config"
+	}
+	return ""
+}
+
+// defaultProfiles are the profiles tor-manager has always used, at the paths
+// it has always used for them.
+func (s *Supervisor) defaultProfiles() []*Profile {
+	now := time.Now()
+	return []*Profile{
+		{Name: "tor", Mode: ModeTor, Created: now},
+		{Name: "i2p", Mode: ModeI2P, Template: "i2p.firefox", Created: now, Path: "i2p.firefox"},
+		{Name: "i2p-app", Mode: ModeApp, Template: "i2p.firefox.config", Created: now, Path: "i2p.firefox.config"},
+		{Name: "i2p-editor", Mode: ModeOffline, Created: now, Path: "i2p.firefox.editor"},
+		{Name: "clearnet", Mode: ModeClearnet, Created: now, Path: tbget.ChannelPath(filepath.Join(tbget.WORKING_DIR, "profile.firefox"), tbget.CHANNEL)},
+		{Name: "offline", Mode: ModeOffline, Created: now, Path: tbget.ChannelPath(filepath.Join(tbget.WORKING_DIR, "profile.firefox.offline"), tbget.CHANNEL)},
+	}
+}
+
+func (s *Supervisor) readProfiles() ([]*Profile, error) {
+	bytes, err := ioutil.ReadFile(s.ProfileIndexPath())
+	if os.IsNotExist(err) {
+		profiles := s.defaultProfiles()
+		if err := s.writeProfiles(profiles); err != nil {
+			log.Println("readProfiles:", err)
+		}
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("readProfiles: %s", err)
+	}
+	var profiles []*Profile
+	if err := json.Unmarshal(bytes, &profiles); err != nil {
+		return nil, fmt.Errorf("readProfiles: %s", err)
+	}
+	// The launchers use the default profiles by name, so any which are
+	// missing from the index are put back.
+	restored := false
+	for _, p := range s.defaultProfiles() {
+		if _, found := findProfile(profiles, p.Name); found == nil {
+			log.Println("readProfiles: restoring the built-in profile", p.Name)
+			profiles = append(profiles, p)
+			restored = true
+		}
+	}
+	if restored {
+		if err := s.writeProfiles(profiles); err != nil {
+			log.Println("readProfiles:", err)
+		}
+	}
+	return profiles, nil
+}
+
+// BuiltinProfile returns true if the named profile is one of the default
+// profiles the launchers use, which can be reset but not deleted.
+func (s *Supervisor) BuiltinProfile(name string) bool {
+	_, p := findProfile(s.defaultProfiles(), name)
+	return p != nil
+}
+
+func (s *Supervisor) writeProfiles(profiles []*Profile) error {
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	bytes, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return fmt.Errorf("writeProfiles: %s", err)
+	}
+	if err := os.MkdirAll(s.ProfileRoot(), 0755); err != nil {
+		return fmt.Errorf("writeProfiles: %s", err)
+	}
+	return ioutil.WriteFile(s.ProfileIndexPath(), bytes, 0644)
+}
+
+func findProfile(profiles []*Profile, name string) (int, *Profile) {
+	for i, p := range profiles {
+		if p.Name == name {
+			return i, p
+		}
+	}
+	return -1, nil
+}
+
+// Profiles returns every profile in the index.
+func (s *Supervisor) Profiles() ([]*Profile, error) {
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+	return s.readProfiles()
+}
+
+// profileNameOf returns the name of the managed profile in the directory, or
+// an empty name if it isn't one.
+func (s *Supervisor) profileNameOf(dir string) string {
+	profiles, err := s.Profiles()
+	if err != nil {
+		return ""
+	}
+	for _, p := range profiles {
+		if p.Path != "" && filepath.Clean(s.ProfileDir(p)) == filepath.Clean(dir) {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+// I2PProxy returns the HTTP proxy the named profile's browser uses in the mode
+// if it is an I2P or app browser: the profile's own from ProfileProxy, or an
+// empty address for the router's. If the profile's own proxy can't be started
+// it returns an error, so the browser isn't launched sharing the router's
+// proxy and identity instead.
+func (s *Supervisor) I2PProxy(name, mode string) (string, error) {
+	if (mode != ModeI2P && mode != ModeApp) || name == "" || s.ProfileProxy == nil {
+		return "", nil
+	}
+	addr, err := s.ProfileProxy(name)
+	if err != nil {
+		return "", fmt.Errorf("I2PProxy: refusing to launch %s without its own proxy: %s", name, err)
+	}
+	return addr, nil
+}
+
+// GetProfile returns the named profile.
+func (s *Supervisor) GetProfile(name string) (*Profile, error) {
+	profiles, err := s.Profiles()
+	if err != nil {
+		return nil, err
+	}
+	if _, p := findProfile(profiles, name); p != nil {
+		return p, nil
+	}
+	return nil, fmt.Errorf("GetProfile: no profile named %s", name)
+}
+
+// ProfileTemplates returns the names of the templates in the embedded content.
+func (s *Supervisor) ProfileTemplates() []string {
+	templates := []string{""}
+	if s.Profile == nil {
+		return templates
+	}
+	entries, err := s.Profile.ReadDir(TEMPLATE_ROOT)
+	if err != nil {
+		return templates
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			templates = append(templates, entry.Name())
+		}
+	}
+	return templates
+}
+
+// unpackTemplate copies the named template from the embedded content into dir.
+// An empty template creates an empty directory.
+func (s *Supervisor) unpackTemplate(template, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if template == "" {
+		return nil
+	}
+	if s.Profile == nil {
+		return fmt.Errorf("unpackTemplate: no embedded content to unpack %s from", template)
+	}
+	root := path.Join(TEMPLATE_ROOT, template)
+	return fs.WalkDir(s.Profile, root, func(embedpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := embedpath[len(root):]
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, filepath.FromSlash(rel)), 0755)
+		}
+		bytes, err := s.Profile.ReadFile(embedpath)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(rel)), bytes, 0644)
+	})
+}
+
+func validTemplate(s *Supervisor, template string) bool {
+	for _, t := range s.ProfileTemplates() {
+		if t == template {
+			return true
+		}
+	}
+	return false
+}
+
+func validMode(mode string) bool {
+	for _, m := range Modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateProfile creates a new profile from a template. If template is empty,
+// the mode's DefaultTemplate is used.
+func (s *Supervisor) CreateProfile(name, mode, template string) (*Profile, error) {
+	if !profileName.MatchString(name) {
+		return nil, fmt.Errorf("CreateProfile: %s is not a valid profile name, use letters, numbers, '.', '_' and '-'", name)
+	}
+	if !validMode(mode) {
+		return nil, fmt.Errorf("CreateProfile: unknown mode %s", mode)
+	}
+	if template == "" {
+		template = DefaultTemplate(mode)
+	}
+	if !validTemplate(s, template) {
+		return nil, fmt.Errorf("CreateProfile: unknown template %s", template)
+	}
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+	profiles, err := s.readProfiles()
+	if err != nil {
+		return nil, err
+	}
+	if _, p := findProfile(profiles, name); p != nil {
+		return nil, fmt.Errorf("CreateProfile: a profile named %s already exists", name)
+	}
+	p := &Profile{
+		Name:     name,
+		Mode:     mode,
+		Template: template,
+		Created:  time.Now(),
+		Path:     filepath.Join("profiles", name),
+	}
+	if err := s.unpackTemplate(template, s.ProfileDir(p)); err != nil {
+		return nil, fmt.Errorf("CreateProfile: %s", err)
+	}
+	return p, s.writeProfiles(append(profiles, p))
+}
+
+// CloneProfile creates a new profile with a copy of the contents, mode and
+// template of an existing one.
+func (s *Supervisor) CloneProfile(from, name string) (*Profile, error) {
+	if !profileName.MatchString(name) {
+		return nil, fmt.Errorf("CloneProfile: %s is not a valid profile name, use letters, numbers, '.', '_' and '-'", name)
+	}
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+	profiles, err := s.readProfiles()
+	if err != nil {
+		return nil, err
+	}
+	_, src := findProfile(profiles, from)
+	if src == nil {
+		return nil, fmt.Errorf("CloneProfile: no profile named %s", from)
+	}
+	if _, p := findProfile(profiles, name); p != nil {
+		return nil, fmt.Errorf("CloneProfile: a profile named %s already exists", name)
+	}
+	p := &Profile{
+		Name:     name,
+		Mode:     src.Mode,
+		Template: src.Template,
+		Created:  time.Now(),
+		Path:     filepath.Join("profiles", name),
+	}
+	if src.Path == "" {
+		if err := s.unpackTemplate(src.Template, s.ProfileDir(p)); err != nil {
+			return nil, fmt.Errorf("CloneProfile: %s", err)
+		}
+	} else if tbget.FileExists(s.ProfileDir(src)) {
+		if err := cp.Copy(s.ProfileDir(src), s.ProfileDir(p)); err != nil {
+			return nil, fmt.Errorf("CloneProfile: %s", err)
+		}
+	} else if err := s.unpackTemplate(src.Template, s.ProfileDir(p)); err != nil {
+		return nil, fmt.Errorf("CloneProfile: %s", err)
+	}
+	return p, s.writeProfiles(append(profiles, p))
+}
+
+// ResetProfile throws away the contents of a profile and recreates it from its template.
+func (s *Supervisor) ResetProfile(name string) error {
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+	profiles, err := s.readProfiles()
+	if err != nil {
+		return err
+	}
+	_, p := findProfile(profiles, name)
+	if p == nil {
+		return fmt.Errorf("ResetProfile: no profile named %s", name)
+	}
+	if p.Path == "" {
+		return fmt.Errorf("ResetProfile: %s uses Tor Browser's own profile, it can't be reset here", name)
+	}
+	if ProfileInUse(s.ProfileDir(p)) {
+		return fmt.Errorf("ResetProfile: a browser is running with %s, close it before resetting the profile", name)
+	}
+	if err := os.RemoveAll(s.ProfileDir(p)); err != nil {
+		return fmt.Errorf("ResetProfile: %s", err)
+	}
+	if err := s.unpackTemplate(p.Template, s.ProfileDir(p)); err != nil {
+		return fmt.Errorf("ResetProfile: %s", err)
+	}
+	return s.writeProfiles(profiles)
+}
+
+// DeleteProfile removes a profile from the index and deletes its contents.
+func (s *Supervisor) DeleteProfile(name string) error {
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+	profiles, err := s.readProfiles()
+	if err != nil {
+		return err
+	}
+	i, p := findProfile(profiles, name)
+	if p == nil {
+		return fmt.Errorf("DeleteProfile: no profile named %s", name)
+	}
+	if s.BuiltinProfile(name) {
+		return fmt.Errorf("DeleteProfile: %s is a built-in profile, it can be reset but not deleted", name)
+	}
+	if p.Path != "" && ProfileInUse(s.ProfileDir(p)) {
+		return fmt.Errorf("DeleteProfile: a browser is running with %s, close it before deleting the profile", name)
+	}
+	if p.Path != "" {
+		if err := os.RemoveAll(s.ProfileDir(p)); err != nil {
+			return fmt.Errorf("DeleteProfile: %s", err)
+		}
+	}
+	return s.writeProfiles(append(profiles[:i], profiles[i+1:]...))
+}
+
+// ensureProfile returns the directory of the named profile, creating its
+// contents from its template if they don't exist yet.
+func (s *Supervisor) ensureProfile(name string) (*Profile, string, error) {
+	p, err := s.GetProfile(name)
+	if err != nil {
+		return nil, "", err
+	}
+	dir := s.ProfileDir(p)
+	if dir != "" && !tbget.FileExists(dir) {
+		log.Printf("profile %s not found at %s, creating it from %s", name, dir, p.Template)
+		if err := s.unpackTemplate(p.Template, dir); err != nil {
+			return nil, "", fmt.Errorf("ensureProfile: %s", err)
+		}
+	}
+	return p, dir, nil
+}
+
+// RunProfile launches the browser with the named profile, in the profile's
+// mode. If EPHEMERAL is set, it runs an ephemeral copy of the profile instead.
+func (s *Supervisor) RunProfile(name string) error {
+	if EPHEMERAL {
+		return s.RunEphemeralProfile(name)
+	}
+	p, dir, err := s.ensureProfile(name)
+	if err != nil {
+		return err
+	}
+	return s.runProfileIn(p, dir)
+}
+
+// runProfileIn launches the browser in the profile's mode with the profile
+// directory dir.
+func (s *Supervisor) runProfileIn(p *Profile, dir string) error {
+	switch p.Mode {
+	case ModeTor:
+		return s.RunTBWithLangAndProfile(dir)
+	case ModeI2P:
+		return s.runSpecificTBB(p.Name, dir, s.IBBUnpackPath(), false, false, false)
+	case ModeApp:
+		return s.runSpecificTBB(p.Name, dir, s.IBBUnpackPath(), true, false, false)
+	case ModeClearnet:
+		return s.RunTBBWithOfflineClearnetProfile(dir, false, true)
+	case ModeOffline:
+		return s.RunTBBWithOfflineClearnetProfile(dir, true, true)
+	}
+	return fmt.Errorf("RunProfile: %s has unknown mode %s", p.Name, p.Mode)
+}
+
+// ModeInstalls returns the installs browsers of the mode are run from. Offline
+// profiles are also run from the I2P Browser install by the site editor.
+func (s *Supervisor) ModeInstalls(mode string) []string {
+	switch mode {
+	case ModeTor:
+		return []string{s.TBUnpackPath()}
+	case ModeI2P, ModeApp:
+		return []string{s.IBBUnpackPath()}
+	case ModeClearnet:
+		return []string{s.ProductUnpackPath()}
+	case ModeOffline:
+		return []string{s.ProductUnpackPath(), s.IBBUnpackPath()}
+	}
+	return nil
+}
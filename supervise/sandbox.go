@@ -0,0 +1,164 @@
+package tbsupervise
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+)
+
+// SANDBOX runs browsers on Linux in the sandbox, unless their profile says
+// otherwise. It can be set with TOR_MANAGER_SANDBOX.
+var SANDBOX = os.Getenv("TOR_MANAGER_SANDBOX") == "true"
+
+// SANDBOX_DEVICES are the entries of /dev sandboxed browsers can use. It can be
+// set with TOR_MANAGER_SANDBOX_DEVICES as a comma-separated list.
+var SANDBOX_DEVICES = DefaultSandboxDevices()
+
+// SANDBOX_HELPER is the argument which makes tor-manager run as the helper
+// which sets up the sandbox and starts the browser in it.
+const SANDBOX_HELPER = "--sandbox-helper"
+
+// DefaultSandboxDevices returns the devices configured in the environment, or
+// the ones a browser needs to draw, play sound and get random numbers.
+func DefaultSandboxDevices() []string {
+	if list := os.Getenv("TOR_MANAGER_SANDBOX_DEVICES"); list != "" {
+		return ParseOfflineAllowlist(list)
+	}
+	return []string{"null", "zero", "full", "random", "urandom", "tty", "pts", "dri", "snd"}
+}
+
+// SandboxSpec describes the sandbox the helper sets up.
+type SandboxSpec struct {
+	// Root is an empty directory the sandbox's root filesystem is built in.
+	Root string `json:"root"`
+	// ReadOnly are the paths visible read-only inside the sandbox.
+	ReadOnly []string `json:"readonly"`
+	// Writable are the paths visible and writable inside the sandbox.
+	Writable []string `json:"writable"`
+	// Private are directories which start empty inside the sandbox, and are
+	// thrown away when it exits.
+	Private []string `json:"private"`
+	// Devices are the entries of /dev visible inside the sandbox.
+	Devices []string `json:"devices"`
+	// Dir is the working directory of the browser.
+	Dir string `json:"dir"`
+	// Socket and Addr are set when the sandbox has its own network namespace,
+	// in which Addr is forwarded to the unix socket Socket.
+	Socket string `json:"socket,omitempty"`
+	Addr   string `json:"addr,omitempty"`
+}
+
+// profileSandboxed returns true if the browser using the profile directory
+// should run in the sandbox. Profiles choose for themselves, the others use
+// SANDBOX.
+func (s *Supervisor) profileSandboxed(profiledata string) bool {
+	if p := s.profileFor(profiledata); p != nil && p.Sandbox != nil {
+		return *p.Sandbox
+	}
+	return SANDBOX
+}
+
+// SetProfileSandbox sets whether the profile runs in the sandbox: on, off, or
+// default to follow SANDBOX.
+func (s *Supervisor) SetProfileSandbox(name, setting string) error {
+	var sandbox *bool
+	switch strings.ToLower(setting) {
+	case "on", "true", "yes":
+		on := true
+		sandbox = &on
+	case "off", "false", "no":
+		off := false
+		sandbox = &off
+	case "default", "":
+	default:
+		return fmt.Errorf("SetProfileSandbox: unknown setting %s, use on, off or default", setting)
+	}
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+	profiles, err := s.readProfiles()
+	if err != nil {
+		return err
+	}
+	_, p := findProfile(profiles, name)
+	if p == nil {
+		return fmt.Errorf("SetProfileSandbox: no profile named %s", name)
+	}
+	p.Sandbox = sandbox
+	return s.writeProfiles(profiles)
+}
+
+// sandboxSpec returns the sandbox for a browser run from the install with the
+// profile directory. Only the profile is writable, or the parts of the install
+// the browser writes to if it uses the install's own profile.
+func (s *Supervisor) sandboxSpec(bcmd *exec.Cmd, install, profiledata string) (*SandboxSpec, error) {
+	install, err := filepath.Abs(install)
+	if err != nil {
+		return nil, err
+	}
+	spec := &SandboxSpec{Devices: SANDBOX_DEVICES, Dir: bcmd.Dir}
+	for _, dir := range []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32", "/etc", "/opt", "/sys", "/run", "/tmp/.X11-unix"} {
+		if _, err := os.Lstat(dir); err == nil {
+			spec.ReadOnly = append(spec.ReadOnly, dir)
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		spec.Private = append(spec.Private, home)
+	}
+	spec.Private = append(spec.Private, "/tmp")
+	spec.ReadOnly = append(spec.ReadOnly, install)
+	if store, err := filepath.Abs(s.ExtensionStore()); err == nil && tbget.FileExists(store) {
+		spec.ReadOnly = append(spec.ReadOnly, store)
+	}
+	if xauth := os.Getenv("XAUTHORITY"); xauth != "" && tbget.FileExists(xauth) {
+		spec.ReadOnly = append(spec.ReadOnly, xauth)
+	}
+	if profiledata == "" {
+		for _, rel := range tbget.MutablePaths() {
+			dir := filepath.Join(install, filepath.FromSlash(rel))
+			if tbget.FileExists(dir) {
+				spec.Writable = append(spec.Writable, dir)
+			}
+		}
+	} else {
+		profile, err := filepath.Abs(profiledata)
+		if err != nil {
+			return nil, err
+		}
+		spec.Writable = append(spec.Writable, profile)
+	}
+	if spec.Dir == "" {
+		spec.Dir = filepath.Dir(bcmd.Path)
+	}
+	return spec, nil
+}
+
+// sandboxed returns the command to run the browser with, in the sandbox if the
+// profile wants it, and with its own network namespace if isolate is set. If
+// the sandbox or namespace can't be created, it warns and falls back to running
+// the browser as it is. The returned function cleans up once the browser exits.
+func (s *Supervisor) sandboxed(bcmd *exec.Cmd, install, profiledata string, isolate bool) (*exec.Cmd, func()) {
+	if s.profileSandboxed(profiledata) {
+		spec, err := s.sandboxSpec(bcmd, install, profiledata)
+		if err == nil {
+			var scmd *exec.Cmd
+			var cleanup func()
+			if scmd, cleanup, err = sandboxCommand(bcmd, spec, isolate); err == nil {
+				return scmd, cleanup
+			}
+		}
+		log.Println("Warning: can't run the browser in the sandbox, running it without:", err)
+	}
+	if isolate {
+		icmd, cleanup, err := isolateNetwork(bcmd)
+		if err == nil {
+			return icmd, cleanup
+		}
+		log.Println("Warning: can't isolate the offline browser's network, relying on the offline proxy alone:", err)
+	}
+	return bcmd, func() {}
+}
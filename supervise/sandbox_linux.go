@@ -0,0 +1,350 @@
+package tbsupervise
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// capSysAdmin is CAP_SYS_ADMIN, which the helper needs to build the sandbox's mounts.
+const capSysAdmin = 21
+
+// sandboxCommand returns a command which runs bcmd in a new user and mount
+// namespace built from spec, and a new network namespace if isolate is set. The
+// helper is dry run first, so an error is returned instead of a command which
+// would fail before the browser starts.
+func sandboxCommand(bcmd *exec.Cmd, spec *SandboxSpec, isolate bool) (*exec.Cmd, func(), error) {
+	if err := UserNamespacesAvailable(); err != nil {
+		return nil, nil, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := ioutil.TempDir("", "tor-manager-sandbox")
+	if err != nil {
+		return nil, nil, err
+	}
+	spec.Root = root
+	cleanups := []func(){func() { os.RemoveAll(root) }}
+	cleanup := func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+	flags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS)
+	caps := []uintptr{capSysAdmin}
+	if isolate {
+		socket, stop, err := forwardOfflineProxy()
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		cleanups = append(cleanups, stop)
+		spec.Socket, spec.Addr = socket, OFFLINE_PROXY
+		spec.ReadOnly = append(spec.ReadOnly, filepath.Dir(socket))
+		flags |= syscall.CLONE_NEWNET
+		caps = append(caps, capNetAdmin)
+	}
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	helper := []string{SANDBOX_HELPER, string(encoded)}
+	if err := dryRun(helperCommand(self, bcmd, flags, caps, helper...)); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	scmd := helperCommand(self, bcmd, flags, caps, append(append(helper, bcmd.Path), bcmd.Args[1:]...)...)
+	return scmd, cleanup, nil
+}
+
+// RunSandboxHelper is run by tor-manager with SANDBOX_HELPER as its first
+// argument inside the namespaces created by sandboxCommand. It moves into its
+// own AppArmor profile if tor-manager has one, builds the sandbox's root
+// filesystem, switches to it, drops its capabilities, installs the seccomp
+// filter and runs the browser. args are the JSON SandboxSpec and
+// the browser's command line or HELPER_DRY_RUN.
+func RunSandboxHelper(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("RunSandboxHelper: usage: %s spec browser [args...]", SANDBOX_HELPER)
+	}
+	if err := enterHelperProfile(); err != nil {
+		return fmt.Errorf("RunSandboxHelper: %s", err)
+	}
+	var spec SandboxSpec
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil {
+		return fmt.Errorf("RunSandboxHelper: %s", err)
+	}
+	browser := args[1:]
+	if spec.Socket != "" {
+		listener, err := connectNamespace(spec.Socket, spec.Addr)
+		if err != nil {
+			return fmt.Errorf("RunSandboxHelper: %s", err)
+		}
+		defer listener.Close()
+	}
+	if err := buildSandbox(&spec); err != nil {
+		return fmt.Errorf("RunSandboxHelper: %s", err)
+	}
+	if err := os.Chdir(spec.Dir); err != nil {
+		os.Chdir("/")
+	}
+	// Capabilities, no_new_privs and the seccomp filter belong to a thread, the
+	// browser inherits them from the thread which starts it.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	// PR_CAP_AMBIENT, PR_CAP_AMBIENT_CLEAR_ALL
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, 47, 4, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("RunSandboxHelper: dropping capabilities: %s", errno)
+	}
+	if err := installSeccomp(); err != nil {
+		return fmt.Errorf("RunSandboxHelper: %s", err)
+	}
+	if browser[0] == HELPER_DRY_RUN {
+		return nil
+	}
+	bcmd := exec.Command(browser[0], browser[1:]...)
+	bcmd.Stdin = os.Stdin
+	bcmd.Stdout = os.Stdout
+	bcmd.Stderr = os.Stderr
+	return bcmd.Run()
+}
+
+type sandboxMount struct {
+	path  string
+	kind  string
+	isDir bool
+}
+
+// buildSandbox mounts the sandbox's root filesystem in spec.Root and makes it
+// the root of the mount namespace.
+func buildSandbox(spec *SandboxSpec) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %s", err)
+	}
+	root := spec.Root
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting the sandbox root: %s", err)
+	}
+	var mounts []sandboxMount
+	for _, list := range []struct {
+		kind  string
+		paths []string
+	}{{"private", spec.Private}, {"readonly", spec.ReadOnly}, {"writable", spec.Writable}} {
+		for _, path := range list.paths {
+			mounts = append(mounts, sandboxMount{path: filepath.Clean(path), kind: list.kind})
+		}
+	}
+	// Parents are mounted before their children, so /tmp/.X11-unix shows
+	// through the private /tmp and the profile through the private home.
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return strings.Count(mounts[i].path, "/") < strings.Count(mounts[j].path, "/")
+	})
+	for _, m := range mounts {
+		target := filepath.Join(root, m.path)
+		if m.kind == "private" {
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			if err := syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0700"); err != nil {
+				return fmt.Errorf("mounting a private %s: %s", m.path, err)
+			}
+			continue
+		}
+		if err := bindInto(m.path, target, m.kind == "readonly"); err != nil {
+			return err
+		}
+	}
+	if err := bindInto("/proc", filepath.Join(root, "proc"), false); err != nil {
+		return err
+	}
+	if err := buildDev(root, spec.Devices); err != nil {
+		return err
+	}
+	old := filepath.Join(root, ".oldroot")
+	if err := os.MkdirAll(old, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, old); err != nil {
+		return fmt.Errorf("switching to the sandbox root: %s", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("hiding the old root: %s", err)
+	}
+	os.Remove("/.oldroot")
+	return nil
+}
+
+// bindInto bind mounts source at target, read-only if readonly is set. Symlinks
+// are recreated instead, so /bin -> usr/bin keeps working.
+func bindInto(source, target string, readonly bool) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		os.Remove(target)
+		return os.Symlink(link, target)
+	}
+	if info.IsDir() {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	} else if f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		return err
+	} else {
+		f.Close()
+	}
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("binding %s: %s", source, err)
+	}
+	if !readonly {
+		return nil
+	}
+	// A bind mount can only be remounted read-only with the flags of the mount
+	// it came from, which are locked in a user namespace.
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(source, &stat); err == nil {
+		for _, f := range []struct{ st, ms int64 }{
+			{2, syscall.MS_NOSUID}, {4, syscall.MS_NODEV}, {8, syscall.MS_NOEXEC},
+			{1024, syscall.MS_NOATIME}, {2048, syscall.MS_NODIRATIME}, {4096, syscall.MS_RELATIME},
+		} {
+			if int64(stat.Flags)&f.st != 0 {
+				flags |= uintptr(f.ms)
+			}
+		}
+	}
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("making %s read-only: %s", source, err)
+	}
+	return nil
+}
+
+// buildDev creates a /dev which only contains the allowed devices.
+func buildDev(root string, devices []string) error {
+	dev := filepath.Join(root, "dev")
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting /dev: %s", err)
+	}
+	for _, device := range devices {
+		if err := bindInto(filepath.Join("/dev", device), filepath.Join(dev, device), false); err != nil {
+			return err
+		}
+	}
+	shm := filepath.Join(dev, "shm")
+	if err := os.MkdirAll(shm, 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", shm, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mounting /dev/shm: %s", err)
+	}
+	for link, target := range map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2", "ptmx": "pts/ptmx"} {
+		os.Symlink(target, filepath.Join(dev, link))
+	}
+	return nil
+}
+
+// seccompArches are the audit architectures of the platforms the seccomp
+// filter supports, and the numbers of the denied system calls which the
+// syscall package doesn't know on them.
+var seccompArches = map[string]struct {
+	audit uint32
+	extra []uint32
+}{
+	"amd64": {0xc000003e, []uint32{310, 311, 313, 321, 323}},
+	"arm64": {0xc00000b7, []uint32{270, 271, 273, 280, 282}},
+	"386":   {0x40000003, nil},
+	"arm":   {0x40000028, nil},
+}
+
+// seccompDenied are the system calls a sandboxed browser gets EPERM for: loading
+// kernel code, changing mounts, tracing other processes, the kernel keyring and
+// the clock. The browser's own sandbox doesn't need any of them.
+var seccompDenied = []uint32{
+	syscall.SYS_PTRACE, syscall.SYS_MOUNT, syscall.SYS_UMOUNT2, syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_KEXEC_LOAD, syscall.SYS_INIT_MODULE, syscall.SYS_DELETE_MODULE,
+	syscall.SYS_SWAPON, syscall.SYS_SWAPOFF, syscall.SYS_REBOOT, syscall.SYS_ACCT,
+	syscall.SYS_SETTIMEOFDAY, syscall.SYS_ADD_KEY, syscall.SYS_REQUEST_KEY,
+	syscall.SYS_KEYCTL, syscall.SYS_PERF_EVENT_OPEN, syscall.SYS_MKNODAT,
+}
+
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// installSeccomp sets no_new_privs and installs the seccomp filter on the
+// calling thread.
+func installSeccomp() error {
+	arch, ok := seccompArches[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("no seccomp filter for %s", runtime.GOARCH)
+	}
+	const (
+		ldAbs    = 0x20 // BPF_LD | BPF_W | BPF_ABS
+		jeq      = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+		jge      = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+		ret      = 0x06 // BPF_RET | BPF_K
+		allow    = 0x7fff0000
+		errno    = 0x00050000
+		kill     = 0x80000000
+		archOff  = 4
+		nrOff    = 0
+		noNewPrv = 38
+		setComp  = 22
+		filter   = 2
+	)
+	denied := append(append([]uint32{}, seccompDenied...), arch.extra...)
+	prog := []sockFilter{
+		{ldAbs, 0, 0, archOff},
+		{jeq, 1, 0, arch.audit},
+		{ret, 0, 0, kill},
+		{ldAbs, 0, 0, nrOff},
+		// x32 system calls on amd64, which would slip past the numbers below.
+		{jge, 0, 1, 0x40000000},
+		{ret, 0, 0, errno | uint32(syscall.EPERM)},
+	}
+	for _, nr := range denied {
+		prog = append(prog, sockFilter{jeq, 0, 1, nr}, sockFilter{ret, 0, 0, errno | uint32(syscall.EPERM)})
+	}
+	prog = append(prog, sockFilter{ret, 0, 0, allow})
+	fprog := sockFprog{len: uint16(len(prog)), filter: &prog[0]}
+	if _, _, e := syscall.RawSyscall6(syscall.SYS_PRCTL, noNewPrv, 1, 0, 0, 0, 0); e != 0 {
+		return fmt.Errorf("setting no_new_privs: %s", e)
+	}
+	if _, _, e := syscall.RawSyscall6(syscall.SYS_PRCTL, setComp, filter, uintptr(unsafe.Pointer(&fprog)), 0, 0, 0); e != 0 {
+		return fmt.Errorf("installing the seccomp filter: %s", e)
+	}
+	return nil
+}
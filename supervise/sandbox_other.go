@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package tbsupervise
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func sandboxCommand(bcmd *exec.Cmd, spec *SandboxSpec, isolate bool) (*exec.Cmd, func(), error) {
+	return nil, nil, fmt.Errorf("the sandbox is only available on Linux")
+}
+
+// RunSandboxHelper returns an error, the sandbox is only available on Linux.
+func RunSandboxHelper(args []string) error {
+	return fmt.Errorf("the sandbox is only available on Linux")
+}
@@ -1,23 +1,21 @@
 package tbsupervise
 
 import (
+	"context"
 	"embed"
 	"fmt"
-	"io/fs"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/go-ps"
-	"github.com/otiai10/copy"
-	cp "github.com/otiai10/copy"
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
 	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+	tbready "i2pgit.org/idk/i2p.plugins.tor-manager/ready"
 )
 
 // UNPACK_URL is the URL to place to unpack the Browser Bundle
@@ -43,28 +41,70 @@ type Supervisor struct {
 	torcmd     *exec.Cmd
 	//tbcmd           *exec.Cmd
 	//ibcmd           *exec.Cmd
-	Profile         *embed.FS
+	Profile *embed.FS
+	// PassThroughArgs are the arguments passed through to every browser. They
+	// are checked with ValidateBrowserArgs for the mode of each launch.
 	PassThroughArgs []string
+	// Product is the name of the installed tbget product the launch modes
+	// run from. If it is empty, Tor Browser is used.
+	Product string
+	// Launcher starts the browsers and tor. If it is nil, the Launcher for
+	// the current platform is used.
+	Launcher Launcher
+	// ProfileProxy returns the address of the named profile's own HTTP proxy
+	// into I2P. If it is nil or returns an empty address, I2P and app profiles
+	// use the router's HTTP proxy.
+	ProfileProxy func(name string) (string, error)
+	// AnchorManifest checks that the manifest of an installed tree was
+	// written from the signed archive the tree was unpacked from, and builds
+	// it if the tree has none, see tbget.TBDownloader.AnchorManifest. If it
+	// is nil, manifests are trusted as they are.
+	AnchorManifest func(install string) error
+}
+
+// GetProduct returns the tbget product the launch modes run from.
+func (s *Supervisor) GetProduct() *tbget.Product {
+	product, err := tbget.GetProduct(s.Product)
+	if err != nil {
+		log.Println(err)
+		return tbget.TorBrowser
+	}
+	return product
+}
+
+// ProductUnpackPath returns the path to the tree of the product the launch modes run from.
+func (s *Supervisor) ProductUnpackPath() string {
+	product := s.GetProduct()
+	if product == tbget.TorBrowser {
+		return s.TBUnpackPath()
+	}
+	return filepath.Join(filepath.Dir(s.TBUnpackPath()), product.InstallDir(s.Lang))
+}
+
+// InstalledProducts returns the names of the tbget products which are unpacked next to this one.
+func (s *Supervisor) InstalledProducts() []string {
+	var installed []string
+	for _, name := range tbget.ProductNames() {
+		product := tbget.Products[name]
+		if tbget.FileExists(filepath.Join(filepath.Dir(s.TBUnpackPath()), product.InstallDir(s.Lang))) {
+			installed = append(installed, name)
+		}
+	}
+	return installed
 }
 
-// PTAS is the validator for the pass-through arguments
-func (s *Supervisor) PTAS() []string {
-	return s.PassThroughArgs
+// PTAS returns the pass-through arguments for a browser in the mode, or an
+// error if they aren't allowed in it.
+func (s *Supervisor) PTAS(mode string) ([]string, error) {
+	if err := ValidateBrowserArgs(mode, s.PassThroughArgs); err != nil {
+		return nil, err
+	}
+	return s.PassThroughArgs, nil
 }
 
 // TBPath returns the path to the Tor Browser Bundle launcher
 func (s *Supervisor) TBPath() string {
-	switch OS() {
-	case "linux":
-		return filepath.Join(s.TBUnpackPath(), "Browser", "start-tor-browser")
-	case "osx":
-		//return filepath.Join(s.TBUnpackPath(), "Browser", "Tor Browser.app", "Contents", "MacOS", "start-tor-browser")
-		return filepath.Join(s.TBUnpackPath(), "Tor Browser.app", "Contents", "MacOS", "firefox")
-	case "windows":
-		return filepath.Join(s.TBDirectory(), "firefox.exe")
-	default:
-		return filepath.Join(s.TBDirectory(), "firefox")
-	}
+	return s.launcher().TorBrowser(s.TBUnpackPath(), "", nil).Path
 }
 
 // FirefoxPath returns the path to the Firefox executable inside Tor Browser
@@ -74,14 +114,7 @@ func (s *Supervisor) FirefoxPath() string {
 
 // FirefoxPath returns the path to the Firefox executable inside Tor Browser
 func (s *Supervisor) SpecificFirefoxPath(unpackedFirefox string) string {
-	switch OS() {
-	case "linux":
-		return filepath.Join(s.SpecificTBDirectory(unpackedFirefox), "firefox.real")
-	case "windows":
-		return filepath.Join(s.SpecificTBDirectory(unpackedFirefox), "firefox.exe")
-	default:
-		return filepath.Join(s.SpecificTBDirectory(unpackedFirefox), "firefox")
-	}
+	return s.launcher().Browser(unpackedFirefox, "", nil).Path
 }
 
 // SpecificTBDirectory returns the path to the Tor Browser firefox directory within an unpacked TBB
@@ -96,10 +129,16 @@ func (s *Supervisor) TBDirectory() string {
 
 // TorPath returns the path to the Tor executable
 func (s *Supervisor) TorPath() string {
-	if OS() == "osx" {
-		return filepath.Join(s.TBUnpackPath(), "Tor Browser.app", "Contents", "Resources", "TorBrowser", "Tor", "tor")
+	return s.torLaunch().Path
+}
+
+// torLaunch returns the launch of the tor from the product, or from Tor
+// Browser if the product doesn't have one.
+func (s *Supervisor) torLaunch() *Launch {
+	if s.GetProduct() == tbget.TorExpertBundle {
+		return s.launcher().Tor(s.ProductUnpackPath(), true)
 	}
-	return filepath.Join(s.TBUnpackPath(), "Browser", "TorBrowser", "Tor", "tor")
+	return s.launcher().Tor(s.TBUnpackPath(), false)
 }
 
 // TorDataPath returns the path to the Tor Browser Bundle Data directory
@@ -107,114 +146,62 @@ func (s *Supervisor) TorDataPath() string {
 	return filepath.Join(s.TBUnpackPath(), "Browser", "TorBrowser", "Data")
 }
 
-// I2PProfilePath returns the path to the I2P profile
+// I2PProfilePath returns the path to the unpacked I2P profile template
 func (s *Supervisor) I2PProfilePath() string {
 	fp := filepath.Join(filepath.Dir(s.IBBUnpackPath()), ".i2p.firefox")
 	if !tbget.FileExists(fp) {
 		log.Printf("i2p data not found at %s, unpacking", fp)
 		if s.Profile != nil {
 			if err := s.UnpackI2PData(); err != nil {
-				log.Fatal(err)
+				log.Println("I2PProfilePath:", err)
 			}
 		}
 	}
 	return fp
 }
 
-// I2PProfilePath returns the path to the I2P profile
+// I2PAppProfilePath returns the path to the unpacked I2P application profile template
 func (s *Supervisor) I2PAppProfilePath() string {
 	fp := filepath.Join(filepath.Dir(s.IBBUnpackPath()), ".i2p.firefox.config")
 	if !tbget.FileExists(fp) {
 		log.Printf("i2p app data not found at %s, unpacking", fp)
 		if s.Profile != nil {
 			if err := s.UnpackI2PAppData(); err != nil {
-				log.Fatal(err)
+				log.Println("I2PAppProfilePath:", err)
 			}
 		}
 	}
 	return fp
 }
 
-// I2PDataPath returns the path to the I2P data directory
+// I2PDataPath returns the path to the I2P data directory, the "i2p" profile
 func (s *Supervisor) I2PDataPath() string {
-	fp := s.I2PProfilePath()
-	up := filepath.Join(filepath.Dir(s.IBBUnpackPath()), "i2p.firefox")
-	if tbget.FileExists(up) {
-		return up
-	}
-	log.Printf("i2p workdir not found at %s, copying", up)
-	if s.Profile != nil {
-		if err := cp.Copy(fp, up); err != nil {
-			log.Fatal(err)
-		}
+	_, dir, err := s.ensureProfile("i2p")
+	if err != nil {
+		log.Println("I2PDataPath:", err)
+		return filepath.Join(filepath.Dir(s.IBBUnpackPath()), "i2p.firefox")
 	}
-	return up
+	return dir
 }
 
-// UnpackI2PData unpacks the I2P data into the s.IBBUnpackPath()
+// UnpackI2PData unpacks the I2P profile template next to s.IBBUnpackPath()
 func (s *Supervisor) UnpackI2PData() error {
-	return fs.WalkDir(s.Profile, ".", func(embedpath string, d fs.DirEntry, err error) error {
-		fp := filepath.Join(filepath.Dir(s.IBBUnpackPath()), ".i2p.firefox")
-		if err != nil {
-			log.Fatal(err)
-		}
-		//fmt.Println(embedpath, filepath.Join(fp, strings.Replace(embedpath, "tor-browser/unpack/i2p.firefox", "", -1)))
-		if d.IsDir() {
-			os.MkdirAll(filepath.Join(fp, strings.Replace(embedpath, "tor-browser/unpack/i2p.firefox", "", -1)), 0755)
-		} else {
-			fullpath := path.Join(embedpath)
-			bytes, err := s.Profile.ReadFile(fullpath)
-			if err != nil {
-				return err
-			}
-			unpack := filepath.Join(fp, strings.Replace(embedpath, "tor-browser/unpack/i2p.firefox", "", -1))
-			if err := ioutil.WriteFile(unpack, bytes, 0644); err != nil {
-				return err
-			}
-		}
-		return nil
-	})
+	return s.unpackTemplate("i2p.firefox", filepath.Join(filepath.Dir(s.IBBUnpackPath()), ".i2p.firefox"))
 }
 
-// I2PAppDataPath returns the path to the I2P application data directory
+// I2PAppDataPath returns the path to the I2P application data directory, the "i2p-app" profile
 func (s *Supervisor) I2PAppDataPath() string {
-	fp := s.I2PAppProfilePath()
-	up := filepath.Join(filepath.Dir(s.IBBUnpackPath()), "i2p.firefox.config")
-	if tbget.FileExists(up) {
-		return up
-	}
-	log.Printf("i2p workdir not found at %s, copying", up)
-	if s.Profile != nil {
-		if err := cp.Copy(fp, up); err != nil {
-			log.Fatal(err)
-		}
+	_, dir, err := s.ensureProfile("i2p-app")
+	if err != nil {
+		log.Println("I2PAppDataPath:", err)
+		return filepath.Join(filepath.Dir(s.IBBUnpackPath()), "i2p.firefox.config")
 	}
-	return up
+	return dir
 }
 
-// UnpackI2PAppData unpacks the I2P application data into the s.IBBUnpackPath()
+// UnpackI2PAppData unpacks the I2P application profile template next to s.IBBUnpackPath()
 func (s *Supervisor) UnpackI2PAppData() error {
-	return fs.WalkDir(s.Profile, ".", func(embedpath string, d fs.DirEntry, err error) error {
-		fp := filepath.Join(filepath.Dir(s.IBBUnpackPath()), ".i2p.firefox.config")
-		if err != nil {
-			log.Fatal(err)
-		}
-		//fmt.Println(embedpath, filepath.Join(fp, strings.Replace(embedpath, "tor-browser/unpack/i2p.firefox.config", "", -1)))
-		if d.IsDir() {
-			os.MkdirAll(filepath.Join(fp, strings.Replace(embedpath, "tor-browser/unpack/i2p.firefox.config", "", -1)), 0755)
-		} else {
-			fullpath := path.Join(embedpath)
-			bytes, err := s.Profile.ReadFile(fullpath)
-			if err != nil {
-				return err
-			}
-			unpack := filepath.Join(fp, strings.Replace(embedpath, "tor-browser/unpack/i2p.firefox.config", "", -1))
-			if err := ioutil.WriteFile(unpack, bytes, 0644); err != nil {
-				return err
-			}
-		}
-		return nil
-	})
+	return s.unpackTemplate("i2p.firefox.config", filepath.Join(filepath.Dir(s.IBBUnpackPath()), ".i2p.firefox.config"))
 }
 
 func (s *Supervisor) tbbail() error {
@@ -223,6 +210,12 @@ func (s *Supervisor) tbbail() error {
 
 // RunTBWithLang runs the Tor Browser with the given language
 func (s *Supervisor) RunTBWithLang() error {
+	return s.RunProfile("tor")
+}
+
+// RunTBWithLangAndProfile runs the Tor Browser with the given language and
+// profile directory. If profiledata is empty, Tor Browser's own profile is used.
+func (s *Supervisor) RunTBWithLangAndProfile(profiledata string) error {
 	tbget.ARCH = ARCH()
 	if s.Lang == "" {
 		s.Lang = DEFAULT_TB_LANG
@@ -234,40 +227,45 @@ func (s *Supervisor) RunTBWithLang() error {
 	if s.tbbail() != nil {
 		return nil
 	}
-
-	log.Println("running tor browser with lang", s.Lang, s.TBUnpackPath(), OS())
-	switch OS() {
-	case "linux":
-		if tbget.FileExists(s.TBUnpackPath()) {
-			log.Println("running tor browser with lang", s.Lang, s.TBUnpackPath())
-			args := []string{}
-			args = append(args, s.PTAS()...)
-			bcmd := exec.Command(s.TBPath(), args...)
-			bcmd.Stdout = os.Stdout
-			bcmd.Stderr = os.Stderr
-			return bcmd.Run()
+	if profiledata != "" {
+		if _, err := s.ApplyPrefs(profiledata, ModeTor, ""); err != nil {
+			return err
 		}
+	}
+	release, err := s.leasePolicies(s.TBUnpackPath(), profiledata, ModeTor)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := s.ApplyPolicies(s.TBUnpackPath(), ModeTor); err != nil {
+		return err
+	}
+
+	if !tbget.FileExists(s.TBUnpackPath()) {
 		log.Println("tor browser not found at", s.TBPath())
 		return fmt.Errorf("tor browser not found at %s", s.TBPath())
-	case "osx":
-		firefoxPath := s.TBPath() //FirefoxPath
-		bcmd := exec.Command(firefoxPath)
-		bcmd.Dir = s.TBUnpackPath()
-		bcmd.Stdout = os.Stdout
-		bcmd.Stderr = os.Stderr
-
-		return bcmd.Run()
-	case "win":
-		log.Println("Running Windows EXE", s.TBDirectory(), "firefox.exe")
-		args := []string{}
-		args = append(args, s.PTAS()...)
-		bcmd := exec.Command(s.TBPath(), args...)
-		bcmd.Dir = s.TBDirectory()
-		return bcmd.Run()
-	default:
 	}
+	log.Println("running tor browser with lang", s.Lang, s.TBUnpackPath(), OS())
+	ptas, err := s.PTAS(ModeTor)
+	if err != nil {
+		return err
+	}
+	launch := s.launcher().TorBrowser(s.TBUnpackPath(), profiledata, ptas)
+	return s.launchBrowser(launch, s.TBUnpackPath(), profiledata, ModeTor, false)
+}
 
-	return nil
+// launchBrowser runs the browser launch from the install in the mode. On Linux
+// it runs in the sandbox if the profile wants it, with its own network
+// namespace if isolate is set.
+func (s *Supervisor) launchBrowser(launch *Launch, install, profiledata, mode string, isolate bool) error {
+	launch.Env = append(launch.Env, ModeEnv(mode)...)
+	bcmd := launch.Command()
+	if s.launcher().OS() == "linux" {
+		var cleanup func()
+		bcmd, cleanup = s.sandboxed(bcmd, install, profiledata, isolate)
+		defer cleanup()
+	}
+	return s.runBrowser(install, profiledata, mode, bcmd)
 }
 
 // RunTBWithLang runs the Tor Browser with the given language
@@ -284,35 +282,13 @@ func (s *Supervisor) RunTBHelpWithLang() error {
 		return nil
 	}
 
-	log.Println("running tor browser with lang", s.Lang, s.TBUnpackPath(), OS())
-	switch OS() {
-	case "linux":
-		if tbget.FileExists(s.TBUnpackPath()) {
-			log.Println("running tor browser with lang", s.Lang, s.TBUnpackPath())
-			bcmd := exec.Command(s.TBPath(), "--help")
-			bcmd.Stdout = os.Stdout
-			bcmd.Stderr = os.Stderr
-			return bcmd.Run()
-		}
+	if !tbget.FileExists(s.TBUnpackPath()) {
 		log.Println("tor browser not found at", s.TBPath())
 		return fmt.Errorf("tor browser not found at %s", s.TBPath())
-	case "osx":
-		firefoxPath := s.TBPath()
-		bcmd := exec.Command(firefoxPath, "--help")
-		bcmd.Stdout = os.Stdout
-		bcmd.Stderr = os.Stderr
-		bcmd.Dir = s.TBDirectory()
-
-		return bcmd.Run()
-	case "win":
-		log.Println("Running Windows EXE", s.TBDirectory(), "firefox.exe")
-		bcmd := exec.Command(s.TBPath(), "--help")
-		bcmd.Dir = s.TBDirectory()
-		return bcmd.Run()
-	default:
 	}
-
-	return nil
+	log.Println("running tor browser with lang", s.Lang, s.TBUnpackPath(), OS())
+	bcmd := s.launcher().TorBrowser(s.TBUnpackPath(), "", []string{"--help"}).Command()
+	return s.launcher().Run(bcmd, nil)
 }
 
 func (s *Supervisor) ibbail() error {
@@ -337,9 +313,7 @@ func (s *Supervisor) RunI2PBWithLang() error {
 	if s.ibbail() != nil {
 		return nil
 	}
-	// export TOR_HIDE_BROWSER_LOGO=1
-	os.Setenv("TOR_HIDE_BROWSER_LOGO", "1")
-	return s.RunSpecificTBBWithOfflineClearnetProfile(s.I2PDataPath(), s.IBBUnpackPath(), false, false, false)
+	return s.RunProfile("i2p")
 }
 
 // RunI2PBAppWithLang runs the I2P Browser with the given language
@@ -347,29 +321,27 @@ func (s *Supervisor) RunI2PBAppWithLang() error {
 	if s.ibbail() != nil {
 		return nil
 	}
-	// export TOR_HIDE_BROWSER_LOGO=1
-	os.Setenv("TOR_HIDE_BROWSER_LOGO", "1")
-	return s.RunSpecificTBBWithOfflineClearnetProfile(s.I2PAppDataPath(), s.IBBUnpackPath(), true, false, false)
+	return s.RunProfile("i2p-app")
 }
 
-func (s *Supervisor) generateOfflineProfile(profiledata string) error {
-	apath, err := filepath.Abs(profiledata)
-	if err != nil {
-		return err
-	}
-	if !tbget.FileExists(filepath.Join(apath, "user.js")) {
-		err := ioutil.WriteFile(filepath.Join(apath, "user.js"), offlinebrowserjs, 0644)
-		if err != nil {
-			return err
-		}
-	}
-	if !tbget.FileExists(filepath.Join(apath, "pref.js")) {
-		err := ioutil.WriteFile(filepath.Join(apath, "pref.js"), offlinebrowserjs, 0644)
-		if err != nil {
-			return err
+// ModeEnv returns the variables added to the environment of browsers launched
+// in the mode. Browsers which aren't in ModeTor are told to hide the Tor
+// Browser logo, and clearnet and offline ones not to start or check for Tor.
+func ModeEnv(mode string) []string {
+	switch mode {
+	case ModeTor:
+		return nil
+	case ModeClearnet, ModeOffline:
+		// see: https://github.com/Whonix/tb-starter/blob/b5d2280ad445bc1fbdb613424664bf8503e6f395/usr/share/secbrowser/variables.bsh
+		return []string{
+			"TOR_NO_DISPLAY_NETWORK_SETTINGS=1",
+			"TOR_HIDE_BROWSER_LOGO=1",
+			"TOR_SKIP_CONTROLPORTTEST=1",
+			"TOR_SKIP_LAUNCH=1",
+			"TOR_TRANSPROXY=1",
 		}
 	}
-	return nil
+	return []string{"TOR_HIDE_BROWSER_LOGO=1"}
 }
 
 func (s *Supervisor) GenerateClearnetProfile(profiledata string) error {
@@ -378,34 +350,10 @@ func (s *Supervisor) GenerateClearnetProfile(profiledata string) error {
 		return err
 	}
 
-	// see: https://github.com/Whonix/tb-starter/blob/b5d2280ad445bc1fbdb613424664bf8503e6f395/usr/share/secbrowser/variables.bsh
-	// export TOR_NO_DISPLAY_NETWORK_SETTINGS=1
-	os.Setenv("TOR_NO_DISPLAY_NETWORK_SETTINGS", "1")
-	// export TOR_HIDE_BROWSER_LOGO=1
-	os.Setenv("TOR_HIDE_BROWSER_LOGO", "1")
-	// export TOR_SKIP_CONTROLPORTTEST=1
-	os.Setenv("TOR_SKIP_CONTROLPORTTEST", "1")
-	// export TOR_SKIP_LAUNCH=1
-	os.Setenv("TOR_SKIP_LAUNCH", "1")
-	// export TOR_TRANSPROXY=1
-	os.Setenv("TOR_TRANSPROXY", "1")
-
 	odir := filepath.Join(apath, "extensions")
 	if err := os.MkdirAll(odir, 0755); err != nil {
 		return err
 	}
-	if !tbget.FileExists(filepath.Join(apath, "user.js")) {
-		err := ioutil.WriteFile(filepath.Join(apath, "user.js"), secbrowserjs, 0644)
-		if err != nil {
-			return err
-		}
-	}
-	if !tbget.FileExists(filepath.Join(apath, "pref.js")) {
-		err := ioutil.WriteFile(filepath.Join(apath, "pref.js"), secbrowserjs, 0644)
-		if err != nil {
-			return err
-		}
-	}
 	htmlfile := filepath.Join(apath, "index.html")
 	if !tbget.FileExists(htmlfile) {
 		err := ioutil.WriteFile(htmlfile, []byte(secbrowserhtml), 0644)
@@ -414,18 +362,10 @@ func (s *Supervisor) GenerateClearnetProfile(profiledata string) error {
 		}
 	}
 
-	opath := filepath.Join(odir, "uBlock0@raymondhill.net.xpi")
-
-	ipath := filepath.Join(filepath.Dir(s.TBUnpackPath()), ".i2p.firefox", "extensions", "uBlock0@raymondhill.net.xpi")
-	if err := copy.Copy(ipath, opath); err != nil {
-		return err
-	}
-	return nil
+	return s.InstallExtension(apath, "uBlock0@raymondhill.net")
 }
 
 func (s *Supervisor) CopyAWOXPI(profiledata string) error {
-	// export TOR_HIDE_BROWSER_LOGO=1
-	os.Setenv("TOR_HIDE_BROWSER_LOGO", "1")
 	apath, err := filepath.Abs(profiledata)
 	if err != nil {
 		return err
@@ -434,41 +374,32 @@ func (s *Supervisor) CopyAWOXPI(profiledata string) error {
 	if err := os.MkdirAll(odir, 0755); err != nil {
 		return err
 	}
-	if !tbget.FileExists(filepath.Join(apath, "user.js")) {
-		err := ioutil.WriteFile(filepath.Join(apath, "user.js"), []byte("#\n"), 0644)
-		if err != nil {
-			return err
-		}
-	}
-	if !tbget.FileExists(filepath.Join(apath, "pref.js")) {
-		err := ioutil.WriteFile(filepath.Join(apath, "pref.js"), []byte("#\n"), 0644)
-		if err != nil {
-			return err
-		}
-	}
-	opath := filepath.Join(odir, "awo@eyedeekay.github.io.xpi")
-
 	htmlfile := filepath.Join(apath, "index.html")
 	if !tbget.FileExists(htmlfile) {
-		err := ioutil.WriteFile(htmlfile, []byte(offlinehtml), 0644)
+		html := strings.Replace(string(offlinehtml), "http://127.0.0.1:7657", tbdiscover.Default().Console.URL(), -1)
+		err := ioutil.WriteFile(htmlfile, []byte(html), 0644)
 		if err != nil {
 			return err
 		}
 	}
-
-	ipath := filepath.Join(filepath.Dir(s.TBUnpackPath()), "awo@eyedeekay.github.io.xpi")
-	if err := copy.Copy(ipath, opath); err != nil {
-		return err
-	}
-	return nil
+	return s.InstallExtension(apath, "awo@eyedeekay.github.io")
 }
 
 // RunTBBWithOfflineProfile runs the I2P Browser with the given language
 func (s *Supervisor) RunTBBWithOfflineClearnetProfile(profiledata string, offline, clearnet bool) error {
-	return s.RunSpecificTBBWithOfflineClearnetProfile(profiledata, s.TBUnpackPath(), offline, clearnet, false)
+	if s.GetProduct().Browser == "" {
+		return fmt.Errorf("%s does not contain a browser", s.GetProduct().Title)
+	}
+	return s.RunSpecificTBBWithOfflineClearnetProfile(profiledata, s.ProductUnpackPath(), offline, clearnet, false)
 }
 
 func (s *Supervisor) RunSpecificTBBWithOfflineClearnetProfile(profiledata, torbrowserdata string, offline, clearnet, editor bool) error {
+	return s.runSpecificTBB(s.profileNameOf(profiledata), profiledata, torbrowserdata, offline, clearnet, editor)
+}
+
+// runSpecificTBB runs the browser from the install with the profile directory,
+// which is the named managed profile's or one of its ephemeral copies.
+func (s *Supervisor) runSpecificTBB(name, profiledata, torbrowserdata string, offline, clearnet, editor bool) error {
 	defaultpage := "about:blank"
 	if clearnet {
 		log.Print("Generating Clearnet Profile")
@@ -483,43 +414,54 @@ func (s *Supervisor) RunSpecificTBBWithOfflineClearnetProfile(profiledata, torbr
 			log.Println("Error copying AWO XPI", err)
 			return err
 		}
-		if err := s.generateOfflineProfile(profiledata); err != nil {
-			log.Println("Error generating Offline Profile", err)
-			return err
-		}
 		if !strings.Contains(filepath.Base(profiledata), "i2p") {
 			defaultpage = profiledata + "/index.html"
 		}
 	}
 	if editor {
-		defaultpage = "http://127.0.0.1:7685"
-		clearnet := true
-		offline := true
-		if clearnet {
-			log.Print("Generating Clearnet Profile")
-			if err := s.GenerateClearnetProfile(profiledata); err != nil {
-				log.Println("Error generating Clearnet Profile", err)
-				return err
-			}
-		}
-		if offline {
-			if err := s.CopyAWOXPI(profiledata); err != nil {
-				log.Println("Error copying AWO XPI", err)
-				return err
-			}
-		}
-		tbget.ARCH = ARCH()
-		if s.Lang == "" {
-			s.Lang = DEFAULT_TB_LANG
-		}
-		if s.UnpackPath == "" {
-			s.UnpackPath = UNPACK_URL()
+		defaultpage = "http://" + EDITOR_ADDR
+	}
+	if prefsMode(offline, clearnet, editor) == ModeOffline {
+		if _, err := StartOfflineProxy(); err != nil {
+			log.Println("Error starting the offline proxy", err)
+			return err
 		}
 	}
-	return s.RunSpecificTBBWithOfflineClearnetProfileAndPage(profiledata, torbrowserdata, offline, clearnet, defaultpage)
+	mode := prefsMode(offline, clearnet, editor)
+	httpProxy, err := s.I2PProxy(name, mode)
+	if err != nil {
+		log.Println("Error starting the profile's proxy", err)
+		return err
+	}
+	if _, err := s.ApplyPrefs(profiledata, mode, httpProxy); err != nil {
+		log.Println("Error applying preferences", err)
+		return err
+	}
+	if err := s.SyncExtensions(profiledata, mode); err != nil {
+		log.Println("Error installing extensions", err)
+		return err
+	}
+	release, err := s.leasePolicies(torbrowserdata, profiledata, mode)
+	if err != nil {
+		log.Println("Error applying policies", err)
+		return err
+	}
+	defer release()
+	if err := s.ApplyPolicies(torbrowserdata, mode); err != nil {
+		log.Println("Error applying policies", err)
+		return err
+	}
+	return s.runBrowserMode(profiledata, torbrowserdata, prefsMode(offline, clearnet, editor), defaultpage)
 }
 
 func (s *Supervisor) RunSpecificTBBWithOfflineClearnetProfileAndPage(profiledata, torbrowserdata string, offline, clearnet bool, defaultpage string) error {
+	return s.runBrowserMode(profiledata, torbrowserdata, prefsMode(offline, clearnet, false), defaultpage)
+}
+
+// runBrowserMode runs the browser from the install with the profile directory
+// in the mode, opening page. Offline browsers get their own network namespace
+// if OFFLINE_NETNS is set.
+func (s *Supervisor) runBrowserMode(profiledata, torbrowserdata, mode, page string) error {
 	tbget.ARCH = ARCH()
 	if s.Lang == "" {
 		s.Lang = DEFAULT_TB_LANG
@@ -527,44 +469,19 @@ func (s *Supervisor) RunSpecificTBBWithOfflineClearnetProfileAndPage(profiledata
 	if torbrowserdata == "" {
 		torbrowserdata = UNPACK_URL()
 	}
-
-	log.Println("running i2p in tor browser with lang", s.Lang, torbrowserdata, OS())
-	switch OS() {
-	case "linux":
-		if tbget.FileExists(torbrowserdata) {
-			args := []string{"--profile", profiledata, defaultpage}
-			args = append(args, s.PTAS()...)
-			log.Println("running Tor browser with lang and Custom Profile", s.Lang, torbrowserdata, s.SpecificFirefoxPath(torbrowserdata), args)
-			bcmd := exec.Command(s.SpecificFirefoxPath(torbrowserdata), args...)
-			bcmd.Stdout = os.Stdout
-			bcmd.Stderr = os.Stderr
-			return bcmd.Run()
-		}
+	if !tbget.FileExists(torbrowserdata) {
 		log.Println("tor browser not found at", s.SpecificFirefoxPath(torbrowserdata))
 		return fmt.Errorf("tor browser not found at %s", s.SpecificFirefoxPath(torbrowserdata))
-	case "osx":
-		firefoxPath := s.TBPath()
-		args := []string{"--profile", profiledata, defaultpage}
-		args = append(args, s.PTAS()...)
-		log.Println("running Tor browser with lang and Custom Profile", s.Lang, torbrowserdata, firefoxPath, args)
-		bcmd := exec.Command(firefoxPath, args...)
-		bcmd.Dir = profiledata
-		bcmd.Stdout = os.Stdout
-		bcmd.Stderr = os.Stderr
-
-		return bcmd.Run()
-	case "win":
-		args := []string{"--profile", profiledata, defaultpage}
-		args = append(args, s.PTAS()...)
-		log.Println("running Tor browser with lang and Custom Profile", s.Lang, torbrowserdata, s.SpecificFirefoxPath(torbrowserdata), args)
-		bcmd := exec.Command(s.SpecificFirefoxPath(torbrowserdata), args...)
-		bcmd.Dir = profiledata
-		bcmd.Stdout = os.Stdout
-		bcmd.Stderr = os.Stderr
-		return bcmd.Run()
-	default:
 	}
-	return nil
+
+	log.Println("running i2p in tor browser with lang", s.Lang, torbrowserdata, OS())
+	ptas, err := s.PTAS(mode)
+	if err != nil {
+		return err
+	}
+	launch := s.launcher().Browser(torbrowserdata, profiledata, append([]string{page}, ptas...))
+	log.Println("running Tor browser with lang and Custom Profile", s.Lang, torbrowserdata, launch.Path, launch.Args)
+	return s.launchBrowser(launch, torbrowserdata, profiledata, mode, mode == ModeOffline && OFFLINE_NETNS)
 }
 
 // RunTBBWithProfile runs the I2P Browser with the given language
@@ -572,17 +489,28 @@ func (s *Supervisor) RunTBBWithProfile(profiledata string) error {
 	return s.RunTBBWithOfflineClearnetProfile(profiledata, false, false)
 }
 
+// EDITOR_ADDR is the address the I2P Site Editor is served on, which the site
+// editor's browser opens.
+var EDITOR_ADDR = "127.0.0.1:7685"
+
+// TOR_SOCKS is the address of the SOCKS port of the Tor the Supervisor runs,
+// or of a system Tor which is used instead.
+var TOR_SOCKS = "127.0.0.1:9050"
+
+// TOR_TIMEOUT is how long StartTor waits for Tor's SOCKS port.
+var TOR_TIMEOUT = 2 * time.Minute
+
+// TorReady returns nil if a Tor SOCKS port answers on TOR_SOCKS.
+func TorReady(ctx context.Context) error {
+	return tbready.SOCKS(TOR_SOCKS)(ctx)
+}
+
 func (s *Supervisor) torbail() error {
-	_, err := net.Listen("tcp", "127.0.0.1:9050")
-	if err != nil {
-		log.Println("Already Running on 9050", err)
+	if err := tbready.Check(time.Second, TorReady); err == nil {
+		log.Println("Already Running on", TOR_SOCKS)
 		return fmt.Errorf("Already running")
 	}
-	if s.torcmd != nil && s.torcmd.Process != nil && s.torcmd.ProcessState != nil {
-		if s.torcmd.ProcessState.Exited() {
-			log.Println("Tor exited, restarting")
-			return nil
-		}
+	if s.torRunning() {
 		log.Println("Already Running")
 		return fmt.Errorf("Already running")
 	}
@@ -590,6 +518,12 @@ func (s *Supervisor) torbail() error {
 	return nil
 }
 
+// torRunning returns true if the Supervisor has started Tor and it hasn't
+// exited.
+func (s *Supervisor) torRunning() bool {
+	return s.torcmd != nil && s.torcmd.Process != nil && s.torcmd.ProcessState == nil
+}
+
 // RunTorWithLang runs the Tor Exe with the given language
 func (s *Supervisor) RunTorWithLang() error {
 	tbget.ARCH = ARCH()
@@ -602,41 +536,55 @@ func (s *Supervisor) RunTorWithLang() error {
 	if err := s.torbail(); err != nil {
 		return nil
 	}
+	if err := s.VerifyInstall(s.ProductUnpackPath()); err != nil {
+		return err
+	}
 
-	log.Println("running tor with lang", s.Lang, s.TBUnpackPath())
-	switch OS() {
-	case "linux":
-		if tbget.FileExists(s.TBUnpackPath()) {
-			log.Println("running tor with lang", s.Lang, s.TBUnpackPath())
-			s.torcmd = exec.Command(s.TorPath())
-			s.torcmd.Stdout = os.Stdout
-			s.torcmd.Stderr = os.Stderr
-			return s.torcmd.Run()
-		}
+	if !tbget.FileExists(s.ProductUnpackPath()) {
 		log.Println("tor not found at", s.TorPath())
 		return fmt.Errorf("tor not found at %s", s.TorPath())
-	case "osx":
-		torPath := filepath.Join(s.TBUnpackPath(), "Tor Browser.app", "Contents", "Resources", "TorBrowser", "Tor", "tor")
-		s.torcmd = exec.Command(torPath)
-		s.torcmd.Dir = filepath.Dir(torPath)
-		s.torcmd.Stdout = os.Stdout
-		s.torcmd.Stderr = os.Stderr
-		defer s.torcmd.Process.Kill()
-		return s.torcmd.Run()
-	case "win":
-		log.Println("Running Windows EXE", filepath.Join(s.TBDirectory(), "TorBrowser", "Tor", "tor.exe"))
-		s.torcmd = exec.Command(filepath.Join(s.TBDirectory(), "TorBrowser", "Tor", "tor.exe"))
-		s.torcmd.Dir = s.TBDirectory()
-		return s.torcmd.Run()
-	default:
 	}
-
+	log.Println("running tor with lang", s.Lang, s.ProductUnpackPath())
+	s.torcmd = s.torLaunch().Command()
+	return s.launcher().Run(s.torcmd, nil)
+}
+
+// StartTor runs Tor in the background unless one is running already, and
+// waits until its SOCKS port answers, TOR_TIMEOUT passes or the context is
+// done. Tor keeps running after StartTor returns, until StopTor.
+func (s *Supervisor) StartTor(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, TOR_TIMEOUT)
+	defer cancel()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- s.RunTorWithLang()
+	}()
+	ready := make(chan error, 1)
+	go func() {
+		ready <- tbready.Wait(ctx, TorReady)
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			return fmt.Errorf("StartTor: %s", err)
+		}
+		return nil
+	case err := <-exited:
+		if err != nil {
+			cancel()
+			return fmt.Errorf("StartTor: %s", err)
+		}
+	}
+	// RunTorWithLang returns nil straight away when Tor is already running.
+	if err := <-ready; err != nil {
+		return fmt.Errorf("StartTor: %s", err)
+	}
 	return nil
 }
 
 // StopTor stops tor
 func (s *Supervisor) StopTor() error {
-	if s.torcmd != nil && s.torcmd.Process != nil && s.torcmd.ProcessState != nil {
+	if s.torRunning() {
 		return s.torcmd.Process.Kill()
 	}
 	return nil
@@ -645,27 +593,26 @@ func (s *Supervisor) StopTor() error {
 // TorIsAlive returns true,true if tor is alive and belongs to us, true,false
 // if it's alive and doesn't belong to us, false,false if no Tor can be found
 func (s *Supervisor) TorIsAlive() (bool, bool) {
-	_, err := net.Listen("TCP", "127.0.0.1:9050")
-	if err != nil {
-		return true, false
+	alive := tbready.Check(time.Second, TorReady) == nil
+	if s.torRunning() {
+		return alive, true
 	}
-	if s.torcmd != nil && s.torcmd.Process != nil && s.torcmd.ProcessState != nil {
-		return !s.torcmd.ProcessState.Exited(), true
+	if !alive {
+		return false, false
 	}
 	processes, err := ps.Processes()
 	if err != nil {
-		return false, true
+		return true, false
 	}
 	for _, p := range processes {
 		if p.Executable() == s.TorPath() {
-			var err error
-			s.torcmd.Process, err = os.FindProcess(p.Pid())
-			if err == nil {
+			if process, err := os.FindProcess(p.Pid()); err == nil {
+				s.torcmd = &exec.Cmd{Path: s.TorPath(), Process: process}
 				return true, true
 			}
 		}
 	}
-	return false, true
+	return true, false
 }
 
 // NewSupervisor creates a new supervisor
@@ -684,70 +631,38 @@ func (s *Supervisor) IBBUnpackPath() string {
 	return strings.Replace(s.TBUnpackPath(), "tor-browser", "i2p-browser", -1)
 }
 
+// FindEepsiteDocroot returns the document root of the I2P router's web server,
+// which the site editor edits.
 func FindEepsiteDocroot() (string, error) {
-	// eepsite docroot could be at:
-	// or: $I2P_CONFIG/eepsite/docroot/
-	// or: $I2P/eepsite/docroot/
-	// or: $HOME/.i2p/eepsite/docroot/
-	// or: /var/lib/i2p/i2p-config/eepsite/docroot/
-	// or: %LOCALAPPDATA\i2p\eepsite\docroot\
-	// or: %APPDATA\i2p\eepsite\docroot\
-	// or: %USERPROFILE\i2p\eepsite\docroot\
-	SNARK_CONFIG := os.Getenv("SNARK_CONFIG")
-	if SNARK_CONFIG != "" {
-		checkfori2pcustom := filepath.Join(SNARK_CONFIG)
-		if tbget.FileExists(checkfori2pcustom) {
-			return checkfori2pcustom, nil
-		}
+	if docroot := tbdiscover.Default().EepsiteDocroot; docroot != "" {
+		return docroot, nil
 	}
+	return "", fmt.Errorf("FindEepsiteDocroot: Unable to find the eepsite docroot")
+}
 
-	I2P_CONFIG := os.Getenv("I2P_CONFIG")
-	if I2P_CONFIG != "" {
-		checkfori2pcustom := filepath.Join(I2P_CONFIG, "eepsite", "docroot")
-		if tbget.FileExists(checkfori2pcustom) {
-			return checkfori2pcustom, nil
-		}
-	}
+// RunTBBWithOfflineProfile runs the I2P Browser with the given language
+func (s *Supervisor) RunI2PSiteEditorWithOfflineClearnetProfile(profiledata string) error {
+	return s.RunSpecificTBBWithOfflineClearnetProfile(profiledata, s.IBBUnpackPath(), true, true, true)
+}
 
-	I2P := os.Getenv("I2P")
-	if I2P != "" {
-		checkfori2p := filepath.Join(I2P, "eepsite", "docroot")
-		if tbget.FileExists(checkfori2p) {
-			return checkfori2p, nil
+// RunI2PSiteEditorWithProfile runs the I2P Site Editor with the named profile,
+// or an ephemeral copy of it if EPHEMERAL is set.
+func (s *Supervisor) RunI2PSiteEditorWithProfile(name string) error {
+	if EPHEMERAL {
+		p, err := s.GetProfile(name)
+		if err != nil {
+			return err
+		}
+		dir, err := s.newEphemeralProfile(p.Template)
+		if err != nil {
+			return err
 		}
+		defer releaseEphemeralProfile(dir)
+		return s.RunI2PSiteEditorWithOfflineClearnetProfile(dir)
 	}
-	home, err := os.UserHomeDir()
+	_, dir, err := s.ensureProfile(name)
 	if err != nil {
-		return "", err
-	}
-	// Start by getting the home directory
-	switch runtime.GOOS {
-	case "windows":
-		checkfori2plocal := filepath.Join(home, "AppData", "Local", "i2p", "eepsite", "docroot")
-		if tbget.FileExists(checkfori2plocal) {
-			return checkfori2plocal, nil
-		}
-		checkfori2proaming := filepath.Join(home, "AppData", "Roaming", "i2p", "eepsite", "docroot")
-		if tbget.FileExists(checkfori2proaming) {
-			return checkfori2proaming, nil
-		}
-	case "linux":
-		checkfori2phome := filepath.Join(home, ".i2p", "eepsite", "docroot")
-		if tbget.FileExists(checkfori2phome) {
-			return checkfori2phome, nil
-		}
-		checkfori2pservice := filepath.Join("/var/lib/i2p/i2p-config", "eepsite", "docroot")
-		if tbget.FileExists(checkfori2pservice) {
-			return checkfori2pservice, nil
-		}
-	case "darwin":
-		return "", fmt.Errorf("FindSnarkDirectory: Automatic torrent generation is not supported on MacOS, for now copy the files manually")
+		return err
 	}
-	return "", fmt.Errorf("FindSnarkDirectory: Unable to find snark directory")
-
-}
-
-// RunTBBWithOfflineProfile runs the I2P Browser with the given language
-func (s *Supervisor) RunI2PSiteEditorWithOfflineClearnetProfile(profiledata string) error {
-	return s.RunSpecificTBBWithOfflineClearnetProfile(profiledata, s.IBBUnpackPath(), true, true, true)
+	return s.RunI2PSiteEditorWithOfflineClearnetProfile(dir)
 }
@@ -11,8 +11,10 @@ import (
 	"time"
 
 	"fyne.io/systray"
-	"github.com/eyedeekay/go-i2pcontrol"
+	tbcontrol "i2pgit.org/idk/i2p.plugins.tor-manager/control"
+	tbdiscover "i2pgit.org/idk/i2p.plugins.tor-manager/discover"
 	"i2pgit.org/idk/i2p.plugins.tor-manager/icon"
+	tbready "i2pgit.org/idk/i2p.plugins.tor-manager/ready"
 )
 
 var running = false
@@ -37,6 +39,9 @@ func onReady() {
 		subMenuBottom2 := subMenuTop.AddSubMenuItem("Launch the Tor Browser", "Launch the standard Tor Browser bundle")
 		subMenuBottom3 := subMenuTop.AddSubMenuItem("Launch Hardened Firefox in Clearnet Mode", "Launch the Tor Browser bundle, but without Tor")
 		subMenuBottom4 := subMenuTop.AddSubMenuItem("Launch Offline Browser", "Launch the Tor Browser bundle configured to have no access to the internet at all")
+		mUpdate := systray.AddMenuItem("Update ready", "A new version has been downloaded and will be installed when no browser is running")
+		mUpdate.Hide()
+		go watchForUpdates(mUpdate)
 		systray.AddSeparator()
 		go onSnowflakeReady()
 		systray.AddSeparator()
@@ -64,12 +69,16 @@ func onReady() {
 				}
 			case <-subMenuBottom3.ClickedCh:
 				fmt.Println("Launching Hardened Firefox in Clearnet Mode")
-				if err := client.TBS.RunTBBWithOfflineClearnetProfile("profile.firefox", false, true); err != nil {
+				if err := client.TBS.RunProfile("clearnet"); err != nil {
 					log.Println(err)
 				}
 			case <-subMenuBottom4.ClickedCh:
 				fmt.Println("Launching Hardened Firefox in Clearnet Mode")
-				if err := client.TBS.RunTBBWithOfflineClearnetProfile("profile.firefox.offline", true, true); err != nil {
+				if err := client.TBS.RunProfile("offline"); err != nil {
+					log.Println(err)
+				}
+			case <-mUpdate.ClickedCh:
+				if _, err := client.ApplyUpdateIfIdle(); err != nil {
 					log.Println(err)
 				}
 			case <-mQuit.ClickedCh:
@@ -83,6 +92,19 @@ func onReady() {
 	}()
 }
 
+// watchForUpdates shows the "Update ready" item while an update is waiting to be installed.
+func watchForUpdates(mUpdate *systray.MenuItem) {
+	for running {
+		if ready := client.UpdateReady(); ready != "" {
+			mUpdate.SetTitle("Update ready: " + ready)
+			mUpdate.Show()
+		} else {
+			mUpdate.Hide()
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
 func onExit() {
 	if *snowflake {
 		snowflakeProxy.Stop()
@@ -92,31 +114,25 @@ func onExit() {
 		os.Remove(*directory + ".tar.xz")
 		EncryptTarXZip(*directory, *password)
 	}
-	if shutdown {
-		i2pcontrol.Initialize("127.0.0.1", "7657", "")
-		_, err := i2pcontrol.Authenticate("itoopie")
-		if err != nil {
+	if proxies != nil {
+		proxies.Close()
+	}
+	if routers != nil {
+		if err := routers.Stop(); err != nil {
 			log.Println(err)
 		}
-		message, err := i2pcontrol.ShutdownGraceful()
-		if err != nil {
-			log.Println(err)
+	}
+	if shutdown {
+		router := client.Router
+		if router == nil {
+			discovered := tbdiscover.Default()
+			router = tbcontrol.NewClient(discovered.I2PControl.URL(), discovered.I2PControlPassword)
 		}
-		ltc := 0
-		for {
-			tunnels, err := i2pcontrol.ParticipatingTunnels()
-			if err != nil {
-				log.Println(err)
-			}
-			if ltc != tunnels {
-				log.Println("Participating tunnels:", tunnels)
-			}
-			ltc = tunnels
-			if tunnels <= 0 {
-				break
-			}
+		if err := tbready.WaitTimeout(10*time.Second, tbready.I2PControl(router.URL())); err != nil {
+			log.Println("The router can't be shut down, i2pcontrol isn't answering", err)
+		} else {
+			shutdownRouter(router)
 		}
-		log.Println(message)
 	}
 	running = false
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -136,3 +152,30 @@ func runSysTray(down bool) {
 		systray.Run(onReady, onExit)
 	}
 }
+
+// shutdownRouter shuts the router down gracefully over i2pcontrol, and waits
+// for its participating tunnels to expire.
+func shutdownRouter(router *tbcontrol.Client) {
+	ctx := context.Background()
+	if err := router.ShutdownGraceful(ctx); err != nil {
+		log.Println(err)
+		return
+	}
+	ltc := 0
+	for {
+		status, err := router.Status(ctx)
+		if err != nil {
+			// The router stops answering once it has shut down.
+			break
+		}
+		if ltc != status.ParticipatingTunnels {
+			log.Println("Participating tunnels:", status.ParticipatingTunnels)
+		}
+		ltc = status.ParticipatingTunnels
+		if ltc <= 0 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	log.Println("I2P router shut down")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	tbget "i2pgit.org/idk/i2p.plugins.tor-manager/get"
+)
+
+// verifyInstalls hashes every file of the installed trees and compares them with
+// the manifests written when they were unpacked, which are checked against the
+// archives the trees came from. If repair is set, trees which don't match, or
+// don't have a manifest, are restored from the cached archive.
+func verifyInstalls(repair bool) error {
+	archive := filepath.Join(client.TBD.DownloadPath, client.TBD.GetName())
+	failed := 0
+	for _, tree := range client.TBD.InstallTrees() {
+		if !tbget.FileExists(tree) {
+			continue
+		}
+		report, err := tbget.VerifyManifest(tree, true)
+		if err != nil {
+			log.Println(err)
+		} else {
+			fmt.Println(report)
+			if report.OK() {
+				// The manifest must also be the one the tree's archive
+				// produces, or it may have been rewritten along with the tree.
+				if err = client.TBS.AnchorManifest(tree); err == nil {
+					continue
+				}
+				log.Println(err)
+			}
+		}
+		if !repair {
+			failed++
+			continue
+		}
+		log.Println("Repairing", tree)
+		if err := client.TBD.RepairInstall(tree, archive); err != nil {
+			log.Println(err)
+			failed++
+			continue
+		}
+		if report, err := tbget.VerifyManifest(tree, true); err != nil || !report.OK() {
+			log.Println("Repair of", tree, "did not succeed", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("verifyInstalls: %d installed trees failed verification", failed)
+	}
+	return nil
+}